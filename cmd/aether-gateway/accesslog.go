@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAccessLogMaxSizeMB  = 100
+	defaultAccessLogMaxBackups = 5
+)
+
+// Target privacy modes of access_log.targets.
+const (
+	targetsFull = "full" // Host and port as requested
+	targetsHash = "hash" // Keyed hash of the host, port kept
+	targetsOmit = "omit" // Neither host nor port
+)
+
+// Close reasons, the "reason" field of an access log entry.
+const (
+	reasonDone       = "done"        // Both directions finished
+	reasonError      = "error"       // Read or write failed on either side
+	reasonQuota      = "quota"       // Monthly quota used up mid-stream
+	reasonAdmin      = "admin"       // Closed through the admin API
+	reasonRejected   = "rejected"    // Refused before the dial by a stream limit or the quota
+	reasonDialFailed = "dial_failed" // Target could not be reached or was denied
+)
+
+// processHashKey keys target hashes when access_log.hash_key is empty, so
+// hashes match within one run but cannot be looked up in a precomputed table.
+var processHashKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// accessLogConfig is the access_log section of the config file.
+type accessLogConfig struct {
+	Path       string `json:"path,omitempty"`        // File, or "stdout"; empty keeps the access log off
+	MaxSizeMB  int    `json:"max_size_mb,omitempty"` // Rotate past this size; default 100
+	MaxBackups int    `json:"max_backups,omitempty"` // Rotated files kept as path.1 ... path.N; default 5
+	Targets    string `json:"targets,omitempty"`     // "full" (default), "hash" or "omit"; also applies to the gateway log
+	HashKey    string `json:"hash_key,omitempty"`    // Keeps "hash" values stable across restarts; random per start when empty
+}
+
+// validate checks cfg without opening the file.
+func (cfg *accessLogConfig) validate() error {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Targets {
+	case "", targetsFull, targetsHash, targetsOmit:
+	default:
+		return fmt.Errorf("targets: unknown mode %q (want full, hash or omit)", cfg.Targets)
+	}
+	if cfg.MaxSizeMB < 0 || cfg.MaxBackups < 0 {
+		return errors.New("max_size_mb and max_backups must not be negative")
+	}
+	return nil
+}
+
+// accessEntry is one line of the access log, written when a stream ends.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Session    uint64    `json:"session"`
+	Stream     string    `json:"stream"` // Same as in the gateway log, e.g. "5" or "5/3"
+	Kind       string    `json:"kind"`   // "tcp", "mux" or "reverse"
+	User       string    `json:"user"`
+	Remote     string    `json:"remote"`
+	TargetHost string    `json:"target_host,omitempty"`
+	TargetHash string    `json:"target_hash,omitempty"`
+	TargetPort uint16    `json:"target_port,omitempty"`
+	Outbound   string    `json:"outbound,omitempty"`
+	DialMs     float64   `json:"dial_ms"`
+	BytesUp    uint64    `json:"bytes_up"`
+	BytesDown  uint64    `json:"bytes_down"`
+	DurationMs float64   `json:"duration_ms"`
+	Reason     string    `json:"reason"`
+	Code       string    `json:"code,omitempty"` // Result code sent to the client, e.g. "0x0401"
+	Error      string    `json:"error,omitempty"`
+
+	target string // host:port, reduced to the fields above per the privacy mode
+	err    error
+}
+
+// accessLogger writes the access log and redacts targets in the gateway log.
+// A logger without output only does the redaction.
+type accessLogger struct {
+	out     io.WriteCloser
+	targets string
+	hashKey []byte
+}
+
+// newAccessLogger opens the configured output. A nil cfg logs nothing and
+// keeps targets in full.
+func newAccessLogger(cfg *accessLogConfig) (*accessLogger, error) {
+	l := &accessLogger{targets: targetsFull, hashKey: processHashKey}
+	if cfg == nil {
+		return l, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Targets != "" {
+		l.targets = cfg.Targets
+	}
+	if cfg.HashKey != "" {
+		l.hashKey = []byte(cfg.HashKey)
+	}
+	switch cfg.Path {
+	case "":
+	case "stdout", "-":
+		l.out = nopCloser{os.Stdout}
+	default:
+		maxSize, backups := cfg.MaxSizeMB, cfg.MaxBackups
+		if maxSize == 0 {
+			maxSize = defaultAccessLogMaxSizeMB
+		}
+		if backups == 0 {
+			backups = defaultAccessLogMaxBackups
+		}
+		f, err := openRotatingFile(cfg.Path, int64(maxSize)<<20, backups)
+		if err != nil {
+			return nil, err
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+func (l *accessLogger) enabled() bool {
+	return l.out != nil
+}
+
+func (l *accessLogger) Close() error {
+	if l.out == nil {
+		return nil
+	}
+	return l.out.Close()
+}
+
+// hash is the keyed hash the "hash" mode logs in place of host.
+func (l *accessLogger) hash(host string) string {
+	mac := hmac.New(sha256.New, l.hashKey)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// target is hostport as the gateway log and admin API may show it.
+func (l *accessLogger) target(hostport string) string {
+	switch l.targets {
+	case targetsOmit:
+		return "-"
+	case targetsHash:
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return "#" + l.hash(hostport)
+		}
+		return net.JoinHostPort("#"+l.hash(host), port)
+	}
+	return hostport
+}
+
+// error is err as the gateway log may show it: outside the full mode the
+// addresses that network errors carry are left out.
+func (l *accessLogger) error(err error) string {
+	if l.targets == targetsFull {
+		return err.Error()
+	}
+	var denied *egressDeniedError
+	var upErr *upstreamError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &denied):
+		return "denied by egress policy"
+	case errors.As(err, &upErr):
+		return "outbound " + upErr.outbound + ": " + l.error(upErr.err)
+	case errors.As(err, &dnsErr):
+		return "lookup: " + dnsErr.Err
+	case errors.As(err, &opErr):
+		return opErr.Op + ": " + opErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// write redacts e per the privacy mode and appends it as one JSON line.
+func (l *accessLogger) write(e *accessEntry) {
+	if l.out == nil {
+		return
+	}
+	if l.targets != targetsOmit && e.target != "" {
+		host, port, err := net.SplitHostPort(e.target)
+		if err != nil {
+			host = e.target
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			e.TargetPort = uint16(p)
+		}
+		if l.targets == targetsHash {
+			e.TargetHash = l.hash(host)
+		} else {
+			e.TargetHost = host
+		}
+	}
+	if e.err != nil {
+		e.Error = l.error(e.err)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// A reload may close the previous file under a stream that just ended.
+	if _, err := l.out.Write(append(line, '\n')); err != nil && !errors.Is(err, os.ErrClosed) {
+		log.Printf("[ERROR] Access log write failed: %v", err)
+	}
+}
+
+// accessEntry starts an entry for a stream of the session.
+func (gs *gatewaySession) accessEntry(logID, kind string, user *gatewayUser, target string) *accessEntry {
+	return &accessEntry{
+		Time:    time.Now(),
+		Session: gs.id,
+		Stream:  logID,
+		Kind:    kind,
+		User:    user.ID,
+		Remote:  gs.session.RemoteAddr().String(),
+		target:  target,
+	}
+}
+
+// logRefused writes the entry of a stream that ended before it was tracked:
+// rejected by a limit or failing its dial.
+func (gs *gatewaySession) logRefused(logID, kind string, user *gatewayUser, target, outbound string, dial time.Duration, reason string, code uint16, err error) {
+	l := currentSettings().accessLog
+	if !l.enabled() {
+		return
+	}
+	e := gs.accessEntry(logID, kind, user, target)
+	e.Outbound = outbound
+	e.DialMs = durationMs(dial)
+	e.DurationMs = e.DialMs
+	e.Reason = reason
+	e.Code = fmt.Sprintf("0x%04x", code)
+	e.err = err
+	l.write(e)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// closeReason classifies the error that ended a stream.
+func closeReason(err error) string {
+	if errors.Is(err, errQuotaExceeded) {
+		return reasonQuota
+	}
+	return reasonError
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile appends to path and, once it would grow past maxSize, renames
+// it to path.1, shifting older files up to path.<backups>.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open access log: %w", err)
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups and starts an empty file. Callers hold mu.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	for i := r.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	// Keep appending to the old file if it cannot be moved aside.
+	renameErr := os.Rename(r.path, r.path+".1")
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		log.Printf("[ERROR] Access log rotation failed: %v", renameErr)
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
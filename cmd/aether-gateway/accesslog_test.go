@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	line := bytes.Repeat([]byte("x"), 39)
+	line = append(line, '\n')
+	// Two lines fit in 100 bytes; each third line starts a new file.
+	for i := 0; i < 9; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("Write #%d: %v", i, err)
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		size int64
+	}{
+		{path, 40},
+		{path + ".1", 80},
+		{path + ".2", 80},
+	} {
+		fi, err := os.Stat(tt.name)
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", filepath.Base(tt.name), err)
+		}
+		if fi.Size() != tt.size {
+			t.Errorf("%s: size %d, want %d", filepath.Base(tt.name), fi.Size(), tt.size)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 kept beyond max_backups: %v", filepath.Base(path), err)
+	}
+
+	// A single line larger than the limit is still written, to a file of its own.
+	if _, err := f.Write(bytes.Repeat([]byte("y"), 150)); err != nil {
+		t.Fatalf("Write(oversized): %v", err)
+	}
+	if fi, _ := os.Stat(path); fi == nil || fi.Size() != 150 {
+		t.Errorf("oversized line: got %v", fi)
+	}
+
+	// Reopening appends and counts what is already there.
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := f.Write(line); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close: got %v, want os.ErrClosed", err)
+	}
+	f, err = openRotatingFile(path, 200, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile(reopen): %v", err)
+	}
+	defer f.Close()
+	if f.size != 150 {
+		t.Errorf("reopened size: got %d, want 150", f.size)
+	}
+}
+
+func TestAccessLoggerTargets(t *testing.T) {
+	hashed := &accessLogger{targets: targetsHash, hashKey: []byte("key")}
+	tests := []struct {
+		name   string
+		logger *accessLogger
+		in     string
+		want   string
+	}{
+		{"full", &accessLogger{targets: targetsFull}, "example.com:443", "example.com:443"},
+		{"omit", &accessLogger{targets: targetsOmit}, "example.com:443", "-"},
+		{"hash keeps the port", hashed, "example.com:443", net.JoinHostPort("#"+hashed.hash("example.com"), "443")},
+		{"hash ipv6", hashed, "[2001:db8::1]:53", net.JoinHostPort("#"+hashed.hash("2001:db8::1"), "53")},
+		{"hash without port", hashed, "example.com", "#" + hashed.hash("example.com")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.logger.target(tt.in); got != tt.want {
+				t.Errorf("target(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	other := &accessLogger{targets: targetsHash, hashKey: []byte("other")}
+	if hashed.hash("example.com") == other.hash("example.com") {
+		t.Error("hashes with different keys match")
+	}
+	if hashed.hash("example.com") == hashed.hash("example.org") {
+		t.Error("hashes of different hosts match")
+	}
+}
+
+func TestAccessLoggerError(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 443}, Err: errors.New("connection refused")}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"op error", dialErr, "dial: connection refused"},
+		{"wrapped op error", fmt.Errorf("connect: %w", dialErr), "dial: connection refused"},
+		{"dns", &net.DNSError{Err: "no such host", Name: "secret.example"}, "lookup: no such host"},
+		{"egress", &egressDeniedError{target: "10.0.0.1:22", reason: "10.0.0.1 is a private address"}, "denied by egress policy"},
+		{"upstream", &upstreamError{outbound: "proxy", err: dialErr}, "outbound proxy: dial: connection refused"},
+		{"plain", errQuotaExceeded, errQuotaExceeded.Error()},
+	}
+	for _, mode := range []string{targetsHash, targetsOmit} {
+		l := &accessLogger{targets: mode}
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				if got := l.error(tt.err); got != tt.want {
+					t.Errorf("error() = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+	if got := (&accessLogger{targets: targetsFull}).error(dialErr); !strings.Contains(got, "192.0.2.7:443") {
+		t.Errorf("full mode dropped the address: %q", got)
+	}
+}
+
+func TestAccessLoggerWrite(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 443}, Err: errors.New("connection refused")}
+	tests := []struct {
+		mode     string
+		wantHost string
+		wantHash bool
+		wantPort uint16
+	}{
+		{targetsFull, "secret.example", false, 443},
+		{targetsHash, "", true, 443},
+		{targetsOmit, "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := &accessLogger{out: nopCloser{&buf}, targets: tt.mode, hashKey: []byte("key")}
+			l.write(&accessEntry{Stream: "5/3", Kind: "mux", User: "bob", Reason: reasonDialFailed, target: "secret.example:443", err: dialErr})
+
+			var got map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("Unmarshal(%q): %v", buf.String(), err)
+			}
+			if host, _ := got["target_host"].(string); host != tt.wantHost {
+				t.Errorf("target_host = %q, want %q", host, tt.wantHost)
+			}
+			if _, ok := got["target_hash"]; ok != tt.wantHash {
+				t.Errorf("target_hash present = %v, want %v", ok, tt.wantHash)
+			}
+			if port, _ := got["target_port"].(float64); uint16(port) != tt.wantPort {
+				t.Errorf("target_port = %v, want %d", port, tt.wantPort)
+			}
+			if got["stream"] != "5/3" || got["reason"] != reasonDialFailed {
+				t.Errorf("entry: got %v", got)
+			}
+			if tt.mode != targetsFull && (strings.Contains(buf.String(), "secret.example") || strings.Contains(buf.String(), "192.0.2.7")) {
+				t.Errorf("target leaked in %s mode: %s", tt.mode, buf.String())
+			}
+		})
+	}
+}
+
+func TestNewAccessLoggerConfig(t *testing.T) {
+	for _, cfg := range []*accessLogConfig{
+		{Targets: "partial"},
+		{MaxSizeMB: -1},
+		{MaxBackups: -1},
+	} {
+		if _, err := newAccessLogger(cfg); err == nil {
+			t.Errorf("newAccessLogger(%+v): expected an error", cfg)
+		}
+	}
+
+	l, err := newAccessLogger(nil)
+	if err != nil || l.enabled() || l.targets != targetsFull {
+		t.Errorf("newAccessLogger(nil): got %+v, %v", l, err)
+	}
+
+	// A configured hash key keeps hashes stable across restarts.
+	a, _ := newAccessLogger(&accessLogConfig{Targets: targetsHash, HashKey: "k"})
+	b, _ := newAccessLogger(&accessLogConfig{Targets: targetsHash, HashKey: "k"})
+	if a.target("example.com:443") != b.target("example.com:443") {
+		t.Error("hash_key did not give stable hashes")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryMin      = time.Minute
+	acmeRetryMax      = time.Hour
+)
+
+// acmeConfig is the acme section of the config file. With domains set, the
+// gateway obtains and renews its own certificates and ignores cert and key.
+type acmeConfig struct {
+	Domains      []string `json:"domains"`
+	Email        string   `json:"email,omitempty"`         // Contact for expiry notices
+	CacheDir     string   `json:"cache_dir,omitempty"`     // Account key and certificates; default "acme"
+	DirectoryURL string   `json:"directory_url,omitempty"` // Default Let's Encrypt; set for staging or a local test CA
+	CAFile       string   `json:"ca_file,omitempty"`       // PEM roots trusted for directory_url, e.g. Pebble's
+	HTTPListen   string   `json:"http_listen,omitempty"`   // Also answer HTTP-01 here, e.g. ":80"
+}
+
+// acmeIssuer obtains certificates through ACME. TLS-ALPN-01 is answered on
+// the TCP listener; HTTP-01 only when http_listen is set.
+type acmeIssuer struct {
+	domains []string
+	manager *autocert.Manager
+}
+
+// newACMEIssuer validates cfg and prepares the ACME client.
+func newACMEIssuer(cfg *acmeConfig) (*acmeIssuer, error) {
+	var domains []string
+	for _, d := range cfg.Domains {
+		if d = normalizeDomain(strings.TrimSpace(d)); d != "" && !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("no domains")
+	}
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no certificates in %s", cfg.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "acme"
+	}
+	return &acmeIssuer{
+		domains: domains,
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      acmeCache{autocert.DirCache(cacheDir)},
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      cfg.Email,
+			Client:     client,
+		},
+	}, nil
+}
+
+// getCertificate serves the certificate for the requested name. Clients that
+// send no SNI, or a name the gateway does not manage, get the first domain's
+// certificate rather than a failed handshake.
+func (a *acmeIssuer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeDomain(hello.ServerName)
+	if !slices.Contains(a.domains, name) && !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		h := *hello
+		h.ServerName = a.domains[0]
+		hello = &h
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+// run obtains every certificate at startup and checks them twice a day,
+// retrying failures with backoff. The manager renews a certificate in the
+// background 30 days before it expires; run covers names no client has asked
+// for yet.
+func (a *acmeIssuer) run() {
+	// TLS-ALPN-01 validation needs the TCP listener.
+	for listeners.tcp.Load() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	retry := acmeRetryMin
+	for {
+		failed := false
+		for _, d := range a.domains {
+			if err := a.obtain(d); err != nil {
+				log.Printf("[ACME] Certificate for %s not available: %v (retrying in %s)", d, err, retry)
+				failed = true
+			}
+		}
+		if !failed {
+			retry = acmeRetryMin
+			time.Sleep(acmeCheckInterval)
+			continue
+		}
+		time.Sleep(retry)
+		retry = min(retry*2, acmeRetryMax)
+	}
+}
+
+// obtain loads or issues both certificate types the manager serves: ECDSA for
+// clients that advertise it, RSA for the rest.
+func (a *acmeIssuer) obtain(domain string) error {
+	hellos := []*tls.ClientHelloInfo{
+		{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		},
+		{
+			ServerName:   domain,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+	}
+	for _, hello := range hellos {
+		cert, err := a.manager.GetCertificate(hello)
+		if err != nil {
+			return err
+		}
+		if leaf := cert.Leaf; leaf != nil && time.Until(leaf.NotAfter) < 7*24*time.Hour {
+			log.Printf("[WARN] ACME: certificate for %s expires %s", domain, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// serveHTTP answers HTTP-01 challenges on addr and redirects everything else to HTTPS.
+func (a *acmeIssuer) serveHTTP(addr string) {
+	log.Printf("[ACME] Serving HTTP-01 challenges on %s", addr)
+	if err := http.ListenAndServe(addr, a.manager.HTTPHandler(nil)); err != nil {
+		log.Printf("[ERROR] ACME HTTP-01 listener failed: %v", err)
+	}
+}
+
+// acmeCache logs certificates as they are stored.
+type acmeCache struct {
+	autocert.DirCache
+}
+
+func (c acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.DirCache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	// Certificates are keyed by name, with "+rsa" for the RSA one; other keys
+	// are the account key and HTTP-01 tokens.
+	if !strings.Contains(key, "+") || strings.HasSuffix(key, "+rsa") {
+		log.Printf("[ACME] Stored certificate %s in %s", key, string(c.DirCache))
+	}
+	return nil
+}
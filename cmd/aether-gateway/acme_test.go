@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeACME is an in-process ACME CA with just enough of RFC 8555 for
+// autocert. It offers one challenge type, validates it by connecting to
+// target, and trusts JWS signatures without checking them.
+type fakeACME struct {
+	srv       *httptest.Server
+	challenge string // "tls-alpn-01" or "http-01"
+	target    string // Where validation connects, for every domain
+	rootKey   *ecdsa.PrivateKey
+	root      *x509.Certificate
+	roots     *x509.CertPool
+
+	mu         sync.Mutex
+	thumbprint string // Of the account key; part of every key authorization
+	orders     []*fakeOrder
+	validated  int
+	serial     int64
+}
+
+// fakeOrder is an order with its single authorization.
+type fakeOrder struct {
+	domain string
+	token  string
+	authz  string // "pending", "valid", "invalid" or "deactivated"
+	chain  []byte // PEM, once issued
+}
+
+func newFakeACME(t *testing.T, challenge string) *fakeACME {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	ca := &fakeACME{challenge: challenge, rootKey: key, root: root, roots: x509.NewCertPool(), serial: 1}
+	ca.roots.AddCert(root)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dir", ca.directory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /account", ca.newAccount)
+	mux.HandleFunc("POST /order", ca.newOrder)
+	mux.HandleFunc("POST /order/{id}", ca.withOrder(ca.getOrder))
+	mux.HandleFunc("POST /authz/{id}", ca.withOrder(ca.getAuthz))
+	mux.HandleFunc("POST /chal/{id}", ca.withOrder(ca.accept))
+	mux.HandleFunc("POST /finalize/{id}", ca.withOrder(ca.finalize))
+	mux.HandleFunc("POST /cert/{id}", ca.withOrder(ca.getCert))
+	ca.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeACME) url(format string, args ...any) string {
+	return ca.srv.URL + fmt.Sprintf(format, args...)
+}
+
+// validations reports how many challenges passed.
+func (ca *fakeACME) validations() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.validated
+}
+
+// sign issues a certificate for domain and returns the PEM chain.
+func (ca *fakeACME) sign(pub any, domain string, notBefore, notAfter time.Time) ([]byte, error) {
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca.root, pub, ca.rootKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})...), nil
+}
+
+func acmeProblem(w http.ResponseWriter, status int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": fmt.Sprintf(format, args...)})
+}
+
+// readJWS decodes the protected header and payload of a request. The payload
+// is empty for POST-as-GET.
+func readJWS(r *http.Request, payload any) (jwk map[string]string, err error) {
+	var msg struct{ Protected, Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	var header struct{ JWK map[string]string }
+	data, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if data, err = base64.RawURLEncoding.DecodeString(msg.Payload); err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && payload != nil {
+		if err := json.Unmarshal(data, payload); err != nil {
+			return nil, err
+		}
+	}
+	return header.JWK, nil
+}
+
+func (ca *fakeACME) directory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"newNonce":   ca.url("/nonce"),
+		"newAccount": ca.url("/account"),
+		"newOrder":   ca.url("/order"),
+	})
+}
+
+func (ca *fakeACME) newAccount(w http.ResponseWriter, r *http.Request) {
+	jwk, err := readJWS(r, nil)
+	if err != nil || jwk["kty"] != "EC" {
+		acmeProblem(w, http.StatusBadRequest, "account key: %v %v", jwk, err)
+		return
+	}
+	// RFC 7638 thumbprint of an EC key.
+	sum := sha256.Sum256(fmt.Appendf(nil, `{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk["crv"], jwk["x"], jwk["y"]))
+	ca.mu.Lock()
+	ca.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+	ca.mu.Unlock()
+	w.Header().Set("Location", ca.url("/account/1"))
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+}
+
+func (ca *fakeACME) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Type, Value string }
+	}
+	if _, err := readJWS(r, &req); err != nil || len(req.Identifiers) != 1 {
+		acmeProblem(w, http.StatusBadRequest, "want one identifier: %v", err)
+		return
+	}
+	ca.mu.Lock()
+	id := len(ca.orders)
+	o := &fakeOrder{domain: req.Identifiers[0].Value, token: fmt.Sprintf("token-%d", id), authz: acme.StatusPending}
+	ca.orders = append(ca.orders, o)
+	body := ca.orderJSON(id, o)
+	ca.mu.Unlock()
+	w.Header().Set("Location", ca.url("/order/%d", id))
+	writeJSON(w, http.StatusCreated, body)
+}
+
+// withOrder looks up the order named by the path. The handler runs without
+// ca.mu held.
+func (ca *fakeACME) withOrder(h func(http.ResponseWriter, *http.Request, int, *fakeOrder)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		ca.mu.Lock()
+		valid := err == nil && id >= 0 && id < len(ca.orders)
+		var o *fakeOrder
+		if valid {
+			o = ca.orders[id]
+		}
+		ca.mu.Unlock()
+		if !valid {
+			acmeProblem(w, http.StatusNotFound, "no order %q", r.PathValue("id"))
+			return
+		}
+		h(w, r, id, o)
+	}
+}
+
+// orderJSON needs ca.mu.
+func (ca *fakeACME) orderJSON(id int, o *fakeOrder) map[string]any {
+	status := acme.StatusPending
+	switch {
+	case o.chain != nil:
+		status = acme.StatusValid
+	case o.authz == acme.StatusValid:
+		status = acme.StatusReady
+	case o.authz != acme.StatusPending:
+		status = acme.StatusInvalid
+	}
+	body := map[string]any{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{ca.url("/authz/%d", id)},
+		"finalize":       ca.url("/finalize/%d", id),
+	}
+	if o.chain != nil {
+		body["certificate"] = ca.url("/cert/%d", id)
+	}
+	return body
+}
+
+// challengeJSON needs ca.mu.
+func (ca *fakeACME) challengeJSON(id int, o *fakeOrder) map[string]string {
+	status := o.authz
+	if status == "deactivated" {
+		status = acme.StatusInvalid
+	}
+	return map[string]string{"type": ca.challenge, "url": ca.url("/chal/%d", id), "token": o.token, "status": status}
+}
+
+func (ca *fakeACME) getOrder(w http.ResponseWriter, r *http.Request, id int, o *fakeOrder) {
+	ca.mu.Lock()
+	body := ca.orderJSON(id, o)
+	ca.mu.Unlock()
+	w.Header().Set("Location", ca.url("/order/%d", id))
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (ca *fakeACME) getAuthz(w http.ResponseWriter, r *http.Request, id int, o *fakeOrder) {
+	var req struct{ Status string }
+	if _, err := readJWS(r, &req); err != nil {
+		acmeProblem(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ca.mu.Lock()
+	if req.Status == "deactivated" {
+		o.authz = req.Status
+	}
+	body := map[string]any{
+		"status":     o.authz,
+		"identifier": map[string]string{"type": "dns", "value": o.domain},
+		"challenges": []map[string]string{ca.challengeJSON(id, o)},
+	}
+	ca.mu.Unlock()
+	writeJSON(w, http.StatusOK, body)
+}
+
+// accept validates the challenge before answering, so the authorization is
+// final by the time the client polls it.
+func (ca *fakeACME) accept(w http.ResponseWriter, r *http.Request, id int, o *fakeOrder) {
+	if _, err := readJWS(r, nil); err != nil {
+		acmeProblem(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ca.mu.Lock()
+	keyAuth := o.token + "." + ca.thumbprint
+	ca.mu.Unlock()
+
+	var err error
+	switch ca.challenge {
+	case "tls-alpn-01":
+		err = ca.validateALPN(o.domain, keyAuth)
+	case "http-01":
+		err = ca.validateHTTP(o.domain, o.token, keyAuth)
+	}
+
+	ca.mu.Lock()
+	if err != nil {
+		o.authz = acme.StatusInvalid
+	} else {
+		o.authz = acme.StatusValid
+		ca.validated++
+	}
+	body := ca.challengeJSON(id, o)
+	ca.mu.Unlock()
+	writeJSON(w, http.StatusOK, body)
+}
+
+// validateALPN checks the acmeIdentifier extension of RFC 8737.
+func (ca *fakeACME) validateALPN(domain, keyAuth string) error {
+	conn, err := tls.Dial("tcp", ca.target, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	cert := state.PeerCertificates[0]
+	if err := cert.VerifyHostname(domain); err != nil {
+		return err
+	}
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+			var got []byte
+			if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+				return err
+			}
+			if !ext.Critical || !bytes.Equal(got, want[:]) {
+				return errors.New("acmeIdentifier does not match the key authorization")
+			}
+			return nil
+		}
+	}
+	return errors.New("no acmeIdentifier extension")
+}
+
+func (ca *fakeACME) validateHTTP(domain, token, keyAuth string) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+ca.target+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = domain
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != keyAuth {
+		return fmt.Errorf("got %d %q, want %q", resp.StatusCode, body, keyAuth)
+	}
+	return nil
+}
+
+func (ca *fakeACME) finalize(w http.ResponseWriter, r *http.Request, id int, o *fakeOrder) {
+	var req struct{ CSR string }
+	if _, err := readJWS(r, &req); err != nil {
+		acmeProblem(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != o.domain {
+		acmeProblem(w, http.StatusBadRequest, "bad CSR for %s: %v", o.domain, err)
+		return
+	}
+	ca.mu.Lock()
+	authorized := o.authz == acme.StatusValid
+	ca.mu.Unlock()
+	if !authorized {
+		acmeProblem(w, http.StatusForbidden, "order %d is not authorized", id)
+		return
+	}
+	chain, err := ca.sign(csr.PublicKey, o.domain, time.Now().Add(-time.Minute), time.Now().Add(90*24*time.Hour))
+	if err != nil {
+		acmeProblem(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ca.mu.Lock()
+	o.chain = chain
+	body := ca.orderJSON(id, o)
+	ca.mu.Unlock()
+	w.Header().Set("Location", ca.url("/order/%d", id))
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (ca *fakeACME) getCert(w http.ResponseWriter, r *http.Request, id int, o *fakeOrder) {
+	ca.mu.Lock()
+	chain := o.chain
+	ca.mu.Unlock()
+	if chain == nil {
+		acmeProblem(w, http.StatusNotFound, "order %d has no certificate", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+}
+
+// newTestIssuer points an issuer at ca, trusting it through ca_file.
+func newTestIssuer(t *testing.T, ca *fakeACME, cacheDir string, domains ...string) *acmeIssuer {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	issuer, err := newACMEIssuer(&acmeConfig{Domains: domains, CacheDir: cacheDir, DirectoryURL: ca.url("/dir"), CAFile: caFile})
+	if err != nil {
+		t.Fatalf("newACMEIssuer: %v", err)
+	}
+	return issuer
+}
+
+// serveACMETLS stands in for the gateway's TCP listener: certificates come
+// from the issuer and acme-tls/1 is offered for TLS-ALPN-01.
+func serveACMETLS(t *testing.T, issuer *acmeIssuer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	loader := &CertificateLoader{acme: issuer}
+	tlsListener := tls.NewListener(ln, &tls.Config{GetCertificate: loader.GetCertificate, NextProtos: []string{"h2", "http/1.1", acme.ALPNProto}})
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// servedLeaf connects like a client and returns the verified certificate.
+func servedLeaf(t *testing.T, addr, domain string, roots *x509.CertPool) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: domain, RootCAs: roots})
+	if err != nil {
+		t.Fatalf("TLS handshake for %s: %v", domain, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestACMETLSALPN(t *testing.T) {
+	ca := newFakeACME(t, "tls-alpn-01")
+	cacheDir := t.TempDir()
+	issuer := newTestIssuer(t, ca, cacheDir, "gw.test")
+	ca.target = serveACMETLS(t, issuer)
+
+	if err := issuer.obtain("gw.test"); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	// One order each for the ECDSA and RSA certificates.
+	if n := ca.validations(); n != 2 {
+		t.Errorf("validations = %d, want 2", n)
+	}
+	leaf := servedLeaf(t, ca.target, "gw.test", ca.roots)
+	if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("served a %T key to an ECDSA client", leaf.PublicKey)
+	}
+	for _, name := range []string{"gw.test", "gw.test+rsa"} {
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+			t.Errorf("cache: %v", err)
+		}
+	}
+
+	// Clients without SNI get the certificate of the first domain.
+	conn, err := tls.Dial("tcp", ca.target, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake without SNI: %v", err)
+	}
+	if err := conn.ConnectionState().PeerCertificates[0].VerifyHostname("gw.test"); err != nil {
+		t.Errorf("without SNI: %v", err)
+	}
+	conn.Close()
+
+	// A restart loads the cached certificates instead of ordering new ones.
+	restarted := newTestIssuer(t, ca, cacheDir, "gw.test")
+	if err := restarted.obtain("gw.test"); err != nil {
+		t.Fatalf("obtain after restart: %v", err)
+	}
+	if n := ca.validations(); n != 2 {
+		t.Errorf("restart ordered new certificates: %d validations", n)
+	}
+}
+
+func TestACMEHTTP01(t *testing.T) {
+	ca := newFakeACME(t, "http-01")
+	issuer := newTestIssuer(t, ca, t.TempDir(), "gw.test")
+	addr := serveACMETLS(t, issuer)
+	// What serveHTTP runs on http_listen.
+	httpSrv := httptest.NewServer(issuer.manager.HTTPHandler(nil))
+	defer httpSrv.Close()
+	ca.target = httpSrv.Listener.Addr().String()
+
+	if err := issuer.obtain("gw.test"); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	if n := ca.validations(); n != 2 {
+		t.Errorf("validations = %d, want 2", n)
+	}
+	if leaf := servedLeaf(t, addr, "gw.test", ca.roots); time.Until(leaf.NotAfter) < 80*24*time.Hour {
+		t.Errorf("served certificate expires %v", leaf.NotAfter)
+	}
+
+	// Anything but a challenge is redirected to HTTPS.
+	req, err := http.NewRequest(http.MethodGet, httpSrv.URL+"/page", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Host = "gw.test"
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("GET /page: %v", err)
+	}
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || loc != "https://gw.test/page" {
+		t.Errorf("GET /page: %d %q", resp.StatusCode, loc)
+	}
+}
+
+func TestACMERenewal(t *testing.T) {
+	ca := newFakeACME(t, "tls-alpn-01")
+	cacheDir := t.TempDir()
+
+	// A certificate from an earlier run, five days from expiry.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	chain, err := ca.sign(&key.PublicKey, "gw.test", time.Now().Add(-85*24*time.Hour), time.Now().Add(5*24*time.Hour))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	cached := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), chain...)
+	if err := os.WriteFile(filepath.Join(cacheDir, "gw.test"), cached, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	issuer := newTestIssuer(t, ca, cacheDir, "gw.test")
+	ca.target = serveACMETLS(t, issuer)
+
+	// The cached certificate is served while the renewal runs.
+	old := servedLeaf(t, ca.target, "gw.test", ca.roots)
+	if time.Until(old.NotAfter) > 6*24*time.Hour {
+		t.Fatalf("first handshake got a new certificate: expires %v", old.NotAfter)
+	}
+	var renewed *x509.Certificate
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if leaf := servedLeaf(t, ca.target, "gw.test", ca.roots); leaf.SerialNumber.Cmp(old.SerialNumber) != 0 {
+			renewed = leaf
+			break
+		}
+	}
+	if renewed == nil {
+		t.Fatal("certificate not renewed")
+	}
+	if time.Until(renewed.NotAfter) < 80*24*time.Hour {
+		t.Errorf("renewed certificate expires %v", renewed.NotAfter)
+	}
+	if n := ca.validations(); n != 1 {
+		t.Errorf("validations = %d, want 1", n)
+	}
+	data, err := os.ReadFile(filepath.Join(cacheDir, "gw.test"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Contains(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.Raw})) {
+		t.Error("renewed certificate not stored in the cache")
+	}
+}
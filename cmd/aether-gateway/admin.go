@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// readinessProbeTimeout bounds each listener check of /readyz.
+const readinessProbeTimeout = 2 * time.Second
+
+// trackedStream is a proxied stream as listed by the admin API. It also does
+// the stream's accounting, so per-stream and per-session bytes stay in step
+// with the user's counters.
+type trackedStream struct {
+	id      uint64
+	logID   string // Stream ID as it appears in log lines, e.g. "5" or "5/3"
+	kind    string // "tcp", "mux" or "reverse"
+	target  string
+	user    *gatewayUser
+	stats   *userStats
+	session *gatewaySession
+	opened  time.Time
+
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+
+	// For the access log.
+	outbound string
+	dial     time.Duration
+	endMu    sync.Mutex
+	reason   string
+	err      error
+
+	closeOnce sync.Once
+	closeFn   func()
+}
+
+func (st *trackedStream) chargeUp(n int) error {
+	st.bytesUp.Add(uint64(n))
+	st.session.bytesUp.Add(uint64(n))
+	return st.stats.chargeUp(st.user, n)
+}
+
+func (st *trackedStream) chargeDown(n int) error {
+	st.bytesDown.Add(uint64(n))
+	st.session.bytesDown.Add(uint64(n))
+	return st.stats.chargeDown(st.user, n)
+}
+
+// close tears the stream down from outside its goroutines.
+func (st *trackedStream) close() {
+	st.closeOnce.Do(st.closeFn)
+}
+
+// finish records why the stream ended; the first reason wins.
+func (st *trackedStream) finish(reason string, err error) {
+	st.endMu.Lock()
+	defer st.endMu.Unlock()
+	if st.reason == "" {
+		st.reason, st.err = reason, err
+	}
+}
+
+// trackStream lists a stream on the session until untrackStream.
+func (gs *gatewaySession) trackStream(logID, kind, target string, user *gatewayUser, stats *userStats, closeFn func()) *trackedStream {
+	st := &trackedStream{
+		id:      gs.streamSeq.Add(1),
+		logID:   logID,
+		kind:    kind,
+		target:  target,
+		user:    user,
+		stats:   stats,
+		session: gs,
+		opened:  time.Now(),
+		closeFn: closeFn,
+	}
+	gs.streamsMu.Lock()
+	gs.streams[st.id] = st
+	gs.streamsMu.Unlock()
+	return st
+}
+
+// untrackStream unlists the stream and writes its access log entry.
+func (gs *gatewaySession) untrackStream(st *trackedStream) {
+	gs.streamsMu.Lock()
+	delete(gs.streams, st.id)
+	gs.streamsMu.Unlock()
+
+	l := currentSettings().accessLog
+	if !l.enabled() {
+		return
+	}
+	st.finish(reasonDone, nil)
+	e := gs.accessEntry(st.logID, st.kind, st.user, st.target)
+	e.Outbound = st.outbound
+	e.DialMs = durationMs(st.dial)
+	e.BytesUp, e.BytesDown = st.bytesUp.Load(), st.bytesDown.Load()
+	e.DurationMs = durationMs(e.Time.Sub(st.opened))
+	st.endMu.Lock()
+	e.Reason, e.err = st.reason, st.err
+	st.endMu.Unlock()
+	l.write(e)
+}
+
+func (gs *gatewaySession) lookupStream(id uint64) *trackedStream {
+	gs.streamsMu.Lock()
+	defer gs.streamsMu.Unlock()
+	return gs.streams[id]
+}
+
+// sessionRegistry holds the open sessions for the admin API.
+type sessionRegistry struct {
+	mu   sync.Mutex
+	seq  uint64
+	byID map[uint64]*gatewaySession
+}
+
+var sessions = &sessionRegistry{byID: make(map[uint64]*gatewaySession)}
+
+// add assigns gs its ID and lists it.
+func (r *sessionRegistry) add(gs *gatewaySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	gs.id = r.seq
+	r.byID[gs.id] = gs
+}
+
+func (r *sessionRegistry) remove(gs *gatewaySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byID, gs.id)
+}
+
+func (r *sessionRegistry) get(id uint64) *gatewaySession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byID[id]
+}
+
+func (r *sessionRegistry) list() []*gatewaySession {
+	r.mu.Lock()
+	out := make([]*gatewaySession, 0, len(r.byID))
+	for _, gs := range r.byID {
+		out = append(out, gs)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// adminSession is the JSON form of a session.
+type adminSession struct {
+	ID        uint64        `json:"id"`
+	Remote    string        `json:"remote"`
+	User      string        `json:"user,omitempty"` // Empty until the first stream authenticates
+	Started   time.Time     `json:"started"`
+	AgeSec    float64       `json:"age_sec"`
+	Active    int           `json:"active_streams"`
+	BytesUp   uint64        `json:"bytes_up"`
+	BytesDown uint64        `json:"bytes_down"`
+	Streams   []adminStream `json:"streams,omitempty"` // Only in the single-session view
+}
+
+// adminStream is the JSON form of a stream.
+type adminStream struct {
+	ID        uint64    `json:"id"`
+	LogID     string    `json:"log_id"`
+	Kind      string    `json:"kind"`
+	Target    string    `json:"target"`
+	User      string    `json:"user"`
+	Opened    time.Time `json:"opened"`
+	AgeSec    float64   `json:"age_sec"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+}
+
+func (gs *gatewaySession) describe(now time.Time, withStreams bool) adminSession {
+	gs.mu.Lock()
+	user := gs.user
+	gs.mu.Unlock()
+	out := adminSession{
+		ID:        gs.id,
+		Remote:    gs.session.RemoteAddr().String(),
+		Started:   gs.started,
+		AgeSec:    now.Sub(gs.started).Seconds(),
+		BytesUp:   gs.bytesUp.Load(),
+		BytesDown: gs.bytesDown.Load(),
+	}
+	if user != nil {
+		out.User = user.ID
+	}
+
+	gs.streamsMu.Lock()
+	out.Active = len(gs.streams)
+	var streams []*trackedStream
+	if withStreams {
+		for _, st := range gs.streams {
+			streams = append(streams, st)
+		}
+	}
+	gs.streamsMu.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].id < streams[j].id })
+	out.Streams = make([]adminStream, 0, len(streams))
+	for _, st := range streams {
+		out.Streams = append(out.Streams, adminStream{
+			ID:        st.id,
+			LogID:     st.logID,
+			Kind:      st.kind,
+			Target:    currentSettings().accessLog.target(st.target),
+			User:      st.user.ID,
+			Opened:    st.opened,
+			AgeSec:    now.Sub(st.opened).Seconds(),
+			BytesUp:   st.bytesUp.Load(),
+			BytesDown: st.bytesDown.Load(),
+		})
+	}
+	return out
+}
+
+// adminBan is the JSON form of a ban.
+type adminBan struct {
+	IP           string    `json:"ip"`
+	Reason       string    `json:"reason"` // Handshake failure that triggered it, see aether_handshake_failures_total
+	Failures     int       `json:"failures"`
+	Since        time.Time `json:"since"`
+	Expires      time.Time `json:"expires"`
+	RemainingSec float64   `json:"remaining_sec"`
+}
+
+// listenerState records the addresses the tunnel listeners are serving on.
+type listenerState struct {
+	udp atomic.Pointer[string]
+	tcp atomic.Pointer[string]
+}
+
+var listeners listenerState
+
+// probeAddr turns a listen address into one this host can dial.
+func probeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// checkTCP completes a TLS handshake with the TCP listener.
+func checkTCP(addr string) error {
+	dialer := &net.Dialer{Timeout: readinessProbeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", probeAddr(addr), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkUDP completes a QUIC handshake with the HTTP/3 listener.
+func checkUDP(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessProbeTimeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, probeAddr(addr), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		return err
+	}
+	return conn.CloseWithError(0, "")
+}
+
+// readiness probes both tunnel listeners and returns a problem per failing one;
+// a draining gateway is never ready.
+func readiness() map[string]string {
+	problems := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string, p *atomic.Pointer[string], probe func(string) error) {
+		defer wg.Done()
+		addr := p.Load()
+		var problem string
+		if addr == nil {
+			problem = "not serving"
+		} else if err := probe(*addr); err != nil {
+			problem = err.Error()
+		}
+		if problem != "" {
+			mu.Lock()
+			problems[name] = problem
+			mu.Unlock()
+		}
+	}
+	wg.Add(2)
+	go check("udp", &listeners.udp, checkUDP)
+	go check("tcp", &listeners.tcp, checkTCP)
+	wg.Wait()
+	if drain.active() {
+		problems["drain"] = "draining, not taking new sessions"
+	}
+	return problems
+}
+
+// requireAdminToken guards h with the bearer token from the live settings.
+// Without a configured token the guarded endpoints are disabled.
+func requireAdminToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentSettings().adminToken
+		if token == "" {
+			http.Error(w, "admin API disabled: no admin token configured", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aether-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func pathID(r *http.Request, name string) (uint64, error) {
+	id, err := strconv.ParseUint(r.PathValue(name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return id, nil
+}
+
+// sessionFromPath resolves {session} or writes the error response.
+func sessionFromPath(w http.ResponseWriter, r *http.Request) *gatewaySession {
+	id, err := pathID(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	gs := sessions.get(id)
+	if gs == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+	}
+	return gs
+}
+
+// serveAdmin runs the admin listener: metrics, the session API and health
+// probes. It is plain HTTP and meant for a loopback or otherwise private address.
+func serveAdmin(addr string, users *userTable) {
+	log.Printf("Admin server listening on %s (/metrics, /api/sessions, /api/bans, /livez, /readyz)", addr)
+	if err := http.ListenAndServe(addr, adminHandler(users)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Admin server failed: %v", err)
+	}
+}
+
+// adminHandler routes the admin endpoints.
+func adminHandler(users *userTable) http.Handler {
+	mux := http.NewServeMux()
+
+	metrics := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := writeMetrics(w, users); err != nil {
+			log.Printf("[ADMIN] Writing metrics failed: %v", err)
+		}
+	}
+	// /metrics stays open until a token is configured, then needs it too.
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		if currentSettings().adminToken == "" {
+			metrics(w, r)
+			return
+		}
+		requireAdminToken(metrics)(w, r)
+	})
+
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		problems := readiness()
+		if len(problems) > 0 {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"ready": false, "problems": problems})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ready": true})
+	})
+
+	mux.HandleFunc("GET /api/sessions", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		out := []adminSession{}
+		for _, gs := range sessions.list() {
+			out = append(out, gs.describe(now, false))
+		}
+		writeJSON(w, http.StatusOK, out)
+	}))
+	mux.HandleFunc("GET /api/sessions/{session}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		if gs := sessionFromPath(w, r); gs != nil {
+			writeJSON(w, http.StatusOK, gs.describe(time.Now(), true))
+		}
+	}))
+	mux.HandleFunc("DELETE /api/sessions/{session}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		gs := sessionFromPath(w, r)
+		if gs == nil {
+			return
+		}
+		log.Printf("[ADMIN] Closing session %d from %s", gs.id, gs.session.RemoteAddr())
+		_ = gs.session.CloseWithError(0, "closed by administrator")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /api/sessions/{session}/streams/{stream}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		gs := sessionFromPath(w, r)
+		if gs == nil {
+			return
+		}
+		id, err := pathID(r, "stream")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		st := gs.lookupStream(id)
+		if st == nil {
+			http.Error(w, "stream not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("[ADMIN] Closing stream %s (%s to %s) of session %d", st.logID, st.kind, currentSettings().accessLog.target(st.target), gs.id)
+		st.finish(reasonAdmin, nil)
+		st.close()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /api/bans", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		out := []adminBan{}
+		for _, b := range guard.listBans() {
+			out = append(out, adminBan{
+				IP:           b.ip,
+				Reason:       b.reason,
+				Failures:     b.failures,
+				Since:        b.since,
+				Expires:      b.expires,
+				RemainingSec: b.expires.Sub(now).Seconds(),
+			})
+		}
+		writeJSON(w, http.StatusOK, out)
+	}))
+	mux.HandleFunc("DELETE /api/bans", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[ADMIN] Lifting all %d bans", guard.unbanAll())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /api/bans/{ip}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := netip.ParseAddr(r.PathValue("ip"))
+		if err != nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		if !guard.unban(ip.String()) {
+			http.Error(w, "ban not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("[ADMIN] Lifting ban on %s", ip)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return mux
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	h := requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	useSettings(t, &liveSettings{})
+	if rec := adminRequest(t, h, http.MethodGet, "/api/sessions", "Bearer anything"); rec.Code != http.StatusForbidden {
+		t.Errorf("no token configured: got %d, want 403", rec.Code)
+	}
+
+	useSettings(t, &liveSettings{adminToken: "s3cret"})
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"prefix of the token", "Bearer s3cre", http.StatusUnauthorized},
+		{"other scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"bare token", "s3cret", http.StatusUnauthorized},
+		{"valid", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(t, h, http.MethodGet, "/api/sessions", tt.header)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	users, err := newUserTable("", "psk", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	h := adminHandler(users)
+
+	// /metrics is open until a token is configured; the API is not.
+	useSettings(t, &liveSettings{})
+	if rec := adminRequest(t, h, http.MethodGet, "/metrics", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "aether_sessions_active") {
+		t.Errorf("/metrics without token configured: %d", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/api/sessions", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("/api/sessions without token configured: got %d, want 403", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/livez", ""); rec.Code != http.StatusOK {
+		t.Errorf("/livez: got %d", rec.Code)
+	}
+
+	useSettings(t, &liveSettings{adminToken: "s3cret"})
+	const auth = "Bearer s3cret"
+	if rec := adminRequest(t, h, http.MethodGet, "/metrics", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("/metrics with token configured: got %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/metrics", auth); rec.Code != http.StatusOK {
+		t.Errorf("/metrics with token: got %d", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/api/sessions", auth); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("/api/sessions: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := adminRequest(t, h, http.MethodGet, "/api/sessions/abc", auth); rec.Code != http.StatusBadRequest {
+		t.Errorf("/api/sessions/abc: got %d, want 400", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/sessions/999999", auth); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE unknown session: got %d, want 404", rec.Code)
+	}
+	// Bans.
+	const ip = "192.0.2.200"
+	t.Cleanup(func() { guard.unban(ip) })
+	guard.handshakeFailed(ip, failDecrypt, &connLimits{banAfter: 1, banDuration: time.Minute})
+	rec := adminRequest(t, h, http.MethodGet, "/api/bans", auth)
+	var bans []adminBan
+	if err := json.Unmarshal(rec.Body.Bytes(), &bans); err != nil {
+		t.Fatalf("GET /api/bans: %v (%q)", err, rec.Body.String())
+	}
+	var found bool
+	for _, b := range bans {
+		if b.IP == ip && b.Reason == failDecrypt && b.RemainingSec > 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("GET /api/bans: %s missing from %+v", ip, bans)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/bans/not-an-ip", auth); rec.Code != http.StatusBadRequest {
+		t.Errorf("DELETE invalid ip: got %d, want 400", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/bans/"+ip, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("DELETE ban without token: got %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/bans/"+ip, auth); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE ban: got %d, want 204", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/bans/"+ip, auth); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE lifted ban: got %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+// gatewayConfig is the -config file, in YAML (.yaml/.yml) or JSON. Fields left
+// empty keep the value from flags and environment; fields set in the file win.
+type gatewayConfig struct {
+	Listen             string            `json:"listen,omitempty"`
+	ReusePort          bool              `json:"reuseport,omitempty"`     // Share listen with another gateway for rolling restarts (Linux)
+	DrainTimeout       string            `json:"drain_timeout,omitempty"` // How long SIGTERM waits for open streams, e.g. "2m"; default 30s
+	AdminListen        string            `json:"admin_listen,omitempty"`  // Plain HTTP, keep it private
+	AdminToken         string            `json:"admin_token,omitempty"`
+	Cert               string            `json:"cert,omitempty"`
+	Key                string            `json:"key,omitempty"`
+	ACME               *acmeConfig       `json:"acme,omitempty"`       // Replaces cert and key with ACME-issued certificates
+	PSK                string            `json:"psk,omitempty"`        // Legacy single user, selected by records without a key ID
+	UsersFile          string            `json:"users_file,omitempty"` // Same format as -users
+	Users              []*gatewayUser    `json:"users,omitempty"`      // Inline users, merged with users_file
+	UsageFile          string            `json:"usage_file,omitempty"` // Monthly traffic per user, kept across restarts
+	Path               string            `json:"path,omitempty"`
+	Decoy              string            `json:"decoy,omitempty"`
+	DecoyUpstream      string            `json:"decoy_upstream,omitempty"` // Reverse-proxied origin; decoy is the fallback when it fails
+	WindowProfile      string            `json:"window_profile,omitempty"`
+	RecordPayloadBytes int               `json:"record_payload_bytes,omitempty"`
+	ReverseBind        string            `json:"reverse_bind,omitempty"`
+	ReversePorts       []string          `json:"reverse_ports,omitempty"`  // Reverse-tunnel ports of the legacy PSK user
+	Egress             *egressConfig     `json:"egress,omitempty"`         // Replaces -egress-allow-private as a whole
+	Outbounds          []*outboundConfig `json:"outbounds,omitempty"`      // Source addresses and upstream proxies
+	OutboundRules      []*outboundRule   `json:"outbound_rules,omitempty"` // First match picks the outbound; default direct
+	ConnLimits         *connLimitsConfig `json:"conn_limits,omitempty"`    // Per-IP sessions, per-session streams and handshake bans
+	AccessLog          *accessLogConfig  `json:"access_log,omitempty"`     // JSON line per stream; targets also governs the gateway log
+}
+
+// restartFields name the settings bound when the listener starts. A reload
+// that changes them is reported and otherwise ignored.
+var restartFields = []string{"listen", "reuseport", "admin_listen", "window_profile", "usage_file", "acme"}
+
+// loadGatewayConfig reads a config file. Unknown keys are errors so a typo
+// does not silently leave a setting at its default.
+func loadGatewayConfig(path string) (*gatewayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// Decode YAML generically and reuse the JSON field names and types.
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg gatewayConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		cfg.Path = "/" + cfg.Path
+	}
+	if _, err := compileEgress(cfg.Egress); err != nil {
+		return nil, fmt.Errorf("egress: %w", err)
+	}
+	if cfg.ACME != nil {
+		if _, err := newACMEIssuer(cfg.ACME); err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+	}
+	if _, err := compileOutbounds(cfg.Outbounds, cfg.OutboundRules); err != nil {
+		return nil, err
+	}
+	if cfg.DecoyUpstream != "" {
+		if _, err := newDecoyProxy(cfg.DecoyUpstream); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := parseDrainTimeout(cfg.DrainTimeout); err != nil {
+		return nil, fmt.Errorf("drain_timeout: %w", err)
+	}
+	if _, err := compileConnLimits(cfg.ConnLimits); err != nil {
+		return nil, fmt.Errorf("conn_limits: %w", err)
+	}
+	if err := cfg.AccessLog.validate(); err != nil {
+		return nil, fmt.Errorf("access_log: %w", err)
+	}
+	if cfg.WindowProfile != "" {
+		if _, err := core.ResolveQUICWindowConfig(cfg.WindowProfile); err != nil {
+			return nil, fmt.Errorf("window_profile: %w", err)
+		}
+	}
+	return &cfg, nil
+}
+
+// overlay returns c with every field set in file replacing its own.
+func (c gatewayConfig) overlay(file *gatewayConfig) gatewayConfig {
+	out := c
+	dst := reflect.ValueOf(&out).Elem()
+	src := reflect.ValueOf(file).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return out
+}
+
+// changedFields lists the JSON names of the settings that differ between a and b.
+func changedFields(a, b *gatewayConfig) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var changed []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// liveSettings are read per request, so a reload applies to the next one.
+type liveSettings struct {
+	secretPath   string
+	decoyRoot    string
+	decoyProxy   *decoyProxy
+	reverseBind  string
+	egress       *egressPolicy
+	outbounds    *outboundRouter
+	adminToken   string
+	drainTimeout time.Duration
+	connLimits   *connLimits
+	accessLog    *accessLogger
+}
+
+var live atomic.Pointer[liveSettings]
+
+func currentSettings() *liveSettings {
+	return live.Load()
+}
+
+// configReloader applies the config file on SIGHUP or when it changes on disk.
+type configReloader struct {
+	path  string
+	base  gatewayConfig // Flags and environment
+	users *userTable
+	certs *CertificateLoader
+
+	mu      sync.Mutex
+	running gatewayConfig // Settings in effect
+	modTime time.Time
+	size    int64
+}
+
+// newConfigReloader starts from the settings the gateway was launched with.
+func newConfigReloader(path string, base, running gatewayConfig, users *userTable, certs *CertificateLoader) *configReloader {
+	r := &configReloader{path: path, base: base, running: running, users: users, certs: certs}
+	if fi, err := os.Stat(path); err == nil {
+		r.modTime, r.size = fi.ModTime(), fi.Size()
+	}
+	return r
+}
+
+// watch reloads on SIGHUP and when the file's size or modification time changes.
+func (r *configReloader) watch() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigCh:
+			log.Printf("[INFO] Received SIGHUP, reloading config from %s...", r.path)
+			r.reload(true)
+			r.users.logStats()
+		case <-ticker.C:
+			fi, err := os.Stat(r.path)
+			if err != nil {
+				continue
+			}
+			r.mu.Lock()
+			changed := !fi.ModTime().Equal(r.modTime) || fi.Size() != r.size
+			r.mu.Unlock()
+			if changed {
+				log.Printf("[INFO] Config file %s changed, reloading...", r.path)
+				r.reload(false)
+			}
+		}
+	}
+}
+
+// reload applies every live setting of the file. On any error the running
+// settings stay untouched. SIGHUP also re-reads the users file, which the
+// config file only names.
+func (r *configReloader) reload(sighup bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fi, err := os.Stat(r.path); err == nil {
+		r.modTime, r.size = fi.ModTime(), fi.Size()
+	}
+
+	file, err := loadGatewayConfig(r.path)
+	if err != nil {
+		log.Printf("[ERROR] Config reload failed, keeping current settings: %v", err)
+		return
+	}
+	next := r.base.overlay(file)
+	changed := changedFields(&r.running, &next)
+	if sighup && next.UsersFile != "" && !slices.Contains(changed, "users_file") {
+		changed = append(changed, "users_file")
+	}
+	if len(changed) == 0 {
+		log.Printf("[CONFIG] Reloaded %s: no changes", r.path)
+		return
+	}
+
+	var applied, ignored []string
+	for _, name := range changed {
+		if slices.Contains(restartFields, name) {
+			ignored = append(ignored, name)
+		} else {
+			applied = append(applied, name)
+		}
+	}
+	// Restart-only settings keep their running values.
+	next.Listen, next.ReusePort, next.AdminListen = r.running.Listen, r.running.ReusePort, r.running.AdminListen
+	next.WindowProfile, next.UsageFile = r.running.WindowProfile, r.running.UsageFile
+	next.ACME = r.running.ACME
+
+	if err := r.apply(&next, applied); err != nil {
+		log.Printf("[ERROR] Config reload failed, keeping current settings: %v", err)
+		return
+	}
+	r.running = next
+	if len(applied) > 0 {
+		log.Printf("[CONFIG] Reloaded %s: applied %s", r.path, strings.Join(applied, ", "))
+	}
+	for _, name := range ignored {
+		log.Printf("[WARN] Config: %s changed in %s but only takes effect after a restart; still using the old value", name, r.path)
+	}
+}
+
+// apply switches the live parts of the gateway to cfg. Users and certificates
+// are validated first, so a bad file changes nothing.
+func (r *configReloader) apply(cfg *gatewayConfig, changed []string) (retErr error) {
+	has := func(names ...string) bool {
+		for _, n := range names {
+			if slices.Contains(changed, n) {
+				return true
+			}
+		}
+		return false
+	}
+	if cfg.PSK == "" && cfg.UsersFile == "" && len(cfg.Users) == 0 {
+		return fmt.Errorf("no users configured (set psk, users or users_file)")
+	}
+	egress, err := compileEgress(cfg.Egress)
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	outbounds, err := compileOutbounds(cfg.Outbounds, cfg.OutboundRules)
+	if err != nil {
+		return err
+	}
+	var decoy *decoyProxy
+	if cfg.DecoyUpstream != "" {
+		if decoy, err = newDecoyProxy(cfg.DecoyUpstream); err != nil {
+			return err
+		}
+	}
+	drainTimeout, err := parseDrainTimeout(cfg.DrainTimeout)
+	if err != nil {
+		return fmt.Errorf("drain_timeout: %w", err)
+	}
+	connLimits, err := compileConnLimits(cfg.ConnLimits)
+	if err != nil {
+		return fmt.Errorf("conn_limits: %w", err)
+	}
+	// The access log is reopened only when its settings change.
+	prev := currentSettings().accessLog
+	accessLog := prev
+	if has("access_log") {
+		if accessLog, err = newAccessLogger(cfg.AccessLog); err != nil {
+			return fmt.Errorf("access_log: %w", err)
+		}
+		defer func() {
+			if retErr != nil {
+				_ = accessLog.Close()
+			}
+		}()
+	}
+	if has("cert", "key") {
+		if _, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key); err != nil {
+			return fmt.Errorf("certificate: %w", err)
+		}
+	}
+	if has("psk", "users_file", "users", "reverse_ports") {
+		if err := r.users.configure(cfg.UsersFile, strings.TrimSpace(cfg.PSK), cfg.ReversePorts, cfg.Users); err != nil {
+			return fmt.Errorf("users: %w", err)
+		}
+	}
+	if has("cert", "key") {
+		if err := r.certs.setFiles(cfg.Cert, cfg.Key); err != nil {
+			return fmt.Errorf("certificate: %w", err)
+		}
+	}
+	if has("record_payload_bytes") && cfg.RecordPayloadBytes > 0 {
+		core.SetRecordPayloadBytes(cfg.RecordPayloadBytes)
+	}
+	live.Store(&liveSettings{secretPath: cfg.Path, decoyRoot: cfg.Decoy, decoyProxy: decoy, reverseBind: cfg.ReverseBind, egress: egress, outbounds: outbounds, adminToken: cfg.AdminToken, drainTimeout: drainTimeout, connLimits: connLimits, accessLog: accessLog})
+	if accessLog != prev {
+		_ = prev.Close()
+	}
+	return nil
+}
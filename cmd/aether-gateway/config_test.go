@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSettings makes s the live settings for the duration of the test.
+func useSettings(t *testing.T, s *liveSettings) {
+	t.Helper()
+	prev := live.Swap(s)
+	t.Cleanup(func() { live.Store(prev) })
+}
+
+func TestLoadGatewayConfig(t *testing.T) {
+	fromYAML, err := loadGatewayConfig(writeTestFile(t, "gateway.yaml", `
+listen: ":8443"
+path: secret
+record_payload_bytes: 8192
+reverse_ports: ["2222", "9000-9100"]
+users:
+  - id: alice
+    psk: alice-psk
+`))
+	if err != nil {
+		t.Fatalf("YAML: %v", err)
+	}
+	fromJSON, err := loadGatewayConfig(writeTestFile(t, "gateway.json", `{
+  "listen": ":8443",
+  "path": "secret",
+  "record_payload_bytes": 8192,
+  "reverse_ports": ["2222", "9000-9100"],
+  "users": [{"id": "alice", "psk": "alice-psk"}]
+}`))
+	if err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML and JSON differ:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+	if fromYAML.Path != "/secret" {
+		t.Errorf("path: got %q, want /secret", fromYAML.Path)
+	}
+	if fromYAML.RecordPayloadBytes != 8192 || len(fromYAML.Users) != 1 || fromYAML.Users[0].PSK != "alice-psk" {
+		t.Errorf("settings: %+v", fromYAML)
+	}
+
+	empty, err := loadGatewayConfig(writeTestFile(t, "empty.yml", ""))
+	if err != nil {
+		t.Fatalf("empty YAML: %v", err)
+	}
+	if !reflect.DeepEqual(*empty, gatewayConfig{}) {
+		t.Errorf("empty YAML: got %+v", *empty)
+	}
+}
+
+func TestLoadGatewayConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"unknown key", "c.yaml", "listen: :443\nlisten_addr: :443\n", "listen_addr"},
+		{"unknown nested key", "c.json", `{"users": [{"id": "alice", "pks": "x"}]}`, "pks"},
+		{"malformed yaml", "c.yaml", "listen: [", "parse config"},
+		{"wrong type", "c.json", `{"record_payload_bytes": "big"}`, "parse config"},
+		{"drain timeout", "c.yaml", "drain_timeout: soon\n", "drain_timeout"},
+		{"conn_limits", "c.yaml", "conn_limits:\n  ban_window: soon\n", "conn_limits"},
+		{"access_log", "c.yaml", "access_log:\n  targets: partial\n", "access_log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadGatewayConfig(writeTestFile(t, tt.file, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := loadGatewayConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: expected an error")
+	}
+}
+
+func TestConfigOverlay(t *testing.T) {
+	base := gatewayConfig{Listen: ":443", PSK: "flag-psk", Path: "/flag", Decoy: "/srv/www"}
+	file := &gatewayConfig{Path: "/file", RecordPayloadBytes: 4096, ReversePorts: []string{"2222"}}
+	got := base.overlay(file)
+	want := gatewayConfig{Listen: ":443", PSK: "flag-psk", Path: "/file", Decoy: "/srv/www", RecordPayloadBytes: 4096, ReversePorts: []string{"2222"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("overlay:\n got %+v\nwant %+v", got, want)
+	}
+	if base.Path != "/flag" {
+		t.Error("overlay modified its receiver")
+	}
+
+	if fields := changedFields(&base, &got); !slices.Equal(fields, []string{"path", "record_payload_bytes", "reverse_ports"}) {
+		t.Errorf("changedFields: got %v", fields)
+	}
+	same := base.overlay(&gatewayConfig{Users: []*gatewayUser{{ID: "alice", PSK: "x"}}})
+	other := base.overlay(&gatewayConfig{Users: []*gatewayUser{{ID: "alice", PSK: "x"}}})
+	if fields := changedFields(&same, &other); len(fields) != 0 {
+		t.Errorf("equal nested settings reported as changed: %v", fields)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	useSettings(t, &liveSettings{})
+	path := writeTestFile(t, "gateway.yaml", "listen: \":443\"\npath: /one\npsk: first\n")
+	base := gatewayConfig{Listen: ":8443", PSK: "flag-psk"}
+	file, err := loadGatewayConfig(path)
+	if err != nil {
+		t.Fatalf("loadGatewayConfig: %v", err)
+	}
+	running := base.overlay(file)
+	users, err := newUserTable("", running.PSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	r := newConfigReloader(path, base, running, users, nil)
+	rewrite := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		r.reload(false)
+	}
+
+	// Live settings apply; the listen address waits for a restart.
+	rewrite("listen: \":9443\"\npath: /two\npsk: second\nreverse_bind: 127.0.0.1\ndrain_timeout: 2m\n")
+	s := currentSettings()
+	if s.secretPath != "/two" || s.reverseBind != "127.0.0.1" || s.drainTimeout != 2*time.Minute {
+		t.Errorf("live settings: %+v", s)
+	}
+	if psk, err := users.pskFor(""); err != nil || psk != "second" {
+		t.Errorf("psk: got %q, %v", psk, err)
+	}
+	if r.running.Listen != ":443" {
+		t.Errorf("listen applied without a restart: %q", r.running.Listen)
+	}
+
+	// A file that fails to apply keeps everything as it was.
+	rewrite("path: /three\nusers:\n  - id: eve\n")
+	if currentSettings() != s || r.running.Path != "/two" {
+		t.Errorf("failed reload changed settings: path=%q", currentSettings().secretPath)
+	}
+
+	// Removing a key falls back to the flag value.
+	rewrite("path: /two\n")
+	if psk, _ := users.pskFor(""); psk != "flag-psk" {
+		t.Errorf("psk after removing it from the file: got %q", psk)
+	}
+	if bind := currentSettings().reverseBind; bind != "" {
+		t.Errorf("reverse_bind after removing it: %q", bind)
+	}
+	if d := currentSettings().drainTimeout; d != defaultDrainTimeout {
+		t.Errorf("drain_timeout after removing it: %v", d)
+	}
+}
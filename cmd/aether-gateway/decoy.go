@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// decoyProxy serves every non-tunnel request from an upstream origin, so both
+// listeners look like that site: its status codes, headers and bodies,
+// streamed as they arrive.
+type decoyProxy struct {
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+}
+
+// decoyHostKey carries the Host the visitor asked for to ModifyResponse.
+type decoyHostKey struct{}
+
+// newDecoyProxy validates raw, an http:// or https:// origin.
+func newDecoyProxy(raw string) (*decoyProxy, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid decoy upstream %q (want an http:// or https:// origin)", raw)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	p := &decoyProxy{upstream: u}
+	p.proxy = &httputil.ReverseProxy{
+		// Rewrite, unlike Director, adds no X-Forwarded-* headers.
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(u)
+			pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), decoyHostKey{}, pr.In.Host))
+		},
+		Transport:      transport,
+		FlushInterval:  -1, // Stream responses as the origin sends them
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[DECOY] Upstream %s failed for %s: %v", u.Host, r.URL.Path, err)
+			serveStaticDecoy(w, r)
+		},
+	}
+	return p, nil
+}
+
+// modifyResponse keeps the gateway's own Alt-Svc and points absolute
+// redirects to the origin back at the host the visitor used.
+func (p *decoyProxy) modifyResponse(resp *http.Response) error {
+	resp.Header.Del("Alt-Svc")
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !loc.IsAbs() || loc.Host != p.upstream.Host {
+		return nil
+	}
+	if host, _ := resp.Request.Context().Value(decoyHostKey{}).(string); host != "" {
+		loc.Scheme, loc.Host = "https", host
+		resp.Header.Set("Location", loc.String())
+	}
+	return nil
+}
+
+// ServeHTTP proxies r. CONNECT requests, including failed WebTransport
+// upgrades on the secret path, are sent as a GET for the same path, so they
+// get whatever the origin serves there: normally its 404.
+func (p *decoyProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+		r.Body, r.ContentLength = http.NoBody, 0
+		for name := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "sec-webtransport") || strings.HasPrefix(strings.ToLower(name), "wt-") {
+				r.Header.Del(name)
+			}
+		}
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// serveDecoy answers every request that is not a tunnel: from the upstream
+// origin when one is configured, otherwise from the static decoy.
+func serveDecoy(w http.ResponseWriter, r *http.Request) {
+	if p := currentSettings().decoyProxy; p != nil {
+		p.ServeHTTP(w, r)
+		return
+	}
+	serveStaticDecoy(w, r)
+}
+
+// serveHealth answers load balancer checks with 200 OK. With an upstream
+// origin a local answer would tell the gateway apart from that site, so the
+// request is proxied like any other; checks then use the admin /readyz.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	if currentSettings().decoyProxy != nil {
+		serveDecoy(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// serveStaticDecoy minimizes path-based fingerprinting/oracles.
+// - If decoyRoot has index.html, serve static files (same behavior as "/").
+// - Otherwise, serve an nginx-like 403 page with aligned headers.
+func serveStaticDecoy(w http.ResponseWriter, r *http.Request) {
+	// If decoyRoot is specified and index.html exists, serve static files.
+	if decoyRoot := currentSettings().decoyRoot; decoyRoot != "" {
+		index := fmt.Sprintf("%s/index.html", strings.TrimSuffix(decoyRoot, "/"))
+		if _, err := os.Stat(index); err == nil {
+			http.FileServer(http.Dir(decoyRoot)).ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// Fallback: Nginx 403 Forbidden Simulation
+	// CRITICAL: Align Status Code and Headers to prevent fingerprinting
+	w.Header().Set("Server", "nginx/1.18.0 (Ubuntu)")
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`<html>
+<head><title>403 Forbidden</title></head>
+<body bgcolor="white">
+<center><h1>403 Forbidden</h1></center>
+<hr><center>nginx/1.18.0 (Ubuntu)</center>
+</body>
+</html>`))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecoyProxy(t *testing.T) {
+	var seen *http.Request
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Clone(r.Context())
+		switch r.URL.Path {
+		case "/moved":
+			w.Header().Set("Location", "http://"+r.Host+"/new?x=1")
+			w.WriteHeader(http.StatusFound)
+		case "/health":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "origin 404")
+		default:
+			w.Header().Set("Server", "origin")
+			w.Header().Set("Alt-Svc", `h3=":8443"`)
+			w.WriteHeader(http.StatusTeapot)
+			io.WriteString(w, "origin body")
+		}
+	}))
+	defer origin.Close()
+	p, err := newDecoyProxy(origin.URL)
+	if err != nil {
+		t.Fatalf("newDecoyProxy: %v", err)
+	}
+	useSettings(t, &liveSettings{decoyProxy: p})
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+
+	// Status, headers and body come from the origin, without forwarding headers.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://gw.example/page", nil)
+	req.RemoteAddr = "198.51.100.9:4000"
+	serveDecoy(rec, req)
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "origin body" || rec.Header().Get("Server") != "origin" {
+		t.Errorf("proxied response: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if rec.Header().Get("Alt-Svc") != "" {
+		t.Errorf("origin Alt-Svc kept: %q", rec.Header().Get("Alt-Svc"))
+	}
+	if seen.Host != originHost {
+		t.Errorf("upstream Host: got %q, want %q", seen.Host, originHost)
+	}
+	for name := range seen.Header {
+		if strings.HasPrefix(name, "X-Forwarded") || name == "Forwarded" {
+			t.Errorf("upstream got %s: %q", name, seen.Header.Get(name))
+		}
+	}
+
+	// Redirects to the origin point back at the host the visitor used.
+	rec = httptest.NewRecorder()
+	serveDecoy(rec, httptest.NewRequest(http.MethodGet, "https://gw.example/moved", nil))
+	if loc := rec.Header().Get("Location"); loc != "https://gw.example/new?x=1" {
+		t.Errorf("Location: got %q", loc)
+	}
+
+	// A failed WebTransport upgrade reads as a GET for the same path.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "https://gw.example/secret", strings.NewReader("x"))
+	req.Method = http.MethodConnect // Extended CONNECT, as HTTP/3 carries it
+	req.Header.Set("Sec-Webtransport-Http3-Draft02", "1")
+	serveDecoy(rec, req)
+	if seen.Method != http.MethodGet || seen.URL.Path != "/secret" || seen.Header.Get("Sec-Webtransport-Http3-Draft02") != "" {
+		t.Errorf("upgrade forwarded as %s %s %v", seen.Method, seen.URL.Path, seen.Header)
+	}
+
+	// /health is the origin's too.
+	rec = httptest.NewRecorder()
+	serveHealth(rec, httptest.NewRequest(http.MethodGet, "https://gw.example/health", nil))
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "origin 404" {
+		t.Errorf("/health with decoy_upstream: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDecoyProxyFallback(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	origin.Close() // Refuses connections from now on
+	p, err := newDecoyProxy(origin.URL)
+	if err != nil {
+		t.Fatalf("newDecoyProxy: %v", err)
+	}
+	useSettings(t, &liveSettings{decoyProxy: p})
+
+	rec := httptest.NewRecorder()
+	serveDecoy(rec, httptest.NewRequest(http.MethodGet, "https://gw.example/", nil))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "403 Forbidden") {
+		t.Errorf("unreachable origin: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServeHealthLocal(t *testing.T) {
+	useSettings(t, &liveSettings{})
+	rec := httptest.NewRecorder()
+	serveHealth(rec, httptest.NewRequest(http.MethodGet, "https://gw.example/health", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK" {
+		t.Errorf("/health: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNewDecoyProxyValidation(t *testing.T) {
+	for _, raw := range []string{"", "example.com", "ftp://example.com", "https://", "://bad"} {
+		if _, err := newDecoyProxy(raw); err == nil {
+			t.Errorf("newDecoyProxy(%q): expected an error", raw)
+		}
+	}
+	if p, err := newDecoyProxy("https://www.example.com"); err != nil || p.upstream.Host != "www.example.com" {
+		t.Errorf("newDecoyProxy(https): got %v, %v", p, err)
+	}
+}
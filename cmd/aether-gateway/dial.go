@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"aether-rea/internal/core"
+)
+
+// connectErrorCode classifies a target dial error into a connect-ack result code.
+func connectErrorCode(err error) uint16 {
+	if errors.Is(err, errEgressDenied) {
+		return core.CodePolicyDenied
+	}
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return upErr.code
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return core.CodeConnectTimeout
+		}
+		return core.CodeDNSFailure
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return core.CodeConnectTimeout
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return core.CodeConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return core.CodeHostUnreachable
+	}
+	return core.CodeConnectFailed
+}
+
+// connectErrorMessage is the short text sent along with a connect-ack code.
+func connectErrorMessage(code uint16) string {
+	switch code {
+	case core.CodeConnRefused:
+		return "connection refused"
+	case core.CodeHostUnreachable:
+		return "host unreachable"
+	case core.CodeDNSFailure:
+		return "dns resolution failed"
+	case core.CodeConnectTimeout:
+		return "connect timed out"
+	case core.CodePolicyDenied:
+		return "denied by policy"
+	case core.CodeResourceLimit:
+		return "port unavailable"
+	case core.CodeGoingAway:
+		return errDraining.Error()
+	default:
+		return "connect failed"
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/quic-go"
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	goAwayInterval      = time.Second // GoAway datagrams may be lost, so they repeat
+)
+
+var errDraining = errors.New("gateway draining")
+
+// parseDrainTimeout reads a drain_timeout setting; empty means the default.
+func parseDrainTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultDrainTimeout, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid drain timeout %q", s)
+	}
+	return d, nil
+}
+
+// drainer shuts the gateway down on SIGINT or SIGTERM without cutting
+// transfers short: new sessions and streams are refused, clients are told to
+// move to a new session, and open streams get until the drain timeout.
+type drainer struct {
+	ctx   context.Context // Done once draining starts
+	start context.CancelFunc
+	done  chan struct{} // Closed when the gateway may exit
+}
+
+var drain = newDrainer()
+
+func newDrainer() *drainer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &drainer{ctx: ctx, start: cancel, done: make(chan struct{})}
+}
+
+// active reports whether the gateway is draining.
+func (d *drainer) active() bool {
+	return d.ctx.Err() != nil
+}
+
+// drainTargets are the parts of the gateway a drain stops.
+type drainTargets struct {
+	quicListener *quic.EarlyListener
+	transport    *quic.Transport
+	server       *webtransport.Server
+	httpServer   *http.Server
+	users        *userTable
+}
+
+// watch drains on the first SIGINT or SIGTERM; a second one exits at once.
+func (d *drainer) watch(t drainTargets) {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	go func() {
+		sig := <-sigCh
+		log.Printf("[DRAIN] Received %v again, exiting without waiting", sig)
+		if err := t.users.saveUsage(); err != nil {
+			log.Printf("[ERROR] Failed to save usage: %v", err)
+		}
+		os.Exit(1)
+	}()
+	d.run(sig, t)
+}
+
+// run drains the gateway, then closes what is left and saves usage.
+func (d *drainer) run(sig os.Signal, t drainTargets) {
+	timeout := currentSettings().drainTimeout
+	deadline := time.Now().Add(timeout)
+	log.Printf("[DRAIN] Received %v: refusing new sessions and streams, draining for up to %v", sig, timeout)
+	d.start()
+
+	// Established QUIC connections survive closing the listener.
+	_ = t.quicListener.Close()
+	listeners.udp.Store(nil)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	go func() {
+		if err := t.httpServer.Shutdown(ctx); err != nil {
+			_ = t.httpServer.Close()
+		}
+	}()
+
+	for {
+		busy, streams := 0, 0
+		for _, gs := range sessions.list() {
+			n := gs.streamCount()
+			if n == 0 {
+				_ = gs.session.CloseWithError(0, "")
+				continue
+			}
+			busy++
+			streams += n
+			gs.sendGoAway(time.Until(deadline))
+		}
+		if busy == 0 {
+			log.Printf("[DRAIN] All streams finished")
+			break
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf("[DRAIN] Timeout: closing %d sessions with %d open streams", busy, streams)
+			break
+		}
+		time.Sleep(min(goAwayInterval, time.Until(deadline)))
+	}
+
+	for _, gs := range sessions.list() {
+		_ = gs.session.CloseWithError(0, "")
+	}
+	_ = t.server.Close()
+	_ = t.transport.Close()
+	if err := t.users.saveUsage(); err != nil {
+		log.Printf("[ERROR] Failed to save usage: %v", err)
+	}
+	log.Printf("[DRAIN] Gateway stopped")
+	close(d.done)
+}
+
+// sendGoAway tells the client to open new streams on a new session.
+func (gs *gatewaySession) sendGoAway(remaining time.Duration) {
+	record, err := core.BuildGoAwayRecord(remaining, gs.ng)
+	if err != nil {
+		return
+	}
+	_ = gs.session.SendDatagram(record[4:])
+}
+
+// streamCount is the number of proxied streams still open on the session.
+func (gs *gatewaySession) streamCount() int {
+	gs.streamsMu.Lock()
+	defer gs.streamsMu.Unlock()
+	return len(gs.streams)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+func TestParseDrainTimeout(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", defaultDrainTimeout, false},
+		{"2m", 2 * time.Minute, false},
+		{"0s", 0, false},
+		{"-1s", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDrainTimeout(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDrainTimeout(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+// useDrainer replaces the gateway's drainer for the duration of the test
+// and sets the drain timeout it reads from the live settings.
+func useDrainer(t *testing.T, timeout time.Duration) *drainer {
+	t.Helper()
+	s := liveSettings{drainTimeout: timeout}
+	if prev := currentSettings(); prev != nil {
+		s = *prev
+		s.drainTimeout = timeout
+	}
+	useSettings(t, &s)
+	prev := drain
+	drain = newDrainer()
+	t.Cleanup(func() { drain = prev })
+	return drain
+}
+
+func TestDrain(t *testing.T) {
+	useLoopbackEgress(t)
+	d := useDrainer(t, 1500*time.Millisecond)
+	users, err := newUserTable("", testPSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	g := startTestGateway(t, users)
+	host, port := startEchoServer(t)
+
+	idle := g.dial(t)
+	busy := g.dial(t)
+	open, err := openTestStream(t, busy, host, port, core.Options{})
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	open.echo(t, "before")
+	waitFor(t, 2*time.Second, "both sessions", func() bool { return len(sessions.list()) == 2 })
+
+	if d.active() {
+		t.Fatal("draining before a signal")
+	}
+	start := time.Now()
+	go d.run(syscall.SIGTERM, drainTargets{quicListener: g.listener, transport: g.transport, server: g.server, httpServer: &http.Server{}, users: users})
+	waitFor(t, time.Second, "drain to start", d.active)
+
+	// The idle session closes at once, the busy one is told to move on.
+	select {
+	case <-idle.Context().Done():
+	case <-time.After(time.Second):
+		t.Error("idle session still open")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	datagram, err := busy.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatalf("no GoAway: %v", err)
+	}
+	record, err := core.ParseDatagramRecord(datagram)
+	if err != nil {
+		t.Fatalf("ParseDatagramRecord: %v", err)
+	}
+	remaining, err := core.ParseGoAway(record)
+	if err != nil || remaining <= 0 || remaining > currentSettings().drainTimeout {
+		t.Errorf("GoAway: remaining %v, %v", remaining, err)
+	}
+
+	// New streams are refused, the open one keeps working.
+	if _, err := openTestStream(t, busy, host, port, core.Options{}); remoteCode(t, err) != core.CodeGoingAway {
+		t.Errorf("stream while draining: got %v", err)
+	}
+	open.echo(t, "during")
+
+	// At the deadline the rest is closed and the gateway may exit.
+	select {
+	case <-d.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not finish")
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("drain finished after %v, before the timeout", elapsed)
+	}
+	select {
+	case <-busy.Context().Done():
+	case <-time.After(time.Second):
+		t.Error("busy session still open after the drain")
+	}
+}
+
+func TestDrainWithoutStreams(t *testing.T) {
+	useLoopbackEgress(t)
+	d := useDrainer(t, time.Minute)
+	users, err := newUserTable("", testPSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	g := startTestGateway(t, users)
+	sess := g.dial(t)
+	waitFor(t, 2*time.Second, "the session", func() bool { return len(sessions.list()) == 1 })
+
+	go d.run(syscall.SIGTERM, drainTargets{quicListener: g.listener, transport: g.transport, server: g.server, httpServer: &http.Server{}, users: users})
+	select {
+	case <-d.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain without streams waited for the timeout")
+	}
+	select {
+	case <-sess.Context().Done():
+	case <-time.After(time.Second):
+		t.Error("session still open after the drain")
+	}
+}
+
+func TestReadinessWhileDraining(t *testing.T) {
+	d := useDrainer(t, time.Minute)
+	if _, ok := readiness()["drain"]; ok {
+		t.Error("drain reported before draining")
+	}
+	d.start()
+	if _, ok := readiness()["drain"]; !ok {
+		t.Error("draining gateway reported ready")
+	}
+}
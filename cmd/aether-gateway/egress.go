@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// egressConfig is the egress section of the config file. Without it, every
+// public destination is allowed and private ones are denied.
+type egressConfig struct {
+	AllowPrivate bool     `json:"allow_private,omitempty"` // Permit loopback, RFC 1918, link-local and similar ranges
+	AllowCIDRs   []string `json:"allow_cidrs,omitempty"`   // Allowed even inside a private range
+	DenyCIDRs    []string `json:"deny_cidrs,omitempty"`    // Always denied; wins over allow_cidrs
+	AllowPorts   []string `json:"allow_ports,omitempty"`   // When set, only these ports, e.g. ["80", "443", "8000-9000"]
+	DenyPorts    []string `json:"deny_ports,omitempty"`    // e.g. ["25"]
+	DenyDomains  []string `json:"deny_domains,omitempty"`  // Domain and all its subdomains
+}
+
+// egressPolicy is a compiled egressConfig.
+type egressPolicy struct {
+	allowPrivate bool
+	allow, deny  []netip.Prefix
+	allowPorts   []portRange
+	denyPorts    []portRange
+	denyDomains  []string
+}
+
+// specialPrefixes are not reachable public destinations but are not covered
+// by the netip classification helpers.
+var specialPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64, may translate to a private IPv4
+}
+
+// errEgressDenied marks dial errors caused by the egress policy.
+var errEgressDenied = errors.New("denied by egress policy")
+
+type egressDeniedError struct {
+	target string
+	reason string
+}
+
+func (e *egressDeniedError) Error() string {
+	return fmt.Sprintf("egress to %s denied: %s", e.target, e.reason)
+}
+
+func (e *egressDeniedError) Unwrap() error { return errEgressDenied }
+
+// compileEgress validates cfg. A nil cfg yields the default policy.
+func compileEgress(cfg *egressConfig) (*egressPolicy, error) {
+	p := &egressPolicy{}
+	if cfg == nil {
+		return p, nil
+	}
+	p.allowPrivate = cfg.AllowPrivate
+	var err error
+	if p.allow, err = parsePrefixes(cfg.AllowCIDRs); err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %w", err)
+	}
+	if p.deny, err = parsePrefixes(cfg.DenyCIDRs); err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %w", err)
+	}
+	if p.allowPorts, err = parsePortRanges(cfg.AllowPorts); err != nil {
+		return nil, fmt.Errorf("allow_ports: %w", err)
+	}
+	if p.denyPorts, err = parsePortRanges(cfg.DenyPorts); err != nil {
+		return nil, fmt.Errorf("deny_ports: %w", err)
+	}
+	for _, d := range cfg.DenyDomains {
+		d = normalizeDomain(strings.TrimPrefix(strings.TrimSpace(d), "*."))
+		if d != "" {
+			p.denyDomains = append(p.denyDomains, d)
+		}
+	}
+	return p, nil
+}
+
+// parsePrefixes accepts CIDRs and bare addresses.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func normalizeDomain(host string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(host), "."), ".")
+}
+
+// matchDomain reports whether name is one of domains or a subdomain of one.
+func matchDomain(domains []string, name string) bool {
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateAddr reports whether addr points into the gateway's own host or network.
+func isPrivateAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	return containsAddr(specialPrefixes, addr)
+}
+
+// checkTarget applies the checks that need no resolution: the port and the
+// domain blocklist. IP literals are checked here as well.
+func (p *egressPolicy) checkTarget(host string, port uint16) error {
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if containsPort(p.denyPorts, port) || (len(p.allowPorts) > 0 && !containsPort(p.allowPorts, port)) {
+		return &egressDeniedError{target: target, reason: "port not allowed"}
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(target, addr)
+	}
+	if matchDomain(p.denyDomains, normalizeDomain(host)) {
+		return &egressDeniedError{target: target, reason: "domain blocked"}
+	}
+	return nil
+}
+
+// checkAddr applies the address rules to a resolved destination.
+func (p *egressPolicy) checkAddr(target string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	switch {
+	case containsAddr(p.deny, addr):
+		return &egressDeniedError{target: target, reason: fmt.Sprintf("%s is in a denied range", addr)}
+	case containsAddr(p.allow, addr), p.allowPrivate:
+		return nil
+	case isPrivateAddr(addr):
+		return &egressDeniedError{target: target, reason: fmt.Sprintf("%s is a private address", addr)}
+	}
+	return nil
+}
+
+// control returns a net.Dialer Control hook that applies the address rules
+// to every address the dialer actually connects to, after resolution, so a
+// name that resolves (or later re-resolves) to a denied address cannot get
+// through.
+func (p *egressPolicy) control(target string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return &egressDeniedError{target: target, reason: "unresolved address " + address}
+		}
+		return p.checkAddr(target, ap.Addr())
+	}
+}
+
+// resolveHost resolves host and returns the first of its addresses the rules
+// allow, for dials whose connect address the control hook cannot see.
+func (p *egressPolicy) resolveHost(ctx context.Context, target, host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap(), p.checkAddr(target, addr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var denied error
+	for _, addr := range addrs {
+		if err := p.checkAddr(target, addr); err != nil {
+			if denied == nil {
+				denied = err
+			}
+			continue
+		}
+		return addr.Unmap(), nil
+	}
+	if denied == nil {
+		denied = &egressDeniedError{target: target, reason: "no address"}
+	}
+	return netip.Addr{}, denied
+}
+
+// resolveUDP resolves host:port and checks the result against the policy.
+func (p *egressPolicy) resolveUDP(host string, port uint16) (*net.UDPAddr, error) {
+	if err := p.checkTarget(host, port); err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkAddr(target, addr.AddrPort().Addr()); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
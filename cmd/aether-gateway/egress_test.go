@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEgressCheckAddr(t *testing.T) {
+	defaults, err := compileEgress(nil)
+	if err != nil {
+		t.Fatalf("compileEgress(nil): %v", err)
+	}
+	custom, err := compileEgress(&egressConfig{
+		AllowCIDRs: []string{"10.8.0.0/16", "fd00::/8"},
+		DenyCIDRs:  []string{"10.8.1.0/24", "203.0.113.0/24", "198.51.100.7"},
+	})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	private, err := compileEgress(&egressConfig{AllowPrivate: true, DenyCIDRs: []string{"169.254.169.254"}})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		policy *egressPolicy
+		addr   string
+		denied bool
+	}{
+		{"public v4", defaults, "93.184.216.34", false},
+		{"public v6", defaults, "2606:2800:220:1::1", false},
+		{"loopback", defaults, "127.0.0.1", true},
+		{"loopback range", defaults, "127.8.9.10", true},
+		{"loopback v6", defaults, "::1", true},
+		{"rfc1918 10/8", defaults, "10.1.2.3", true},
+		{"rfc1918 172.16/12", defaults, "172.31.255.254", true},
+		{"rfc1918 192.168/16", defaults, "192.168.1.1", true},
+		{"ula", defaults, "fd12:3456::1", true},
+		{"link-local", defaults, "169.254.169.254", true},
+		{"link-local v6", defaults, "fe80::1", true},
+		{"unspecified", defaults, "0.0.0.0", true},
+		{"this network", defaults, "0.1.2.3", true},
+		{"cgnat", defaults, "100.64.0.1", true},
+		{"benchmarking", defaults, "198.18.0.1", true},
+		{"multicast", defaults, "224.0.0.251", true},
+		{"reserved", defaults, "240.0.0.1", true},
+		{"nat64", defaults, "64:ff9b::a00:1", true},
+		{"ipv4-mapped loopback", defaults, "::ffff:127.0.0.1", true},
+		{"ipv4-mapped private", defaults, "::ffff:10.0.0.1", true},
+		{"ipv4-mapped public", defaults, "::ffff:93.184.216.34", false},
+		{"allow cidr opens private", custom, "10.8.2.3", false},
+		{"allow cidr v6", custom, "fd00::1", false},
+		{"deny wins over allow", custom, "10.8.1.5", true},
+		{"deny public cidr", custom, "203.0.113.9", true},
+		{"deny bare address", custom, "198.51.100.7", true},
+		{"deny mapped address", custom, "::ffff:198.51.100.7", true},
+		{"outside allow stays private", custom, "10.9.0.1", true},
+		{"allow_private", private, "192.168.1.1", false},
+		{"allow_private loopback", private, "127.0.0.1", false},
+		{"deny wins over allow_private", private, "169.254.169.254", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.checkAddr("target", netip.MustParseAddr(tt.addr))
+			if (err != nil) != tt.denied {
+				t.Errorf("checkAddr(%s): err=%v, denied=%v", tt.addr, err, tt.denied)
+			}
+			if err != nil && !errors.Is(err, errEgressDenied) {
+				t.Errorf("checkAddr(%s): %v does not wrap errEgressDenied", tt.addr, err)
+			}
+		})
+	}
+}
+
+func TestEgressCheckTarget(t *testing.T) {
+	p, err := compileEgress(&egressConfig{
+		AllowPorts:  []string{"80", "443", "8000-9000"},
+		DenyPorts:   []string{"8080"},
+		DenyDomains: []string{"*.blocked.test", "Evil.Test."},
+	})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	tests := []struct {
+		name   string
+		host   string
+		port   uint16
+		denied bool
+	}{
+		{"allowed port", "example.com", 443, false},
+		{"port range", "example.com", 8500, false},
+		{"port outside allow list", "example.com", 22, true},
+		{"deny wins over allow range", "example.com", 8080, true},
+		{"blocked domain", "blocked.test", 443, true},
+		{"blocked subdomain", "a.b.blocked.test", 443, true},
+		{"case and trailing dot", "WWW.EVIL.TEST.", 80, true},
+		{"suffix is not a subdomain", "notblocked.test", 443, false},
+		{"parent stays allowed", "test", 443, false},
+		{"ip literal checked here", "127.0.0.1", 443, true},
+		{"public ip literal", "93.184.216.34", 80, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.checkTarget(tt.host, tt.port)
+			if (err != nil) != tt.denied {
+				t.Errorf("checkTarget(%s, %d): err=%v, denied=%v", tt.host, tt.port, err, tt.denied)
+			}
+		})
+	}
+
+	deny, err := compileEgress(&egressConfig{DenyPorts: []string{"25"}})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	if deny.checkTarget("example.com", 25) == nil || deny.checkTarget("example.com", 26) != nil {
+		t.Error("deny_ports without allow_ports")
+	}
+}
+
+func TestCompileEgressErrors(t *testing.T) {
+	for _, cfg := range []*egressConfig{
+		{AllowCIDRs: []string{"10.0.0.0/33"}},
+		{DenyCIDRs: []string{"not-an-ip"}},
+		{AllowPorts: []string{"0"}},
+		{DenyPorts: []string{"9000-8000"}},
+	} {
+		if _, err := compileEgress(cfg); err == nil {
+			t.Errorf("compileEgress(%+v): expected an error", cfg)
+		}
+	}
+}
+
+func TestEgressControl(t *testing.T) {
+	p, err := compileEgress(nil)
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	control := p.control("rebind.test:80")
+	var raw syscall.RawConn
+	if err := control("tcp4", "127.0.0.1:80", raw); !errors.Is(err, errEgressDenied) {
+		t.Errorf("control(loopback): got %v", err)
+	}
+	if err := control("tcp6", "[::ffff:10.0.0.1]:80", raw); !errors.Is(err, errEgressDenied) {
+		t.Errorf("control(mapped private): got %v", err)
+	}
+	if err := control("tcp4", "93.184.216.34:80", raw); err != nil {
+		t.Errorf("control(public): got %v", err)
+	}
+	if err := control("tcp", "unresolved:80", raw); !errors.Is(err, errEgressDenied) {
+		t.Errorf("control(unresolved): got %v", err)
+	}
+}
+
+func TestEgressResolveUDP(t *testing.T) {
+	strict, err := compileEgress(nil)
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	// The name passes checkTarget; the address it resolves to does not.
+	if _, err := strict.resolveUDP("localhost", 53); !errors.Is(err, errEgressDenied) {
+		t.Errorf("resolveUDP(localhost): got %v", err)
+	}
+
+	open, err := compileEgress(&egressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	if addr, err := open.resolveUDP("127.0.0.1", 53); err != nil || addr.Port != 53 {
+		t.Errorf("resolveUDP with allow_private: %v, %v", addr, err)
+	}
+}
+
+func TestUDPFlowResolve(t *testing.T) {
+	strict, err := compileEgress(nil)
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	useSettings(t, &liveSettings{egress: strict})
+	flow := &udpFlow{dests: make(map[string]udpDest)}
+
+	if _, fresh, err := flow.resolve("127.0.0.1", 53); !fresh || !errors.Is(err, errEgressDenied) {
+		t.Fatalf("first datagram: fresh=%v, err=%v", fresh, err)
+	}
+	// Later datagrams reuse the verdict, denials included.
+	if _, fresh, err := flow.resolve("127.0.0.1", 53); fresh || !errors.Is(err, errEgressDenied) {
+		t.Errorf("cached denial: fresh=%v, err=%v", fresh, err)
+	}
+
+	// A reload re-checks at once.
+	open, err := compileEgress(&egressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	useSettings(t, &liveSettings{egress: open})
+	addr, fresh, err := flow.resolve("127.0.0.1", 53)
+	if !fresh || err != nil || addr.String() != "127.0.0.1:53" {
+		t.Fatalf("after reload: %v, fresh=%v, err=%v", addr, fresh, err)
+	}
+	if _, fresh, _ := flow.resolve("127.0.0.1", 53); fresh {
+		t.Error("allowed destination resolved again")
+	}
+
+	// So does an expired entry.
+	d := flow.dests["127.0.0.1:53"]
+	d.expires = time.Now().Add(-time.Second)
+	flow.dests["127.0.0.1:53"] = d
+	if _, fresh, _ := flow.resolve("127.0.0.1", 53); !fresh {
+		t.Error("expired destination not resolved again")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection limit defaults; -1 in the config turns a limit off.
+const (
+	defaultMaxSessionsPerIP   = 16
+	defaultMaxSessionStreams  = 1024
+	defaultMaxPendingMetadata = 1024
+	defaultBanAfter           = 10
+	defaultBanWindow          = time.Minute
+	defaultBanDuration        = 10 * time.Minute
+	guardPruneInterval        = time.Minute
+)
+
+// Limits a connection was refused by, the "limit" label of
+// aether_conn_limit_rejected_total.
+const (
+	limitBanned          = "banned"           // Source IP is banned
+	limitSessionsPerIP   = "sessions_per_ip"  // Too many sessions from the source IP
+	limitSessionStreams  = "session_streams"  // Too many open streams on the session
+	limitPendingMetadata = "pending_metadata" // Too many streams waiting for their first record
+)
+
+var connLimitNames = []string{limitBanned, limitSessionsPerIP, limitSessionStreams, limitPendingMetadata}
+
+// connLimitsConfig is the conn_limits section of the config file. Zero or a
+// missing field keeps the default, -1 disables the limit.
+type connLimitsConfig struct {
+	MaxSessionsPerIP   int    `json:"max_sessions_per_ip,omitempty"`
+	MaxSessionStreams  int    `json:"max_session_streams,omitempty"`  // Streams and mux sub-streams open at once
+	MaxPendingMetadata int    `json:"max_pending_metadata,omitempty"` // Gateway-wide streams still waiting for metadata
+	BanAfter           int    `json:"ban_after,omitempty"`            // Handshake failures within ban_window that ban the IP
+	BanWindow          string `json:"ban_window,omitempty"`           // e.g. "1m"
+	BanDuration        string `json:"ban_duration,omitempty"`         // e.g. "10m"
+}
+
+// connLimits is a compiled connLimitsConfig; 0 means unlimited.
+type connLimits struct {
+	sessionsPerIP   int
+	sessionStreams  int
+	pendingMetadata int
+	banAfter        int
+	banWindow       time.Duration
+	banDuration     time.Duration
+}
+
+// compileConnLimits validates cfg. A nil cfg yields the defaults.
+func compileConnLimits(cfg *connLimitsConfig) (*connLimits, error) {
+	if cfg == nil {
+		cfg = &connLimitsConfig{}
+	}
+	l := &connLimits{}
+	for _, f := range []struct {
+		name     string
+		value    int
+		fallback int
+		dst      *int
+	}{
+		{"max_sessions_per_ip", cfg.MaxSessionsPerIP, defaultMaxSessionsPerIP, &l.sessionsPerIP},
+		{"max_session_streams", cfg.MaxSessionStreams, defaultMaxSessionStreams, &l.sessionStreams},
+		{"max_pending_metadata", cfg.MaxPendingMetadata, defaultMaxPendingMetadata, &l.pendingMetadata},
+		{"ban_after", cfg.BanAfter, defaultBanAfter, &l.banAfter},
+	} {
+		switch {
+		case f.value == 0:
+			*f.dst = f.fallback
+		case f.value == -1:
+			*f.dst = 0
+		case f.value > 0:
+			*f.dst = f.value
+		default:
+			return nil, fmt.Errorf("%s: must be positive, 0 for the default or -1 for unlimited", f.name)
+		}
+	}
+	var err error
+	if l.banWindow, err = parseGuardDuration(cfg.BanWindow, defaultBanWindow); err != nil {
+		return nil, fmt.Errorf("ban_window: %w", err)
+	}
+	if l.banDuration, err = parseGuardDuration(cfg.BanDuration, defaultBanDuration); err != nil {
+		return nil, fmt.Errorf("ban_duration: %w", err)
+	}
+	return l, nil
+}
+
+func parseGuardDuration(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// failureWindow counts the handshake failures of one IP since start.
+type failureWindow struct {
+	start time.Time
+	count int
+}
+
+// ipBan is a source IP refused new sessions until expires.
+type ipBan struct {
+	ip       string
+	reason   string // Kind of the handshake failure that triggered the ban
+	failures int
+	since    time.Time
+	expires  time.Time
+}
+
+// connGuard enforces the per-IP and gateway-wide connection limits and bans
+// source IPs that keep failing the handshake.
+type connGuard struct {
+	mu       sync.Mutex
+	sessions map[string]int
+	failures map[string]*failureWindow
+	bans     map[string]*ipBan
+
+	pending   atomic.Int64
+	bansTotal atomic.Uint64
+	rejected  map[string]*atomic.Uint64
+}
+
+var guard = newConnGuard()
+
+func newConnGuard() *connGuard {
+	g := &connGuard{
+		sessions: make(map[string]int),
+		failures: make(map[string]*failureWindow),
+		bans:     make(map[string]*ipBan),
+		rejected: make(map[string]*atomic.Uint64),
+	}
+	for _, name := range connLimitNames {
+		g.rejected[name] = new(atomic.Uint64)
+	}
+	return g
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (g *connGuard) reject(limit string) {
+	g.rejected[limit].Add(1)
+}
+
+// activeBan returns the ban on ip, dropping it once expired. Callers hold mu.
+func (g *connGuard) activeBan(ip string, now time.Time) *ipBan {
+	b := g.bans[ip]
+	if b != nil && !now.Before(b.expires) {
+		delete(g.bans, ip)
+		return nil
+	}
+	return b
+}
+
+// openSession takes a session slot for ip. It returns the limit that refused
+// it, or "" after which the caller releases the slot with closeSession.
+func (g *connGuard) openSession(ip string, limits *connLimits) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.activeBan(ip, time.Now()) != nil {
+		g.reject(limitBanned)
+		return limitBanned
+	}
+	if limits.sessionsPerIP > 0 && g.sessions[ip] >= limits.sessionsPerIP {
+		g.reject(limitSessionsPerIP)
+		return limitSessionsPerIP
+	}
+	g.sessions[ip]++
+	return ""
+}
+
+func (g *connGuard) closeSession(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sessions[ip]--; g.sessions[ip] <= 0 {
+		delete(g.sessions, ip)
+	}
+}
+
+// beginMetadata takes one of the gateway-wide slots for streams waiting for
+// their first record; on true the caller releases it with endMetadata.
+func (g *connGuard) beginMetadata(limits *connLimits) bool {
+	if n := g.pending.Add(1); limits.pendingMetadata > 0 && n > int64(limits.pendingMetadata) {
+		g.pending.Add(-1)
+		g.reject(limitPendingMetadata)
+		return false
+	}
+	return true
+}
+
+func (g *connGuard) endMetadata() {
+	g.pending.Add(-1)
+}
+
+// handshakeFailed counts a failed handshake from ip and bans the IP once it
+// reaches the limit within the window. It reports whether ip got banned.
+func (g *connGuard) handshakeFailed(ip, kind string, limits *connLimits) bool {
+	if limits.banAfter == 0 {
+		return false
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.activeBan(ip, now) != nil {
+		return false
+	}
+	w := g.failures[ip]
+	if w == nil || now.Sub(w.start) > limits.banWindow {
+		w = &failureWindow{start: now}
+		g.failures[ip] = w
+	}
+	w.count++
+	if w.count < limits.banAfter {
+		return false
+	}
+	delete(g.failures, ip)
+	g.bans[ip] = &ipBan{ip: ip, reason: kind, failures: w.count, since: now, expires: now.Add(limits.banDuration)}
+	g.bansTotal.Add(1)
+	log.Printf("[BAN] %s banned for %v after %d handshake failures within %v (last: %s)", ip, limits.banDuration, w.count, limits.banWindow, kind)
+	return true
+}
+
+// banKinds are the handshake failures that count toward a ban: only a peer
+// without a valid key produces them. Clock skew, replays and timeouts also
+// hit genuine clients, possibly many of them behind one NAT address.
+var banKinds = map[string]bool{failRead: true, failRecordType: true, failKeyID: true, failDecrypt: true}
+
+// countsTowardBan reports whether a handshake failure of kind on gs counts
+// toward banning its IP. Nothing does once a user has authenticated on gs.
+func (gs *gatewaySession) countsTowardBan(kind string) bool {
+	if !banKinds[kind] {
+		return false
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.user == nil
+}
+
+// listBans returns the active bans, oldest first.
+func (g *connGuard) listBans() []*ipBan {
+	now := time.Now()
+	g.mu.Lock()
+	out := make([]*ipBan, 0, len(g.bans))
+	for ip := range g.bans {
+		if b := g.activeBan(ip, now); b != nil {
+			out = append(out, b)
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].since.Before(out[j].since) })
+	return out
+}
+
+// unban lifts the ban on ip, reporting whether there was one.
+func (g *connGuard) unban(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := g.activeBan(ip, time.Now())
+	delete(g.bans, ip)
+	delete(g.failures, ip)
+	return b != nil
+}
+
+// unbanAll lifts every ban and forgets the failure counts.
+func (g *connGuard) unbanAll() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := len(g.bans)
+	clear(g.bans)
+	clear(g.failures)
+	return n
+}
+
+// activeBans is the number of bans in force.
+func (g *connGuard) activeBans() int {
+	return len(g.listBans())
+}
+
+// prune drops expired bans and failure windows every interval, so addresses
+// that fail once and never return do not pile up.
+func (g *connGuard) prune(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		window := currentSettings().connLimits.banWindow
+		g.mu.Lock()
+		for ip := range g.bans {
+			g.activeBan(ip, now)
+		}
+		for ip, w := range g.failures {
+			if now.Sub(w.start) > window {
+				delete(g.failures, ip)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// closeSessionsFrom closes every session from ip, e.g. after it got banned.
+func closeSessionsFrom(ip, reason string) {
+	for _, gs := range sessions.list() {
+		if gs.remoteIP == ip {
+			_ = gs.session.CloseWithError(0, reason)
+		}
+	}
+}
+
+// openStream takes one of the session's stream slots; on true the caller
+// releases it with closeStream.
+func (gs *gatewaySession) openStream(limits *connLimits) bool {
+	if n := gs.openStreams.Add(1); limits.sessionStreams > 0 && n > int64(limits.sessionStreams) {
+		gs.openStreams.Add(-1)
+		guard.reject(limitSessionStreams)
+		return false
+	}
+	return true
+}
+
+func (gs *gatewaySession) closeStream() {
+	gs.openStreams.Add(-1)
+}
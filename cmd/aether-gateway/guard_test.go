@@ -0,0 +1,183 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileConnLimits(t *testing.T) {
+	l, err := compileConnLimits(nil)
+	if err != nil {
+		t.Fatalf("compileConnLimits(nil): %v", err)
+	}
+	want := connLimits{defaultMaxSessionsPerIP, defaultMaxSessionStreams, defaultMaxPendingMetadata, defaultBanAfter, defaultBanWindow, defaultBanDuration}
+	if *l != want {
+		t.Errorf("defaults: got %+v, want %+v", *l, want)
+	}
+
+	l, err = compileConnLimits(&connLimitsConfig{MaxSessionsPerIP: -1, MaxSessionStreams: 5, BanAfter: -1, BanWindow: "30s", BanDuration: "1h"})
+	if err != nil {
+		t.Fatalf("compileConnLimits: %v", err)
+	}
+	want = connLimits{0, 5, defaultMaxPendingMetadata, 0, 30 * time.Second, time.Hour}
+	if *l != want {
+		t.Errorf("overrides: got %+v, want %+v", *l, want)
+	}
+
+	for _, cfg := range []*connLimitsConfig{
+		{MaxSessionsPerIP: -2},
+		{BanAfter: -5},
+		{BanWindow: "soon"},
+		{BanDuration: "-1m"},
+		{BanDuration: "0s"},
+	} {
+		if _, err := compileConnLimits(cfg); err == nil {
+			t.Errorf("compileConnLimits(%+v): expected an error", cfg)
+		}
+	}
+}
+
+func TestConnGuardSessions(t *testing.T) {
+	g := newConnGuard()
+	limits := &connLimits{sessionsPerIP: 2}
+	for i := 0; i < 2; i++ {
+		if limit := g.openSession("192.0.2.1", limits); limit != "" {
+			t.Fatalf("openSession #%d: refused by %s", i, limit)
+		}
+	}
+	if limit := g.openSession("192.0.2.1", limits); limit != limitSessionsPerIP {
+		t.Errorf("third session: got %q, want %s", limit, limitSessionsPerIP)
+	}
+	if limit := g.openSession("192.0.2.2", limits); limit != "" {
+		t.Errorf("other IP: refused by %s", limit)
+	}
+	g.closeSession("192.0.2.1")
+	if limit := g.openSession("192.0.2.1", limits); limit != "" {
+		t.Errorf("after close: refused by %s", limit)
+	}
+	if limit := g.openSession("192.0.2.3", &connLimits{}); limit != "" {
+		t.Errorf("unlimited: refused by %s", limit)
+	}
+	if got := g.rejected[limitSessionsPerIP].Load(); got != 1 {
+		t.Errorf("rejected[%s] = %d, want 1", limitSessionsPerIP, got)
+	}
+}
+
+func TestConnGuardPendingMetadata(t *testing.T) {
+	g := newConnGuard()
+	limits := &connLimits{pendingMetadata: 2}
+	if !g.beginMetadata(limits) || !g.beginMetadata(limits) {
+		t.Fatal("beginMetadata refused below the limit")
+	}
+	if g.beginMetadata(limits) {
+		t.Error("beginMetadata allowed past the limit")
+	}
+	g.endMetadata()
+	if !g.beginMetadata(limits) {
+		t.Error("beginMetadata refused after endMetadata")
+	}
+	if got := g.pending.Load(); got != 2 {
+		t.Errorf("pending = %d, want 2", got)
+	}
+}
+
+func TestConnGuardBans(t *testing.T) {
+	g := newConnGuard()
+	limits := &connLimits{banAfter: 3, banWindow: time.Minute, banDuration: time.Minute}
+	for i := 0; i < 2; i++ {
+		if g.handshakeFailed("192.0.2.1", failDecrypt, limits) {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	if !g.handshakeFailed("192.0.2.1", failKeyID, limits) {
+		t.Fatal("not banned after 3 failures")
+	}
+	if limit := g.openSession("192.0.2.1", limits); limit != limitBanned {
+		t.Errorf("banned IP: got %q, want %s", limit, limitBanned)
+	}
+	bans := g.listBans()
+	if len(bans) != 1 || bans[0].ip != "192.0.2.1" || bans[0].reason != failKeyID || bans[0].failures != 3 {
+		t.Errorf("listBans: got %+v", bans)
+	}
+	if g.handshakeFailed("192.0.2.1", failDecrypt, limits) {
+		t.Error("a banned IP was banned again")
+	}
+
+	if !g.unban("192.0.2.1") || g.unban("192.0.2.1") {
+		t.Error("unban: want true once, then false")
+	}
+	if limit := g.openSession("192.0.2.1", limits); limit != "" {
+		t.Errorf("after unban: refused by %s", limit)
+	}
+
+	// Failures older than the window start a new count.
+	short := &connLimits{banAfter: 2, banWindow: 20 * time.Millisecond, banDuration: 20 * time.Millisecond}
+	g.handshakeFailed("192.0.2.2", failDecrypt, short)
+	time.Sleep(40 * time.Millisecond)
+	if g.handshakeFailed("192.0.2.2", failDecrypt, short) {
+		t.Error("banned for failures outside the window")
+	}
+	if !g.handshakeFailed("192.0.2.2", failDecrypt, short) {
+		t.Error("not banned for failures inside the window")
+	}
+	// Bans lift on their own.
+	time.Sleep(40 * time.Millisecond)
+	if n := g.activeBans(); n != 0 {
+		t.Errorf("expired ban still active: %d", n)
+	}
+
+	g.handshakeFailed("192.0.2.3", failDecrypt, &connLimits{banAfter: 1, banDuration: time.Minute})
+	g.handshakeFailed("192.0.2.4", failDecrypt, &connLimits{banAfter: 1, banDuration: time.Minute})
+	if n := g.unbanAll(); n != 2 || g.activeBans() != 0 {
+		t.Errorf("unbanAll: lifted %d, %d left", n, g.activeBans())
+	}
+	if g.handshakeFailed("192.0.2.5", failDecrypt, &connLimits{}) {
+		t.Error("banned with ban_after off")
+	}
+	if got := g.bansTotal.Load(); got != 4 {
+		t.Errorf("bansTotal = %d, want 4", got)
+	}
+}
+
+func TestCountsTowardBan(t *testing.T) {
+	tests := []struct {
+		kind   string
+		authed bool
+		want   bool
+	}{
+		{failDecrypt, false, true},
+		{failKeyID, false, true},
+		{failRead, false, true},
+		{failRecordType, false, true},
+		{failTimestamp, false, false},
+		{failCounter, false, false},
+		{failTimeout, false, false},
+		{failUser, false, false},
+		{failDecrypt, true, false},
+		{failRead, true, false},
+	}
+	for _, tt := range tests {
+		gs := &gatewaySession{}
+		if tt.authed {
+			gs.user = &gatewayUser{ID: "alice"}
+		}
+		if got := gs.countsTowardBan(tt.kind); got != tt.want {
+			t.Errorf("countsTowardBan(%s, authenticated=%v) = %v, want %v", tt.kind, tt.authed, got, tt.want)
+		}
+	}
+}
+
+func TestSessionStreamLimit(t *testing.T) {
+	gs := &gatewaySession{}
+	limits := &connLimits{sessionStreams: 1}
+	if !gs.openStream(limits) {
+		t.Fatal("openStream refused below the limit")
+	}
+	if gs.openStream(limits) {
+		t.Error("openStream allowed past the limit")
+	}
+	gs.closeStream()
+	if !gs.openStream(limits) {
+		t.Error("openStream refused after closeStream")
+	}
+}
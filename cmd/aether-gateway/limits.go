@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+const (
+	// rateBurst is how much traffic a rate limit lets through without delay,
+	// expressed as time at the full rate.
+	rateBurst         = 250 * time.Millisecond
+	usageSaveInterval = 30 * time.Second
+)
+
+var errQuotaExceeded = errors.New("monthly traffic quota exceeded")
+
+// tokenBucket is shared by every stream of a user in one direction. Callers
+// take tokens first and sleep off any debt, so concurrent streams split the
+// rate between them.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// wait takes n tokens from a bucket refilled at rate bytes per second and
+// blocks until the bucket is out of debt. A rate of 0 means unlimited.
+func (b *tokenBucket) wait(n int, rate float64) {
+	if rate <= 0 {
+		return
+	}
+	burst := rate * rateBurst.Seconds()
+	b.mu.Lock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / rate * float64(time.Second)))
+	}
+}
+
+// mbpsToBytes converts a rate in Mbit/s to bytes per second.
+func mbpsToBytes(mbps float64) float64 {
+	return mbps * 1e6 / 8
+}
+
+// validateLimits rejects negative limits; zero means unlimited.
+func (u *gatewayUser) validateLimits() error {
+	if u.UpMbps < 0 || u.DownMbps < 0 || u.MaxStreams < 0 || u.MonthlyQuotaGB < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// quotaBytes returns the monthly quota in bytes, or 0 for unlimited.
+func (u *gatewayUser) quotaBytes() uint64 {
+	return uint64(u.MonthlyQuotaGB * 1e9)
+}
+
+// overQuota reports whether the user has used up this month's quota.
+func (u *gatewayUser) overQuota(s *userStats) bool {
+	q := u.quotaBytes()
+	return q > 0 && s.monthBytes() >= q
+}
+
+func (s *userStats) monthBytes() uint64 {
+	return s.monthUp.Load() + s.monthDown.Load()
+}
+
+// admitStream takes a stream slot for u. It returns CodeOK, or the code and
+// message to reject the stream with; on CodeOK the caller releases the slot
+// with activeStreams.Add(-1).
+func (s *userStats) admitStream(u *gatewayUser) (uint16, string) {
+	if u.overQuota(s) {
+		s.rejected.Add(1)
+		return core.CodeQuotaExceeded, "monthly quota exceeded"
+	}
+	if n := s.activeStreams.Add(1); u.MaxStreams > 0 && n > int64(u.MaxStreams) {
+		s.activeStreams.Add(-1)
+		s.rejected.Add(1)
+		return core.CodeResourceLimit, "too many streams"
+	}
+	s.streams.Add(1)
+	return core.CodeOK, ""
+}
+
+// chargeUp accounts n bytes forwarded from the client, waiting for the
+// user's upload rate. It fails once the monthly quota is used up.
+func (s *userStats) chargeUp(u *gatewayUser, n int) error {
+	return s.charge(u, n, &s.bytesUp, &s.monthUp, &s.upBucket, u.UpMbps)
+}
+
+// chargeDown is chargeUp for bytes forwarded to the client.
+func (s *userStats) chargeDown(u *gatewayUser, n int) error {
+	return s.charge(u, n, &s.bytesDown, &s.monthDown, &s.downBucket, u.DownMbps)
+}
+
+func (s *userStats) charge(u *gatewayUser, n int, total, month *atomic.Uint64, bucket *tokenBucket, mbps float64) error {
+	total.Add(uint64(n))
+	month.Add(uint64(n))
+	bucket.wait(n, mbpsToBytes(mbps))
+	if u.overQuota(s) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// countDatagram accounts a relayed UDP payload. Datagrams are not held back by
+// the rate limits; callers drop them once the quota is used up.
+func (s *userStats) countDatagram(up bool, n int) {
+	s.datagrams.Add(1)
+	if up {
+		s.bytesUp.Add(uint64(n))
+		s.monthUp.Add(uint64(n))
+	} else {
+		s.bytesDown.Add(uint64(n))
+		s.monthDown.Add(uint64(n))
+	}
+}
+
+// usageFile is the on-disk format of -usage-file.
+type usageFile struct {
+	Period string                `json:"period"` // Calendar month in UTC, e.g. "2026-10"
+	Users  map[string]usageEntry `json:"users"`
+}
+
+type usageEntry struct {
+	UpBytes   uint64 `json:"up_bytes"`
+	DownBytes uint64 `json:"down_bytes"`
+}
+
+func usagePeriod(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+// loadUsage restores this month's counters from path. A missing file or one
+// from an earlier month starts the month at zero.
+func (t *userTable) loadUsage(path string) error {
+	t.usageMu.Lock()
+	defer t.usageMu.Unlock()
+	t.usagePath = path
+	t.period = usagePeriod(time.Now())
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read usage file: %w", err)
+	}
+	var file usageFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse usage file: %w", err)
+	}
+	if file.Period != t.period {
+		log.Printf("Config: Usage file %s is from %s, starting %s at zero", path, file.Period, t.period)
+		return nil
+	}
+	for id, e := range file.Users {
+		s := t.statsFor(id)
+		s.monthUp.Store(e.UpBytes)
+		s.monthDown.Store(e.DownBytes)
+	}
+	log.Printf("Config: Restored %s usage for %d users from %s", t.period, len(file.Users), path)
+	return nil
+}
+
+// saveUsage writes the monthly counters, replacing the file atomically.
+// Crossing into a new month saves the old one last and resets the counters.
+func (t *userTable) saveUsage() error {
+	t.usageMu.Lock()
+	defer t.usageMu.Unlock()
+
+	ids := t.statIDs()
+	file := usageFile{Period: t.period, Users: make(map[string]usageEntry)}
+	for _, id := range ids {
+		s := t.statsFor(id)
+		if up, down := s.monthUp.Load(), s.monthDown.Load(); up > 0 || down > 0 {
+			file.Users[id] = usageEntry{UpBytes: up, DownBytes: down}
+		}
+	}
+
+	var err error
+	if t.usagePath != "" {
+		err = writeFileAtomic(t.usagePath, file)
+	}
+	if period := usagePeriod(time.Now()); period != t.period {
+		log.Printf("[USER] Traffic period %s ended, resetting monthly usage", t.period)
+		for _, id := range ids {
+			s := t.statsFor(id)
+			s.monthUp.Store(0)
+			s.monthDown.Store(0)
+		}
+		t.period = period
+	}
+	return err
+}
+
+// trackUsage saves usage every interval and rolls it over at the start of a
+// month. A drain saves once more before the gateway exits.
+func (t *userTable) trackUsage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.saveUsage(); err != nil {
+			log.Printf("[ERROR] Failed to save usage: %v", err)
+		}
+	}
+}
+
+func writeFileAtomic(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
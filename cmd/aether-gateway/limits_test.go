@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+func TestTokenBucket(t *testing.T) {
+	const rate = 1e6 // bytes per second; the burst is 250000 bytes
+	var b tokenBucket
+
+	start := time.Now()
+	b.wait(250000, rate)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst waited %v", d)
+	}
+
+	// 100000 bytes past the burst are 100ms of debt.
+	start = time.Now()
+	b.wait(100000, rate)
+	if d := time.Since(start); d < 80*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("debt of 100ms waited %v", d)
+	}
+
+	start = time.Now()
+	b.wait(1<<30, 0)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("unlimited rate waited %v", d)
+	}
+}
+
+func TestCharge(t *testing.T) {
+	u := &gatewayUser{ID: "alice", MonthlyQuotaGB: 1e-6, MaxStreams: 1} // 1000 bytes
+	s := &userStats{}
+
+	if code, _ := s.admitStream(u); code != core.CodeOK {
+		t.Fatalf("admitStream: got 0x%04x", code)
+	}
+	if code, _ := s.admitStream(u); code != core.CodeResourceLimit {
+		t.Errorf("second stream: got 0x%04x, want resource limit", code)
+	}
+	s.activeStreams.Add(-1)
+
+	if err := s.chargeUp(u, 600); err != nil {
+		t.Fatalf("chargeUp: %v", err)
+	}
+	if err := s.chargeDown(u, 500); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("chargeDown past the quota: got %v", err)
+	}
+	if s.bytesUp.Load() != 600 || s.bytesDown.Load() != 500 || s.monthBytes() != 1100 {
+		t.Errorf("counters: up=%d down=%d month=%d", s.bytesUp.Load(), s.bytesDown.Load(), s.monthBytes())
+	}
+	if !u.overQuota(s) {
+		t.Error("overQuota: got false")
+	}
+	if code, _ := s.admitStream(u); code != core.CodeQuotaExceeded {
+		t.Errorf("stream over quota: got 0x%04x", code)
+	}
+	if s.rejected.Load() != 2 {
+		t.Errorf("rejected = %d, want 2", s.rejected.Load())
+	}
+
+	s.countDatagram(true, 10)
+	s.countDatagram(false, 20)
+	if s.datagrams.Load() != 2 || s.monthBytes() != 1130 {
+		t.Errorf("datagrams: count=%d month=%d", s.datagrams.Load(), s.monthBytes())
+	}
+
+	unlimited := &gatewayUser{ID: "bob"}
+	if err := (&userStats{}).chargeUp(unlimited, 1<<40); err != nil {
+		t.Errorf("unlimited user: %v", err)
+	}
+}
+
+func TestUsageRollover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	current := usagePeriod(time.Now())
+	writeUsage := func(period string) {
+		t.Helper()
+		if err := writeFileAtomic(path, usageFile{Period: period, Users: map[string]usageEntry{"alice": {UpBytes: 100, DownBytes: 200}}}); err != nil {
+			t.Fatalf("writeFileAtomic: %v", err)
+		}
+	}
+	readUsage := func() usageFile {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		var file usageFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		return file
+	}
+
+	// This month's file is restored.
+	writeUsage(current)
+	users, err := newUserTable("", "psk", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	if err := users.loadUsage(path); err != nil {
+		t.Fatalf("loadUsage: %v", err)
+	}
+	if s := users.statsFor("alice"); s.monthUp.Load() != 100 || s.monthDown.Load() != 200 {
+		t.Errorf("restored: up=%d down=%d", s.monthUp.Load(), s.monthDown.Load())
+	}
+
+	// Last month's file is not.
+	writeUsage("2000-01")
+	users, err = newUserTable("", "psk", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	if err := users.loadUsage(path); err != nil {
+		t.Fatalf("loadUsage: %v", err)
+	}
+	if s := users.statsFor("alice"); s.monthBytes() != 0 {
+		t.Errorf("old period restored: %d bytes", s.monthBytes())
+	}
+
+	// Crossing into a new month saves the old one, then starts at zero.
+	users.period = "2000-01"
+	users.statsFor("alice").monthUp.Store(500)
+	if err := users.saveUsage(); err != nil {
+		t.Fatalf("saveUsage: %v", err)
+	}
+	if file := readUsage(); file.Period != "2000-01" || file.Users["alice"].UpBytes != 500 {
+		t.Errorf("saved at rollover: %+v", file)
+	}
+	if users.period != current || users.statsFor("alice").monthBytes() != 0 {
+		t.Errorf("after rollover: period=%s, %d bytes", users.period, users.statsFor("alice").monthBytes())
+	}
+	if err := users.saveUsage(); err != nil {
+		t.Fatalf("saveUsage: %v", err)
+	}
+	if file := readUsage(); file.Period != current || len(file.Users) != 0 {
+		t.Errorf("saved after rollover: %+v", file)
+	}
+}
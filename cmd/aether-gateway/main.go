@@ -10,6 +10,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -34,6 +35,7 @@ import (
 	"github.com/quic-go/quic-go/qlog"
 	"github.com/quic-go/quic-go/qlogwriter"
 	"github.com/quic-go/webtransport-go"
+	"golang.org/x/crypto/acme"
 )
 
 // BufferedWriteCloser buffers writes and flushes on close
@@ -58,11 +60,40 @@ func (b *BufferedWriteCloser) Close() error {
 
 var (
 	listenAddr = flag.String("listen", ":8080", "Listen address")
+	reusePort  = flag.Bool("reuseport", false, "Bind -listen with SO_REUSEPORT so a new gateway can take over while this one drains (Linux)")
+	drainWait  = flag.String("drain-timeout", "", "How long SIGINT/SIGTERM waits for open streams before closing them (default 30s)")
 	certFile   = flag.String("cert", "cert.pem", "TLS certificate file")
 	keyFile    = flag.String("key", "key.pem", "TLS key file")
-	psk        = flag.String("psk", "", "Pre-shared key")
+	psk        = flag.String("psk", "", "Pre-shared key (legacy single user, selected by records without a key ID)")
+	usersPath  = flag.String("users", "", "Path to the JSON users file (id, key_id, psk, enabled, expires_at, reverse_ports, limits); reloaded on SIGHUP")
+	usagePath  = flag.String("usage-file", "", "Path where monthly per-user traffic is kept across restarts (empty: in memory only)")
 	secretPath = flag.String("path", "/aether", "Secret path for WebTransport")
 	decoyRoot  = flag.String("decoy", "", "Path to the decoy/masquerade static website root")
+	decoyUp    = flag.String("decoy-upstream", "", "Reverse-proxy every non-tunnel request to this origin, e.g. https://example.com (overrides -decoy)")
+
+	reverseBind  = flag.String("reverse-bind", "", "Host reverse-tunnel listeners bind to (empty: all interfaces)")
+	reversePorts = flag.String("reverse-ports", "", "Ports the legacy -psk user may expose as reverse tunnels, e.g. 8080,9000-9010")
+
+	acmeDomains   = flag.String("acme-domains", "", "Obtain and renew certificates for these comma-separated domains via ACME instead of -cert/-key")
+	acmeEmail     = flag.String("acme-email", "", "ACME account contact email")
+	acmeCacheDir  = flag.String("acme-cache", "", "Directory for the ACME account key and certificates (default ./acme)")
+	acmeDirectory = flag.String("acme-directory", "", "ACME directory URL (empty: Let's Encrypt production)")
+	acmeHTTP      = flag.String("acme-http", "", "Also answer ACME HTTP-01 challenges on this address, e.g. :80 (TLS-ALPN-01 always runs on -listen)")
+
+	egressAllowPrivate = flag.Bool("egress-allow-private", false, "Allow streams to loopback, private and link-local destinations (denied by default)")
+
+	maxSessionsPerIP   = flag.Int("max-sessions-per-ip", 0, "Sessions one source IP may hold open (0: default 16, -1: unlimited)")
+	maxSessionStreams  = flag.Int("max-session-streams", 0, "Streams and mux sub-streams one session may have open (0: default 1024, -1: unlimited)")
+	maxPendingMetadata = flag.Int("max-pending-metadata", 0, "Streams gateway-wide still waiting for their metadata (0: default 1024, -1: unlimited)")
+	banAfter           = flag.Int("ban-after", 0, "Handshake failures within a minute that ban the source IP (0: default 10, -1: never ban)")
+	banDuration        = flag.String("ban-duration", "", "How long a banned IP is refused new sessions (default 10m)")
+
+	accessLogPath    = flag.String("access-log", "", "Write a JSON access log line per stream to this file (rotated at 100MB) or \"stdout\" (empty: off)")
+	accessLogTargets = flag.String("access-log-targets", "", "How stream targets appear in the access and gateway logs: full (default), hash or omit")
+
+	adminListen = flag.String("admin", "", "Admin listen address for /metrics, the session API and health probes, e.g. 127.0.0.1:9090 (empty: disabled)")
+	adminToken  = flag.String("admin-token", "", "Bearer token for the admin API (and /metrics once set); the API is disabled without it")
+	configPath  = flag.String("config", "", "Path to a YAML or JSON config file; settings in it override flags and env, reloaded on SIGHUP or change")
 )
 
 type gatewayPerfStats struct {
@@ -236,22 +267,174 @@ func main() {
 	if envDecoy := os.Getenv("DECOY_ROOT"); envDecoy != "" {
 		*decoyRoot = envDecoy
 	}
+	if envUpstream := os.Getenv("DECOY_UPSTREAM"); envUpstream != "" && *decoyUp == "" {
+		*decoyUp = envUpstream
+	}
+
+	if envUsers := os.Getenv("USERS_FILE"); envUsers != "" && *usersPath == "" {
+		*usersPath = envUsers
+	}
+	if envUsage := os.Getenv("USAGE_FILE"); envUsage != "" && *usagePath == "" {
+		*usagePath = envUsage
+	}
+	if envAdmin := os.Getenv("ADMIN_LISTEN"); envAdmin != "" && *adminListen == "" {
+		*adminListen = envAdmin
+	}
+	if envToken := os.Getenv("ADMIN_TOKEN"); envToken != "" && *adminToken == "" {
+		*adminToken = envToken
+	}
+	for env, value := range map[string]*string{
+		"ACME_DOMAINS":       acmeDomains,
+		"ACME_EMAIL":         acmeEmail,
+		"ACME_CACHE_DIR":     acmeCacheDir,
+		"ACME_DIRECTORY":     acmeDirectory,
+		"ACME_HTTP_LISTEN":   acmeHTTP,
+		"DRAIN_TIMEOUT":      drainWait,
+		"ACCESS_LOG":         accessLogPath,
+		"ACCESS_LOG_TARGETS": accessLogTargets,
+	} {
+		if v := os.Getenv(env); v != "" && *value == "" {
+			*value = v
+		}
+	}
+	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" && *configPath == "" {
+		*configPath = envConfig
+	}
+
+	var legacyReverse []string
+	if *reversePorts != "" {
+		legacyReverse = strings.Split(*reversePorts, ",")
+	}
+	base := gatewayConfig{
+		Listen:             *listenAddr,
+		ReusePort:          *reusePort || os.Getenv("REUSEPORT") == "1",
+		DrainTimeout:       *drainWait,
+		Cert:               *certFile,
+		Key:                *keyFile,
+		PSK:                *psk,
+		UsersFile:          *usersPath,
+		UsageFile:          *usagePath,
+		AdminListen:        *adminListen,
+		AdminToken:         *adminToken,
+		Path:               *secretPath,
+		Decoy:              *decoyRoot,
+		DecoyUpstream:      *decoyUp,
+		WindowProfile:      os.Getenv("WINDOW_PROFILE"),
+		RecordPayloadBytes: core.GetMaxRecordPayload(),
+		ReverseBind:        *reverseBind,
+		ReversePorts:       legacyReverse,
+		ConnLimits: &connLimitsConfig{
+			MaxSessionsPerIP:   *maxSessionsPerIP,
+			MaxSessionStreams:  *maxSessionStreams,
+			MaxPendingMetadata: *maxPendingMetadata,
+			BanAfter:           *banAfter,
+			BanDuration:        *banDuration,
+		},
+		AccessLog: &accessLogConfig{Path: *accessLogPath, Targets: *accessLogTargets},
+	}
+	if *egressAllowPrivate || os.Getenv("EGRESS_ALLOW_PRIVATE") == "1" {
+		base.Egress = &egressConfig{AllowPrivate: true}
+	}
+	if *acmeDomains != "" {
+		base.ACME = &acmeConfig{
+			Domains:      strings.Split(*acmeDomains, ","),
+			Email:        *acmeEmail,
+			CacheDir:     *acmeCacheDir,
+			DirectoryURL: *acmeDirectory,
+			HTTPListen:   *acmeHTTP,
+		}
+	}
+	cfg := base
+	if *configPath != "" {
+		file, err := loadGatewayConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		cfg = base.overlay(file)
+		if strings.HasPrefix(cfg.Listen, ":") {
+			cfg.Listen = "0.0.0.0" + cfg.Listen
+		}
+		core.SetRecordPayloadBytes(cfg.RecordPayloadBytes)
+		log.Printf("Config: Loaded %s (listen=%s path=%s)", *configPath, cfg.Listen, cfg.Path)
+	}
+	egress, err := compileEgress(cfg.Egress)
+	if err != nil {
+		log.Fatalf("Invalid egress policy: %v", err)
+	}
+	if egress.allowPrivate {
+		log.Printf("[WARN] Egress: private and loopback destinations are allowed")
+	}
+	outbounds, err := compileOutbounds(cfg.Outbounds, cfg.OutboundRules)
+	if err != nil {
+		log.Fatalf("Invalid outbounds: %v", err)
+	}
+	var decoy *decoyProxy
+	if cfg.DecoyUpstream != "" {
+		if decoy, err = newDecoyProxy(cfg.DecoyUpstream); err != nil {
+			log.Fatalf("Invalid decoy: %v", err)
+		}
+		log.Printf("Config: Decoy reverse-proxies to %s", cfg.DecoyUpstream)
+	}
+	drainTimeout, err := parseDrainTimeout(cfg.DrainTimeout)
+	if err != nil {
+		log.Fatalf("Invalid drain timeout: %v", err)
+	}
+	connLimits, err := compileConnLimits(cfg.ConnLimits)
+	if err != nil {
+		log.Fatalf("Invalid connection limits: %v", err)
+	}
+	accessLog, err := newAccessLogger(cfg.AccessLog)
+	if err != nil {
+		log.Fatalf("Invalid access log: %v", err)
+	}
+	if accessLog.enabled() {
+		log.Printf("Config: Access log to %s (targets=%s)", cfg.AccessLog.Path, accessLog.targets)
+	} else if accessLog.targets != targetsFull {
+		log.Printf("Config: Stream targets logged as %s", accessLog.targets)
+	}
+	live.Store(&liveSettings{secretPath: cfg.Path, decoyRoot: cfg.Decoy, decoyProxy: decoy, reverseBind: cfg.ReverseBind, egress: egress, outbounds: outbounds, adminToken: cfg.AdminToken, drainTimeout: drainTimeout, connLimits: connLimits, accessLog: accessLog})
+	go guard.prune(guardPruneInterval)
 
-	if *psk == "" {
-		log.Println("ERROR: PSK is required. Please set -psk flag or PSK environment variable.")
+	if cfg.PSK == "" && cfg.UsersFile == "" && len(cfg.Users) == 0 {
+		log.Println("ERROR: PSK is required. Please set -psk flag, PSK environment variable, -users file or -config file.")
 		os.Exit(1)
 	}
 	// Normalize PSK (Trim whitespace to avoid common config issues)
-	*psk = strings.TrimSpace(*psk)
-	if len(*psk) > 4 {
-		log.Printf("Config: PSK loaded (Length: %d, Prefix: %s...)", len(*psk), (*psk)[:4])
-	} else {
-		log.Printf("Config: PSK loaded (Length: %d)", len(*psk))
+	legacyPSK := strings.TrimSpace(cfg.PSK)
+	if len(legacyPSK) > 4 {
+		log.Printf("Config: PSK loaded (Length: %d, Prefix: %s...)", len(legacyPSK), legacyPSK[:4])
+	} else if legacyPSK != "" {
+		log.Printf("Config: PSK loaded (Length: %d)", len(legacyPSK))
 	}
 
-	// Initialize Certificate Loader for hot-reloading
-	certLoader, err := NewCertificateLoader(*certFile, *keyFile)
+	users, err := newUserTable(cfg.UsersFile, legacyPSK, cfg.ReversePorts, cfg.Users)
 	if err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	if err := users.loadUsage(cfg.UsageFile); err != nil {
+		log.Fatalf("Failed to load usage: %v", err)
+	}
+	go users.trackUsage(usageSaveInterval)
+	go users.reportStats(5 * time.Minute)
+	if cfg.AdminListen != "" {
+		go serveAdmin(cfg.AdminListen, users)
+	}
+
+	// Initialize Certificate Loader for hot-reloading
+	var certLoader *CertificateLoader
+	if cfg.ACME != nil {
+		// ACME replaces the certificate files; there is no self-signed fallback.
+		issuer, err := newACMEIssuer(cfg.ACME)
+		if err != nil {
+			log.Fatalf("Invalid ACME config: %v", err)
+		}
+		log.Printf("TLS certificates managed by ACME for %s (directory %s)", strings.Join(issuer.domains, ", "), issuer.manager.Client.DirectoryURL)
+		certLoader = &CertificateLoader{acme: issuer}
+		go issuer.run()
+		if cfg.ACME.HTTPListen != "" {
+			go issuer.serveHTTP(cfg.ACME.HTTPListen)
+		}
+	} else if certLoader, err = NewCertificateLoader(cfg.Cert, cfg.Key); err != nil {
 		// Fallback to self-signed if loading failed
 		// V5: We always generate a 10-year self-signed cert if the provided path is missing
 		log.Printf("TLS certificates not found or invalid (%v). Generating 10-year self-signed certificate...", err)
@@ -259,9 +442,16 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to generate self-signed cert: %v", err)
 		}
-		certLoader = &CertificateLoader{cert: &certs, certFile: *certFile, keyFile: *keyFile}
+		certLoader = &CertificateLoader{cert: &certs, certFile: cfg.Cert, keyFile: cfg.Key}
 	} else {
-		log.Printf("TLS certificates loaded successfully from %s", *certFile)
+		log.Printf("TLS certificates loaded successfully from %s", cfg.Cert)
+	}
+
+	// The config file takes over SIGHUP for users; without it -users reloads on its own.
+	if *configPath != "" {
+		go newConfigReloader(*configPath, base, cfg, users, certLoader).watch()
+	} else if cfg.UsersFile != "" {
+		go users.listenForSignal()
 	}
 
 	tlsConfig := &tls.Config{
@@ -299,8 +489,7 @@ func main() {
 	}
 
 	// V5.2: Profile defaults + optional explicit QUIC window overrides.
-	profile := os.Getenv("WINDOW_PROFILE")
-	windowCfg, err := core.ResolveQUICWindowConfig(profile)
+	windowCfg, err := core.ResolveQUICWindowConfig(cfg.WindowProfile)
 	if err != nil {
 		log.Fatalf("Invalid QUIC window config: %v", err)
 	}
@@ -340,7 +529,7 @@ func main() {
 
 	server := webtransport.Server{
 		H3: &http3.Server{
-			Addr:            *listenAddr,
+			Addr:            cfg.Listen,
 			TLSConfig:       tlsConfig,
 			QUICConfig:      quicConfig,
 			EnableDatagrams: true,
@@ -351,45 +540,29 @@ func main() {
 	// This is required for clients that validate SETTINGS before sending CONNECT.
 	webtransport.ConfigureHTTP3Server(server.H3)
 	log.Printf("WebTransport capability: H3 datagrams enabled=%v, QUIC datagrams enabled=%v", server.H3.EnableDatagrams, quicConfig.EnableDatagrams)
-	// V5: ReplayCache removed - using counter-based anti-replay
-
-	// Serve decoy content in a way that minimizes path-based fingerprinting/oracles.
-	// - If decoyRoot has index.html, serve static files (same behavior as "/").
-	// - Otherwise, serve an nginx-like 403 page with aligned headers.
-	serveDecoyOrForbidden := func(w http.ResponseWriter, r *http.Request) {
-		// If decoyRoot is specified and index.html exists, serve static files.
-		if *decoyRoot != "" {
-			index := fmt.Sprintf("%s/index.html", strings.TrimSuffix(*decoyRoot, "/"))
-			if _, err := os.Stat(index); err == nil {
-				http.FileServer(http.Dir(*decoyRoot)).ServeHTTP(w, r)
-				return
-			}
-		}
-
-		// Fallback: Nginx 403 Forbidden Simulation
-		// CRITICAL: Align Status Code and Headers to prevent fingerprinting
-		w.Header().Set("Server", "nginx/1.18.0 (Ubuntu)")
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Connection", "keep-alive")
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte(`<html>
-<head><title>403 Forbidden</title></head>
-<body bgcolor="white">
-<center><h1>403 Forbidden</h1></center>
-<hr><center>nginx/1.18.0 (Ubuntu)</center>
-</body>
-</html>`))
-	}
 
-	http.HandleFunc(*secretPath, func(w http.ResponseWriter, r *http.Request) {
+	serveTunnel := func(w http.ResponseWriter, r *http.Request) {
 		// Log every attempt to the secret path
 		log.Printf("[DEBUG] connection attempt from %s to %s (Method: %s)", r.RemoteAddr, r.URL.Path, r.Method)
+		if drain.active() {
+			// No new sessions while draining; clients retry on a new connection.
+			serveDecoy(w, r)
+			return
+		}
+		// Refused sources see the decoy like any other non-tunnel request.
+		ip := remoteIP(r.RemoteAddr)
+		if limit := guard.openSession(ip, currentSettings().connLimits); limit != "" {
+			log.Printf("[LIMIT] Refusing session from %s: %s", r.RemoteAddr, limit)
+			serveDecoy(w, r)
+			return
+		}
+		defer guard.closeSession(ip)
 
 		session, err := server.Upgrade(w, r)
 		if err != nil {
 			log.Printf("[DEBUG] WebTransport upgrade failed (likely non-WT request): %v", err)
 			// Non-protocol requests must be indistinguishable from normal decoy traffic.
-			serveDecoyOrForbidden(w, r)
+			serveDecoy(w, r)
 			return
 		}
 
@@ -401,58 +574,98 @@ func main() {
 			log.Printf("[ERROR] Failed to create NonceGenerator: %v", err)
 			return
 		}
-		handleSession(session, *psk, ng)
-	})
+		gs := &gatewaySession{
+			session:  session,
+			remoteIP: ip,
+			ng:       ng,
+			users:    users,
+			started:  time.Now(),
+			streams:  make(map[uint64]*trackedStream),
+		}
+		gs.relay = newUDPRelay(gs)
+		go gs.relay.run()
+		go gs.watchRekey()
+		sessions.add(gs)
+		defer sessions.remove(gs)
+		gwMetrics.sessionsTotal.Add(1)
+		gwMetrics.sessionsActive.Add(1)
+		defer gwMetrics.sessionsActive.Add(-1)
+		handleSession(gs)
+	}
 
+	// The secret path is matched per request so a config reload can move it.
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		serveDecoyOrForbidden(w, r)
+		if r.URL.Path == currentSettings().secretPath {
+			serveTunnel(w, r)
+			return
+		}
+		serveDecoy(w, r)
 	})
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		// Health check must return 200 OK for load balancers
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	http.HandleFunc("/health", serveHealth)
 
 	// 1. Start HTTP/3 (UDP) Server for WebTransport
-	go func() {
-		log.Printf("Starting HTTP/3 (UDP) server on %s", *listenAddr)
-
-		udpAddr, err := net.ResolveUDPAddr("udp", *listenAddr)
-		if err != nil {
-			log.Fatalf("Failed to resolve UDP addr: %v", err)
-		}
-
-		conn, err := net.ListenUDP("udp", udpAddr)
-		if err != nil {
-			log.Fatalf("Failed to listen UDP: %v", err)
-		}
+	log.Printf("Starting HTTP/3 (UDP) server on %s", cfg.Listen)
+	var connIDs *taggedConnIDs
+	if cfg.ReusePort {
+		connIDs = newTaggedConnIDs()
+		log.Printf("Config: SO_REUSEPORT enabled; new connections move to the newest gateway on %s", cfg.Listen)
+	}
+	conn, err := listenUDP(cfg.Listen, connIDs)
+	if err != nil {
+		log.Fatalf("Failed to listen UDP: %v", err)
+	}
 
-		// V5.1 Performance Fix: Increase UDP buffers to 32MB to absorb ISP bursts
-		// This prevents kernel-level packet drops during token bucket refills
-		const bufSize = 32 * 1024 * 1024 // 32MB
-		if err := conn.SetReadBuffer(bufSize); err != nil {
-			log.Printf("Warning: Failed to set UDP read buffer: %v", err)
-		}
-		if err := conn.SetWriteBuffer(bufSize); err != nil {
-			log.Printf("Warning: Failed to set UDP write buffer: %v", err)
-		}
-		log.Printf("UDP Send/Recv buffers set to %d bytes", bufSize)
+	// V5.1 Performance Fix: Increase UDP buffers to 32MB to absorb ISP bursts
+	// This prevents kernel-level packet drops during token bucket refills
+	const bufSize = 32 * 1024 * 1024 // 32MB
+	if err := conn.SetReadBuffer(bufSize); err != nil {
+		log.Printf("Warning: Failed to set UDP read buffer: %v", err)
+	}
+	if err := conn.SetWriteBuffer(bufSize); err != nil {
+		log.Printf("Warning: Failed to set UDP write buffer: %v", err)
+	}
+	log.Printf("UDP Send/Recv buffers set to %d bytes", bufSize)
 
-		if err := server.Serve(conn); err != nil {
-			log.Fatalf("HTTP/3 server failed: %v", err)
+	// Our own listener instead of server.Serve: a drain closes it to refuse
+	// new connections while the established ones keep running.
+	transport := &quic.Transport{Conn: conn}
+	if connIDs != nil {
+		transport.ConnectionIDGenerator = connIDs
+	}
+	quicListener, err := transport.ListenEarly(tlsConfig, quicConfig)
+	if err != nil {
+		log.Fatalf("Failed to start QUIC listener: %v", err)
+	}
+	go func() {
+		udpServing := conn.LocalAddr().String()
+		listeners.udp.Store(&udpServing)
+		defer listeners.udp.Store(nil)
+		for {
+			qconn, err := quicListener.Accept(context.Background())
+			if err != nil {
+				if drain.active() {
+					return
+				}
+				log.Fatalf("HTTP/3 server failed: %v", err)
+			}
+			go func() {
+				if err := server.ServeQUICConn(qconn); err != nil && !drain.active() {
+					log.Printf("http3: error serving QUIC connection: %v", err)
+				}
+			}()
 		}
 	}()
 
 	// 2. Start HTTP/1.1 (TCP) Server for Health Checks & Alt-Svc
 	// This is CRITICAL for PaaS health checks which use TCP
 	httpServer := &http.Server{
-		Addr: *listenAddr,
+		Addr: cfg.Listen,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Add Alt-Svc header to advertise HTTP/3 capability
 			// This tells clients "I speak H3 on this same port"
 			port := "443"
-			if _, p, err := net.SplitHostPort(*listenAddr); err == nil {
+			if _, p, err := net.SplitHostPort(cfg.Listen); err == nil {
 				port = p
 			}
 			w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"; ma=2592000`, port))
@@ -463,64 +676,215 @@ func main() {
 	}
 
 	// Create a TCP listener explicitly to get the actual bound port
-	tcpListener, err := net.Listen("tcp", *listenAddr)
+	tcpListener, err := listenTCP(cfg.Listen, cfg.ReusePort)
 	if err != nil {
-		log.Fatalf("Failed to listen on TCP %s: %v", *listenAddr, err)
+		log.Fatalf("Failed to listen on TCP %s: %v", cfg.Listen, err)
 	}
 	log.Printf("HTTP/1.1 (TCP+TLS) server listening on %s", tcpListener.Addr().String())
 
 	// Clone TLS config for TCP, setting correct ALPN for HTTP/1.1 and HTTP/2
 	tcpTLSConfig := tlsConfig.Clone()
 	tcpTLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	if certLoader.acme != nil {
+		// TLS-ALPN-01 validation connects here.
+		tcpTLSConfig.NextProtos = append(tcpTLSConfig.NextProtos, acme.ALPNProto)
+	}
 
 	// Enable TLS on TCP listener using the tcp specific config
 	tlsListener := tls.NewListener(tcpListener, tcpTLSConfig)
 
-	if err := httpServer.Serve(tlsListener); err != nil {
+	go drain.watch(drainTargets{quicListener: quicListener, transport: transport, server: &server, httpServer: httpServer, users: users})
+
+	tcpServing := tcpListener.Addr().String()
+	listeners.tcp.Store(&tcpServing)
+	err = httpServer.Serve(tlsListener)
+	listeners.tcp.Store(nil)
+	if !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("TCP server failed: %v", err)
 	}
+	<-drain.done
+}
+
+// gatewaySession holds the state shared by the streams and datagrams of one WebTransport session.
+type gatewaySession struct {
+	session  *webtransport.Session
+	remoteIP string
+	ng       *core.NonceGenerator // V5: per-session counter-based nonce
+	users    *userTable
+	relay    *udpRelay
+
+	openStreams atomic.Int64 // Streams and mux sub-streams being served, for max_session_streams
+
+	mu   sync.Mutex
+	user *gatewayUser // bound by the first authenticated record
+
+	// Listed by the admin API.
+	id                 uint64
+	started            time.Time
+	bytesUp, bytesDown atomic.Uint64
+	streamSeq          atomic.Uint64
+	streamsMu          sync.Mutex
+	streams            map[uint64]*trackedStream
+}
+
+// bindUser ties the session to the first user that authenticates on it.
+// Records sealed for a different user on the same session are rejected.
+func (gs *gatewaySession) bindUser(u *gatewayUser) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.user == nil {
+		gs.user = u
+		log.Printf("[INFO] Session from %s authenticated as user=%s", gs.session.RemoteAddr(), u.ID)
+		return nil
+	}
+	if gs.user.ID != u.ID {
+		return fmt.Errorf("session bound to user %s, got %s", gs.user.ID, u.ID)
+	}
+	return nil
+}
+
+// handleRekey answers a client rekey request. The client keeps sealing with its old
+// SessionID until it reads the ack; the gateway switches its own generator right after
+// writing it. Records in flight on either side stay valid since every record names
+// the SessionID its key is derived from.
+func (gs *gatewaySession) handleRekey(stream *webtransport.Stream, streamID uint64, record *core.Record) {
+	gs.mu.Lock()
+	user := gs.user
+	gs.mu.Unlock()
+	if user == nil {
+		handleHandshakeFailure(gs, stream, streamID, failUser, "Rekey before authentication")
+		return
+	}
+	if !core.IsTimestampValid(record.TimestampNano, time.Now(), core.DefaultReplayWindow) {
+		handleHandshakeFailure(gs, stream, streamID, failTimestamp, "Rekey timestamp outside allowed window")
+		return
+	}
+	req, err := core.OpenRekeyRecord(record, user.PSK)
+	if err != nil || req.Ack {
+		handleHandshakeFailure(gs, stream, streamID, failDecrypt, fmt.Sprintf("Invalid rekey request for user=%s: %v", user.ID, err))
+		return
+	}
+	if err := gs.checkReplay(user, record); err != nil {
+		handleHandshakeFailure(gs, stream, streamID, failCounter, fmt.Sprintf("Rekey rejected for user=%s: %v", user.ID, err))
+		return
+	}
+
+	newSID, epoch, err := gs.ng.PrepareRekey()
+	if err != nil {
+		writeError(stream, core.CodeStreamAbort, "rekey failed", gs.ng)
+		return
+	}
+	ack, err := core.BuildRekeyRecord(core.RekeyMessage{Ack: true, SessionID: newSID, Epoch: req.Epoch}, user.PSK, gs.ng)
+	if err != nil {
+		writeError(stream, core.CodeStreamAbort, "rekey failed", gs.ng)
+		return
+	}
+	if _, err := stream.Write(ack); err != nil {
+		return
+	}
+	if err := gs.ng.CommitRekey(); err != nil {
+		return
+	}
+	gs.users.statsFor(user.ID).rekeys.Add(1)
+	log.Printf("[INFO] Session from %s user=%s rekeyed (client sid=%x epoch=%d, gateway sid=%x epoch=%d)",
+		gs.session.RemoteAddr(), user.ID, req.SessionID, req.Epoch, newSID, epoch)
+}
+
+// watchRekey switches the gateway's own SessionID when its counter passes the
+// threshold without a client request, e.g. on download-heavy sessions.
+func (gs *gatewaySession) watchRekey() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	ctx := gs.session.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !gs.ng.NeedsRekey() {
+				continue
+			}
+			sid, epoch, err := gs.ng.Rekey()
+			if err != nil {
+				log.Printf("[ERROR] Session from %s rekey failed: %v", gs.session.RemoteAddr(), err)
+				continue
+			}
+			gs.mu.Lock()
+			user := gs.user
+			gs.mu.Unlock()
+			if user != nil {
+				gs.users.statsFor(user.ID).rekeys.Add(1)
+			}
+			log.Printf("[INFO] Session from %s rekeyed locally (gateway sid=%x epoch=%d)", gs.session.RemoteAddr(), sid, epoch)
+		}
+	}
 }
 
 // handleSession processes incoming streams for a WebTransport session.
 // V5: Uses NonceGenerator for counter-based nonce instead of ReplayCache.
-func handleSession(session *webtransport.Session, psk string, ng *core.NonceGenerator) {
+func handleSession(gs *gatewaySession) {
 	log.Println("New session established")
 	var streamID uint64
 
 	for {
-		stream, err := session.AcceptStream(context.Background())
+		stream, err := gs.session.AcceptStream(context.Background())
 		if err != nil {
 			log.Printf("AcceptStream failed: %v", err)
 			break
 		}
 
 		streamID++
-		go handleStream(stream, psk, streamID, ng)
+		if !gs.openStream(currentSettings().connLimits) {
+			log.Printf("[LIMIT] [Stream %d] Session from %s has too many open streams, resetting", streamID, gs.session.RemoteAddr())
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			continue
+		}
+		go func() {
+			defer gs.closeStream()
+			handleStream(gs, stream, streamID)
+		}()
+	}
+}
+
+// checkReplay runs an authenticated record through the shared replay filter.
+func (gs *gatewaySession) checkReplay(user *gatewayUser, record *core.Record) error {
+	err := gs.users.replay.Check(user.ID, record.SessionID, record.Counter, record.TimestampNano, time.Now())
+	if err != nil {
+		gs.users.statsFor(user.ID).replays.Add(1)
 	}
+	return err
 }
 
 // handleStream processes a single bidirectional stream.
-// V5: Uses counter-based anti-replay with per-stream lastCounter tracking.
-func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *core.NonceGenerator) {
+func handleStream(gs *gatewaySession, stream *webtransport.Stream, streamID uint64) {
 	defer stream.Close()
+	ng := gs.ng
 
 	reader := core.NewRecordReader(stream)
-	var lastCounter uint64 = 0 // V5: Per-stream counter tracking
 
 	// Read Metadata
+	if !guard.beginMetadata(currentSettings().connLimits) {
+		log.Printf("[LIMIT] [Stream %d] Too many streams waiting for metadata, resetting stream from %s", streamID, gs.session.RemoteAddr())
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return
+	}
 	readTimeout := jitterDuration(4*time.Second, 6*time.Second)
 	if err := stream.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		guard.endMetadata()
 		log.Printf("[SECURITY] [Stream %d] Failed to set metadata read deadline: %v", streamID, err)
 		return
 	}
 	record, err := reader.ReadNextRecord()
+	guard.endMetadata()
 	_ = stream.SetReadDeadline(time.Time{})
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			handleHandshakeFailure(stream, streamID, "Metadata read timed out")
+			handleHandshakeFailure(gs, stream, streamID, failTimeout, "Metadata read timed out")
 			return
 		}
-		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Failed to read metadata record: %v", err))
+		handleHandshakeFailure(gs, stream, streamID, failRead, fmt.Sprintf("Failed to read metadata record: %v", err))
 		return
 	}
 
@@ -534,43 +898,201 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 		return
 	}
 
-	if record.Type != core.TypeMetadata {
-		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Invalid record type: %d", record.Type))
+	if record.Type == core.TypeRekey {
+		gs.handleRekey(stream, streamID, record)
+		return
+	}
+
+	if record.Type != core.TypeMetadata && record.Type != core.TypeKeyedMetadata {
+		handleHandshakeFailure(gs, stream, streamID, failRecordType, fmt.Sprintf("Invalid record type: %d", record.Type))
 		return
 	}
 
 	if !core.IsTimestampValid(record.TimestampNano, time.Now(), core.DefaultReplayWindow) {
-		handleHandshakeFailure(stream, streamID, "Timestamp outside allowed window")
+		handleHandshakeFailure(gs, stream, streamID, failTimestamp, "Timestamp outside allowed window")
 		return
 	}
 
-	// V5: Counter-based anti-replay (first record counter must be 0 or strictly increasing)
-	if record.Counter != 0 && record.Counter <= lastCounter {
-		handleHandshakeFailure(stream, streamID, "Counter not strictly increasing")
+	keyID, err := core.MetadataKeyID(record)
+	if err != nil {
+		handleHandshakeFailure(gs, stream, streamID, failKeyID, fmt.Sprintf("Invalid key ID: %v", err))
+		return
+	}
+	user, err := gs.users.authenticate(keyID)
+	if err != nil {
+		handleHandshakeFailure(gs, stream, streamID, failKeyID, fmt.Sprintf("Key ID %q rejected: %v", keyID, err))
 		return
 	}
-	lastCounter = record.Counter
 
-	meta, err := core.DecryptMetadata(record, psk)
+	meta, err := core.DecryptMetadata(record, user.PSK)
+	var unsupported *core.UnsupportedOptionError
+	if errors.As(err, &unsupported) {
+		// Authenticated peer asking for something we lack: answer plainly.
+		log.Printf("[Stream %d] user=%s Rejecting metadata: %v", streamID, user.ID, err)
+		writeError(stream, core.CodeUnsupported, "unsupported option", ng)
+		return
+	}
 	if err != nil {
-		handleHandshakeFailure(stream, streamID, fmt.Sprintf("Decrypt failed: %v", err))
+		handleHandshakeFailure(gs, stream, streamID, failDecrypt, fmt.Sprintf("Decrypt failed for user=%s: %v", user.ID, err))
+		return
+	}
+	if err := gs.bindUser(user); err != nil {
+		handleHandshakeFailure(gs, stream, streamID, failUser, err.Error())
+		return
+	}
+	// Replay check comes after decryption: only then are SessionID, Counter and timestamp authentic.
+	if err := gs.checkReplay(user, record); err != nil {
+		handleHandshakeFailure(gs, stream, streamID, failCounter, fmt.Sprintf("Metadata rejected for user=%s: %v", user.ID, err))
 		return
 	}
+	stats := gs.users.statsFor(user.ID)
 
-	targetAddr := fmt.Sprintf("%s:%d", meta.Host, meta.Port)
-	log.Printf("[Stream %d] Connecting to %s", streamID, targetAddr)
+	// Capability negotiation: V6 clients advertise a version range and feature set,
+	// and get the negotiated set back as the first record. V5 clients get nothing.
+	negotiated, err := core.Negotiate(meta.Options.Capabilities)
+	if err != nil {
+		log.Printf("[Stream %d] user=%s Rejecting client: %v", streamID, user.ID, err)
+		writeError(stream, core.CodeUnsupported, "unsupported protocol version", ng)
+		return
+	}
+	if meta.Options.Capabilities != nil {
+		capsRecord, err := core.BuildCapabilitiesRecord(negotiated, user.PSK, ng)
+		if err != nil {
+			return
+		}
+		if _, err := stream.Write(capsRecord); err != nil {
+			return
+		}
+	}
 
-	conn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+	// Optional data-plane AEAD requested through the options TLV. It only takes
+	// effect once negotiated: a client that got no confirmation sends plain records.
+	suite := meta.Options.DataCipher
+	if !negotiated.Has(core.FeatureDataCipher) {
+		suite = core.CipherNone
+	}
+	dataCipher, err := core.NewDataCipher(suite, user.PSK)
 	if err != nil {
-		log.Printf("[Stream %d] Connect failed: %v", streamID, err)
+		log.Printf("[Stream %d] Rejecting data cipher: %v", streamID, err)
+		writeError(stream, core.CodeUnsupported, "unsupported data cipher", ng)
+		return
+	}
+	reader.SetDataCipher(dataCipher)
+
+	if drain.active() {
+		log.Printf("[Stream %d] user=%s Rejected: gateway draining", streamID, user.ID)
+		rejectStream(stream, core.CodeGoingAway, errDraining.Error(), negotiated.Has(core.FeatureConnectAck), ng, dataCipher)
+		return
+	}
+
+	if meta.Options.ReverseName != "" {
+		if !negotiated.Has(core.FeatureReverse) {
+			writeError(stream, core.CodeUnsupported, "reverse tunnels not negotiated", ng)
+			return
+		}
+		gs.serveReverse(stream, reader, streamID, user, stats, meta, dataCipher)
+		return
+	}
+
+	if meta.Options.UDPRelay {
+		gs.relay.serveStream(stream, reader, streamID)
+		return
+	}
+
+	if meta.Options.Mux {
+		if !negotiated.Has(core.FeatureMux) {
+			writeError(stream, core.CodeUnsupported, "mux not negotiated", ng)
+			return
+		}
+		gs.serveMux(stream, reader, streamID, user, stats, dataCipher)
+		return
+	}
+
+	// Early data: the client wrote its first payload in the same write as the
+	// metadata. Take it off the stream now so it reaches the target right after the dial.
+	var earlyData []byte
+	if meta.Options.EarlyData {
+		_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, core.MaxEarlyDataBytes)
+		n, err := reader.Read(buf)
+		_ = stream.SetReadDeadline(time.Time{})
+		if err != nil && err != io.EOF {
+			log.Printf("[Stream %d] user=%s Early data read failed: %v", streamID, user.ID, err)
+			return
+		}
+		earlyData = buf[:n]
+	}
+
+	logID := strconv.FormatUint(streamID, 10)
+	targetAddr := net.JoinHostPort(meta.Host, strconv.Itoa(int(meta.Port)))
+	if code, msg := stats.admitStream(user); code != core.CodeOK {
+		log.Printf("[Stream %d] user=%s Rejected (0x%04x): %s", streamID, user.ID, code, msg)
+		gs.logRefused(logID, "tcp", user, targetAddr, "", 0, reasonRejected, code, nil)
+		rejectStream(stream, code, msg, negotiated.Has(core.FeatureConnectAck), ng, dataCipher)
+		return
+	}
+	defer stats.activeStreams.Add(-1)
+
+	// Pad our data records with the client's profile so both directions look alike.
+	padding := core.Padding{Profile: meta.Options.PaddingProfile, MaxPadding: meta.Options.MaxPadding}
+	settings := currentSettings()
+	out := settings.outbounds.route(user.ID, meta.Host, meta.Port)
+	log.Printf("[Stream %d] user=%s Connecting to %s via %s (cipher=%s v=%d early=%d padding=%s)", streamID, user.ID, settings.accessLog.target(targetAddr), out.name, core.DataCipherName(suite), negotiated.Version, len(earlyData), padding.Profile)
+
+	dialStart := time.Now()
+	conn, err := out.dialTCP(settings.egress, user.ID, meta.Host, meta.Port, 10*time.Second)
+	dial := time.Since(dialStart)
+	if err != nil {
+		code := connectErrorCode(err)
+		log.Printf("[Stream %d] user=%s Connect failed (0x%04x): %s", streamID, user.ID, code, settings.accessLog.error(err))
+		gs.logRefused(logID, "tcp", user, targetAddr, out.name, dial, reasonDialFailed, code, err)
+		if negotiated.Has(core.FeatureConnectAck) {
+			writeConnectAck(stream, code, ng, dataCipher)
+			return
+		}
+		// Older clients only see the error record; policy denials keep their own code.
+		if code != core.CodePolicyDenied {
+			code = core.CodeConnectFailed
+		}
 		// V5: writeError now requires NonceGenerator
-		writeError(stream, 0x0004, "connect failed", ng)
+		writeError(stream, code, connectErrorMessage(code), ng)
 		return
 	}
 	defer conn.Close()
+	st := gs.trackStream(logID, "tcp", targetAddr, user, stats, func() {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		conn.Close()
+	})
+	st.outbound, st.dial = out.name, dial
+	defer gs.untrackStream(st)
+	if negotiated.Has(core.FeatureConnectAck) {
+		if err := writeConnectAck(stream, core.CodeOK, ng, dataCipher); err != nil {
+			return
+		}
+	}
+	if len(earlyData) > 0 {
+		if _, err := conn.Write(earlyData); err != nil {
+			log.Printf("[Stream %d] user=%s Early data write failed: %s", streamID, user.ID, settings.accessLog.error(err))
+			st.finish(reasonError, err)
+			return
+		}
+		// Quota overruns surface on the next chunk in either direction.
+		_ = st.chargeUp(len(earlyData))
+	}
 
-	// Bidirectional pipe
+	// Bidirectional pipe. Each direction reports exactly once on errCh (nil on clean EOF).
+	// With half-close negotiated the directions drain independently: a FIN from the
+	// client becomes TCP CloseWrite, and target EOF becomes a FIN record.
+	halfClose := negotiated.Has(core.FeatureHalfClose)
 	errCh := make(chan error, 2)
+	// Closed when the upload uses up the quota; the TCP -> WebTransport side
+	// owns the stream writes and tells the client.
+	quotaHit := make(chan struct{})
+	// Closed once the TCP -> WebTransport side has returned; quotaReported
+	// tells whether it told the client about quotaHit on its way out.
+	downDone := make(chan struct{})
+	var quotaReported bool
 
 	// WebTransport -> TCP
 	go func() {
@@ -584,13 +1106,28 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 					return
 				}
 				gwPerf.observeWTToTCP(n, time.Since(writeStart))
+				if err := st.chargeUp(n); err != nil {
+					close(quotaHit)
+					<-downDone
+					// After a half-closed download there is no one else to report it.
+					if !quotaReported {
+						writeError(stream, core.CodeQuotaExceeded, "monthly quota exceeded", ng)
+						errCh <- err
+					}
+					return
+				}
 			}
 			if err != nil {
 				if err != io.EOF {
 					errCh <- err
-				} else {
-					errCh <- nil
+					return
+				}
+				if halfClose {
+					if cw, ok := conn.(closeWriter); ok {
+						_ = cw.CloseWrite()
+					}
 				}
+				errCh <- nil
 				return
 			}
 		}
@@ -598,9 +1135,11 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 
 	// TCP -> WebTransport
 	go func() {
+		defer close(downDone)
 		chunkCh := make(chan []byte, 1024)
 		stageCtx, stageCancel := context.WithCancel(context.Background())
 		defer stageCancel()
+		var readErr error // set by Stage A before it closes chunkCh
 
 		// Stage A: Continuous read from TCP to keep window open
 		go func() {
@@ -622,9 +1161,7 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 				}
 				if err != nil {
 					if err != io.EOF && !strings.Contains(err.Error(), "closed network connection") {
-						errCh <- err
-					} else {
-						errCh <- nil
+						readErr = err
 					}
 					return
 				}
@@ -637,6 +1174,14 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 			select {
 			case data, ok := <-chunkCh:
 				if !ok {
+					if readErr == nil && halfClose {
+						fin, err := core.BuildFinRecord(ng, dataCipher)
+						if err == nil {
+							_, err = stream.Write(fin)
+						}
+						readErr = err
+					}
+					errCh <- readErr
 					return
 				}
 				remaining := data
@@ -647,7 +1192,7 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 					}
 					
 					buildStart := time.Now()
-					recordBytes, buildErr := core.BuildDataRecord(remaining[:chunkSize], 0, ng)
+					recordBytes, buildErr := core.BuildPaddedDataRecord(remaining[:chunkSize], ng, dataCipher, padding)
 					if buildErr != nil {
 						errCh <- buildErr
 						return
@@ -662,19 +1207,35 @@ func handleStream(stream *webtransport.Stream, psk string, streamID uint64, ng *
 					}
 					gwPerf.observeTCPToWT(len(recordBytes), time.Since(writeStart))
 					core.PutBuffer(recordBytes)
+					if err := st.chargeDown(chunkSize); err != nil {
+						quotaReported = true
+						writeError(stream, core.CodeQuotaExceeded, "monthly quota exceeded", ng)
+						errCh <- err
+						return
+					}
 					
 					remaining = remaining[chunkSize:]
 				}
+			case <-quotaHit:
+				quotaReported = true
+				writeError(stream, core.CodeQuotaExceeded, "monthly quota exceeded", ng)
+				errCh <- errQuotaExceeded
+				return
 			case <-stageCtx.Done():
 				return
 			}
 		}
 	}()
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			log.Printf("[Stream %d] Stream error: %v", streamID, err)
+	pending := 1
+	if halfClose {
+		pending = 2
+	}
+	for i := 0; i < pending; i++ {
+		if err := <-errCh; err != nil {
+			log.Printf("[Stream %d] user=%s Stream error: %s", streamID, user.ID, currentSettings().accessLog.error(err))
+			st.finish(closeReason(err), err)
+			break
 		}
 	}
 	// Cleanup happens via defer stream.Close() and defer conn.Close()
@@ -686,8 +1247,37 @@ func writeError(w io.Writer, code uint16, msg string, ng *core.NonceGenerator) {
 	w.Write(record)
 }
 
-func handleHandshakeFailure(stream *webtransport.Stream, streamID uint64, reason string) {
+// writeConnectAck reports the target dial result to clients that negotiated FeatureConnectAck.
+func writeConnectAck(w io.Writer, code uint16, ng *core.NonceGenerator, dc *core.DataCipher) error {
+	msg := ""
+	if code != core.CodeOK {
+		msg = connectErrorMessage(code)
+	}
+	record, err := core.BuildConnectAckRecord(code, msg, ng, dc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(record)
+	return err
+}
+
+// rejectStream refuses a stream before the dial: with a ConnectAck when the
+// client negotiated one, with an error record otherwise.
+func rejectStream(w io.Writer, code uint16, msg string, ack bool, ng *core.NonceGenerator, dc *core.DataCipher) {
+	if !ack {
+		writeError(w, code, msg, ng)
+		return
+	}
+	if record, err := core.BuildConnectAckRecord(code, msg, ng, dc); err == nil {
+		_, _ = w.Write(record)
+	}
+}
+
+func handleHandshakeFailure(gs *gatewaySession, stream *webtransport.Stream, streamID uint64, kind, reason string) {
 	log.Printf("[SECURITY] [Stream %d] %s", streamID, reason)
+	if countHandshakeFailure(gs, kind) {
+		return
+	}
 	time.Sleep(jitterDuration(100*time.Millisecond, 1000*time.Millisecond))
 	decoyLen, err := randomIntRange(32, 128)
 	if err != nil {
@@ -699,6 +1289,18 @@ func handleHandshakeFailure(stream *webtransport.Stream, streamID uint64, reason
 	}
 }
 
+// countHandshakeFailure records a failure of kind in the metrics and toward a
+// ban of the session's IP. It reports whether the IP got banned, in which case
+// its sessions are already closed.
+func countHandshakeFailure(gs *gatewaySession, kind string) bool {
+	gwMetrics.handshakeFailed(kind)
+	if gs.countsTowardBan(kind) && guard.handshakeFailed(gs.remoteIP, kind, currentSettings().connLimits) {
+		closeSessionsFrom(gs.remoteIP, "")
+		return true
+	}
+	return false
+}
+
 func randomIntRange(min, max int) (int, error) {
 	if min < 0 || max < min {
 		return 0, fmt.Errorf("invalid range: %d-%d", min, max)
@@ -768,6 +1370,7 @@ type CertificateLoader struct {
 	certFile string
 	keyFile  string
 	cert     *tls.Certificate
+	acme     *acmeIssuer // When set, certificates come from ACME instead of the files
 	mu       sync.RWMutex
 }
 
@@ -803,19 +1406,31 @@ func (l *CertificateLoader) listenForSignal() {
 }
 
 func (l *CertificateLoader) forceReload() error {
-	kp, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	l.mu.RLock()
+	certFile, keyFile := l.certFile, l.keyFile
+	l.mu.RUnlock()
+	return l.setFiles(certFile, keyFile)
+}
+
+// setFiles loads a certificate from new paths; later reloads use them too.
+func (l *CertificateLoader) setFiles(certFile, keyFile string) error {
+	kp, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 	l.mu.Lock()
+	l.certFile, l.keyFile = certFile, keyFile
 	l.cert = &kp
 	l.mu.Unlock()
-	log.Printf("[INFO] Reloaded TLS certificate from %s", l.certFile)
+	log.Printf("[INFO] Reloaded TLS certificate from %s", certFile)
 	return nil
 }
 
 // GetCertificate implements tls.Config.GetCertificate
 func (l *CertificateLoader) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if l.acme != nil {
+		return l.acme.getCertificate(clientHello)
+	}
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	return l.cert, nil
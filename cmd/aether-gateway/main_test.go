@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+const testPSK = "test-psk"
+
+// testGateway serves tunnel sessions on a loopback QUIC listener the way
+// main does, without the decoy and the TCP listener.
+type testGateway struct {
+	addr      string
+	users     *userTable
+	server    *webtransport.Server
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+	served    chan *gatewaySession // Sessions as they are accepted
+}
+
+func startTestGateway(t *testing.T, users *userTable) *testGateway {
+	t.Helper()
+	cert, err := generateSelfSignedCert("localhost")
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{http3.NextProtoH3}}
+	quicConfig := &quic.Config{EnableDatagrams: true, EnableStreamResetPartialDelivery: true, MaxIdleTimeout: 10 * time.Second}
+
+	served := make(chan *gatewaySession, 16)
+	mux := http.NewServeMux()
+	server := &webtransport.Server{
+		H3:          &http3.Server{TLSConfig: tlsConfig, QUICConfig: quicConfig, EnableDatagrams: true, Handler: mux},
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	webtransport.ConfigureHTTP3Server(server.H3)
+	mux.HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r.RemoteAddr)
+		if limit := guard.openSession(ip, currentSettings().connLimits); limit != "" {
+			http.Error(w, limit, http.StatusForbidden)
+			return
+		}
+		defer guard.closeSession(ip)
+		session, err := server.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		ng, err := core.NewNonceGenerator()
+		if err != nil {
+			return
+		}
+		gs := &gatewaySession{session: session, remoteIP: ip, ng: ng, users: users, started: time.Now(), streams: make(map[uint64]*trackedStream)}
+		gs.relay = newUDPRelay(gs)
+		go gs.relay.run()
+		sessions.add(gs)
+		defer sessions.remove(gs)
+		select {
+		case served <- gs:
+		default:
+		}
+		handleSession(gs)
+	})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.ListenEarly(tlsConfig, quicConfig)
+	if err != nil {
+		t.Fatalf("ListenEarly: %v", err)
+	}
+	go func() {
+		for {
+			qconn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go server.ServeQUICConn(qconn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = transport.Close()
+	})
+	return &testGateway{addr: conn.LocalAddr().String(), users: users, server: server, transport: transport, listener: listener, served: served}
+}
+
+// dial opens a client session to the gateway.
+func (g *testGateway) dial(t *testing.T) *webtransport.Session {
+	t.Helper()
+	d := &webtransport.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+		QUICConfig:      &quic.Config{EnableDatagrams: true, EnableStreamResetPartialDelivery: true, MaxIdleTimeout: 10 * time.Second},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, sess, err := d.Dial(ctx, "https://"+g.addr+"/tunnel", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { _ = sess.CloseWithError(0, "") })
+	return sess
+}
+
+// accepted returns the gateway end of the next session dialed.
+func (g *testGateway) accepted(t *testing.T) *gatewaySession {
+	t.Helper()
+	select {
+	case gs := <-g.served:
+		return gs
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the gateway session")
+		return nil
+	}
+}
+
+// testStream is the client end of a tunnel stream.
+type testStream struct {
+	*webtransport.Stream
+	reader *core.RecordReader
+	ng     *core.NonceGenerator
+}
+
+// openTestStream opens a stream as a current client does: metadata with
+// capabilities, then the gateway's answer up to the connect ack.
+func openTestStream(t *testing.T, sess *webtransport.Session, host string, port uint16, opts core.Options) (*testStream, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync: %v", err)
+	}
+	t.Cleanup(func() { stream.CancelRead(0); stream.CancelWrite(0) })
+	ng, err := core.NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	opts.Capabilities = core.LocalCapabilities()
+	record, err := core.BuildMetadataRecordWithOptions(host, port, opts, testPSK, ng)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+	}
+	if _, err := stream.Write(record); err != nil {
+		t.Fatalf("write metadata: %v", err)
+	}
+	ts := &testStream{Stream: stream, reader: core.NewRecordReader(stream), ng: ng}
+	ts.reader.ExpectCapabilities(testPSK, nil)
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer stream.SetReadDeadline(time.Time{})
+	return ts, ts.reader.AwaitConnectAck()
+}
+
+// echo writes p as a data record and reads it back.
+func (s *testStream) echo(t *testing.T, p string) {
+	t.Helper()
+	record, err := core.BuildDataRecord([]byte(p), 0, s.ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	if _, err := s.Write(record); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer s.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(p))
+	if _, err := io.ReadFull(s.reader, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(buf) != p {
+		t.Fatalf("echo: got %q, want %q", buf, p)
+	}
+}
+
+// remoteCode returns the code of a gateway error answer, or fails.
+func remoteCode(t *testing.T, err error) uint16 {
+	t.Helper()
+	var remote *core.RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("expected a gateway error, got %v", err)
+	}
+	return remote.Code
+}
+
+// startEchoServer runs a TCP echo server on loopback.
+func startEchoServer(t *testing.T) (string, uint16) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), uint16(addr.Port)
+}
+
+// useLoopbackEgress lets the test's streams reach loopback servers, with
+// the default connection limits and access log.
+func useLoopbackEgress(t *testing.T) {
+	t.Helper()
+	egress, err := compileEgress(&egressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	connLimits, err := compileConnLimits(nil)
+	if err != nil {
+		t.Fatalf("compileConnLimits: %v", err)
+	}
+	accessLog, err := newAccessLogger(nil)
+	if err != nil {
+		t.Fatalf("newAccessLogger: %v", err)
+	}
+	useSettings(t, &liveSettings{egress: egress, connLimits: connLimits, accessLog: accessLog})
+}
+
+// waitFor polls cond until it holds or fails the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A V5 client sends no capabilities: the gateway must answer with nothing
+// but plain data records, even when asked for a data cipher.
+func TestV5Client(t *testing.T) {
+	useLoopbackEgress(t)
+	host, port := startEchoServer(t)
+	users, err := newUserTable("", testPSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	sess := startTestGateway(t, users).dial(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync: %v", err)
+	}
+	defer stream.Close()
+	ng, err := core.NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := core.BuildMetadataRecordWithOptions(host, port, core.Options{DataCipher: core.CipherAES128GCM}, testPSK, ng)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+	}
+	data, err := core.BuildDataRecord([]byte("v5"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	if _, err := stream.Write(append(record, data...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := core.NewRecordReader(stream).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	if reply.Type != core.TypeData || string(reply.Payload) != "v5" {
+		t.Fatalf("first record: type 0x%02x payload %q, want plain data %q", reply.Type, reply.Payload, "v5")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake failure reasons, the "reason" label of aether_handshake_failures_total.
+const (
+	failTimeout    = "timeout"     // No metadata before the read deadline
+	failRead       = "read"        // Malformed or truncated first record
+	failRecordType = "record_type" // First record is not metadata, ping or rekey
+	failTimestamp  = "timestamp"   // Record timestamp outside the replay window
+	failKeyID      = "key_id"      // Unknown, disabled or expired key ID
+	failDecrypt    = "decrypt"     // Metadata or rekey request did not authenticate
+	failCounter    = "counter"     // Rejected by the replay filter
+	failUser       = "user"        // Session already bound to another user
+)
+
+var handshakeFailureReasons = []string{failTimeout, failRead, failRecordType, failTimestamp, failKeyID, failDecrypt, failCounter, failUser}
+
+// dialBuckets are the upper bounds, in seconds, of the dial latency histogram.
+var dialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a fixed-bucket Prometheus histogram.
+type histogram struct {
+	bounds   []float64
+	counts   []atomic.Uint64 // per bucket, not cumulative; the last one is +Inf
+	sumNanos atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	h.counts[i].Add(1)
+	h.sumNanos.Add(uint64(d.Nanoseconds()))
+}
+
+// gatewayMetrics are the process-wide counters behind /metrics. Per-user
+// traffic comes from userStats, the data-path timings from gwPerf.
+type gatewayMetrics struct {
+	sessionsActive atomic.Int64
+	sessionsTotal  atomic.Uint64
+
+	dialOK    *histogram
+	dialError *histogram
+
+	handshakeFailures map[string]*atomic.Uint64
+}
+
+var gwMetrics = newGatewayMetrics()
+
+func newGatewayMetrics() *gatewayMetrics {
+	m := &gatewayMetrics{
+		dialOK:            newHistogram(dialBuckets),
+		dialError:         newHistogram(dialBuckets),
+		handshakeFailures: make(map[string]*atomic.Uint64),
+	}
+	for _, reason := range handshakeFailureReasons {
+		m.handshakeFailures[reason] = new(atomic.Uint64)
+	}
+	return m
+}
+
+// observeDial records how long a target dial took.
+func (m *gatewayMetrics) observeDial(d time.Duration, err error) {
+	if err != nil {
+		m.dialError.observe(d)
+		return
+	}
+	m.dialOK.observe(d)
+}
+
+func (m *gatewayMetrics) handshakeFailed(reason string) {
+	if c, ok := m.handshakeFailures[reason]; ok {
+		c.Add(1)
+	}
+}
+
+// metricsWriter writes the Prometheus text exposition format (version 0.0.4).
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one series; labels alternate names and values.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(formatMetricValue(value))
+	mw.w.WriteByte('\n')
+}
+
+func (mw *metricsWriter) counter(name, help string, value float64) {
+	mw.family(name, "counter", help)
+	mw.sample(name, value)
+}
+
+func (mw *metricsWriter) gauge(name, help string, value float64) {
+	mw.family(name, "gauge", help)
+	mw.sample(name, value)
+}
+
+// histogram writes the series of h, which the caller has declared with family.
+func (mw *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		mw.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatMetricValue(bound))...)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	mw.sample(name+"_bucket", float64(cumulative), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", float64(h.sumNanos.Load())/1e9, labels...)
+	mw.sample(name+"_count", float64(cumulative), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeMetrics renders every gateway metric.
+func writeMetrics(w io.Writer, users *userTable) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	m := gwMetrics
+
+	mw.gauge("aether_sessions_active", "WebTransport sessions currently open.", float64(m.sessionsActive.Load()))
+	mw.counter("aether_sessions_total", "WebTransport sessions accepted.", float64(m.sessionsTotal.Load()))
+
+	// Per-user series, plus gateway-wide sums.
+	ids := users.statIDs()
+	var activeStreams int64
+	var streams, up, down uint64
+	for _, id := range ids {
+		s := users.statsFor(id)
+		activeStreams += s.activeStreams.Load()
+		streams += s.streams.Load()
+		up += s.bytesUp.Load()
+		down += s.bytesDown.Load()
+	}
+	mw.gauge("aether_streams_active", "Proxied streams currently open.", float64(activeStreams))
+	mw.counter("aether_streams_total", "Proxied streams admitted.", float64(streams))
+	mw.family("aether_bytes_total", "counter", "Payload bytes forwarded; up is client to target.")
+	mw.sample("aether_bytes_total", float64(up), "direction", "up")
+	mw.sample("aether_bytes_total", float64(down), "direction", "down")
+
+	mw.family("aether_user_streams_active", "gauge", "Proxied streams currently open per user.")
+	for _, id := range ids {
+		mw.sample("aether_user_streams_active", float64(users.statsFor(id).activeStreams.Load()), "user", id)
+	}
+	mw.family("aether_user_streams_total", "counter", "Proxied streams admitted per user.")
+	for _, id := range ids {
+		mw.sample("aether_user_streams_total", float64(users.statsFor(id).streams.Load()), "user", id)
+	}
+	mw.family("aether_user_rejected_total", "counter", "Streams and sessions refused per user (disabled, expired, over a limit).")
+	for _, id := range ids {
+		mw.sample("aether_user_rejected_total", float64(users.statsFor(id).rejected.Load()), "user", id)
+	}
+	mw.family("aether_user_bytes_total", "counter", "Payload bytes forwarded per user; up is client to target.")
+	for _, id := range ids {
+		s := users.statsFor(id)
+		mw.sample("aether_user_bytes_total", float64(s.bytesUp.Load()), "user", id, "direction", "up")
+		mw.sample("aether_user_bytes_total", float64(s.bytesDown.Load()), "user", id, "direction", "down")
+	}
+	mw.family("aether_user_month_bytes", "gauge", "Bytes counted against the monthly quota per user.")
+	for _, id := range ids {
+		mw.sample("aether_user_month_bytes", float64(users.statsFor(id).monthBytes()), "user", id)
+	}
+	mw.family("aether_user_datagrams_total", "counter", "UDP datagrams relayed per user.")
+	for _, id := range ids {
+		mw.sample("aether_user_datagrams_total", float64(users.statsFor(id).datagrams.Load()), "user", id)
+	}
+	mw.family("aether_user_rekeys_total", "counter", "Session key rotations per user, requested by the client or started by the gateway.")
+	for _, id := range ids {
+		mw.sample("aether_user_rekeys_total", float64(users.statsFor(id).rekeys.Load()), "user", id)
+	}
+	mw.family("aether_user_replays_total", "counter", "Records rejected by the replay filter per user.")
+	for _, id := range ids {
+		mw.sample("aether_user_replays_total", float64(users.statsFor(id).replays.Load()), "user", id)
+	}
+
+	mw.family("aether_dial_duration_seconds", "histogram", "Time to connect to stream targets.")
+	mw.histogram("aether_dial_duration_seconds", m.dialOK, "result", "ok")
+	mw.histogram("aether_dial_duration_seconds", m.dialError, "result", "error")
+
+	mw.family("aether_handshake_failures_total", "counter", "Streams dropped before authentication completed, by reason.")
+	for _, reason := range handshakeFailureReasons {
+		mw.sample("aether_handshake_failures_total", float64(m.handshakeFailures[reason].Load()), "reason", reason)
+	}
+	mw.counter("aether_replay_rejected_total", "Records rejected by the shared replay filter.", float64(users.replay.Rejected()))
+	mw.family("aether_conn_limit_rejected_total", "counter", "Sessions and streams refused by a connection limit or ban, by limit.")
+	for _, limit := range connLimitNames {
+		mw.sample("aether_conn_limit_rejected_total", float64(guard.rejected[limit].Load()), "limit", limit)
+	}
+	mw.gauge("aether_bans_active", "Source IPs currently banned.", float64(guard.activeBans()))
+	mw.counter("aether_bans_total", "Source IPs banned after repeated handshake failures.", float64(guard.bansTotal.Load()))
+	mw.gauge("aether_pending_metadata", "Streams waiting for their metadata record.", float64(guard.pending.Load()))
+
+	// Data-path timings, the counters behind the [PERF-GW] log lines.
+	p := &gwPerf
+	seconds := func(nanos uint64) float64 { return float64(nanos) / 1e9 }
+	mw.counter("aether_perf_wt_to_tcp_bytes_total", "Bytes written from WebTransport streams to targets.", float64(p.wtToTCPBytes.Load()))
+	mw.counter("aether_perf_wt_to_tcp_writes_total", "Writes to targets.", float64(p.wtToTCPWrites.Load()))
+	mw.counter("aether_perf_wt_to_tcp_write_seconds_total", "Time spent in writes to targets.", seconds(p.wtToTCPWriteNanos.Load()))
+	mw.counter("aether_perf_tcp_to_wt_bytes_total", "Record bytes written to WebTransport streams.", float64(p.tcpToWTBytes.Load()))
+	mw.counter("aether_perf_tcp_to_wt_writes_total", "Record writes to WebTransport streams.", float64(p.tcpToWTWrites.Load()))
+	mw.counter("aether_perf_tcp_to_wt_write_seconds_total", "Time spent in record writes to WebTransport streams.", seconds(p.tcpToWTWriteNanos.Load()))
+	mw.counter("aether_perf_tcp_reads_total", "Reads from targets.", float64(p.tcpToWTReadWaitCalls.Load()))
+	mw.counter("aether_perf_tcp_read_wait_seconds_total", "Time spent waiting on reads from targets.", seconds(p.tcpToWTReadWaitNanos.Load()))
+	mw.counter("aether_perf_record_builds_total", "Data records built.", float64(p.tcpToWTBuildCalls.Load()))
+	mw.counter("aether_perf_record_build_seconds_total", "Time spent building data records.", seconds(p.tcpToWTBuildNanos.Load()))
+	return mw.w.Flush()
+}
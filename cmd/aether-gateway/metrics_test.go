@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1, 1})
+	for _, d := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 2 * time.Second} {
+		h.observe(d)
+	}
+	var buf bytes.Buffer
+	mw := &metricsWriter{w: bufio.NewWriter(&buf)}
+	mw.family("dial_seconds", "histogram", "Dial time.")
+	mw.histogram("dial_seconds", h, "result", "ok")
+	mw.w.Flush()
+
+	want := `# HELP dial_seconds Dial time.
+# TYPE dial_seconds histogram
+dial_seconds_bucket{result="ok",le="0.01"} 2
+dial_seconds_bucket{result="ok",le="0.1"} 3
+dial_seconds_bucket{result="ok",le="1"} 3
+dial_seconds_bucket{result="ok",le="+Inf"} 4
+dial_seconds_sum{result="ok"} 2.065
+dial_seconds_count{result="ok"} 4
+`
+	if buf.String() != want {
+		t.Errorf("histogram:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestMetricsLabelsAndValues(t *testing.T) {
+	var buf bytes.Buffer
+	mw := &metricsWriter{w: bufio.NewWriter(&buf)}
+	mw.sample("m", 1.5, "user", "a\"b\\c\nd")
+	mw.sample("m", math.Inf(1))
+	mw.sample("m", 1e9)
+	mw.w.Flush()
+	want := "m{user=\"a\\\"b\\\\c\\nd\"} 1.5\nm +Inf\nm 1e+09\n"
+	if buf.String() != want {
+		t.Errorf("samples: got %q, want %q", buf.String(), want)
+	}
+}
+
+var sampleLine = regexp.MustCompile(`^([a-z_]+)(\{[a-z_]+="(?:[^"\\]|\\.)*"(?:,[a-z_]+="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+
+func TestWriteMetrics(t *testing.T) {
+	users, err := newUserTable("", "psk", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	alice := users.statsFor("alice")
+	alice.bytesUp.Add(100)
+	alice.bytesDown.Add(200)
+	alice.monthUp.Add(100)
+	alice.rekeys.Add(3)
+	users.statsFor(`we"ird`).streams.Add(1)
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, users); err != nil {
+		t.Fatalf("writeMetrics: %v", err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`aether_user_bytes_total{user="alice",direction="up"} 100`,
+		`aether_user_bytes_total{user="alice",direction="down"} 200`,
+		`aether_user_month_bytes{user="alice"} 100`,
+		`aether_user_rekeys_total{user="alice"} 3`,
+		`aether_user_streams_total{user="we\"ird"} 1`,
+		`aether_handshake_failures_total{reason="decrypt"} `,
+		`aether_conn_limit_rejected_total{limit="banned"} `,
+		`aether_dial_duration_seconds_bucket{result="error",le="+Inf"} `,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	// Every series belongs to a family declared once, before it, with a type.
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, typ, _ := strings.Cut(rest, " ")
+			if _, dup := types[name]; dup {
+				t.Errorf("family %s declared twice", name)
+			}
+			types[name] = typ
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed line %q", line)
+			continue
+		}
+		name := m[1]
+		if typ := types[strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")]; typ == "" && types[name] == "" {
+			t.Errorf("series %s has no TYPE line before it", name)
+		}
+	}
+}
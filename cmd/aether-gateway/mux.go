@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"aether-rea/internal/core"
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// serveMux serves a mux carrier stream: every sub-stream the client opens is
+// dialed and piped independently until the carrier goes away.
+func (gs *gatewaySession) serveMux(stream *webtransport.Stream, reader *core.RecordReader, streamID uint64, user *gatewayUser, stats *userStats, dc *core.DataCipher) {
+	mux := core.NewMuxSession(stream, reader, gs.ng, dc, false)
+	defer mux.Close()
+	log.Printf("[Stream %d] user=%s Mux carrier opened", streamID, user.ID)
+
+	for {
+		sub, err := mux.Accept()
+		if err != nil {
+			log.Printf("[Stream %d] user=%s Mux carrier closed: %v", streamID, user.ID, err)
+			return
+		}
+		if !gs.openStream(currentSettings().connLimits) {
+			log.Printf("[Stream %d/%d] user=%s Rejected: too many open streams on the session", streamID, sub.ID(), user.ID)
+			_ = sub.Ack(core.CodeResourceLimit, "too many streams")
+			sub.Close()
+			continue
+		}
+		go func() {
+			defer gs.closeStream()
+			gs.serveMuxStream(sub, streamID, user, stats)
+		}()
+	}
+}
+
+// serveMuxStream dials the sub-stream's target, reports the result and pipes
+// both directions with half-close.
+func (gs *gatewaySession) serveMuxStream(sub *core.MuxStream, streamID uint64, user *gatewayUser, stats *userStats) {
+	defer sub.Close()
+	if drain.active() {
+		_ = sub.Ack(core.CodeGoingAway, errDraining.Error())
+		return
+	}
+	logID := fmt.Sprintf("%d/%d", streamID, sub.ID())
+	host, port := sub.Target()
+	targetAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if code, msg := stats.admitStream(user); code != core.CodeOK {
+		log.Printf("[Stream %d/%d] user=%s Rejected (0x%04x): %s", streamID, sub.ID(), user.ID, code, msg)
+		gs.logRefused(logID, "mux", user, targetAddr, "", 0, reasonRejected, code, nil)
+		_ = sub.Ack(code, msg)
+		return
+	}
+	defer stats.activeStreams.Add(-1)
+
+	settings := currentSettings()
+	out := settings.outbounds.route(user.ID, host, port)
+	dialStart := time.Now()
+	conn, err := out.dialTCP(settings.egress, user.ID, host, port, 10*time.Second)
+	dial := time.Since(dialStart)
+	if err != nil {
+		code := connectErrorCode(err)
+		log.Printf("[Stream %d/%d] user=%s Connect to %s via %s failed (0x%04x): %s", streamID, sub.ID(), user.ID, settings.accessLog.target(targetAddr), out.name, code, settings.accessLog.error(err))
+		gs.logRefused(logID, "mux", user, targetAddr, out.name, dial, reasonDialFailed, code, err)
+		_ = sub.Ack(code, connectErrorMessage(code))
+		return
+	}
+	defer conn.Close()
+	st := gs.trackStream(logID, "mux", targetAddr, user, stats, func() {
+		sub.Reset(core.CodeStreamAbort)
+		conn.Close()
+	})
+	st.outbound, st.dial = out.name, dial
+	defer gs.untrackStream(st)
+	if err := sub.Ack(core.CodeOK, ""); err != nil {
+		return
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		err := copyCounted(conn, sub, st.chargeUp)
+		if err == nil {
+			if cw, ok := conn.(closeWriter); ok {
+				_ = cw.CloseWrite()
+			}
+		}
+		errCh <- err
+	}()
+	go func() {
+		err := copyCounted(sub, conn, st.chargeDown)
+		if err == nil {
+			err = sub.CloseWrite()
+		}
+		errCh <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			log.Printf("[Stream %d/%d] user=%s Stream error: %s", streamID, sub.ID(), user.ID, currentSettings().accessLog.error(err))
+			st.finish(closeReason(err), err)
+			if errors.Is(err, errQuotaExceeded) {
+				sub.Reset(core.CodeQuotaExceeded)
+			}
+			break
+		}
+	}
+}
+
+// copyCounted copies src to dst until EOF, passing the size of every forwarded
+// chunk to charge; an error from charge stops the copy.
+func copyCounted(dst io.Writer, src io.Reader, charge func(n int) error) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, wErr := dst.Write(buf[:n]); wErr != nil {
+				return wErr
+			}
+			if err := charge(n); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// Outbound types.
+const (
+	outboundDirect = "direct"
+	outboundSOCKS5 = "socks5"
+	outboundHTTP   = "http" // HTTP CONNECT
+)
+
+// outboundConfig is one entry of the outbounds section of the config file.
+type outboundConfig struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type,omitempty"`       // direct (default), socks5 or http
+	Interface string   `json:"interface,omitempty"`  // direct: bind to this network interface (Linux only)
+	SourceIPs []string `json:"source_ips,omitempty"` // direct: local addresses to connect from
+	Pool      string   `json:"pool,omitempty"`       // direct: how source_ips are picked, round_robin (default) or user
+	Address   string   `json:"address,omitempty"`    // socks5/http: proxy host:port
+	Username  string   `json:"username,omitempty"`   // socks5/http: optional proxy credentials
+	Password  string   `json:"password,omitempty"`
+	RemoteDNS bool     `json:"remote_dns,omitempty"` // socks5/http: send names to the proxy instead of resolving them here
+}
+
+// outboundRule sends matching streams through an outbound. Rules are tried in
+// order and the first match wins; streams no rule matches leave directly.
+// Every condition that is set must match, except that domains and cidrs
+// together describe one destination set.
+type outboundRule struct {
+	Domains  []string `json:"domains,omitempty"` // Domain and all its subdomains
+	CIDRs    []string `json:"cidrs,omitempty"`   // IP-literal targets; names are not resolved for routing
+	Ports    []string `json:"ports,omitempty"`
+	Users    []string `json:"users,omitempty"`
+	Outbound string   `json:"outbound"` // Name of an outbound, or "direct"
+}
+
+// outbound is a compiled outboundConfig.
+type outbound struct {
+	name string
+	kind string
+
+	iface  string
+	v4, v6 []netip.Addr
+	byUser bool
+	next   atomic.Uint64
+
+	address            string
+	username, password string
+	remoteDNS          bool
+}
+
+// directOutbound leaves from the default route. It is what the name "direct"
+// refers to in rules.
+var directOutbound = &outbound{name: outboundDirect, kind: outboundDirect}
+
+type compiledRule struct {
+	domains []string
+	cidrs   []netip.Prefix
+	ports   []portRange
+	users   []string
+	out     *outbound
+}
+
+// outboundRouter picks the outbound for each target.
+type outboundRouter struct {
+	rules []compiledRule
+}
+
+// closeWriter is implemented by target connections that support half-close.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// upstreamError is a failure reported by, or in reaching, an upstream proxy.
+// It carries its own connect-ack code: a refused connection to the proxy must
+// not read as the target refusing.
+type upstreamError struct {
+	outbound string
+	code     uint16
+	err      error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("outbound %s: %v", e.outbound, e.err)
+}
+
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// compileOutbounds validates the outbounds and the rules that refer to them.
+func compileOutbounds(configs []*outboundConfig, rules []*outboundRule) (*outboundRouter, error) {
+	byName := map[string]*outbound{outboundDirect: directOutbound}
+	for i, cfg := range configs {
+		if cfg == nil || cfg.Name == "" {
+			return nil, fmt.Errorf("outbound #%d: missing name", i+1)
+		}
+		if _, dup := byName[cfg.Name]; dup {
+			return nil, fmt.Errorf("outbound %q: name already used", cfg.Name)
+		}
+		out, err := compileOutbound(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("outbound %q: %w", cfg.Name, err)
+		}
+		byName[cfg.Name] = out
+	}
+
+	r := &outboundRouter{}
+	for i, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		out, ok := byName[rule.Outbound]
+		if !ok {
+			return nil, fmt.Errorf("outbound rule #%d: unknown outbound %q", i+1, rule.Outbound)
+		}
+		cr := compiledRule{out: out, users: rule.Users}
+		var err error
+		if cr.cidrs, err = parsePrefixes(rule.CIDRs); err != nil {
+			return nil, fmt.Errorf("outbound rule #%d: %w", i+1, err)
+		}
+		if cr.ports, err = parsePortRanges(rule.Ports); err != nil {
+			return nil, fmt.Errorf("outbound rule #%d: %w", i+1, err)
+		}
+		for _, d := range rule.Domains {
+			if d = normalizeDomain(strings.TrimPrefix(strings.TrimSpace(d), "*.")); d != "" {
+				cr.domains = append(cr.domains, d)
+			}
+		}
+		r.rules = append(r.rules, cr)
+	}
+	return r, nil
+}
+
+func compileOutbound(cfg *outboundConfig) (*outbound, error) {
+	out := &outbound{name: cfg.Name, kind: strings.ToLower(cfg.Type)}
+	if out.kind == "" {
+		out.kind = outboundDirect
+	}
+	switch out.kind {
+	case outboundDirect:
+		if cfg.Address != "" || cfg.Username != "" || cfg.Password != "" || cfg.RemoteDNS {
+			return nil, errors.New("address, credentials and remote_dns only apply to proxies")
+		}
+		if cfg.Interface != "" {
+			if err := checkInterface(cfg.Interface); err != nil {
+				return nil, err
+			}
+			out.iface = cfg.Interface
+		}
+		for _, entry := range cfg.SourceIPs {
+			addr, err := netip.ParseAddr(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, fmt.Errorf("invalid source IP %q", entry)
+			}
+			if addr = addr.Unmap(); addr.Is4() {
+				out.v4 = append(out.v4, addr)
+			} else {
+				out.v6 = append(out.v6, addr)
+			}
+		}
+		switch cfg.Pool {
+		case "", "round_robin":
+		case "user":
+			out.byUser = true
+		default:
+			return nil, fmt.Errorf("unknown pool %q (want round_robin or user)", cfg.Pool)
+		}
+	case outboundSOCKS5, outboundHTTP:
+		if cfg.Interface != "" || len(cfg.SourceIPs) > 0 || cfg.Pool != "" {
+			return nil, errors.New("interface and source_ips only apply to direct outbounds")
+		}
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return nil, fmt.Errorf("invalid address %q", cfg.Address)
+		}
+		if out.kind == outboundSOCKS5 && (len(cfg.Username) > 255 || len(cfg.Password) > 255) {
+			return nil, errors.New("socks5 credentials are limited to 255 bytes")
+		}
+		out.address, out.username, out.password = cfg.Address, cfg.Username, cfg.Password
+		out.remoteDNS = cfg.RemoteDNS
+	default:
+		return nil, fmt.Errorf("unknown type %q (want direct, socks5 or http)", cfg.Type)
+	}
+	return out, nil
+}
+
+// route returns the outbound for a stream of user to host:port. A nil router
+// sends everything direct.
+func (r *outboundRouter) route(user, host string, port uint16) *outbound {
+	if r == nil {
+		return directOutbound
+	}
+	addr, addrErr := netip.ParseAddr(host)
+	name := normalizeDomain(host)
+	for _, rule := range r.rules {
+		if len(rule.users) > 0 && !slices.Contains(rule.users, user) {
+			continue
+		}
+		if len(rule.ports) > 0 && !containsPort(rule.ports, port) {
+			continue
+		}
+		if len(rule.domains) > 0 || len(rule.cidrs) > 0 {
+			var hit bool
+			if addrErr == nil {
+				hit = containsAddr(rule.cidrs, addr.Unmap())
+			} else {
+				hit = matchDomain(rule.domains, name)
+			}
+			if !hit {
+				continue
+			}
+		}
+		return rule.out
+	}
+	return directOutbound
+}
+
+// sourceIP picks the local address for a connection to host. IP literals use
+// the pool of their family; names prefer IPv4. With only the other family in
+// the pool the dial fails rather than leaving from the default address.
+func (o *outbound) sourceIP(user, host string) (netip.Addr, bool) {
+	pool, other := o.v4, o.v6
+	if addr, err := netip.ParseAddr(host); err == nil && !addr.Unmap().Is4() {
+		pool, other = o.v6, o.v4
+	}
+	if len(pool) == 0 {
+		pool = other
+	}
+	if len(pool) == 0 {
+		return netip.Addr{}, false
+	}
+	var i uint64
+	if o.byUser {
+		h := fnv.New32a()
+		h.Write([]byte(user))
+		i = uint64(h.Sum32())
+	} else {
+		i = o.next.Add(1) - 1
+	}
+	return pool[i%uint64(len(pool))], true
+}
+
+// controlFor chains the interface binding after control, which may be nil.
+func (o *outbound) controlFor(control func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		if o.iface != "" {
+			return bindToDevice(c, o.iface)
+		}
+		return nil
+	}
+}
+
+// dialTCP connects a stream of user to host:port. The egress policy checks
+// the target first, then every address a direct outbound connects to. Names
+// for a proxy are resolved and checked here, and the proxy gets the address,
+// so it cannot reach loopback or private services on the gateway's behalf.
+// With remote_dns the proxy gets the name and resolves it itself: only the
+// port and domain rules apply then, the address rules cannot.
+func (o *outbound) dialTCP(policy *egressPolicy, user, host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	if err := policy.checkTarget(host, port); err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	switch o.kind {
+	case outboundSOCKS5, outboundHTTP:
+		dest := host
+		if !o.remoteDNS {
+			var addr netip.Addr
+			if addr, err = policy.resolveHost(ctx, target, host); err != nil {
+				break
+			}
+			dest = addr.String()
+		}
+		if o.kind == outboundSOCKS5 {
+			conn, err = o.dialSOCKS5(ctx, dest, port)
+		} else {
+			conn, err = o.dialHTTP(ctx, net.JoinHostPort(dest, strconv.Itoa(int(port))))
+		}
+	default:
+		dialer := &net.Dialer{Control: o.controlFor(policy.control(target))}
+		if src, ok := o.sourceIP(user, host); ok {
+			dialer.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", target)
+	}
+	if !errors.Is(err, errEgressDenied) {
+		gwMetrics.observeDial(time.Since(start), err)
+	}
+	return conn, err
+}
+
+// listenUDP opens the socket of a UDP flow. Only direct outbounds carry UDP.
+func (o *outbound) listenUDP(user, host string) (*net.UDPConn, error) {
+	if o.kind != outboundDirect {
+		return nil, fmt.Errorf("outbound %s (%s) does not carry udp", o.name, o.kind)
+	}
+	laddr := ":0"
+	if src, ok := o.sourceIP(user, host); ok {
+		laddr = net.JoinHostPort(src.String(), "0")
+	}
+	lc := net.ListenConfig{Control: o.controlFor(nil)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// dialProxy connects to the upstream proxy. The handshake runs under the
+// context deadline, which the caller clears once it succeeds.
+func (o *outbound) dialProxy(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", o.address)
+	if err != nil {
+		return nil, o.fail(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// fail wraps an I/O error with the proxy: a timeout, or a generic connect failure.
+func (o *outbound) fail(err error) error {
+	code := core.CodeConnectFailed
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		code = core.CodeConnectTimeout
+	}
+	return &upstreamError{outbound: o.name, code: code, err: err}
+}
+
+// dialSOCKS5 opens host:port through a SOCKS5 proxy (RFC 1928), with
+// username/password authentication (RFC 1929) when credentials are set.
+func (o *outbound) dialSOCKS5(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	conn, err := o.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.socks5Handshake(conn, host, port); err != nil {
+		conn.Close()
+		var upErr *upstreamError
+		if errors.As(err, &upErr) {
+			return nil, err
+		}
+		return nil, o.fail(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (o *outbound) socks5Handshake(conn net.Conn, host string, port uint16) error {
+	methods := []byte{0x05, 0x01, 0x00}
+	if o.username != "" {
+		methods = []byte{0x05, 0x02, 0x00, 0x02}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != 0x05:
+		return fmt.Errorf("socks5: unexpected version %d", reply[0])
+	case reply[1] == 0x02 && o.username != "":
+		auth := []byte{0x01, byte(len(o.username))}
+		auth = append(auth, o.username...)
+		auth = append(auth, byte(len(o.password)))
+		auth = append(auth, o.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return &upstreamError{outbound: o.name, code: core.CodeConnectFailed, err: errors.New("socks5: authentication rejected")}
+		}
+	case reply[1] != 0x00:
+		return &upstreamError{outbound: o.name, code: core.CodeConnectFailed, err: errors.New("socks5: no acceptable authentication method")}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr = addr.Unmap(); addr.Is4() {
+			req = append(req, 0x01)
+		} else {
+			req = append(req, 0x04)
+		}
+		req = append(req, addr.AsSlice()...)
+	} else {
+		// Metadata caps host names at 255 bytes, which is also the SOCKS5 limit.
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, which is not needed.
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return &upstreamError{outbound: o.name, code: socks5ReplyCode(head[1]), err: fmt.Errorf("socks5: connect failed with reply %d", head[1])}
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socks5ReplyCode maps a SOCKS5 reply to a connect-ack code.
+func socks5ReplyCode(rep byte) uint16 {
+	switch rep {
+	case 0x02: // Connection not allowed by ruleset
+		return core.CodePolicyDenied
+	case 0x03, 0x04: // Network or host unreachable
+		return core.CodeHostUnreachable
+	case 0x05:
+		return core.CodeConnRefused
+	case 0x06: // TTL expired
+		return core.CodeConnectTimeout
+	default:
+		return core.CodeConnectFailed
+	}
+}
+
+// dialHTTP opens target through an HTTP CONNECT proxy, with Basic
+// authentication when credentials are set.
+func (o *outbound) dialHTTP(ctx context.Context, target string) (net.Conn, error) {
+	conn, err := o.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if o.username != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(o.username+":"+o.password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		conn.Close()
+		return nil, o.fail(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, o.fail(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &upstreamError{outbound: o.name, code: httpStatusCode(resp.StatusCode), err: fmt.Errorf("http connect: %s", resp.Status)}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// The target spoke first and its bytes arrived with the response.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// httpStatusCode maps a CONNECT response status to a connect-ack code.
+func httpStatusCode(status int) uint16 {
+	switch status {
+	case http.StatusForbidden:
+		return core.CodePolicyDenied
+	case http.StatusGatewayTimeout:
+		return core.CodeConnectTimeout
+	default:
+		return core.CodeConnectFailed
+	}
+}
+
+// bufferedConn serves reads from r first, keeping half-close of the proxy connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
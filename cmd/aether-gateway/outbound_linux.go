@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// checkInterface reports whether outbounds can bind to the named interface.
+func checkInterface(name string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return fmt.Errorf("interface %q: %w", name, err)
+	}
+	return nil
+}
+
+// bindToDevice sets SO_BINDTODEVICE, which needs CAP_NET_RAW on older kernels.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("bind to interface %s: %w", iface, sockErr)
+	}
+	return nil
+}
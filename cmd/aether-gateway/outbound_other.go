@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errNoInterfaceBinding = errors.New("binding outbounds to an interface is only supported on Linux")
+
+func checkInterface(string) error {
+	return errNoInterfaceBinding
+}
+
+func bindToDevice(syscall.RawConn, string) error {
+	return errNoInterfaceBinding
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOutboundRoute(t *testing.T) {
+	router, err := compileOutbounds([]*outboundConfig{
+		{Name: "proxy", Type: "socks5", Address: "127.0.0.1:1080"},
+		{Name: "corp", Type: "http", Address: "127.0.0.1:3128"},
+		{Name: "pool", SourceIPs: []string{"192.0.2.10", "2001:db8::10"}},
+	}, []*outboundRule{
+		{Users: []string{"alice"}, Outbound: "corp"},
+		{Domains: []string{"*.example.com"}, CIDRs: []string{"203.0.113.0/24"}, Outbound: "proxy"},
+		{Ports: []string{"25", "8000-8100"}, Outbound: "pool"},
+		{Domains: []string{"internal.test"}, Ports: []string{"443"}, Outbound: "direct"},
+	})
+	if err != nil {
+		t.Fatalf("compileOutbounds: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		host string
+		port uint16
+		want string
+	}{
+		{"user rule first", "alice", "www.example.com", 443, "corp"},
+		{"subdomain", "bob", "www.example.com", 443, "proxy"},
+		{"domain itself", "bob", "Example.COM.", 443, "proxy"},
+		{"not a subdomain", "bob", "badexample.com", 443, "direct"},
+		{"cidr", "bob", "203.0.113.7", 80, "proxy"},
+		{"ipv4-mapped cidr", "bob", "::ffff:203.0.113.7", 80, "proxy"},
+		{"domains do not match literals", "bob", "198.51.100.1", 443, "direct"},
+		{"port", "bob", "198.51.100.1", 25, "pool"},
+		{"port range", "bob", "host.test", 8050, "pool"},
+		{"port outside range", "bob", "host.test", 8101, "direct"},
+		{"every condition must hold", "bob", "internal.test", 80, "direct"},
+		{"explicit direct", "bob", "internal.test", 443, "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := router.route(tt.user, tt.host, tt.port).name; got != tt.want {
+				t.Errorf("route(%s, %s, %d) = %s, want %s", tt.user, tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+
+	var nilRouter *outboundRouter
+	if got := nilRouter.route("bob", "example.com", 443); got != directOutbound {
+		t.Errorf("nil router: got %s, want direct", got.name)
+	}
+}
+
+func TestCompileOutboundsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []*outboundConfig
+		rules   []*outboundRule
+	}{
+		{"missing name", []*outboundConfig{{Type: "socks5", Address: "127.0.0.1:1080"}}, nil},
+		{"duplicate name", []*outboundConfig{{Name: "a"}, {Name: "a"}}, nil},
+		{"direct is reserved", []*outboundConfig{{Name: "direct"}}, nil},
+		{"unknown type", []*outboundConfig{{Name: "a", Type: "vpn"}}, nil},
+		{"proxy without address", []*outboundConfig{{Name: "a", Type: "http"}}, nil},
+		{"proxy with source ips", []*outboundConfig{{Name: "a", Type: "socks5", Address: "127.0.0.1:1080", SourceIPs: []string{"192.0.2.1"}}}, nil},
+		{"direct with address", []*outboundConfig{{Name: "a", Address: "127.0.0.1:1080"}}, nil},
+		{"direct with remote dns", []*outboundConfig{{Name: "a", RemoteDNS: true}}, nil},
+		{"bad source ip", []*outboundConfig{{Name: "a", SourceIPs: []string{"nope"}}}, nil},
+		{"bad pool", []*outboundConfig{{Name: "a", Pool: "random"}}, nil},
+		{"unknown outbound", nil, []*outboundRule{{Outbound: "missing"}}},
+		{"bad cidr", nil, []*outboundRule{{CIDRs: []string{"10.0.0.0/33"}, Outbound: "direct"}}},
+		{"bad port", nil, []*outboundRule{{Ports: []string{"70000"}, Outbound: "direct"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compileOutbounds(tt.configs, tt.rules); err == nil {
+				t.Error("compileOutbounds: expected an error")
+			}
+		})
+	}
+}
+
+// fakeProxy accepts one connection on a loopback listener and reports the
+// destination the gateway asked for.
+func fakeProxy(t *testing.T, serve func(net.Conn) string) (addr string, got <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ch <- serve(conn)
+	}()
+	return ln.Addr().String(), ch
+}
+
+func serveSOCKS5(conn net.Conn) string {
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return ""
+	}
+	conn.Write([]byte{0x05, 0x00})
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return ""
+	}
+	var host string
+	switch buf[3] {
+	case 0x01:
+		io.ReadFull(conn, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 0x04:
+		io.ReadFull(conn, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	case 0x03:
+		io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(conn, buf[:n])
+		host = "name:" + string(buf[:n])
+	}
+	io.ReadFull(conn, buf[:2])
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return host
+}
+
+func serveHTTPConnect(conn net.Conn) string {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return ""
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.RequestURI
+}
+
+func TestProxyOutboundResolvesLocally(t *testing.T) {
+	strict, err := compileEgress(nil)
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	open, err := compileEgress(&egressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+
+	for _, kind := range []string{outboundSOCKS5, outboundHTTP} {
+		t.Run(kind, func(t *testing.T) {
+			serve, want := serveSOCKS5, "127.0.0.1"
+			if kind == outboundHTTP {
+				serve, want = serveHTTPConnect, "127.0.0.1:8080"
+			}
+
+			// A name resolving to loopback must not reach the proxy at all.
+			addr, got := fakeProxy(t, serve)
+			out, err := compileOutbound(&outboundConfig{Name: "up", Type: kind, Address: addr})
+			if err != nil {
+				t.Fatalf("compileOutbound: %v", err)
+			}
+			if _, err := out.dialTCP(strict, "bob", "localhost", 8080, time.Second); !errors.Is(err, errEgressDenied) {
+				t.Fatalf("dialTCP(localhost): got %v, want an egress denial", err)
+			}
+			select {
+			case host := <-got:
+				t.Fatalf("proxy was asked for %q", host)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			// Where the policy allows it, the proxy gets the checked address.
+			addr, got = fakeProxy(t, serve)
+			out, err = compileOutbound(&outboundConfig{Name: "up", Type: kind, Address: addr})
+			if err != nil {
+				t.Fatalf("compileOutbound: %v", err)
+			}
+			conn, err := out.dialTCP(open, "bob", "localhost", 8080, time.Second)
+			if err != nil {
+				t.Fatalf("dialTCP(localhost, allow_private): %v", err)
+			}
+			conn.Close()
+			if host := <-got; host != want {
+				t.Errorf("proxy was asked for %q, want %q", host, want)
+			}
+		})
+	}
+}
+
+func TestProxyOutboundRemoteDNS(t *testing.T) {
+	strict, err := compileEgress(&egressConfig{DenyDomains: []string{"blocked.test"}})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+
+	for _, kind := range []string{outboundSOCKS5, outboundHTTP} {
+		t.Run(kind, func(t *testing.T) {
+			serve, want := serveSOCKS5, "name:localhost"
+			if kind == outboundHTTP {
+				serve, want = serveHTTPConnect, "localhost:8080"
+			}
+
+			// The proxy gets the name as the client sent it.
+			addr, got := fakeProxy(t, serve)
+			out, err := compileOutbound(&outboundConfig{Name: "up", Type: kind, Address: addr, RemoteDNS: true})
+			if err != nil {
+				t.Fatalf("compileOutbound: %v", err)
+			}
+			conn, err := out.dialTCP(strict, "bob", "localhost", 8080, time.Second)
+			if err != nil {
+				t.Fatalf("dialTCP(localhost): %v", err)
+			}
+			conn.Close()
+			if host := <-got; host != want {
+				t.Errorf("proxy was asked for %q, want %q", host, want)
+			}
+
+			// Domain rules and IP literals are still checked here.
+			for _, host := range []string{"www.blocked.test", "127.0.0.1"} {
+				if _, err := out.dialTCP(strict, "bob", host, 8080, time.Second); !errors.Is(err, errEgressDenied) {
+					t.Errorf("dialTCP(%s): got %v, want an egress denial", host, err)
+				}
+			}
+		})
+	}
+}
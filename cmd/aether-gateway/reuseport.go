@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Rolling restarts: with reuseport a new gateway binds the port the old one
+// still holds. Each process tags the QUIC connection IDs it issues, and the
+// socket filter the newest process installs sends packets for its own
+// connections and every new connection to it, and the rest to the old
+// process until that one has drained and exited.
+
+// connIDLength is Random(4) | Tag xor Random(4) | Random(4), so the tag is not
+// a constant prefix on the wire.
+const connIDLength = 12
+
+// taggedConnIDs issues the connection IDs of one gateway process.
+type taggedConnIDs struct {
+	tag uint32
+}
+
+func newTaggedConnIDs() *taggedConnIDs {
+	var b [4]byte
+	rand.Read(b[:])
+	return &taggedConnIDs{tag: binary.BigEndian.Uint32(b[:])}
+}
+
+func (g *taggedConnIDs) GenerateConnectionID() (quic.ConnectionID, error) {
+	b := make([]byte, connIDLength)
+	rand.Read(b)
+	binary.BigEndian.PutUint32(b[4:8], binary.BigEndian.Uint32(b[0:4])^g.tag)
+	return quic.ConnectionIDFromBytes(b), nil
+}
+
+func (g *taggedConnIDs) ConnectionIDLen() int {
+	return connIDLength
+}
+
+// listenUDP binds the QUIC socket. With ids set it joins the port's
+// SO_REUSEPORT group and takes over new connections from any older process.
+func listenUDP(addr string, ids *taggedConnIDs) (*net.UDPConn, error) {
+	if ids == nil {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenUDP("udp", udpAddr)
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, reusePortHint(err)
+	}
+	conn := pc.(*net.UDPConn)
+	if err := steerToOwner(conn, ids.tag); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenTCP binds the TCP listener, sharing the port when reuse is set.
+func listenTCP(addr string, reuse bool) (net.Listener, error) {
+	if !reuse {
+		return net.Listen("tcp", addr)
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, reusePortHint(err)
+	}
+	return ln, nil
+}
+
+// reusePortHint explains the usual cause of a failed shared bind.
+func reusePortHint(err error) error {
+	return fmt.Errorf("%w (a process already holding the port must also run with reuseport, as the same user)", err)
+}
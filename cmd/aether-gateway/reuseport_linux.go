@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEPORT before the socket is bound.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("set SO_REUSEPORT: %w", sockErr)
+	}
+	return nil
+}
+
+// steeringProgram is the group's socket filter. The kernel runs it on the
+// UDP payload and delivers to the socket at the returned index: 1 for long
+// header packets (new connections) and short headers carrying tag, 0 for the
+// rest.
+func steeringProgram(tag uint32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x80, SkipTrue: 6},
+		bpf.LoadAbsolute{Off: 1, Size: 4}, // Destination connection ID, bytes 0-3
+		bpf.TAX{},
+		bpf.LoadAbsolute{Off: 5, Size: 4}, // Bytes 4-7
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: tag, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+}
+
+// steerToOwner installs the steering program for tag. The process that
+// joined last sits at index 1; once it is alone in the group the index is
+// out of range and the kernel falls back to its own hash, which can only
+// pick it.
+func steerToOwner(conn *net.UDPConn, tag uint32) error {
+	prog, err := bpf.Assemble(steeringProgram(tag))
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	fprog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &fprog)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("attach reuseport filter: %w", sockErr)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// shortHeader is a 1-RTT packet for the connection ID id.
+func shortHeader(id []byte) []byte {
+	return append(append([]byte{0x40}, id...), 0xaa, 0xbb, 0xcc)
+}
+
+func TestSteeringProgram(t *testing.T) {
+	own, other := newTaggedConnIDs(), newTaggedConnIDs()
+	for own.tag == other.tag {
+		other = newTaggedConnIDs()
+	}
+	vm, err := bpf.NewVM(steeringProgram(own.tag))
+	if err != nil {
+		t.Fatalf("NewVM: %v", err)
+	}
+	ownID, _ := own.GenerateConnectionID()
+	otherID, _ := other.GenerateConnectionID()
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"long header", []byte{0xc0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}, 1},
+		{"short header with own tag", shortHeader(ownID.Bytes()), 1},
+		{"short header with other tag", shortHeader(otherID.Bytes()), 0},
+		{"truncated short header", []byte{0x40, 1, 2}, 0},
+	}
+	for _, tt := range tests {
+		got, err := vm.Run(tt.packet)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got socket %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReusePortHandover(t *testing.T) {
+	oldIDs, newIDs := newTaggedConnIDs(), newTaggedConnIDs()
+	for oldIDs.tag == newIDs.tag {
+		newIDs = newTaggedConnIDs()
+	}
+	oldConn, err := listenUDP("127.0.0.1:0", oldIDs)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("reuseport filter not permitted here: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("listenUDP: %v", err)
+	}
+	defer oldConn.Close()
+	addr := oldConn.LocalAddr().String()
+	newConn, err := listenUDP(addr, newIDs)
+	if err != nil {
+		t.Fatalf("second listenUDP on %s: %v", addr, err)
+	}
+	defer newConn.Close()
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	oldID, _ := oldIDs.GenerateConnectionID()
+	newID, _ := newIDs.GenerateConnectionID()
+	tests := []struct {
+		name   string
+		packet []byte
+		want   *net.UDPConn
+	}{
+		{"new connection", []byte{0xc0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}, newConn},
+		{"old connection", shortHeader(oldID.Bytes()), oldConn},
+		{"new process connection", shortHeader(newID.Bytes()), newConn},
+	}
+	for _, tt := range tests {
+		if _, err := client.Write(tt.packet); err != nil {
+			t.Fatalf("%s: Write: %v", tt.name, err)
+		}
+		buf := make([]byte, 64)
+		_ = tt.want.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := tt.want.Read(buf); err != nil {
+			t.Errorf("%s: not delivered to the expected socket: %v", tt.name, err)
+		}
+	}
+
+	// TCP shares the port only when every listener asks for it.
+	ln, err := listenTCP("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("listenTCP: %v", err)
+	}
+	defer ln.Close()
+	second, err := listenTCP(ln.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("second listenTCP: %v", err)
+	}
+	second.Close()
+	if plain, err := listenTCP(ln.Addr().String(), false); err == nil {
+		plain.Close()
+		t.Error("plain listen on a shared port succeeded")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errNoReusePort = errors.New("reuseport is only supported on Linux")
+
+func reusePortControl(string, string, syscall.RawConn) error {
+	return errNoReusePort
+}
+
+func steerToOwner(*net.UDPConn, uint32) error {
+	return errNoReusePort
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestTaggedConnIDs(t *testing.T) {
+	ids := newTaggedConnIDs()
+	a, _ := ids.GenerateConnectionID()
+	b, _ := ids.GenerateConnectionID()
+	if a.Len() != connIDLength || ids.ConnectionIDLen() != connIDLength {
+		t.Fatalf("length: got %d", a.Len())
+	}
+	if a == b {
+		t.Error("two equal connection IDs")
+	}
+	for _, id := range [][]byte{a.Bytes(), b.Bytes()} {
+		if got := binary.BigEndian.Uint32(id[0:4]) ^ binary.BigEndian.Uint32(id[4:8]); got != ids.tag {
+			t.Errorf("tag: got %08x, want %08x", got, ids.tag)
+		}
+	}
+}
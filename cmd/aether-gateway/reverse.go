@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"aether-rea/internal/core"
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// serveReverse registers a reverse tunnel: it listens on the requested port for
+// as long as the registration stream stays open and carries every inbound
+// connection back to the client on a stream the gateway opens.
+func (gs *gatewaySession) serveReverse(stream *webtransport.Stream, reader *core.RecordReader, streamID uint64, user *gatewayUser, stats *userStats, meta *core.Metadata, dc *core.DataCipher) {
+	name, port := meta.Options.ReverseName, meta.Options.ReversePort
+	if !user.allowsReversePort(port) {
+		log.Printf("[Stream %d] user=%s Reverse tunnel %q denied: port %d not allowed", streamID, user.ID, name, port)
+		_ = writeConnectAck(stream, core.CodePolicyDenied, gs.ng, dc)
+		return
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(currentSettings().reverseBind, strconv.Itoa(int(port))))
+	if err != nil {
+		log.Printf("[Stream %d] user=%s Reverse tunnel %q: listen failed: %v", streamID, user.ID, name, err)
+		_ = writeConnectAck(stream, core.CodeResourceLimit, gs.ng, dc)
+		return
+	}
+	defer ln.Close()
+	if err := writeConnectAck(stream, core.CodeOK, gs.ng, dc); err != nil {
+		return
+	}
+	log.Printf("[Stream %d] user=%s Reverse tunnel %q listening on %s", streamID, user.ID, name, ln.Addr())
+
+	// A drain frees the port at once so the client can register again on a
+	// new session, possibly with the gateway taking over.
+	stop := context.AfterFunc(drain.ctx, func() {
+		ln.Close()
+		stream.CancelRead(0)
+	})
+	defer stop()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go gs.forwardReverse(conn, name, port, dc.Suite(), user, stats)
+		}
+	}()
+
+	// The client never writes on the registration stream; it ends when the
+	// client removes the binding or the session goes away.
+	_, err = io.Copy(io.Discard, reader)
+	log.Printf("[Stream %d] user=%s Reverse tunnel %q closed: %v", streamID, user.ID, name, err)
+}
+
+// forwardReverse carries one inbound connection to the client. The stream
+// starts with a metadata record sealed with the user's PSK: the binding in the
+// reverse option, the inbound peer's address as Host/Port.
+func (gs *gatewaySession) forwardReverse(conn net.Conn, name string, port uint16, suite byte, user *gatewayUser, stats *userStats) {
+	defer conn.Close()
+	// Inbound connections take stream slots like client streams: a user at
+	// max_streams or out of quota gets the connection closed.
+	if code, msg := stats.admitStream(user); code != core.CodeOK {
+		log.Printf("[REVERSE] user=%s %q: connection from %s rejected (0x%04x): %s", user.ID, name, conn.RemoteAddr(), code, msg)
+		gs.logRefused("reverse "+name, "reverse", user, conn.RemoteAddr().String(), "", 0, reasonRejected, code, nil)
+		return
+	}
+	defer stats.activeStreams.Add(-1)
+
+	ctx, cancel := context.WithTimeout(gs.session.Context(), 10*time.Second)
+	stream, err := gs.session.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("[REVERSE] user=%s %q: open stream for %s failed: %v", user.ID, name, conn.RemoteAddr(), err)
+		return
+	}
+	defer stream.Close()
+
+	dc, err := core.NewDataCipher(suite, user.PSK)
+	if err != nil {
+		stream.CancelRead(0)
+		return
+	}
+	peer := conn.RemoteAddr().(*net.TCPAddr)
+	opts := core.Options{DataCipher: suite, ReverseName: name, ReversePort: port}
+	record, err := core.BuildMetadataRecordWithOptions(peer.IP.String(), uint16(peer.Port), opts, user.PSK, gs.ng)
+	if err != nil {
+		stream.CancelRead(0)
+		return
+	}
+	if _, err := stream.Write(record); err != nil {
+		return
+	}
+	st := gs.trackStream("reverse "+name, "reverse", conn.RemoteAddr().String(), user, stats, func() {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		conn.Close()
+	})
+	defer gs.untrackStream(st)
+	rw := core.NewRecordReadWriter(stream, 0, gs.ng)
+	rw.SetDataCipher(dc)
+
+	errCh := make(chan error, 2)
+	go func() {
+		err := copyCounted(conn, rw, st.chargeUp)
+		if err == nil {
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				_ = tcpConn.CloseWrite()
+			}
+		}
+		errCh <- err
+	}()
+	go func() {
+		err := copyCounted(rw, conn, st.chargeDown)
+		if err == nil {
+			err = rw.CloseWrite()
+		}
+		errCh <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			log.Printf("[REVERSE] user=%s %q: connection from %s: %v", user.ID, name, conn.RemoteAddr(), err)
+			st.finish(closeReason(err), err)
+			stream.CancelRead(0)
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// freePort returns a loopback TCP port nothing listens on.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// useReverseGateway starts a gateway whose legacy user may expose port, with
+// reverse listeners bound to loopback.
+func useReverseGateway(t *testing.T, port uint16) (*testGateway, *gatewayUser) {
+	t.Helper()
+	useLoopbackEgress(t)
+	s := *currentSettings()
+	s.reverseBind = "127.0.0.1"
+	useSettings(t, &s)
+	users, err := newUserTable("", testPSK, []string{strconv.Itoa(int(port))}, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	user, err := users.authenticate("")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	return startTestGateway(t, users), user
+}
+
+// registerReverse registers a reverse tunnel for port as the client does.
+func registerReverse(t *testing.T, sess *webtransport.Session, name string, port uint16) (*testStream, error) {
+	t.Helper()
+	return openTestStream(t, sess, "0.0.0.0", 0, core.Options{ReverseName: name, ReversePort: port})
+}
+
+// acceptReverse takes the next stream the gateway opens for an inbound
+// connection and returns its metadata and data channel.
+func acceptReverse(t *testing.T, sess *webtransport.Session) (*core.Metadata, *core.RecordReadWriter) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := sess.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	t.Cleanup(func() { stream.CancelRead(0); stream.CancelWrite(0) })
+	ng, err := core.NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	rw := core.NewRecordReadWriter(stream, 0, ng)
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	record, err := rw.ReadNextRecord()
+	if err != nil || record.Type != core.TypeMetadata {
+		t.Fatalf("first record: %v", err)
+	}
+	meta, err := core.DecryptMetadata(record, testPSK)
+	if err != nil {
+		t.Fatalf("DecryptMetadata: %v", err)
+	}
+	dc, err := core.NewDataCipher(meta.Options.DataCipher, testPSK)
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	rw.SetDataCipher(dc)
+	return meta, rw
+}
+
+// dialReverse connects to a reverse tunnel port on loopback.
+func dialReverse(port uint16) (net.Conn, error) {
+	return net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), time.Second)
+}
+
+func TestReverseTunnel(t *testing.T) {
+	port := freePort(t)
+	g, _ := useReverseGateway(t, port)
+	sess := g.dial(t)
+
+	if _, err := registerReverse(t, sess, "web", port); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	conn, err := dialReverse(port)
+	if err != nil {
+		t.Fatalf("dial tunnel port: %v", err)
+	}
+	defer conn.Close()
+
+	// The inbound connection comes back to the client on a gateway stream.
+	meta, rw := acceptReverse(t, sess)
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if meta.Options.ReverseName != "web" || meta.Options.ReversePort != port || meta.Port != uint16(local.Port) {
+		t.Fatalf("metadata: %+v", meta)
+	}
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatalf("write inbound: %v", err)
+	}
+	buf := make([]byte, len("request"))
+	if _, err := io.ReadFull(rw, buf); err != nil || string(buf) != "request" {
+		t.Fatalf("client read: %q, %v", buf, err)
+	}
+	if _, err := rw.Write([]byte("response")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	buf = make([]byte, len("response"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "response" {
+		t.Fatalf("inbound read: %q, %v", buf, err)
+	}
+}
+
+func TestReversePortAllowlist(t *testing.T) {
+	allowed := freePort(t)
+	g, _ := useReverseGateway(t, allowed)
+	sess := g.dial(t)
+
+	other := freePort(t)
+	if _, err := registerReverse(t, sess, "other", other); remoteCode(t, err) != core.CodePolicyDenied {
+		t.Errorf("port outside the allowlist: got %v", err)
+	}
+	if conn, err := dialReverse(other); err == nil {
+		conn.Close()
+		t.Error("gateway listens on a denied port")
+	}
+	if _, err := registerReverse(t, sess, "web", allowed); err != nil {
+		t.Errorf("allowed port: %v", err)
+	}
+}
+
+func TestReverseListenerRelease(t *testing.T) {
+	port := freePort(t)
+	g, _ := useReverseGateway(t, port)
+	d := useDrainer(t, time.Minute)
+	sess := g.dial(t)
+	released := func() bool {
+		conn, err := dialReverse(port)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	}
+
+	// Closing the registration stream frees the port for a new registration.
+	reg, err := registerReverse(t, sess, "web", port)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if released() {
+		t.Fatal("port not listening after registration")
+	}
+	reg.CancelRead(0)
+	reg.CancelWrite(0)
+	waitFor(t, 5*time.Second, "the listener to close with its stream", released)
+	if _, err := registerReverse(t, sess, "web", port); err != nil {
+		t.Fatalf("register again: %v", err)
+	}
+
+	// A drain frees it at once, while the session lives on.
+	d.start()
+	waitFor(t, 5*time.Second, "the listener to close on drain", released)
+	if sess.Context().Err() != nil {
+		t.Error("session closed by the start of a drain")
+	}
+}
+
+func TestReverseStreamLimit(t *testing.T) {
+	port := freePort(t)
+	g, user := useReverseGateway(t, port)
+	user.MaxStreams = 1
+	sess := g.dial(t)
+	if _, err := registerReverse(t, sess, "web", port); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	first, err := dialReverse(port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	acceptReverse(t, sess)
+
+	// A second connection would exceed max_streams: it is closed, not carried.
+	second, err := dialReverse(port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection over the limit: read returned %v, want EOF", err)
+	}
+	if n := g.users.statsFor(user.ID).rejected.Load(); n != 1 {
+		t.Errorf("rejected = %d, want 1", n)
+	}
+}
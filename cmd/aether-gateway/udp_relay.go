@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+const (
+	udpFlowIdleTimeout    = 60 * time.Second
+	udpJanitorInterval    = 15 * time.Second
+	udpMaxFlowsPerSession = 256
+	udpResolveTTL         = 30 * time.Second // How long a checked destination is reused
+	udpMaxDestsPerFlow    = 256
+)
+
+// udpRelay serves the UDP flows of one WebTransport session.
+// Flows arrive as WebTransport datagrams, or as datagram records on a
+// UDP relay stream when a payload did not fit in a QUIC datagram.
+type udpRelay struct {
+	gs      *gatewaySession
+	session *webtransport.Session
+	ng      *core.NonceGenerator
+	ciphers *core.DatagramCiphers
+
+	mu    sync.Mutex
+	flows map[uint32]*udpFlow
+}
+
+// udpFlow is the gateway end of a client flow: one unconnected UDP socket,
+// so replies from any destination are relayed back with their source address.
+type udpFlow struct {
+	id         uint32
+	keyID      string
+	user       *gatewayUser
+	stats      *userStats
+	conn       *net.UDPConn
+	dc         *core.DataCipher
+	lastActive atomic.Int64
+
+	streamMu sync.Mutex
+	stream   *webtransport.Stream // relay stream opened by the client, if any
+
+	destMu sync.Mutex
+	dests  map[string]udpDest // By host:port as the client sent it
+}
+
+// udpDest is a destination of a flow, resolved and checked against the
+// egress policy. Denials are kept as well, so they cost no lookup either.
+type udpDest struct {
+	addr    *net.UDPAddr
+	err     error
+	policy  *egressPolicy
+	expires time.Time
+}
+
+func newUDPRelay(gs *gatewaySession) *udpRelay {
+	return &udpRelay{
+		gs:      gs,
+		session: gs.session,
+		ng:      gs.ng,
+		ciphers: core.NewDatagramCiphers(gs.users.pskFor),
+		flows:   make(map[uint32]*udpFlow),
+	}
+}
+
+// run receives datagrams until the session ends, then releases all flows.
+func (r *udpRelay) run() {
+	ctx := r.session.Context()
+	defer r.closeAll()
+	go r.janitor()
+
+	for {
+		b, err := r.session.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		record, err := core.ParseDatagramRecord(b)
+		if err != nil {
+			r.handshakeFailed(failRead, fmt.Sprintf("Dropping datagram: %v", err))
+			continue
+		}
+		if record.Type == core.TypePing {
+			r.answerProbe(record)
+			continue
+		}
+		r.handleRecord(record, nil)
+	}
+}
+
+// answerProbe echoes a client probe back as a pong datagram.
+func (r *udpRelay) answerProbe(record *core.Record) {
+	seq, sent, err := core.ParseProbe(record)
+	if err != nil {
+		return
+	}
+	pong, err := core.BuildProbeRecord(core.TypePong, seq, sent, r.ng)
+	if err != nil {
+		return
+	}
+	_ = r.session.SendDatagram(pong[4:])
+}
+
+// serveStream reads datagram records from a UDP relay stream until it closes.
+func (r *udpRelay) serveStream(stream *webtransport.Stream, reader *core.RecordReader, streamID uint64) {
+	log.Printf("[Stream %d] UDP relay stream opened", streamID)
+	defer r.detachStream(stream)
+	for {
+		record, err := reader.ReadNextRecord()
+		if err != nil {
+			return
+		}
+		r.handleRecord(record, stream)
+		if record.RawBuffer != nil {
+			core.PutBuffer(record.RawBuffer)
+		}
+	}
+}
+
+// handleRecord opens a datagram record and sends its payload to the destination.
+func (r *udpRelay) handleRecord(record *core.Record, stream *webtransport.Stream) {
+	if record.Type != core.TypeDatagram {
+		return
+	}
+	suite, keyID, err := core.DatagramKey(record)
+	if err != nil {
+		r.handshakeFailed(failRead, err.Error())
+		return
+	}
+	dc, err := r.ciphers.Get(keyID, suite)
+	if err != nil {
+		r.handshakeFailed(failKeyID, fmt.Sprintf("Key ID %q rejected: %v", keyID, err))
+		return
+	}
+	d, err := core.OpenUDPDatagram(record, dc)
+	if err != nil {
+		r.handshakeFailed(failDecrypt, err.Error())
+		return
+	}
+	user, err := r.gs.users.authenticate(d.KeyID)
+	if err != nil {
+		r.handshakeFailed(failKeyID, err.Error())
+		return
+	}
+	if err := r.gs.bindUser(user); err != nil {
+		r.handshakeFailed(failUser, err.Error())
+		return
+	}
+	// Datagrams share the replay filter of stream records, so a captured one
+	// cannot be resent to its target within the window.
+	if err := r.gs.checkReplay(user, record); err != nil {
+		r.handshakeFailed(failCounter, fmt.Sprintf("Flow %08x user=%s: datagram rejected: %v", d.FlowID, user.ID, err))
+		return
+	}
+
+	flow, err := r.flowFor(d.FlowID, d.KeyID, user, dc, d.Host, d.Port)
+	if err != nil {
+		log.Printf("[UDP] Flow %08x: %v", d.FlowID, err)
+		return
+	}
+	if stream != nil {
+		flow.streamMu.Lock()
+		flow.stream = stream
+		flow.streamMu.Unlock()
+	}
+
+	if user.overQuota(flow.stats) {
+		return // Datagrams are dropped, not throttled, once the quota is used up
+	}
+	addr, fresh, err := flow.resolve(d.Host, d.Port)
+	if err != nil {
+		if !fresh {
+			return
+		}
+		log.Printf("[UDP] Flow %08x user=%s: %s", d.FlowID, user.ID, currentSettings().accessLog.error(err))
+		return
+	}
+	if _, err := flow.conn.WriteToUDP(d.Payload, addr); err != nil {
+		log.Printf("[UDP] Flow %08x: send to %s failed: %s", d.FlowID, currentSettings().accessLog.target(addr.String()), currentSettings().accessLog.error(err))
+		return
+	}
+	flow.lastActive.Store(time.Now().UnixNano())
+	flow.stats.countDatagram(true, len(d.Payload))
+}
+
+// handshakeFailed counts a datagram that failed authentication like a failed
+// stream handshake. There is no stream to answer on, so no decoy is sent.
+func (r *udpRelay) handshakeFailed(kind, reason string) {
+	log.Printf("[SECURITY] [UDP] %s", reason)
+	countHandshakeFailure(r.gs, kind)
+}
+
+// flowFor returns the flow for id, creating its socket on first use. The
+// outbound is picked by the destination of the flow's first datagram.
+func (r *udpRelay) flowFor(id uint32, keyID string, user *gatewayUser, dc *core.DataCipher, host string, port uint16) (*udpFlow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if flow, ok := r.flows[id]; ok {
+		return flow, nil
+	}
+	if drain.active() {
+		return nil, errDraining
+	}
+	if len(r.flows) >= udpMaxFlowsPerSession {
+		return nil, fmt.Errorf("too many udp flows (%d)", len(r.flows))
+	}
+
+	out := currentSettings().outbounds.route(user.ID, host, port)
+	conn, err := out.listenUDP(user.ID, host)
+	if err != nil {
+		return nil, err
+	}
+	flow := &udpFlow{id: id, keyID: keyID, user: user, stats: r.gs.users.statsFor(user.ID), conn: conn, dc: dc, dests: make(map[string]udpDest)}
+	flow.lastActive.Store(time.Now().UnixNano())
+	r.flows[id] = flow
+	log.Printf("[UDP] Flow %08x user=%s opened on %s via %s", id, user.ID, conn.LocalAddr(), out.name)
+	go r.readFlow(flow)
+	return flow, nil
+}
+
+// resolve returns the checked address of host:port. It resolves on the first
+// datagram to a destination, after udpResolveTTL and after an egress reload;
+// fresh reports whether it did.
+func (f *udpFlow) resolve(host string, port uint16) (addr *net.UDPAddr, fresh bool, err error) {
+	policy := currentSettings().egress
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	now := time.Now()
+	f.destMu.Lock()
+	defer f.destMu.Unlock()
+	if d, ok := f.dests[key]; ok && d.policy == policy && now.Before(d.expires) {
+		return d.addr, false, d.err
+	}
+	addr, err = policy.resolveUDP(host, port)
+	if len(f.dests) >= udpMaxDestsPerFlow {
+		clear(f.dests)
+	}
+	f.dests[key] = udpDest{addr: addr, err: err, policy: policy, expires: now.Add(udpResolveTTL)}
+	return addr, true, err
+}
+
+// readFlow relays replies from the flow socket back to the client.
+func (r *udpRelay) readFlow(flow *udpFlow) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := flow.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		flow.lastActive.Store(time.Now().UnixNano())
+		if flow.user.overQuota(flow.stats) {
+			continue
+		}
+
+		record, err := core.BuildUDPDatagramRecord(&core.UDPDatagram{
+			FlowID:  flow.id,
+			KeyID:   flow.keyID,
+			Host:    src.IP.String(),
+			Port:    uint16(src.Port),
+			Payload: buf[:n],
+		}, r.ng, flow.dc)
+		if err != nil {
+			log.Printf("[UDP] Flow %08x: build reply failed: %v", flow.id, err)
+			continue
+		}
+		r.send(flow, record)
+		flow.stats.countDatagram(false, n)
+	}
+}
+
+// send delivers a datagram record, falling back to the flow's relay stream when
+// the record does not fit in a QUIC datagram.
+func (r *udpRelay) send(flow *udpFlow, record []byte) {
+	err := r.session.SendDatagram(record[4:])
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return
+	}
+
+	flow.streamMu.Lock()
+	defer flow.streamMu.Unlock()
+	if flow.stream == nil {
+		log.Printf("[UDP] Flow %08x: dropping %d byte reply (no relay stream)", flow.id, len(record))
+		return
+	}
+	if _, err := flow.stream.Write(record); err != nil {
+		flow.stream = nil
+	}
+}
+
+// detachStream forgets a closed relay stream on every flow that used it.
+func (r *udpRelay) detachStream(stream *webtransport.Stream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, flow := range r.flows {
+		flow.streamMu.Lock()
+		if flow.stream == stream {
+			flow.stream = nil
+		}
+		flow.streamMu.Unlock()
+	}
+}
+
+// janitor closes flows idle for longer than udpFlowIdleTimeout.
+func (r *udpRelay) janitor() {
+	ticker := time.NewTicker(udpJanitorInterval)
+	defer ticker.Stop()
+	ctx := r.session.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.expireIdle(now)
+		}
+	}
+}
+
+// expireIdle closes the flows that saw no traffic for udpFlowIdleTimeout before now.
+func (r *udpRelay) expireIdle(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, flow := range r.flows {
+		if now.Sub(time.Unix(0, flow.lastActive.Load())) > udpFlowIdleTimeout {
+			flow.conn.Close()
+			delete(r.flows, id)
+			log.Printf("[UDP] Flow %08x expired", id)
+		}
+	}
+}
+
+func (r *udpRelay) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, flow := range r.flows {
+		flow.conn.Close()
+		delete(r.flows, id)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aether-rea/internal/core"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// startUDPEchoServer runs a UDP echo server on loopback and counts the
+// datagrams it received.
+func startUDPEchoServer(t *testing.T) (uint16, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var received atomic.Int32
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			received.Add(1)
+			_, _ = conn.WriteToUDP(buf[:n], src)
+		}
+	}()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port), &received
+}
+
+// udpClient sends and receives flow datagrams over a tunnel session.
+type udpClient struct {
+	sess *webtransport.Session
+	ng   *core.NonceGenerator
+	dc   *core.DataCipher
+}
+
+func newUDPClient(t *testing.T, sess *webtransport.Session, psk string) *udpClient {
+	t.Helper()
+	ng, err := core.NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := core.NewDataCipher(core.CipherAES128GCM, psk)
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	return &udpClient{sess: sess, ng: ng, dc: dc}
+}
+
+// send seals payload for port on loopback and returns the datagram sent.
+func (c *udpClient) send(t *testing.T, flowID uint32, port uint16, payload string) []byte {
+	t.Helper()
+	record, err := core.BuildUDPDatagramRecord(&core.UDPDatagram{FlowID: flowID, Host: "127.0.0.1", Port: port, Payload: []byte(payload)}, c.ng, c.dc)
+	if err != nil {
+		t.Fatalf("BuildUDPDatagramRecord: %v", err)
+	}
+	if err := c.sess.SendDatagram(record[4:]); err != nil {
+		t.Fatalf("SendDatagram: %v", err)
+	}
+	return record[4:]
+}
+
+// receive returns the next datagram relayed back, or nil after timeout.
+func (c *udpClient) receive(t *testing.T, timeout time.Duration) *core.UDPDatagram {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		b, err := c.sess.ReceiveDatagram(ctx)
+		if err != nil {
+			return nil
+		}
+		record, err := core.ParseDatagramRecord(b)
+		if err != nil || record.Type != core.TypeDatagram {
+			continue
+		}
+		d, err := core.OpenUDPDatagram(record, c.dc)
+		if err != nil {
+			t.Fatalf("OpenUDPDatagram: %v", err)
+		}
+		return d
+	}
+}
+
+func TestUDPRelay(t *testing.T) {
+	useLoopbackEgress(t)
+	allowed, allowedCount := startUDPEchoServer(t)
+	denied, deniedCount := startUDPEchoServer(t)
+	users, err := newUserTable("", testPSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	g := startTestGateway(t, users)
+	c := newUDPClient(t, g.dial(t), testPSK)
+	gs := g.accepted(t)
+
+	// The first datagram sets up the flow and the reply comes back on it.
+	c.send(t, 7, allowed, "ping")
+	d := c.receive(t, 5*time.Second)
+	if d == nil {
+		t.Fatal("no reply on a new flow")
+	}
+	if d.FlowID != 7 || d.Host != "127.0.0.1" || d.Port != allowed || string(d.Payload) != "ping" {
+		t.Fatalf("reply: %+v", d)
+	}
+	gs.relay.mu.Lock()
+	flows := len(gs.relay.flows)
+	gs.relay.mu.Unlock()
+	if flows != 1 {
+		t.Fatalf("flows after the first datagram: %d", flows)
+	}
+
+	// The egress policy applies to each destination of a flow, not only to
+	// the one that opened it.
+	egress, err := compileEgress(&egressConfig{AllowPrivate: true, DenyPorts: []string{strconv.Itoa(int(denied))}})
+	if err != nil {
+		t.Fatalf("compileEgress: %v", err)
+	}
+	s := *currentSettings()
+	s.egress = egress
+	useSettings(t, &s)
+	c.send(t, 7, denied, "blocked")
+	if d := c.receive(t, 300*time.Millisecond); d != nil {
+		t.Fatalf("reply from a denied destination: %+v", d)
+	}
+	if n := deniedCount.Load(); n != 0 {
+		t.Fatalf("denied destination received %d datagrams", n)
+	}
+	replay := c.send(t, 7, allowed, "again")
+	if d := c.receive(t, 5*time.Second); d == nil || string(d.Payload) != "again" {
+		t.Fatalf("allowed destination after a denial: %+v", d)
+	}
+
+	// A datagram sent twice reaches its destination once.
+	if err := c.sess.SendDatagram(replay); err != nil {
+		t.Fatalf("SendDatagram: %v", err)
+	}
+	if d := c.receive(t, 300*time.Millisecond); d != nil {
+		t.Fatalf("replayed datagram was relayed: %+v", d)
+	}
+	if n := allowedCount.Load(); n != 2 {
+		t.Errorf("destination received %d datagrams, want 2", n)
+	}
+}
+
+func TestUDPRelayIdleFlows(t *testing.T) {
+	useLoopbackEgress(t)
+	port, _ := startUDPEchoServer(t)
+	users, err := newUserTable("", testPSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	g := startTestGateway(t, users)
+	c := newUDPClient(t, g.dial(t), testPSK)
+	gs := g.accepted(t)
+
+	c.send(t, 1, port, "one")
+	if c.receive(t, 5*time.Second) == nil {
+		t.Fatal("no reply")
+	}
+	gs.relay.mu.Lock()
+	flow := gs.relay.flows[1]
+	gs.relay.mu.Unlock()
+	if flow == nil {
+		t.Fatal("flow not set up")
+	}
+
+	// A flow that just saw traffic stays.
+	gs.relay.expireIdle(time.Now())
+	gs.relay.mu.Lock()
+	_, ok := gs.relay.flows[1]
+	gs.relay.mu.Unlock()
+	if !ok {
+		t.Fatal("active flow expired")
+	}
+
+	gs.relay.expireIdle(time.Now().Add(udpFlowIdleTimeout + time.Second))
+	gs.relay.mu.Lock()
+	_, ok = gs.relay.flows[1]
+	gs.relay.mu.Unlock()
+	if ok {
+		t.Fatal("idle flow not expired")
+	}
+	if _, err := flow.conn.WriteToUDP([]byte("x"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}); err == nil {
+		t.Error("socket of an expired flow still open")
+	}
+
+	// The next datagram of the flow starts it over.
+	c.send(t, 1, port, "two")
+	if d := c.receive(t, 5*time.Second); d == nil || string(d.Payload) != "two" {
+		t.Fatalf("reply after expiry: %+v", d)
+	}
+}
+
+func TestUDPRelayHandshakeFailures(t *testing.T) {
+	useLoopbackEgress(t)
+	port, received := startUDPEchoServer(t)
+	users, err := newUserTable("", testPSK, nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	g := startTestGateway(t, users)
+
+	// A datagram that does not authenticate counts like a failed stream handshake.
+	before := gwMetrics.handshakeFailures[failDecrypt].Load()
+	c := newUDPClient(t, g.dial(t), "wrong-psk")
+	c.send(t, 1, port, "forged")
+	waitFor(t, 5*time.Second, "the decrypt failure", func() bool {
+		return gwMetrics.handshakeFailures[failDecrypt].Load() > before
+	})
+	if received.Load() != 0 {
+		t.Fatal("forged datagram reached its destination")
+	}
+
+	// And bans the IP before any user authenticated on the session.
+	limits, err := compileConnLimits(&connLimitsConfig{BanAfter: 1, BanWindow: "1m", BanDuration: "1m"})
+	if err != nil {
+		t.Fatalf("compileConnLimits: %v", err)
+	}
+	s := *currentSettings()
+	s.connLimits = limits
+	useSettings(t, &s)
+	t.Cleanup(func() { guard.unban("127.0.0.1") })
+	sess := g.dial(t)
+	c = newUDPClient(t, sess, "wrong-psk")
+	c.send(t, 1, port, "forged")
+	select {
+	case <-sess.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after the ban")
+	}
+	if bans := guard.listBans(); len(bans) != 1 || bans[0].ip != "127.0.0.1" || bans[0].reason != failDecrypt {
+		t.Errorf("bans: %+v", bans)
+	}
+}
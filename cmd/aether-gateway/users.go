@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aether-rea/internal/core"
+)
+
+// defaultUserID names the user backed by the legacy -psk flag.
+// It is selected by records that carry no key ID.
+const defaultUserID = "default"
+
+var (
+	errUnknownKeyID = errors.New("unknown key ID")
+	errUserDisabled = errors.New("user disabled")
+	errUserExpired  = errors.New("user expired")
+)
+
+// gatewayUser is one entry of the users file.
+type gatewayUser struct {
+	ID        string     `json:"id"`
+	KeyID     string     `json:"key_id,omitempty"` // Clear identifier sent by the client; defaults to ID
+	PSK       string     `json:"psk"`
+	Enabled   *bool      `json:"enabled,omitempty"` // Defaults to true
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// ReversePorts lists the gateway ports the user may expose as reverse tunnels,
+	// e.g. ["8080", "9000-9010"]. Empty denies reverse tunnels.
+	ReversePorts []string    `json:"reverse_ports,omitempty"`
+	reverse      []portRange // parsed ReversePorts
+
+	// Limits shared by all of the user's sessions; zero means unlimited.
+	UpMbps         float64 `json:"up_mbps,omitempty"`          // client -> target
+	DownMbps       float64 `json:"down_mbps,omitempty"`        // target -> client
+	MaxStreams     int     `json:"max_streams,omitempty"`      // Concurrent TCP streams, mux sub-streams included
+	MonthlyQuotaGB float64 `json:"monthly_quota_gb,omitempty"` // Up plus down per calendar month (UTC), 10^9 bytes
+}
+
+// portRange is an inclusive range of TCP ports.
+type portRange struct {
+	lo, hi uint16
+}
+
+// parsePortRanges parses entries like "8080" or "9000-9010".
+func parsePortRanges(entries []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, errLo := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		h, errHi := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if errLo != nil || errHi != nil || l == 0 || l > h {
+			return nil, fmt.Errorf("invalid port range %q", entry)
+		}
+		ranges = append(ranges, portRange{lo: uint16(l), hi: uint16(h)})
+	}
+	return ranges, nil
+}
+
+// allowsReversePort reports whether the user may listen on port for a reverse tunnel.
+func (u *gatewayUser) allowsReversePort(port uint16) bool {
+	for _, r := range u.reverse {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// usersFile is the on-disk format of -users.
+type usersFile struct {
+	Users []*gatewayUser `json:"users"`
+}
+
+// userStats are per-user counters kept across reloads.
+type userStats struct {
+	streams       atomic.Uint64
+	activeStreams atomic.Int64
+	rejected      atomic.Uint64
+	bytesUp       atomic.Uint64 // client -> target
+	bytesDown     atomic.Uint64 // target -> client
+	datagrams     atomic.Uint64
+	rekeys        atomic.Uint64
+	replays       atomic.Uint64 // records rejected by the replay filter
+
+	monthUp, monthDown   atomic.Uint64 // bytes in the current quota period
+	upBucket, downBucket tokenBucket
+}
+
+// userTable maps key IDs to users. It is loaded from -users (and inline users
+// of the config file) and reloaded on SIGHUP.
+type userTable struct {
+	reloadMu  sync.Mutex // serializes reloads and guards the sources below
+	path      string
+	legacyPSK string
+	// legacyReverse is the reverse-tunnel allowlist of the legacy -psk user.
+	legacyReverse []string
+	inline        []*gatewayUser
+
+	mu      sync.RWMutex
+	byKeyID map[string]*gatewayUser
+
+	statsMu sync.Mutex
+	stats   map[string]*userStats
+
+	// replay is shared by every session so a captured record cannot be replayed on a new stream.
+	replay *core.ReplayFilter
+
+	usageMu   sync.Mutex // serializes usage saves
+	usagePath string
+	period    string // quota period of the month counters, see usagePeriod
+}
+
+// newUserTable builds the table from the users file, inline users and the
+// legacy PSK (each optional, at least one required).
+func newUserTable(path, legacyPSK string, legacyReverse []string, inline []*gatewayUser) (*userTable, error) {
+	t := &userTable{
+		path:          path,
+		legacyPSK:     legacyPSK,
+		legacyReverse: legacyReverse,
+		inline:        inline,
+		stats:         make(map[string]*userStats),
+		replay:        core.NewReplayFilter(core.DefaultReplayWindow, core.DefaultReplaySessions),
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// configure switches the table to new sources. On error the previous sources
+// and table stay active.
+func (t *userTable) configure(path, legacyPSK string, legacyReverse []string, inline []*gatewayUser) error {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+	byKeyID, err := loadUsers(path, legacyPSK, legacyReverse, inline)
+	if err != nil {
+		return err
+	}
+	t.path, t.legacyPSK, t.legacyReverse, t.inline = path, legacyPSK, legacyReverse, inline
+	t.install(byKeyID)
+	return nil
+}
+
+// reload re-reads the users file. On error the previous table stays active.
+func (t *userTable) reload() error {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+	byKeyID, err := loadUsers(t.path, t.legacyPSK, t.legacyReverse, t.inline)
+	if err != nil {
+		return err
+	}
+	t.install(byKeyID)
+	return nil
+}
+
+// loadUsers builds the key ID map from the legacy PSK, inline users and the users file.
+func loadUsers(path, legacyPSK string, legacyReverse []string, inline []*gatewayUser) (map[string]*gatewayUser, error) {
+	byKeyID := make(map[string]*gatewayUser)
+	if legacyPSK != "" {
+		reverse, err := parsePortRanges(legacyReverse)
+		if err != nil {
+			return nil, fmt.Errorf("reverse ports: %w", err)
+		}
+		byKeyID[""] = &gatewayUser{ID: defaultUserID, PSK: legacyPSK, ReversePorts: legacyReverse, reverse: reverse}
+	}
+
+	users := inline
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read users file: %w", err)
+		}
+		var file usersFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parse users file: %w", err)
+		}
+		users = append(append([]*gatewayUser(nil), inline...), file.Users...)
+	}
+
+	seenIDs := make(map[string]bool)
+	for i, u := range users {
+		if u == nil || strings.TrimSpace(u.ID) == "" {
+			return nil, fmt.Errorf("users[%d]: missing id", i)
+		}
+		// Normalize a copy: the sources are kept for later reloads.
+		c := *u
+		u = &c
+		u.ID = strings.TrimSpace(u.ID)
+		u.PSK = strings.TrimSpace(u.PSK)
+		if u.KeyID == "" {
+			u.KeyID = u.ID
+		}
+		if u.PSK == "" {
+			return nil, fmt.Errorf("user %s: missing psk", u.ID)
+		}
+		if len(u.KeyID) > core.MaxKeyIDLength {
+			return nil, fmt.Errorf("user %s: key_id longer than %d bytes", u.ID, core.MaxKeyIDLength)
+		}
+		if seenIDs[u.ID] || (u.ID == defaultUserID && legacyPSK != "") {
+			return nil, fmt.Errorf("user %s: duplicate id", u.ID)
+		}
+		if _, dup := byKeyID[u.KeyID]; dup {
+			return nil, fmt.Errorf("user %s: duplicate key_id %q", u.ID, u.KeyID)
+		}
+		reverse, err := parsePortRanges(u.ReversePorts)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: reverse_ports: %w", u.ID, err)
+		}
+		u.reverse = reverse
+		if err := u.validateLimits(); err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.ID, err)
+		}
+		seenIDs[u.ID] = true
+		byKeyID[u.KeyID] = u
+	}
+
+	if len(byKeyID) == 0 {
+		return nil, errors.New("no users configured (set -psk or -users)")
+	}
+	return byKeyID, nil
+}
+
+// install makes byKeyID the active table.
+func (t *userTable) install(byKeyID map[string]*gatewayUser) {
+	t.mu.Lock()
+	t.byKeyID = byKeyID
+	t.mu.Unlock()
+
+	enabled := 0
+	now := time.Now()
+	for _, u := range byKeyID {
+		if u.usable(now) == nil {
+			enabled++
+		}
+	}
+	log.Printf("Config: %d users loaded (%d usable)", len(byKeyID), enabled)
+}
+
+// usable reports why a user may not authenticate right now, or nil.
+func (u *gatewayUser) usable(now time.Time) error {
+	if u.Enabled != nil && !*u.Enabled {
+		return errUserDisabled
+	}
+	if u.ExpiresAt != nil && now.After(*u.ExpiresAt) {
+		return errUserExpired
+	}
+	return nil
+}
+
+// authenticate returns the user for keyID if it exists, is enabled and has not expired.
+func (t *userTable) authenticate(keyID string) (*gatewayUser, error) {
+	t.mu.RLock()
+	u, ok := t.byKeyID[keyID]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, errUnknownKeyID
+	}
+	if err := u.usable(time.Now()); err != nil {
+		t.statsFor(u.ID).rejected.Add(1)
+		return nil, err
+	}
+	return u, nil
+}
+
+// pskFor is the key lookup used for datagram records.
+func (t *userTable) pskFor(keyID string) (string, error) {
+	u, err := t.authenticate(keyID)
+	if err != nil {
+		return "", err
+	}
+	return u.PSK, nil
+}
+
+// statsFor returns the counters for a user ID, creating them on first use.
+func (t *userTable) statsFor(id string) *userStats {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	s, ok := t.stats[id]
+	if !ok {
+		s = &userStats{}
+		t.stats[id] = s
+	}
+	return s
+}
+
+// statIDs returns the sorted IDs of every user that has counters.
+func (t *userTable) statIDs() []string {
+	t.statsMu.Lock()
+	ids := make([]string, 0, len(t.stats))
+	for id := range t.stats {
+		ids = append(ids, id)
+	}
+	t.statsMu.Unlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// logStats writes one [USER] line per user that has seen traffic.
+func (t *userTable) logStats() {
+	for _, id := range t.statIDs() {
+		s := t.statsFor(id)
+		log.Printf("[USER] user=%s streams=%d active=%d rejected=%d up_bytes=%d down_bytes=%d month_bytes=%d datagrams=%d rekeys=%d replays=%d",
+			id, s.streams.Load(), s.activeStreams.Load(), s.rejected.Load(),
+			s.bytesUp.Load(), s.bytesDown.Load(), s.monthBytes(), s.datagrams.Load(), s.rekeys.Load(), s.replays.Load())
+	}
+	log.Printf("[SECURITY] Replay filter: rejected=%d tracked_sessions=%d", t.replay.Rejected(), t.replay.Len())
+}
+
+// reportStats logs per-user counters every interval.
+func (t *userTable) reportStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.logStats()
+	}
+}
+
+func (t *userTable) listenForSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		log.Println("[INFO] Received SIGHUP, reloading users...")
+		if err := t.reload(); err != nil {
+			log.Printf("[ERROR] Failed to reload users: %v", err)
+		}
+		t.logStats()
+	}
+}
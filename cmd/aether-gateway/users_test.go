@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"aether-rea/internal/core"
+)
+
+// writeTestFile writes content to name in a fresh temporary directory.
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+const testUsersFile = `{"users": [
+  {"id": "alice", "psk": " alice-psk "},
+  {"id": "bob", "key_id": "b0b", "psk": "bob-psk"},
+  {"id": "carol", "psk": "carol-psk", "enabled": false},
+  {"id": "dave", "psk": "dave-psk", "expires_at": "2000-01-01T00:00:00Z"}
+]}`
+
+func TestUserTableAuthenticate(t *testing.T) {
+	users, err := newUserTable(writeTestFile(t, "users.json", testUsersFile), "legacy-psk", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	tests := []struct {
+		keyID   string
+		wantID  string
+		wantPSK string
+		wantErr error
+	}{
+		{"alice", "alice", "alice-psk", nil},
+		{"b0b", "bob", "bob-psk", nil},
+		{"bob", "", "", errUnknownKeyID},
+		{"carol", "", "", errUserDisabled},
+		{"dave", "", "", errUserExpired},
+		{"", defaultUserID, "legacy-psk", nil},
+	}
+	for _, tt := range tests {
+		u, err := users.authenticate(tt.keyID)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("authenticate(%q): got %v, want %v", tt.keyID, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (u.ID != tt.wantID || u.PSK != tt.wantPSK) {
+			t.Errorf("authenticate(%q): got %s/%s, want %s/%s", tt.keyID, u.ID, u.PSK, tt.wantID, tt.wantPSK)
+		}
+	}
+	if psk, err := users.pskFor("b0b"); err != nil || psk != "bob-psk" {
+		t.Errorf("pskFor(b0b): got %q, %v", psk, err)
+	}
+	if got := users.statsFor("carol").rejected.Load(); got != 1 {
+		t.Errorf("carol rejected = %d, want 1", got)
+	}
+
+	// Without a users file only the legacy PSK exists.
+	legacy, err := newUserTable("", "legacy-psk", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	if _, err := legacy.authenticate("alice"); !errors.Is(err, errUnknownKeyID) {
+		t.Errorf("legacy only, authenticate(alice): got %v", err)
+	}
+}
+
+func TestUserTableErrors(t *testing.T) {
+	long := strings.Repeat("k", core.MaxKeyIDLength+1)
+	tests := []struct {
+		name    string
+		content string
+		legacy  string
+	}{
+		{"malformed", `{"users": [`, ""},
+		{"missing id", `{"users": [{"psk": "x"}]}`, ""},
+		{"missing psk", `{"users": [{"id": "alice"}]}`, ""},
+		{"duplicate id", `{"users": [{"id": "alice", "psk": "x"}, {"id": "alice", "key_id": "a2", "psk": "y"}]}`, ""},
+		{"duplicate key_id", `{"users": [{"id": "alice", "psk": "x"}, {"id": "bob", "key_id": "alice", "psk": "y"}]}`, ""},
+		{"key_id too long", `{"users": [{"id": "alice", "key_id": "` + long + `", "psk": "x"}]}`, ""},
+		{"default id next to the legacy psk", `{"users": [{"id": "default", "psk": "x"}]}`, "legacy-psk"},
+		{"no users", `{"users": []}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newUserTable(writeTestFile(t, "users.json", tt.content), tt.legacy, nil, nil); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := newUserTable("", "", nil, nil); err == nil {
+		t.Error("no psk and no users file: expected an error")
+	}
+}
+
+func TestUserTableReload(t *testing.T) {
+	path := writeTestFile(t, "users.json", testUsersFile)
+	users, err := newUserTable(path, "", nil, nil)
+	if err != nil {
+		t.Fatalf("newUserTable: %v", err)
+	}
+	alice := users.statsFor("alice")
+	alice.bytesUp.Add(100)
+
+	// What SIGHUP runs: alice gets a new key, bob is removed.
+	if err := os.WriteFile(path, []byte(`{"users": [{"id": "alice", "psk": "rotated"}]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := users.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if psk, err := users.pskFor("alice"); err != nil || psk != "rotated" {
+		t.Errorf("alice after reload: got %q, %v", psk, err)
+	}
+	if _, err := users.authenticate("b0b"); !errors.Is(err, errUnknownKeyID) {
+		t.Errorf("removed user: got %v", err)
+	}
+	if s := users.statsFor("alice"); s != alice || s.bytesUp.Load() != 100 {
+		t.Error("reload lost the stats of an unchanged user")
+	}
+
+	// A broken file keeps the previous table.
+	if err := os.WriteFile(path, []byte(`{"users": [{"id": "alice"}]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := users.reload(); err == nil {
+		t.Fatal("reload of a broken file: expected an error")
+	}
+	if psk, err := users.pskFor("alice"); err != nil || psk != "rotated" {
+		t.Errorf("alice after a failed reload: got %q, %v", psk, err)
+	}
+}
@@ -69,6 +69,11 @@ export const translations = {
             label_socks_port: 'SOCKS5 Listen Addr',
             label_http_port: 'HTTP Listen Addr',
             label_padding: 'Max Padding (bytes)',
+            label_padding_profile: 'Padding Profile',
+            padding_off: 'Off',
+            padding_light: 'Light (Random)',
+            padding_bucket: 'Uniform Buckets',
+            padding_video: 'Mimic Video',
             label_perf_capture_enabled: 'Enable PERF Log Capture',
             label_perf_capture_on_connect: 'Capture Only When Connected',
             label_perf_log_path: 'PERF Log File Path',
@@ -182,6 +187,11 @@ export const translations = {
             label_socks_port: 'SOCKS5 监听地址',
             label_http_port: 'HTTP 监听地址',
             label_padding: '最大填充 (bytes)',
+            label_padding_profile: '填充 Profile',
+            padding_off: '关闭',
+            padding_light: '轻量 (随机)',
+            padding_bucket: '均匀分档',
+            padding_video: '模拟视频',
             label_perf_capture_enabled: '启用 PERF 日志采集',
             label_perf_capture_on_connect: '仅连接时采集',
             label_perf_log_path: 'PERF 日志文件路径',
@@ -31,6 +31,7 @@ const eventTypeLabels: Record<string, Record<string, string>> = {
     'core.stateChanged': 'State Change',
     'session.established': 'Session Est.',
     'session.rotating': 'Rotating',
+    'session.rekeyed': 'Rekeyed',
     'session.closed': 'Session Closed',
     'stream.opened': 'Stream Opened',
     'stream.closed': 'Stream Closed',
@@ -42,6 +43,7 @@ const eventTypeLabels: Record<string, Record<string, string>> = {
     'core.stateChanged': '状态变更',
     'session.established': '会话建立',
     'session.rotating': '会话轮换',
+    'session.rekeyed': '会话换钥',
     'session.closed': '会话关闭',
     'stream.opened': '连接建立',
     'stream.closed': '连接关闭',
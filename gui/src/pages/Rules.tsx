@@ -226,6 +226,30 @@ export default function Rules() {
                 sx={{ maxWidth: 200 }}
               />
 
+              <Box>
+                <Typography variant="subtitle2" sx={{ mb: 1, color: 'text.secondary' }}>
+                  {t.rules.label_padding_profile}
+                </Typography>
+                <Box sx={{ display: 'flex', gap: 1 }}>
+                  {[
+                    { id: 'off', label: t.rules.padding_off },
+                    { id: 'light', label: t.rules.padding_light },
+                    { id: 'uniform-bucket', label: t.rules.padding_bucket },
+                    { id: 'mimic-video', label: t.rules.padding_video },
+                  ].map((p) => (
+                    <Button
+                      key={p.id}
+                      variant={editingConfig.padding_profile === p.id || (!editingConfig.padding_profile && p.id === 'off') ? 'contained' : 'outlined'}
+                      size="small"
+                      onClick={() => updateEditingConfig({ padding_profile: p.id as any })}
+                      sx={{ textTransform: 'none', borderRadius: 2 }}
+                    >
+                      {p.label}
+                    </Button>
+                  ))}
+                </Box>
+              </Box>
+
               <TextField
                 label="Record Payload Bytes"
                 type="number"
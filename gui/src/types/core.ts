@@ -13,6 +13,7 @@ export type CoreEventType =
   | 'core.stateChanged'
   | 'session.established'
   | 'session.rotating'
+  | 'session.rekeyed'
   | 'session.closed'
   | 'stream.opened'
   | 'stream.closed'
@@ -45,6 +46,14 @@ export interface SessionRotatingEvent extends CoreEvent {
   oldSessionId: string;
 }
 
+export interface SessionRekeyedEvent extends CoreEvent {
+  type: 'session.rekeyed';
+  sessionId: string;
+  epoch: number;
+  wireId: string;
+  peerWireId: string;
+}
+
 export interface SessionClosedEvent extends CoreEvent {
   type: 'session.closed';
   sessionId: string;
@@ -83,6 +92,12 @@ export interface MetricsSnapshotEvent extends CoreEvent {
   bytesSent: number;
   bytesReceived: number;
   latencyMs?: number;
+  rekeys: number;
+  ttfbMs?: number;
+  earlyTtfbMs?: number;
+  srttMs?: number;
+  jitterMs?: number;
+  probeLossPct?: number;
 }
 
 export interface RotationScheduledEvent extends CoreEvent {
@@ -103,6 +118,7 @@ export type AnyCoreEvent =
   | StateChangedEvent
   | SessionEstablishedEvent
   | SessionRotatingEvent
+  | SessionRekeyedEvent
   | SessionClosedEvent
   | StreamOpenedEvent
   | StreamClosedEvent
@@ -130,6 +146,7 @@ export interface CoreConfig {
   http_proxy_addr: string;
   dial_addr?: string;
   max_padding: number;
+  padding_profile?: 'off' | 'light' | 'uniform-bucket' | 'mimic-video';
   record_payload_bytes?: number;
   allow_insecure?: boolean;
   session_pool_min?: number;
@@ -147,6 +164,22 @@ export interface CoreConfig {
   block_ads?: boolean;
   window_profile?: 'conservative' | 'normal' | 'aggressive';
   rules?: Rule[];
+  reverse_bindings?: ReverseBinding[];
+  dns?: DNSConfig;
+}
+
+export interface DNSConfig {
+  listen_addr: string;
+  remote_server?: string;
+  direct_server?: string;
+  rules?: Rule[];
+  cache_size?: number;
+}
+
+export interface ReverseBinding {
+  name: string;
+  remote_port: number;
+  local_addr: string;
 }
 
 export interface Rule {
@@ -4,6 +4,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -70,6 +71,7 @@ func (s *Server) Start() error {
 	mux.HandleFunc("/api/v1/rules", s.handleRules)
 	mux.HandleFunc("/api/v1/streams", s.handleStreams)
 	mux.HandleFunc("/api/v1/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/v1/reverse", s.handleReverse)
 	mux.HandleFunc("/api/v1/control/start", s.handleStart)
 	mux.HandleFunc("/api/v1/control/stop", s.handleStop)
 	mux.HandleFunc("/api/v1/control/rotate", s.handleRotate)
@@ -247,6 +249,48 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(metrics)
 }
 
+// handleReverse lists, adds and removes reverse tunnel bindings
+func (s *Server) handleReverse(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.core.GetReverseBindings())
+
+	case http.MethodPost:
+		var binding core.ReverseBinding
+		if err := json.NewDecoder(r.Body).Decode(&binding); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.core.AddReverseBinding(binding); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, core.ErrReverseBindingExists) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "added"})
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		if err := s.core.RemoveReverseBinding(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // handleStart starts the Core
 func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
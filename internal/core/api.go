@@ -20,10 +20,15 @@ type SessionConfig struct {
 	ServerPort     int            `json:"server_port"`        // Port (1-65535)
 	ServerPath     string         `json:"server_path"`        // e.g. /aether
 	PSK            string         `json:"psk"`                // Pre-shared key
+	KeyID          string         `json:"key_id,omitempty"`   // Names the PSK on multi-user gateways
 	ListenAddr     string         `json:"listen_addr"`         // SOCKS5 listen address
 	HttpProxyAddr  string         `json:"http_proxy_addr"`      // HTTP proxy listen address
 	DialAddr       string         `json:"dial_addr,omitempty"` // Override dial address (optional)
 	MaxPadding     int            `json:"max_padding,omitempty"` // 0-65535, default 0
+	DataCipher     string         `json:"data_cipher,omitempty"` // "", "none", "aes-128-gcm", "chacha20-poly1305"
+	Mux            bool           `json:"mux,omitempty"`         // Carry TCP flows as sub-streams of one WebTransport stream
+	EarlyData      bool           `json:"early_data,omitempty"`  // Send the first write together with the metadata
+	PaddingProfile string         `json:"padding_profile,omitempty"` // "off", "light", "uniform-bucket", "mimic-video"
 	RecordPayloadBytes int        `json:"record_payload_bytes,omitempty"` // data record payload size in bytes
 	AllowInsecure  bool           `json:"allow_insecure"`        // Skip TLS verification
 	SessionPoolMin int            `json:"session_pool_min,omitempty"` // Pre-warmed WT sessions
@@ -37,6 +42,10 @@ type SessionConfig struct {
 	WindowProfile  string         `json:"window_profile,omitempty"` // conservative, normal, aggressive
 	
 	Rules []*Rule `json:"rules,omitempty"` // Custom routing rules
+
+	ReverseBindings []*ReverseBinding `json:"reverse_bindings,omitempty"` // Gateway ports forwarded to local services
+
+	DNS *DNSConfig `json:"dns,omitempty"` // Local DNS server with split-DNS rules (optional)
 }
 
 // TargetAddress represents a destination host:port.
@@ -96,12 +105,14 @@ type Core struct {
 	sessionPool  []*sessionManager
 	socksServer  *socks5Server
 	httpProxyServer *HttpProxyServer
+	dnsServer    *dnsServer
 	metrics      *Metrics
 	metricsCollector *MetricsCollector
 	streams      map[string]*StreamInfo
 	activeStreams map[string]io.ReadWriteCloser
 	systemProxyEnabled bool
 	ruleEngine   *RuleEngine
+	reverse      *reverseManager
 	eventBus     chan Event
 	ctx          context.Context
 	cancel       context.CancelFunc
@@ -316,7 +327,9 @@ func (c *Core) UpdateConfig(config SessionConfig) error {
 	var oldListenAddr, oldHttpAddr string
 	var oldServerAddr, oldServerPath, oldPSK string
 	var oldServerPort int
+	var oldDNSAddr string
 	if c.config != nil {
+		oldDNSAddr = dnsListenAddr(c.config.DNS)
 		oldListenAddr = c.config.ListenAddr
 		oldHttpAddr = c.config.HttpProxyAddr
 		oldServerAddr = c.config.ServerAddr
@@ -362,6 +375,13 @@ func (c *Core) UpdateConfig(config SessionConfig) error {
 	if oldServerAddr != config.ServerAddr || oldServerPort != config.ServerPort || oldServerPath != config.ServerPath || oldPSK != config.PSK {
 		addressChanged = true
 	}
+	if oldDNSAddr != dnsListenAddr(config.DNS) {
+		addressChanged = true
+	} else if c.dnsServer != nil {
+		if err := c.dnsServer.update(config.DNS); err != nil {
+			log.Printf("[ERROR] Failed to update DNS server: %v", err)
+		}
+	}
 	needsProxyRefresh := c.systemProxyEnabled && oldHttpAddr != config.HttpProxyAddr
 	rules := config.Rules
 	c.mu.Unlock()
@@ -610,9 +630,11 @@ func (c *Core) initialize() error {
 	if poolMin > 8 {
 		poolMin = 8
 	}
+	c.reverse = newReverseManager(c)
 	c.sessionPool = make([]*sessionManager, 0, poolMin)
 	for i := 0; i < poolMin; i++ {
 		sm := newSessionManager(c.config, c.emit, c.metrics)
+		sm.reverse = c.reverse
 		if err := sm.initialize(); err != nil {
 			return err
 		}
@@ -640,6 +662,18 @@ func (c *Core) initialize() error {
 		}
 	}
 
+	if dns := c.config.DNS; dns != nil && dns.ListenAddr != "" {
+		log.Printf("[DEBUG] Starting DNS server on %s", dns.ListenAddr)
+		server, err := newDNSServer(dns, c)
+		if err != nil {
+			return err
+		}
+		if err := server.start(); err != nil {
+			return err
+		}
+		c.dnsServer = server
+	}
+
 	// Connect to upstream (if configured)
 	if c.config.ServerAddr != "" {
 		log.Printf("[DEBUG] Connecting to upstream: %s:%d%s", c.config.ServerAddr, c.config.ServerPort, c.config.ServerPath)
@@ -661,6 +695,16 @@ func (c *Core) initialize() error {
 		c.mu.Lock() // Re-lock for the rest of initialize
 	}
 
+	for _, b := range c.config.ReverseBindings {
+		if err := b.Validate(); err != nil {
+			log.Printf("[WARN] Skipping reverse binding: %v", err)
+			continue
+		}
+		if err := c.reverse.add(*b); err != nil {
+			log.Printf("[WARN] Skipping reverse binding %s: %v", b.Name, err)
+		}
+	}
+
 	log.Printf("[DEBUG] initialize finished")
 	return nil
 }
@@ -680,12 +724,20 @@ func (c *Core) cleanup() {
 		c.metricsCollector.Stop()
 	}
 
+	if c.reverse != nil {
+		c.reverse.stop()
+		c.reverse = nil
+	}
 	if c.socksServer != nil {
 		c.socksServer.stop()
 	}
 	if c.httpProxyServer != nil {
 		c.httpProxyServer.Stop()
 	}
+	if c.dnsServer != nil {
+		c.dnsServer.stop()
+		c.dnsServer = nil
+	}
 	if len(c.sessionPool) > 0 {
 		for _, sm := range c.sessionPool {
 			if sm != nil {
@@ -735,11 +787,6 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 	if sm == nil {
 		return StreamHandle{}, fmt.Errorf("no available session manager")
 	}
-	stream, streamID, err := sm.OpenStream(c.ctx)
-	if err != nil {
-		log.Printf("[DEBUG] Open stream to %s:%d failed: %v", target.Host, target.Port, err)
-		return StreamHandle{}, err
-	}
 
 	// Handshake metadata
 	maxPadding := uint16(c.config.MaxPadding)
@@ -747,22 +794,58 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 		maxPadding = uint16(v)
 	}
 
-	metaRecord, err := BuildMetadataRecord(target.Host, uint16(target.Port), maxPadding, c.config.PSK, sm.nonceGen)
+	cipherName := c.config.DataCipher
+	if v, ok := options["dataCipher"].(string); ok {
+		cipherName = v
+	}
+	cipherSuite, err := ParseDataCipher(cipherName)
 	if err != nil {
-		stream.Close()
 		return StreamHandle{}, err
 	}
 
-	if _, err := stream.Write(metaRecord); err != nil {
-		stream.Close()
+	profileName := c.config.PaddingProfile
+	if v, ok := options["paddingProfile"].(string); ok {
+		profileName = v
+	}
+	profile, err := ParsePaddingProfile(profileName)
+	if err != nil {
 		return StreamHandle{}, err
 	}
 
-	// Wrap the stream in a RecordReadWriter to handle data-phase encapsulation
-	// V5: Pass NonceGenerator for counter-based nonce
-	wrappedStream := NewRecordReadWriter(stream, maxPadding, sm.nonceGen)
+	useMux := c.config.Mux
+	if v, ok := options["mux"].(bool); ok {
+		useMux = v
+	}
+	// Early data rides on the metadata write of a native stream.
+	earlyData, _ := options["earlyData"].([]byte)
+	if len(earlyData) > 0 {
+		useMux = false
+	}
+
+	var conn io.ReadWriteCloser
+	var id string
+	if useMux && sm.peerHas(FeatureMux) {
+		sub, err := sm.openMuxStream(target, cipherSuite)
+		if err == nil {
+			conn = sub
+			id = fmt.Sprintf("str-m%d-%d", sub.ID(), time.Now().UnixNano())
+		} else if remote, ok := AsRemoteError(err); ok && remote.Code != CodeResourceLimit {
+			log.Printf("[DEBUG] Connect to %s:%d failed: %v", target.Host, target.Port, err)
+			return StreamHandle{}, err
+		} else {
+			log.Printf("[DEBUG] Mux stream to %s:%d unavailable, using a native stream: %v", target.Host, target.Port, err)
+		}
+	}
+	if conn == nil {
+		opts := Options{MaxPadding: maxPadding, DataCipher: cipherSuite, PaddingProfile: profile}
+		stream, streamID, err := c.openNativeStream(sm, target, opts, earlyData)
+		if err != nil {
+			return StreamHandle{}, err
+		}
+		conn = stream
+		id = fmt.Sprintf("str-%d-%d", streamID, time.Now().UnixNano())
+	}
 
-	id := fmt.Sprintf("str-%d-%d", streamID, time.Now().UnixNano())
 	handle := StreamHandle{ID: id}
 
 	info := &StreamInfo{
@@ -775,7 +858,7 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 
 	c.mu.Lock()
 	c.streams[id] = info
-	c.activeStreams[id] = wrappedStream
+	c.activeStreams[id] = conn
 	c.mu.Unlock()
 
 	if c.metrics != nil {
@@ -787,6 +870,100 @@ func (c *Core) openStreamInternal(target TargetAddress, options map[string]inter
 	return handle, nil
 }
 
+// openNativeStream opens a dedicated WebTransport stream to target and completes
+// the metadata handshake. earlyData, if any, is sent in the same write as the
+// metadata and the connect ack is left to the first Read.
+func (c *Core) openNativeStream(sm *sessionManager, target TargetAddress, opts Options, earlyData []byte) (*RecordReadWriter, uint64, error) {
+	stream, streamID, err := sm.OpenStream(c.ctx)
+	if err != nil {
+		log.Printf("[DEBUG] Open stream to %s:%d failed: %v", target.Host, target.Port, err)
+		return nil, 0, err
+	}
+
+	// Records are sealed only once the gateway confirmed the data cipher; one
+	// that lacks it would take sealed payloads for plain data. Early data is
+	// written before any confirmation can arrive, so it needs known capabilities.
+	if !sm.peerHas(FeatureDataCipher) && (sm.peerCaps.Load() != nil || len(earlyData) > 0) {
+		opts.DataCipher = CipherNone
+	}
+	dataCipher, err := NewDataCipher(opts.DataCipher, c.config.PSK)
+	if err != nil {
+		stream.Close()
+		return nil, 0, err
+	}
+	padding := Padding{Profile: opts.PaddingProfile, MaxPadding: opts.MaxPadding}
+
+	opts.EarlyData = len(earlyData) > 0
+	opts.Capabilities = LocalCapabilities()
+	metaRecord, err := BuildKeyedMetadataRecord(c.config.KeyID, target.Host, uint16(target.Port), opts, c.config.PSK, sm.nonceGen)
+	if err != nil {
+		stream.Close()
+		return nil, 0, err
+	}
+	if len(earlyData) > GetMaxRecordPayload() {
+		stream.Close()
+		return nil, 0, fmt.Errorf("early data exceeds %d bytes", GetMaxRecordPayload())
+	}
+	if len(earlyData) > 0 {
+		dataRecord, err := BuildPaddedDataRecord(earlyData, sm.nonceGen, dataCipher, padding)
+		if err != nil {
+			stream.Close()
+			return nil, 0, err
+		}
+		metaRecord = append(metaRecord, dataRecord...)
+		PutBuffer(dataRecord)
+	}
+
+	if _, err := stream.Write(metaRecord); err != nil {
+		stream.Close()
+		return nil, 0, err
+	}
+
+	// Wrap the stream in a RecordReadWriter to handle data-phase encapsulation
+	// V5: Pass NonceGenerator for counter-based nonce
+	wrappedStream := NewRecordReadWriter(stream, opts.MaxPadding, sm.nonceGen)
+	wrappedStream.SetDataCipher(dataCipher)
+	wrappedStream.SetPaddingProfile(opts.PaddingProfile)
+	wrappedStream.ExpectCapabilities(c.config.PSK, sm.recordPeerCaps)
+
+	// Gateways that negotiated connect acks report the dial result before any data,
+	// so failures surface here as a *RemoteError instead of on the first Read.
+	awaitAck := sm.peerHas(FeatureConnectAck)
+	if sm.peerCaps.Load() == nil && len(earlyData) == 0 {
+		// First stream since connecting: the capabilities record tells whether an
+		// ack follows. V5 gateways send none and leave the stream optimistic.
+		_ = stream.SetReadDeadline(time.Now().Add(capabilitiesTimeout))
+		n, ok, err := wrappedStream.AwaitCapabilities()
+		_ = stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("[DEBUG] Handshake with gateway for %s:%d failed: %v", target.Host, target.Port, err)
+			stream.CancelRead(0)
+			stream.Close()
+			return nil, 0, err
+		}
+		if !ok {
+			// No capabilities: a V5 gateway. Later streams skip the wait.
+			sm.recordPeerCaps(BaselineNegotiated())
+		}
+		if !n.Has(FeatureDataCipher) {
+			wrappedStream.SetDataCipher(nil)
+		}
+		awaitAck = ok && n.Has(FeatureConnectAck)
+	}
+	if awaitAck && len(earlyData) == 0 {
+		_ = stream.SetReadDeadline(time.Now().Add(connectAckTimeout))
+		err := wrappedStream.AwaitConnectAck()
+		_ = stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("[DEBUG] Connect to %s:%d failed: %v", target.Host, target.Port, err)
+			stream.CancelRead(0)
+			stream.Close()
+			return nil, 0, err
+		}
+	}
+	return wrappedStream, streamID, nil
+}
+
 // closeStreamInternal closes a stream.
 func (c *Core) closeStreamInternal(handle StreamHandle) error {
 	c.mu.Lock()
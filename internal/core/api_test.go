@@ -0,0 +1,147 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// startV5Gateway runs a gateway that, like V5, answers no stream with a
+// capabilities record: it reads what the client sends and stays silent.
+func startV5Gateway(t *testing.T) int {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"localhost"}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{http3.NextProtoH3},
+	}
+
+	mux := http.NewServeMux()
+	server := &webtransport.Server{
+		H3: &http3.Server{
+			TLSConfig:       tlsConfig,
+			QUICConfig:      &quic.Config{EnableDatagrams: true, EnableStreamResetPartialDelivery: true},
+			EnableDatagrams: true,
+			Handler:         mux,
+		},
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	webtransport.ConfigureHTTP3Server(server.H3)
+	mux.HandleFunc("/aether", func(w http.ResponseWriter, r *http.Request) {
+		sess, err := server.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			stream, err := sess.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, stream)
+		}
+	})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Close() })
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestOpenNativeStreamV5Gateway(t *testing.T) {
+	config := &SessionConfig{ServerAddr: "127.0.0.1", ServerPort: startV5Gateway(t), ServerPath: "/aether", PSK: "psk", AllowInsecure: true}
+	sm := newSessionManager(config, func(Event) {}, NewMetrics())
+	if err := sm.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { sm.close("test done") })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Core{config: config, ctx: ctx}
+	target := TargetAddress{Host: "example.com", Port: 80}
+
+	// The first stream waits for capabilities that never come.
+	start := time.Now()
+	first, _, err := c.openNativeStream(sm, target, Options{}, nil)
+	if err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+	defer first.Close()
+	if d := time.Since(start); d < capabilitiesTimeout {
+		t.Errorf("first stream returned after %v, before the capabilities timeout", d)
+	}
+	if n := sm.peerCaps.Load(); n == nil || *n != BaselineNegotiated() {
+		t.Fatalf("peer capabilities after a silent gateway: %v", n)
+	}
+
+	// The session now knows the gateway is V5.
+	start = time.Now()
+	second, _, err := c.openNativeStream(sm, target, Options{}, nil)
+	if err != nil {
+		t.Fatalf("second stream: %v", err)
+	}
+	defer second.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("second stream waited %v", d)
+	}
+}
+
+func TestOpenNativeStreamUnconfirmedCipher(t *testing.T) {
+	config := &SessionConfig{ServerAddr: "127.0.0.1", ServerPort: startV5Gateway(t), ServerPath: "/aether", PSK: "psk", AllowInsecure: true}
+	sm := newSessionManager(config, func(Event) {}, NewMetrics())
+	if err := sm.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { sm.close("test done") })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Core{config: config, ctx: ctx}
+	target := TargetAddress{Host: "example.com", Port: 80}
+	opts := Options{DataCipher: CipherAES128GCM}
+
+	// Early data goes out before capabilities are known: it is never sealed.
+	early, _, err := c.openNativeStream(sm, target, opts, []byte("hello"))
+	if err != nil {
+		t.Fatalf("early data stream: %v", err)
+	}
+	defer early.Close()
+	if early.dataCipher != nil {
+		t.Error("early data sealed before the gateway confirmed the data cipher")
+	}
+
+	// The first stream without early data drops the cipher once the gateway
+	// turns out not to confirm it, later ones never set it up.
+	for _, name := range []string{"first", "second"} {
+		s, _, err := c.openNativeStream(sm, target, opts, nil)
+		if err != nil {
+			t.Fatalf("%s stream: %v", name, err)
+		}
+		defer s.Close()
+		if s.dataCipher != nil || s.RecordReader.dataCipher != nil {
+			t.Errorf("%s stream sealed against a V5 gateway", name)
+		}
+	}
+}
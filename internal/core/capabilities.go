@@ -0,0 +1,154 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Feature bits advertised in the capabilities option and echoed, intersected,
+// in the gateway's TypeCapabilities record. Unknown bits are ignored.
+const (
+	FeatureDataCipher = 1 << 0 // Options TLV 0x02, sealed TypeData records
+	FeatureUDPRelay   = 1 << 1 // TypeDatagram records and UDP relay streams
+	FeatureRekey      = 1 << 2 // TypeRekey exchange
+	FeatureHalfClose  = 1 << 3 // TypeFin records, each direction closes independently
+	FeatureConnectAck = 1 << 4 // TypeConnectAck after the gateway dialed the target
+	FeatureMux        = 1 << 5 // Options TLV 0x05, TypeMux sub-streams on one carrier stream
+	FeatureReverse    = 1 << 6 // Options TLV 0x88, reverse tunnels over gateway-initiated streams
+	FeatureProbe      = 1 << 7 // TypePing/TypePong probes over WebTransport datagrams
+	FeatureGoAway     = 1 << 8 // TypeGoAway datagrams before the gateway shuts down
+)
+
+// SupportedFeatures is the feature set implemented by this build.
+const SupportedFeatures uint32 = FeatureDataCipher | FeatureUDPRelay | FeatureRekey | FeatureHalfClose | FeatureConnectAck | FeatureMux | FeatureReverse | FeatureProbe | FeatureGoAway
+
+// baselineFeatures is what a V5 peer that sends no capabilities is assumed to
+// support: nothing beyond plain records, not even the data cipher, whose option
+// a V5 peer silently ignores.
+const baselineFeatures uint32 = 0
+
+// featuresFor returns the features a version can carry: V5 stays at the
+// baseline, every feature beyond it needs V6.
+func featuresFor(version byte) uint32 {
+	if version < 0x06 {
+		return baselineFeatures
+	}
+	return SupportedFeatures
+}
+
+// capabilitiesLength is MinVersion(1) | MaxVersion(1) | Features(4).
+const capabilitiesLength = 6
+
+// Capabilities is the version range and feature set a client advertises in its metadata.
+type Capabilities struct {
+	MinVersion byte
+	MaxVersion byte
+	Features   uint32
+}
+
+// LocalCapabilities returns the capabilities of this build.
+func LocalCapabilities() *Capabilities {
+	return &Capabilities{MinVersion: MinProtocolVersion, MaxVersion: MaxProtocolVersion, Features: SupportedFeatures}
+}
+
+// Negotiated is the outcome of a capability exchange for one stream.
+type Negotiated struct {
+	Version  byte
+	Features uint32
+}
+
+// Has reports whether every bit of f was negotiated.
+func (n Negotiated) Has(f uint32) bool {
+	return n.Features&f == f
+}
+
+// BaselineNegotiated is assumed when the peer does not take part in negotiation (V5).
+func BaselineNegotiated() Negotiated {
+	return Negotiated{Version: MinProtocolVersion, Features: baselineFeatures}
+}
+
+// ErrNoCommonVersion is returned when the version ranges of both sides do not overlap.
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// Negotiate picks the highest version in both ranges and the features both sides support
+// at that version. A nil peer is a V5 client and yields BaselineNegotiated.
+func Negotiate(peer *Capabilities) (Negotiated, error) {
+	if peer == nil {
+		return BaselineNegotiated(), nil
+	}
+	version := peer.MaxVersion
+	if version > MaxProtocolVersion {
+		version = MaxProtocolVersion
+	}
+	if version < peer.MinVersion || version < MinProtocolVersion {
+		return Negotiated{}, ErrNoCommonVersion
+	}
+	return Negotiated{Version: version, Features: peer.Features & featuresFor(version)}, nil
+}
+
+func appendCapabilities(dst []byte, c *Capabilities) []byte {
+	dst = append(dst, optionCapabilities, capabilitiesLength, c.MinVersion, c.MaxVersion)
+	return binary.BigEndian.AppendUint32(dst, c.Features)
+}
+
+func parseCapabilities(value []byte) *Capabilities {
+	return &Capabilities{
+		MinVersion: value[0],
+		MaxVersion: value[1],
+		Features:   binary.BigEndian.Uint32(value[2:6]),
+	}
+}
+
+// BuildCapabilitiesRecord creates the TypeCapabilities record a gateway sends first on
+// a stream whose metadata carried capabilities. Payload Version(1) | Features(4),
+// sealed like metadata with the gateway's SessionID.
+func BuildCapabilitiesRecord(n Negotiated, psk string, ng *NonceGenerator) ([]byte, error) {
+	plaintext := make([]byte, 5)
+	plaintext[0] = n.Version
+	binary.BigEndian.PutUint32(plaintext[1:5], n.Features)
+
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	gcm, err := metadataAEAD(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	header, err := buildHeader(TypeCapabilities, len(plaintext)+gcm.Overhead(), 0, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, gcm.Seal(nil, nonce[:], plaintext, header), nil), nil
+}
+
+// OpenCapabilitiesRecord authenticates a TypeCapabilities record, checks that the
+// negotiated version lies in this build's range and drops features it cannot carry.
+func OpenCapabilitiesRecord(record *Record, psk string) (Negotiated, error) {
+	if record.Type != TypeCapabilities {
+		return Negotiated{}, fmt.Errorf("not a capabilities record: %d", record.Type)
+	}
+	gcm, err := metadataAEAD(psk, record.SessionID)
+	if err != nil {
+		return Negotiated{}, err
+	}
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+
+	plaintext, err := gcm.Open(nil, nonce[:], record.Payload, record.Header)
+	if err != nil {
+		return Negotiated{}, errors.New("capabilities record authentication failed")
+	}
+	if len(plaintext) != 5 {
+		return Negotiated{}, fmt.Errorf("invalid capabilities payload length: %d", len(plaintext))
+	}
+	n := Negotiated{Version: plaintext[0], Features: binary.BigEndian.Uint32(plaintext[1:5])}
+	if n.Version < MinProtocolVersion || n.Version > MaxProtocolVersion {
+		return Negotiated{}, fmt.Errorf("negotiated version %d outside supported range", n.Version)
+	}
+	n.Features &= featuresFor(n.Version)
+	return n, nil
+}
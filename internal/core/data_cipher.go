@@ -0,0 +1,164 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Data cipher suites negotiated through the metadata options TLV (option 0x02).
+const (
+	CipherNone             byte = 0x00
+	CipherAES128GCM        byte = 0x01
+	CipherChaCha20Poly1305 byte = 0x02
+)
+
+// dataKeyLabel separates data-plane keys from the metadata key derived from the same PSK/salt.
+const dataKeyLabel = ProtocolLabel + "/data"
+
+// dataCipherCacheSize bounds the per-stream AEAD cache (own SessionID + peer SessionID + rekeys).
+const dataCipherCacheSize = 4
+
+// ParseDataCipher maps a config name to a cipher suite ID.
+// Empty string and "none" disable data-plane AEAD.
+func ParseDataCipher(name string) (byte, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return CipherNone, nil
+	case "aes-128-gcm", "aes128gcm", "aes":
+		return CipherAES128GCM, nil
+	case "chacha20-poly1305", "chacha20", "chacha":
+		return CipherChaCha20Poly1305, nil
+	default:
+		return CipherNone, fmt.Errorf("unknown data cipher: %s", name)
+	}
+}
+
+// DataCipherName returns the config name of a cipher suite ID.
+func DataCipherName(suite byte) string {
+	switch suite {
+	case CipherNone:
+		return "none"
+	case CipherAES128GCM:
+		return "aes-128-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("unknown(0x%02x)", suite)
+	}
+}
+
+// DataCipher seals and opens TypeData payloads for a single stream.
+// Keys are derived per SessionID (HKDF salt), so records written by either
+// peer can be opened with the same DataCipher instance.
+type DataCipher struct {
+	suite byte
+	psk   string
+
+	mu    sync.Mutex
+	cache map[[4]byte]cipher.AEAD
+}
+
+// NewDataCipher creates a DataCipher for the given suite and PSK.
+// Returns nil (no error) for CipherNone.
+func NewDataCipher(suite byte, psk string) (*DataCipher, error) {
+	switch suite {
+	case CipherNone:
+		return nil, nil
+	case CipherAES128GCM, CipherChaCha20Poly1305:
+	default:
+		return nil, fmt.Errorf("unsupported data cipher: 0x%02x", suite)
+	}
+	if psk == "" {
+		return nil, fmt.Errorf("missing psk")
+	}
+	return &DataCipher{
+		suite: suite,
+		psk:   psk,
+		cache: make(map[[4]byte]cipher.AEAD, dataCipherCacheSize),
+	}, nil
+}
+
+// Suite returns the cipher suite ID, CipherNone for a nil DataCipher.
+func (dc *DataCipher) Suite() byte {
+	if dc == nil {
+		return CipherNone
+	}
+	return dc.suite
+}
+
+// Overhead returns the AEAD tag length added to each payload.
+func (dc *DataCipher) Overhead() int {
+	return 16
+}
+
+// aeadFor returns the AEAD keyed for the given SessionID, deriving it on first use.
+func (dc *DataCipher) aeadFor(sessionID []byte) (cipher.AEAD, error) {
+	if len(sessionID) != headerSessionIDLength {
+		return nil, fmt.Errorf("invalid SessionID length: %d", len(sessionID))
+	}
+	var sid [4]byte
+	copy(sid[:], sessionID)
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if aead, ok := dc.cache[sid]; ok {
+		return aead, nil
+	}
+
+	aead, err := newDataAEAD(dc.suite, dc.psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(dc.cache) >= dataCipherCacheSize {
+		// Old SessionIDs are only kept around while a rekey drains; start over.
+		dc.cache = make(map[[4]byte]cipher.AEAD, dataCipherCacheSize)
+	}
+	dc.cache[sid] = aead
+	return aead, nil
+}
+
+// open decrypts a sealed TypeData record in place and returns the plaintext.
+func (dc *DataCipher) open(record *Record) ([]byte, error) {
+	aead, err := dc.aeadFor(record.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+	return aead.Open(record.Payload[:0], nonce[:], record.Payload, record.Header)
+}
+
+func newDataAEAD(suite byte, psk string, salt []byte) (cipher.AEAD, error) {
+	keyLen := 16
+	if suite == CipherChaCha20Poly1305 {
+		keyLen = chacha20poly1305.KeySize
+	}
+	reader := hkdf.New(sha256.New, []byte(strings.TrimSpace(psk)), salt, []byte(dataKeyLabel))
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+
+	switch suite {
+	case CipherAES128GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported data cipher: 0x%02x", suite)
+	}
+}
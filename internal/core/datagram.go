@@ -0,0 +1,202 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MaxUDPPayload is the largest UDP payload a datagram record may carry.
+const MaxUDPPayload = 65507
+
+// UDPDatagram is a single UDP payload relayed through a TypeDatagram record.
+// Host/Port is the destination on the way out and the source on the way back.
+// KeyID names the PSK the record is sealed with ("" for the default key).
+type UDPDatagram struct {
+	FlowID  uint32
+	KeyID   string
+	Host    string
+	Port    uint16
+	Payload []byte
+}
+
+// BuildUDPDatagramRecord creates a length-prefixed TypeDatagram record.
+// Payload layout: Suite(1) | KeyIDLen(1) | KeyID | Seal(FlowID(4) | Address | Data),
+// nonce SessionID||Counter, AAD header plus the clear prefix.
+// Datagram records are always sealed, so dc must not be nil.
+// Strip the 4-byte length prefix before sending over a WebTransport datagram.
+func BuildUDPDatagramRecord(d *UDPDatagram, ng *NonceGenerator, dc *DataCipher) ([]byte, error) {
+	if dc == nil {
+		return nil, errors.New("datagram records require a data cipher")
+	}
+	if len(d.Payload) > MaxUDPPayload {
+		return nil, fmt.Errorf("udp payload too large: %d", len(d.Payload))
+	}
+	if len(d.KeyID) > MaxKeyIDLength {
+		return nil, fmt.Errorf("key ID too long: %d", len(d.KeyID))
+	}
+
+	plain := make([]byte, 4, 4+1+2+1+len(d.Host)+len(d.Payload))
+	binary.BigEndian.PutUint32(plain, d.FlowID)
+	plain, err := appendAddress(plain, d.Host, d.Port)
+	if err != nil {
+		return nil, err
+	}
+	plain = append(plain, d.Payload...)
+
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	aead, err := dc.aeadFor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixLen := 2 + len(d.KeyID)
+	bodyLen := prefixLen + len(plain) + aead.Overhead()
+	totalLength := RecordHeaderLength + bodyLen
+	record := make([]byte, 4+totalLength)
+	binary.BigEndian.PutUint32(record[0:4], uint32(totalLength))
+	if err := buildHeaderInto(record[4:4+RecordHeaderLength], TypeDatagram, bodyLen, 0, sessionID, counter); err != nil {
+		return nil, err
+	}
+	prefixOffset := 4 + RecordHeaderLength
+	record[prefixOffset] = dc.suite
+	record[prefixOffset+1] = byte(len(d.KeyID))
+	copy(record[prefixOffset+2:], d.KeyID)
+	sealOffset := prefixOffset + prefixLen
+	aead.Seal(record[sealOffset:sealOffset], nonce[:], plain, record[4:sealOffset])
+	return record, nil
+}
+
+// ParseDatagramRecord parses a record received as a WebTransport datagram
+// (no length prefix). Version and timestamp are validated as for stream records.
+func ParseDatagramRecord(b []byte) (*Record, error) {
+	return parseRecord(b)
+}
+
+// DatagramKey returns the cipher suite and key ID a TypeDatagram record was sealed with.
+func DatagramKey(record *Record) (byte, string, error) {
+	if record.Type != TypeDatagram {
+		return 0, "", fmt.Errorf("not a datagram record: %d", record.Type)
+	}
+	if len(record.Payload) < 2 {
+		return 0, "", errors.New("datagram record too short")
+	}
+	keyIDLen := int(record.Payload[1])
+	if keyIDLen > MaxKeyIDLength || len(record.Payload) < 2+keyIDLen {
+		return 0, "", fmt.Errorf("invalid key ID length: %d", keyIDLen)
+	}
+	return record.Payload[0], string(record.Payload[2 : 2+keyIDLen]), nil
+}
+
+// OpenUDPDatagram decrypts a TypeDatagram record in place.
+// The returned Payload aliases the record buffer.
+func OpenUDPDatagram(record *Record, dc *DataCipher) (*UDPDatagram, error) {
+	suite, keyID, err := DatagramKey(record)
+	if err != nil {
+		return nil, err
+	}
+	if dc == nil || dc.suite != suite {
+		return nil, fmt.Errorf("datagram cipher mismatch: %s", DataCipherName(suite))
+	}
+	aead, err := dc.aeadFor(record.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+	prefixLen := 2 + len(keyID)
+	aad := make([]byte, 0, len(record.Header)+prefixLen)
+	aad = append(aad, record.Header...)
+	aad = append(aad, record.Payload[:prefixLen]...)
+
+	body := record.Payload[prefixLen:]
+	plain, err := aead.Open(body[:0], nonce[:], body, aad)
+	if err != nil {
+		return nil, errors.New("datagram record authentication failed")
+	}
+	if len(plain) < 4 {
+		return nil, errors.New("datagram body too short")
+	}
+	host, port, consumed, err := parseAddress(plain[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &UDPDatagram{
+		FlowID:  binary.BigEndian.Uint32(plain[0:4]),
+		KeyID:   keyID,
+		Host:    host,
+		Port:    port,
+		Payload: plain[4+consumed:],
+	}, nil
+}
+
+// DatagramCiphers lazily keeps one DataCipher per (PSK, suite) for opening datagram
+// records, since each datagram names its own suite and key ID.
+type DatagramCiphers struct {
+	lookup func(keyID string) (string, error)
+	mu     sync.Mutex
+	cache  map[datagramCipherKey]*DataCipher
+}
+
+type datagramCipherKey struct {
+	psk   string
+	suite byte
+}
+
+// NewDatagramCiphers creates a cipher set; lookup maps a key ID to its PSK.
+func NewDatagramCiphers(lookup func(keyID string) (string, error)) *DatagramCiphers {
+	return &DatagramCiphers{lookup: lookup, cache: make(map[datagramCipherKey]*DataCipher, 2)}
+}
+
+// StaticDatagramCiphers creates a cipher set that opens every key ID with psk.
+func StaticDatagramCiphers(psk string) *DatagramCiphers {
+	return NewDatagramCiphers(func(string) (string, error) { return psk, nil })
+}
+
+// Get returns the DataCipher for keyID and suite, creating it on first use.
+func (c *DatagramCiphers) Get(keyID string, suite byte) (*DataCipher, error) {
+	if suite == CipherNone {
+		return nil, errors.New("datagram records require a data cipher")
+	}
+	psk, err := c.lookup(keyID)
+	if err != nil {
+		return nil, err
+	}
+	key := datagramCipherKey{psk: psk, suite: suite}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dc, ok := c.cache[key]; ok {
+		return dc, nil
+	}
+	dc, err := NewDataCipher(suite, psk)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.cache) >= dataCipherCacheSize*4 {
+		// PSKs rotated by a users reload; drop stale entries.
+		c.cache = make(map[datagramCipherKey]*DataCipher, 2)
+	}
+	c.cache[key] = dc
+	return dc, nil
+}
+
+// Open decrypts a TypeDatagram record using the key ID and suite it names.
+func (c *DatagramCiphers) Open(record *Record) (*UDPDatagram, error) {
+	suite, keyID, err := DatagramKey(record)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := c.Get(keyID, suite)
+	if err != nil {
+		return nil, err
+	}
+	return OpenUDPDatagram(record, dc)
+}
@@ -0,0 +1,439 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSRemoteServer = "1.1.1.1:53"
+	dnsQueryTimeout        = 5 * time.Second
+	dnsTCPIdleTimeout      = 30 * time.Second
+	dnsMaxUDPSize          = 512 // Without EDNS (RFC 1035 4.2.1)
+)
+
+// DNSConfig enables the local DNS server. Names matched by a direct rule are
+// asked from DirectServer; everything else goes to RemoteServer as DNS over
+// TCP through the tunnel, so queries never leak to the local network.
+type DNSConfig struct {
+	ListenAddr   string  `json:"listen_addr"`             // UDP and TCP, e.g. 127.0.0.1:5353
+	RemoteServer string  `json:"remote_server,omitempty"` // Resolver reached through the tunnel, default 1.1.1.1:53
+	DirectServer string  `json:"direct_server,omitempty"` // Resolver for direct rules, default the first system nameserver
+	Rules        []*Rule `json:"rules,omitempty"`         // Split-DNS rules: direct, proxy, block (NXDOMAIN) or reject (REFUSED)
+	CacheSize    int     `json:"cache_size,omitempty"`    // Cached answers, default 4096; negative disables the cache
+}
+
+// dnsServer answers queries on UDP and TCP at the same address.
+type dnsServer struct {
+	core  *Core
+	addr  string
+	cache *dnsCache
+
+	udp *net.UDPConn
+	tcp net.Listener
+
+	mu     sync.RWMutex
+	rules  *RuleEngine
+	remote string
+	direct string
+}
+
+// newDNSServer creates a DNS server for cfg.
+func newDNSServer(cfg *DNSConfig, core *Core) (*dnsServer, error) {
+	s := &dnsServer{
+		core:  core,
+		addr:  cfg.ListenAddr,
+		cache: newDNSCache(cfg.CacheSize),
+	}
+	if err := s.update(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// update applies new rules and upstreams; the listen address needs a restart.
+func (s *dnsServer) update(cfg *DNSConfig) error {
+	rules := NewRuleEngine(ActionProxy)
+	if err := rules.UpdateRules(cfg.Rules); err != nil {
+		return fmt.Errorf("dns rules: %w", err)
+	}
+	remote := cfg.RemoteServer
+	if remote == "" {
+		remote = defaultDNSRemoteServer
+	}
+	remote, err := dnsServerAddr(remote)
+	if err != nil {
+		return fmt.Errorf("dns remote_server: %w", err)
+	}
+	direct := cfg.DirectServer
+	if direct != "" {
+		if direct, err = dnsServerAddr(direct); err != nil {
+			return fmt.Errorf("dns direct_server: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.rules, s.remote, s.direct = rules, remote, direct
+	s.mu.Unlock()
+	s.cache.flush()
+	return nil
+}
+
+// dnsListenAddr returns where cfg wants the DNS server, or "" when it is off.
+func dnsListenAddr(cfg *DNSConfig) string {
+	if cfg == nil {
+		return ""
+	}
+	return cfg.ListenAddr
+}
+
+// dnsServerAddr adds the default port to a resolver address.
+func dnsServerAddr(addr string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	if net.ParseIP(strings.Trim(addr, "[]")) == nil && strings.Contains(addr, ":") {
+		return "", fmt.Errorf("invalid address: %s", addr)
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53"), nil
+}
+
+// start listens on UDP and TCP.
+func (s *dnsServer) start() error {
+	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", s.addr, err)
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", s.addr, err)
+	}
+	tcp, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		_ = udp.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", s.addr, err)
+	}
+	s.udp, s.tcp = udp, tcp
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// stop closes both listeners.
+func (s *dnsServer) stop() {
+	if s.udp != nil {
+		_ = s.udp.Close()
+	}
+	if s.tcp != nil {
+		_ = s.tcp.Close()
+	}
+}
+
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[DNS] UDP listener stopped: %v", err)
+			}
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp := s.handle(query, false)
+			if resp != nil {
+				_, _ = s.udp.WriteToUDP(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[DNS] TCP listener stopped: %v", err)
+			}
+			return
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers length-prefixed queries in order until the client goes idle.
+func (s *dnsServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		_ = conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSTCPMessage(r)
+		if err != nil {
+			return
+		}
+		resp := s.handle(query, true)
+		if resp == nil {
+			return
+		}
+		if err := writeDNSTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one query. It returns nil for messages that are not worth a reply.
+func (s *dnsServer) handle(query []byte, overTCP bool) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsErrorResponse(hdr, nil, dnsmessage.RCodeFormatError)
+	}
+	maxSize := dnsMaxUDPSize
+	if !overTCP {
+		maxSize = dnsClientUDPSize(&p)
+	}
+
+	key := newDNSCacheKey(q)
+	if resp := s.cache.get(key, hdr.ID, time.Now()); resp != nil {
+		return dnsFitResponse(resp, hdr, q, overTCP, maxSize)
+	}
+
+	s.mu.RLock()
+	rules, remote, direct := s.rules, s.remote, s.direct
+	s.mu.RUnlock()
+
+	action := ActionProxy
+	ruleID := ""
+	if res, err := rules.Match(&MatchRequest{Domain: key.name, Port: 53}); err == nil {
+		action, ruleID = res.Action, res.RuleID
+	}
+
+	var resp []byte
+	switch action {
+	case ActionBlock:
+		return dnsErrorResponse(hdr, &q, dnsmessage.RCodeNameError)
+	case ActionReject:
+		return dnsErrorResponse(hdr, &q, dnsmessage.RCodeRefused)
+	case ActionDirect:
+		if direct == "" {
+			direct = systemNameserver()
+		}
+		if direct == "" {
+			err = errors.New("no direct_server configured and no system nameserver found")
+		} else {
+			resp, err = exchangeDNSDirect(direct, query, overTCP)
+		}
+	default:
+		resp, err = s.exchangeTunnel(remote, query)
+	}
+	if err != nil {
+		log.Printf("[DNS] %s %s (action=%s, rule=%s) failed: %v", key.name, q.Type, action, ruleID, err)
+		return dnsErrorResponse(hdr, &q, dnsmessage.RCodeServerFailure)
+	}
+	if len(resp) < 2 || binary.BigEndian.Uint16(resp) != hdr.ID {
+		return dnsErrorResponse(hdr, &q, dnsmessage.RCodeServerFailure)
+	}
+	s.cache.put(key, resp, time.Now())
+	return dnsFitResponse(resp, hdr, q, overTCP, maxSize)
+}
+
+// exchangeTunnel sends the query as DNS over TCP on a tunnel stream to remote.
+func (s *dnsServer) exchangeTunnel(remote string, query []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.core.dialStream(TargetAddress{Host: host, Port: int(port)}, dummyAddr("dns-local"), dummyAddr(remote))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Tunnel streams have no deadlines; closing the stream unblocks the read.
+	timer := time.AfterFunc(dnsQueryTimeout, func() { _ = conn.Close() })
+	defer timer.Stop()
+
+	if err := writeDNSTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSTCPMessage(conn)
+}
+
+// exchangeDNSDirect asks server over UDP, retrying over TCP when the answer
+// was truncated or the client itself used TCP.
+func exchangeDNSDirect(server string, query []byte, overTCP bool) ([]byte, error) {
+	if !overTCP {
+		conn, err := net.DialTimeout("udp", server, dnsQueryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// Skip stray datagrams that do not answer this query.
+			if n < 12 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(query) {
+				continue
+			}
+			if buf[2]&0x02 == 0 { // TC bit clear
+				return buf[:n:n], nil
+			}
+			break
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", server, dnsQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if err := writeDNSTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSTCPMessage(conn)
+}
+
+// readDNSTCPMessage reads one message with its 2-byte length prefix (RFC 1035 4.2.2).
+func readDNSTCPMessage(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return fmt.Errorf("dns message too large: %d", len(msg))
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// dnsClientUDPSize returns the largest UDP response the client accepts: its
+// EDNS payload size if it sent an OPT record, 512 otherwise.
+func dnsClientUDPSize(p *dnsmessage.Parser) int {
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return dnsMaxUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsMaxUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(int(h.Class), dnsMaxUDPSize)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsMaxUDPSize
+		}
+	}
+}
+
+// dnsFitResponse truncates a UDP response that exceeds maxSize to its
+// question with TC set, telling the client to retry over TCP.
+func dnsFitResponse(resp []byte, hdr dnsmessage.Header, q dnsmessage.Question, overTCP bool, maxSize int) []byte {
+	if overTCP || len(resp) <= maxSize {
+		return resp
+	}
+	var rh dnsmessage.Header
+	var p dnsmessage.Parser
+	if h, err := p.Start(resp); err == nil {
+		rh = h
+	}
+	rh.ID = hdr.ID
+	rh.Response = true
+	rh.Truncated = true
+	b := dnsmessage.NewBuilder(nil, rh)
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := b.Question(q); err != nil {
+		return nil
+	}
+	out, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// dnsErrorResponse builds an answer-less response with rcode.
+func dnsErrorResponse(hdr dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		OpCode:             hdr.OpCode,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if q != nil {
+		if err := b.StartQuestions(); err != nil {
+			return nil
+		}
+		if err := b.Question(*q); err != nil {
+			return nil
+		}
+	}
+	out, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf, or "".
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				return net.JoinHostPort(ip.String(), "53")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSCacheSize = 4096
+	dnsMaxCacheTTL      = time.Hour        // Upper bound for any cached answer
+	dnsNegativeTTL      = 30 * time.Second // Negative answers without an SOA
+)
+
+// dnsCacheKey identifies a question; the name is lower-cased without the trailing dot.
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache holds answers until their smallest TTL runs out. Hits are served
+// with TTLs reduced by the time spent in the cache.
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+func newDNSCache(size int) *dnsCache {
+	if size == 0 {
+		size = defaultDNSCacheSize
+	}
+	if size < 0 {
+		return nil
+	}
+	return &dnsCache{size: size, entries: make(map[dnsCacheKey]*dnsCacheEntry)}
+}
+
+func newDNSCacheKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{
+		name:  strings.TrimSuffix(strings.ToLower(q.Name.String()), "."),
+		qtype: q.Type,
+		class: q.Class,
+	}
+}
+
+// get returns a packed copy of the cached answer with the given ID, or nil.
+func (c *dnsCache) get(key dnsCacheKey, id uint16, now time.Time) []byte {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && !now.Before(e.expires) {
+		delete(c.entries, key)
+		e = nil
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	msg := e.msg
+	msg.Header.ID = id
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// put caches a successful or NXDOMAIN response for as long as its TTLs allow.
+func (c *dnsCache) put(key dnsCacheKey, resp []byte, now time.Time) {
+	if c == nil {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Truncated {
+		return
+	}
+	ttl, ok := dnsCacheTTL(&msg)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: drop an arbitrary entry (map order is random).
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// flush drops every cached answer.
+func (c *dnsCache) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+// len reports the number of cached answers, expired ones included.
+func (c *dnsCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// dnsCacheTTL returns how long msg may be cached: the smallest answer TTL, or
+// for negative answers the SOA TTL capped by its MINIMUM field (RFC 2308).
+func dnsCacheTTL(msg *dnsmessage.Message) (time.Duration, bool) {
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	var ttl uint32
+	found := false
+	if msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0 {
+		for _, rr := range msg.Answers {
+			if !found || rr.Header.TTL < ttl {
+				ttl, found = rr.Header.TTL, true
+			}
+		}
+	} else {
+		for _, rr := range msg.Authorities {
+			soa, ok := rr.Body.(*dnsmessage.SOAResource)
+			if !ok {
+				continue
+			}
+			ttl, found = min(rr.Header.TTL, soa.MinTTL), true
+			break
+		}
+		if !found {
+			return dnsNegativeTTL, true
+		}
+	}
+	return min(time.Duration(ttl)*time.Second, dnsMaxCacheTTL), found
+}
+
+// agedResources returns a copy of rrs with elapsed seconds taken off each TTL.
+// The EDNS OPT pseudo-record keeps its header, which carries flags, not a TTL.
+func agedResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	out := make([]dnsmessage.Resource, len(rrs))
+	copy(out, rrs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if out[i].Header.TTL > elapsed {
+			out[i].Header.TTL -= elapsed
+		} else {
+			out[i].Header.TTL = 0
+		}
+	}
+	return out
+}
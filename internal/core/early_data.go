@@ -0,0 +1,130 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// MaxEarlyDataBytes bounds the part of the first write sent with the metadata.
+	// It is further capped by the record payload size.
+	MaxEarlyDataBytes = 16 * 1024
+	// earlyDataWait is how long a Read on a deferred stream waits for the first
+	// Write before opening the stream without early data (server-speaks-first protocols).
+	earlyDataWait = 30 * time.Millisecond
+)
+
+// dialStream returns a net.Conn tunnelled to target. With SessionConfig.EarlyData
+// the stream is opened by the first Write, which then leaves together with the
+// metadata and saves the round trip between connect and first payload. Connect
+// failures are reported by Read instead of here in that mode.
+func (c *Core) dialStream(target TargetAddress, local, remote net.Addr) (*streamConn, error) {
+	conn := &streamConn{
+		core:    c,
+		local:   local,
+		remote:  remote,
+		target:  target,
+		started: time.Now(),
+		ready:   make(chan struct{}),
+	}
+	if c.config.EarlyData {
+		if state := c.stateMachine.State(); state != StateActive {
+			return nil, fmt.Errorf("cannot open stream in state %s", state)
+		}
+		return conn, nil
+	}
+	if _, err := conn.open(nil); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// earlyDataLimit returns how many bytes of the first write go out with the metadata.
+func earlyDataLimit() int {
+	return min(MaxEarlyDataBytes, GetMaxRecordPayload())
+}
+
+// open opens the tunnel stream once; later calls return the first result.
+// It reports whether early was sent with the metadata.
+func (c *streamConn) open(early []byte) (bool, error) {
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+	if c.opened {
+		return false, c.openErr
+	}
+	c.opened = true
+	defer close(c.ready)
+
+	var options map[string]interface{}
+	if len(early) > 0 {
+		options = map[string]interface{}{"earlyData": early}
+	}
+	handle, err := c.core.OpenStream(c.target, options)
+	if err != nil {
+		code := ErrTargetConnect
+		if remote, ok := AsRemoteError(err); ok {
+			code = remote.EventCode()
+		}
+		c.core.emit(NewCoreErrorEvent(code, err.Error(), false))
+		c.openErr = err
+		return false, err
+	}
+	log.Printf("[DEBUG] Stream opened: %s (early data: %d bytes)", handle.ID, len(early))
+	c.handle = handle
+	c.earlySent = len(early) > 0
+	return c.earlySent, nil
+}
+
+// writeEarly opens a deferred stream with the head of p as early data and returns
+// how many bytes of p were sent that way.
+func (c *streamConn) writeEarly(p []byte) (int, error) {
+	select {
+	case <-c.ready:
+		return 0, c.openErr
+	default:
+	}
+	n := min(len(p), earlyDataLimit())
+	sent, err := c.open(p[:n])
+	if err != nil || !sent {
+		return 0, err
+	}
+	if c.core.metrics != nil {
+		c.core.metrics.RecordBytesSent(uint64(n))
+	}
+	return n, nil
+}
+
+// waitOpen blocks until the stream is open. A deferred stream that sees no Write
+// within earlyDataWait is opened without early data.
+func (c *streamConn) waitOpen() error {
+	select {
+	case <-c.ready:
+		return c.openErr
+	default:
+	}
+	timer := time.NewTimer(earlyDataWait)
+	defer timer.Stop()
+	select {
+	case <-c.ready:
+		return c.openErr
+	case <-timer.C:
+		_, err := c.open(nil)
+		return err
+	}
+}
+
+// abandon marks a never-opened stream as closed. It reports whether there is an
+// open stream left to close.
+func (c *streamConn) abandon() bool {
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+	if !c.opened {
+		c.opened = true
+		c.openErr = net.ErrClosed
+		close(c.ready)
+		return false
+	}
+	return c.openErr == nil
+}
@@ -68,6 +68,26 @@ func NewSessionRotatingEvent(oldID string) Event {
 	}
 }
 
+// Event: session.rekeyed
+// Fires when the session switched to a new SessionID/key epoch in place.
+type SessionRekeyedEvent struct {
+	baseEvent
+	SessionID  string `json:"sessionId"`
+	Epoch      uint32 `json:"epoch"`
+	WireID     string `json:"wireId"`     // new protocol SessionID (hex)
+	PeerWireID string `json:"peerWireId"` // gateway's new protocol SessionID (hex)
+}
+
+func NewSessionRekeyedEvent(id string, epoch uint32, wireID, peerWireID string) Event {
+	return SessionRekeyedEvent{
+		baseEvent:  baseEvent{Type: "session.rekeyed", Timestamp: time.Now().UnixMilli()},
+		SessionID:  id,
+		Epoch:      epoch,
+		WireID:     wireID,
+		PeerWireID: peerWireID,
+	}
+}
+
 // Event: session.closed
 // Fires when session is fully closed.
 type SessionClosedEvent struct {
@@ -164,9 +184,15 @@ type MetricsSnapshotEvent struct {
 	BytesSent       uint64 `json:"bytesSent"`
 	BytesReceived   uint64 `json:"bytesReceived"`
 	LatencyMs       *int64 `json:"latencyMs,omitempty"`
+	Rekeys          uint64 `json:"rekeys"`
+	TTFBMs          *int64 `json:"ttfbMs,omitempty"`      // Mean time to first byte, streams without early data
+	EarlyTTFBMs     *int64 `json:"earlyTtfbMs,omitempty"` // Mean time to first byte, streams with early data
+	SRTTMs          *int64   `json:"srttMs,omitempty"`       // Smoothed RTT from datagram probes
+	JitterMs        *int64   `json:"jitterMs,omitempty"`     // RTT jitter from datagram probes
+	ProbeLossPct    *float64 `json:"probeLossPct,omitempty"` // Share of unanswered datagram probes
 }
 
-func NewMetricsSnapshotEvent(uptime int64, active, total int64, sent, recv uint64, latency *int64) Event {
+func NewMetricsSnapshotEvent(uptime int64, active, total int64, sent, recv uint64, latency *int64, rekeys uint64, ttfb, earlyTTFB, srtt, jitter *int64, probeLoss *float64) Event {
 	return MetricsSnapshotEvent{
 		baseEvent:     baseEvent{Type: "metrics.snapshot", Timestamp: time.Now().UnixMilli()},
 		SessionUptime: uptime,
@@ -175,6 +201,12 @@ func NewMetricsSnapshotEvent(uptime int64, active, total int64, sent, recv uint6
 		BytesSent:     sent,
 		BytesReceived: recv,
 		LatencyMs:     latency,
+		Rekeys:        rekeys,
+		TTFBMs:        ttfb,
+		EarlyTTFBMs:   earlyTTFB,
+		SRTTMs:        srtt,
+		JitterMs:      jitter,
+		ProbeLossPct:  probeLoss,
 	}
 }
 
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// goAwayPayloadLength is Remaining(u32 milliseconds).
+const goAwayPayloadLength = 4
+
+// BuildGoAwayRecord creates the TypeGoAway record a draining gateway sends on
+// every session: no new streams belong on it, and it is closed once remaining
+// has passed. Like probes it travels as a datagram, without its length prefix.
+func BuildGoAwayRecord(remaining time.Duration, ng *NonceGenerator) ([]byte, error) {
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, goAwayPayloadLength)
+	binary.BigEndian.PutUint32(payload, uint32(max(remaining, 0).Milliseconds()))
+	header, err := buildHeader(TypeGoAway, len(payload), 0, nonce[0:4], counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, payload, nil), nil
+}
+
+// ParseGoAway returns how long the gateway keeps the session open.
+func ParseGoAway(record *Record) (time.Duration, error) {
+	if record.Type != TypeGoAway {
+		return 0, fmt.Errorf("not a goaway record: %d", record.Type)
+	}
+	if len(record.Payload) != goAwayPayloadLength {
+		return 0, fmt.Errorf("invalid goaway payload length: %d", len(record.Payload))
+	}
+	return time.Duration(binary.BigEndian.Uint32(record.Payload)) * time.Millisecond, nil
+}
+
+// handleGoAway retires sess when the gateway starts draining it. Streams
+// already open finish on it; the next stream dials a fresh session, which a
+// restarted or replacement gateway accepts.
+func (sm *sessionManager) handleGoAway(sess *webtransport.Session, record *Record) {
+	remaining, err := ParseGoAway(record)
+	if err != nil {
+		return
+	}
+	sm.mu.Lock()
+	if sm.session != sess {
+		sm.mu.Unlock()
+		return
+	}
+	id := sm.sessionID
+	sm.session = nil
+	sm.mu.Unlock()
+
+	log.Printf("[INFO] Gateway is draining session %s (closing within %v); new streams use a fresh session", id, remaining)
+	sm.onEvent(NewSessionRotatingEvent(id))
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -109,19 +110,13 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 		}
 		destConn = d
 	} else {
-		handle, err := s.core.OpenStream(target, nil)
+		// Wrap stream as net.Conn
+		conn, err := s.core.dialStream(target, dummyAddr("http-local"), dummyAddr(r.Host))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Upstream failed: %v", err), http.StatusBadGateway)
+			http.Error(w, fmt.Sprintf("Upstream failed: %v", err), httpStatusForError(err))
 			return
 		}
-		
-		// Wrap stream as net.Conn
-		destConn = &streamConn{
-			handle: handle,
-			core:   s.core,
-			local:  dummyAddr("http-local"),
-			remote: dummyAddr(r.Host),
-		}
+		destConn = conn
 	}
 	defer destConn.Close()
 
@@ -139,8 +134,20 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	defer clientConn.Close()
 
 	// Transfer data
-	go io.Copy(destConn, clientConn)
-	io.Copy(clientConn, destConn)
+	// Each direction is half-closed on its own so shutdown(SHUT_WR) reaches the other end.
+	upstreamDone := make(chan struct{})
+	go func() {
+		io.Copy(destConn, clientConn)
+		if cw, ok := destConn.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		}
+		close(upstreamDone)
+	}()
+	_, err = io.Copy(clientConn, destConn)
+	if cw, ok := clientConn.(closeWriter); ok && err == nil {
+		_ = cw.CloseWrite()
+		<-upstreamDone
+	}
 }
 
 // handleHTTP handles plain HTTP requests.
@@ -186,16 +193,7 @@ func (s *HttpProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		// Use custom transport carrying traffic over Streams
 		transport = &http.Transport{
 			Dial: func(network, addr string) (net.Conn, error) {
-				handle, err := s.core.OpenStream(target, nil)
-				if err != nil {
-					return nil, err
-				}
-				return &streamConn{
-					handle: handle,
-					core:   s.core,
-					local:  dummyAddr("http-local"),
-					remote: dummyAddr(addr),
-				}, nil
+				return s.core.dialStream(target, dummyAddr("http-local"), dummyAddr(addr))
 			},
 		}
 	}
@@ -204,7 +202,7 @@ func (s *HttpProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	r.RequestURI = ""
 	resp, err := transport.RoundTrip(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		http.Error(w, err.Error(), httpStatusForError(err))
 		return
 	}
 	defer resp.Body.Close()
@@ -218,3 +216,28 @@ func (s *HttpProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
+
+// httpStatusForError maps an upstream failure to a proxy response status:
+// 403 for policy denials, 429 for an exhausted quota, 503 while the gateway
+// drains, 504 for timeouts and 502 for everything else.
+func httpStatusForError(err error) int {
+	if remote, ok := AsRemoteError(err); ok {
+		switch remote.Code {
+		case CodePolicyDenied:
+			return http.StatusForbidden
+		case CodeQuotaExceeded:
+			return http.StatusTooManyRequests
+		case CodeGoingAway:
+			return http.StatusServiceUnavailable
+		case CodeConnectTimeout, CodeTimeout:
+			return http.StatusGatewayTimeout
+		default:
+			return http.StatusBadGateway
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
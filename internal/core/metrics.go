@@ -1,12 +1,14 @@
 package core
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // Metrics tracks runtime statistics for the Core.
-// All fields are thread-safe via atomic operations.
+// All fields are thread-safe via atomic operations, except the probe
+// estimators which update together under their own mutex.
 type Metrics struct {
 	sessionStart   atomic.Value // time.Time
 	activeStreams  atomic.Int64
@@ -14,6 +16,25 @@ type Metrics struct {
 	bytesSent      atomic.Uint64
 	bytesReceived  atomic.Uint64
 	lastLatency    atomic.Value // *int64 (milliseconds)
+	rekeys         atomic.Uint64
+	ttfb           [2]ttfbStats // Indexed by whether the stream sent early data
+	probe          probeStats
+}
+
+// probeStats holds the estimators fed by datagram RTT probes.
+type probeStats struct {
+	mu      sync.Mutex
+	samples int64
+	srtt    time.Duration // RFC 6298 smoothed RTT (gain 1/8)
+	jitter  time.Duration // RFC 3550 interarrival jitter over successive RTTs (gain 1/16)
+	prevRTT time.Duration
+	loss    float64 // Moving loss rate (gain 1/16) over probe outcomes
+}
+
+// ttfbStats accumulates time-to-first-byte samples for proxied connections.
+type ttfbStats struct {
+	count atomic.Int64
+	total atomic.Int64 // nanoseconds
 }
 
 // NewMetrics creates a new Metrics instance.
@@ -99,9 +120,87 @@ func (m *Metrics) LastLatency() *int64 {
 	return val.(*int64)
 }
 
+// RecordRekey counts an in-session rekey.
+func (m *Metrics) RecordRekey() {
+	m.rekeys.Add(1)
+}
+
+// Rekeys returns the number of in-session rekeys.
+func (m *Metrics) Rekeys() uint64 {
+	return m.rekeys.Load()
+}
+
+// RecordTTFB records the time from a proxied connection request to its first
+// byte from the tunnel. early tells whether the stream sent early data.
+func (m *Metrics) RecordTTFB(d time.Duration, early bool) {
+	s := &m.ttfb[ttfbIndex(early)]
+	s.count.Add(1)
+	s.total.Add(int64(d))
+}
+
+// AverageTTFB returns the mean time to first byte in milliseconds (nil if no samples).
+func (m *Metrics) AverageTTFB(early bool) *int64 {
+	s := &m.ttfb[ttfbIndex(early)]
+	count := s.count.Load()
+	if count == 0 {
+		return nil
+	}
+	ms := time.Duration(s.total.Load() / count).Milliseconds()
+	return &ms
+}
+
+// RecordProbeRTT feeds one answered probe into the RTT, jitter and loss estimators.
+func (m *Metrics) RecordProbeRTT(rtt time.Duration) {
+	p := &m.probe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.samples == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt += (rtt - p.srtt) / 8
+		d := rtt - p.prevRTT
+		if d < 0 {
+			d = -d
+		}
+		p.jitter += (d - p.jitter) / 16
+	}
+	p.prevRTT = rtt
+	p.samples++
+	p.loss -= p.loss / 16
+}
+
+// RecordProbeLost counts a probe that got no answer in time.
+func (m *Metrics) RecordProbeLost() {
+	p := &m.probe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loss += (1 - p.loss) / 16
+}
+
+// ProbeStats returns smoothed RTT and jitter in milliseconds and the loss rate
+// in percent (all nil until the first probe was answered).
+func (m *Metrics) ProbeStats() (srtt, jitter *int64, lossPct *float64) {
+	p := &m.probe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.samples == 0 {
+		return nil, nil, nil
+	}
+	s, j, l := p.srtt.Milliseconds(), p.jitter.Milliseconds(), p.loss*100
+	return &s, &j, &l
+}
+
+func ttfbIndex(early bool) int {
+	if early {
+		return 1
+	}
+	return 0
+}
+
 // Snapshot returns current metrics as an event.
 func (m *Metrics) Snapshot() Event {
 	latency := m.LastLatency()
+	srtt, jitter, loss := m.ProbeStats()
 	return NewMetricsSnapshotEvent(
 		m.SessionUptime(),
 		m.ActiveStreams(),
@@ -109,6 +208,10 @@ func (m *Metrics) Snapshot() Event {
 		m.BytesSent(),
 		m.BytesReceived(),
 		latency,
+		m.Rekeys(),
+		m.AverageTTFB(false),
+		m.AverageTTFB(true),
+		srtt, jitter, loss,
 	)
 }
 
@@ -0,0 +1,645 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mux frame commands. Each TypeMux record carries one frame:
+// Cmd(u8) | SubID(u32) | Body, sealed with the stream's data cipher when set.
+const (
+	muxCmdSyn    = 0x01 // Body: Address; client opens a sub-stream to the target
+	muxCmdAck    = 0x02 // Body: Code(u16) | Message; gateway's dial result for a SYN
+	muxCmdData   = 0x03 // Body: payload bytes, counted against the receive window
+	muxCmdFin    = 0x04 // Sender will write no more data on the sub-stream
+	muxCmdRst    = 0x05 // Body: Code(u16); sub-stream aborted in both directions
+	muxCmdWindow = 0x06 // Body: Increment(u32); receiver consumed that many bytes
+)
+
+const (
+	// MuxInitialWindow is the per-sub-stream receive window. A receiver grants more
+	// credit with a WINDOW frame once it consumed half of it.
+	MuxInitialWindow = 256 * 1024
+	// MuxMaxStreams bounds concurrent sub-streams on one carrier stream.
+	MuxMaxStreams = 256
+
+	muxFrameHeaderLength = 5 // Cmd(1) | SubID(4)
+	muxAcceptBacklog     = 64
+)
+
+var (
+	// ErrMuxClosed is returned once the carrier stream is gone.
+	ErrMuxClosed = errors.New("mux session closed")
+	// ErrMuxStreamLimit is returned by Open when the carrier has MuxMaxStreams sub-streams.
+	ErrMuxStreamLimit = errors.New("mux stream limit reached")
+)
+
+// BuildMuxRecord creates a TypeMux record carrying one frame.
+func BuildMuxRecord(cmd byte, id uint32, body []byte, ng *NonceGenerator, dc *DataCipher) ([]byte, error) {
+	frame := make([]byte, muxFrameHeaderLength+len(body))
+	frame[0] = cmd
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	copy(frame[muxFrameHeaderLength:], body)
+	return buildSealedRecord(TypeMux, frame, 0, ng, dc)
+}
+
+// openMuxRecord authenticates a TypeMux record and splits the frame.
+// body aliases the record buffer.
+func openMuxRecord(record *Record, dc *DataCipher) (cmd byte, id uint32, body []byte, err error) {
+	frame := record.Payload
+	if dc != nil {
+		if frame, err = dc.open(record); err != nil {
+			return 0, 0, nil, errors.New("mux record authentication failed")
+		}
+	}
+	if len(frame) < muxFrameHeaderLength {
+		return 0, 0, nil, errors.New("mux frame too short")
+	}
+	return frame[0], binary.BigEndian.Uint32(frame[1:5]), frame[muxFrameHeaderLength:], nil
+}
+
+// MuxSession runs many TCP flows as framed sub-streams of one long-lived stream
+// (the carrier). The client opens sub-streams with Open, the gateway receives them
+// with Accept. Each sub-stream has its own flow-control window and half-close.
+type MuxSession struct {
+	carrier io.ReadWriteCloser
+	reader  *RecordReader
+	ng      *NonceGenerator
+	dc      *DataCipher
+	client  bool
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	err     error
+
+	accept    chan *MuxStream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMuxSession starts a mux session on carrier. reader must read from carrier;
+// records other than TypeMux are skipped. client selects which side opens sub-streams.
+func NewMuxSession(carrier io.ReadWriteCloser, reader *RecordReader, ng *NonceGenerator, dc *DataCipher, client bool) *MuxSession {
+	m := &MuxSession{
+		carrier: carrier,
+		reader:  reader,
+		ng:      ng,
+		dc:      dc,
+		client:  client,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  1,
+		done:    make(chan struct{}),
+	}
+	if !client {
+		m.accept = make(chan *MuxStream, muxAcceptBacklog)
+	}
+	go m.readLoop()
+	return m
+}
+
+// Open creates a sub-stream to host:port and waits for the gateway's dial result.
+// A failed dial is returned as a *RemoteError.
+func (m *MuxSession) Open(ctx context.Context, host string, port uint16) (*MuxStream, error) {
+	addr, err := appendAddress(nil, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	if len(m.streams) >= MuxMaxStreams {
+		m.mu.Unlock()
+		return nil, ErrMuxStreamLimit
+	}
+	s := newMuxStream(m, m.nextID, host, port)
+	s.ackCh = make(chan error, 1)
+	m.nextID += 2 // Client IDs stay odd
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(muxCmdSyn, s.id, addr); err != nil {
+		m.remove(s.id)
+		return nil, err
+	}
+
+	select {
+	case err := <-s.ackCh:
+		if err != nil {
+			m.remove(s.id)
+			return nil, err
+		}
+		return s, nil
+	case <-ctx.Done():
+		s.reset(CodeStreamAbort, ctx.Err())
+		return nil, ctx.Err()
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// Accept returns the next sub-stream opened by the client. The caller dials the
+// target and answers with MuxStream.Ack.
+func (m *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// NumStreams returns the number of open sub-streams.
+func (m *MuxSession) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+// Done is closed once the carrier stream failed or was closed.
+func (m *MuxSession) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the session ended, or nil while it is running.
+func (m *MuxSession) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close closes the carrier and fails every open sub-stream.
+func (m *MuxSession) Close() error {
+	m.fail(ErrMuxClosed)
+	return nil
+}
+
+func (m *MuxSession) fail(err error) {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.err = err
+		streams := m.streams
+		m.streams = make(map[uint32]*MuxStream)
+		m.mu.Unlock()
+
+		close(m.done)
+		_ = m.carrier.Close()
+		for _, s := range streams {
+			s.terminate(err)
+		}
+	})
+}
+
+func (m *MuxSession) writeFrame(cmd byte, id uint32, body []byte) error {
+	record, err := BuildMuxRecord(cmd, id, body, m.ng, m.dc)
+	if err != nil {
+		return err
+	}
+	m.writeMu.Lock()
+	_, err = m.carrier.Write(record)
+	m.writeMu.Unlock()
+	PutBuffer(record)
+	if err != nil {
+		m.fail(err)
+	}
+	return err
+}
+
+func (m *MuxSession) writeReset(id uint32, code uint16) {
+	var body [2]byte
+	binary.BigEndian.PutUint16(body[:], code)
+	_ = m.writeFrame(muxCmdRst, id, body[:])
+}
+
+func (m *MuxSession) lookup(id uint32) *MuxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *MuxSession) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *MuxSession) readLoop() {
+	for {
+		record, err := m.reader.ReadNextRecord()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrMuxClosed
+			}
+			m.fail(err)
+			return
+		}
+		if record.Type == TypeError {
+			m.fail(&RemoteError{Code: record.ErrorCode, Message: record.ErrorMessage})
+			return
+		}
+		if record.Type != TypeMux {
+			if record.RawBuffer != nil {
+				PutBuffer(record.RawBuffer)
+			}
+			continue
+		}
+		cmd, id, body, err := openMuxRecord(record, m.dc)
+		if err == nil {
+			err = m.dispatch(cmd, id, body)
+		}
+		if record.RawBuffer != nil {
+			PutBuffer(record.RawBuffer)
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// dispatch handles one frame. body must not be retained.
+func (m *MuxSession) dispatch(cmd byte, id uint32, body []byte) error {
+	if cmd == muxCmdSyn {
+		return m.handleSyn(id, body)
+	}
+	s := m.lookup(id)
+	if s == nil {
+		// Frames racing a local close or reset are dropped.
+		return nil
+	}
+	switch cmd {
+	case muxCmdAck:
+		if len(body) < 2 {
+			return errors.New("mux ack too short")
+		}
+		var err error
+		if code := binary.BigEndian.Uint16(body[0:2]); code != CodeOK {
+			err = &RemoteError{Code: code, Message: string(body[2:])}
+		}
+		if s.ackCh != nil {
+			select {
+			case s.ackCh <- err:
+			default:
+			}
+		}
+	case muxCmdData:
+		if !s.receive(body) {
+			m.writeReset(id, CodeResourceLimit)
+			s.terminate(errors.New("mux stream flow control violated"))
+		}
+	case muxCmdFin:
+		s.receiveFin()
+	case muxCmdRst:
+		code := CodeStreamAbort
+		if len(body) >= 2 {
+			code = binary.BigEndian.Uint16(body[0:2])
+		}
+		err := &RemoteError{Code: code, Message: "stream reset by peer"}
+		if s.ackCh != nil {
+			select {
+			case s.ackCh <- err:
+			default:
+			}
+		}
+		s.terminate(err)
+	case muxCmdWindow:
+		if len(body) != 4 {
+			return errors.New("invalid mux window frame")
+		}
+		s.grant(binary.BigEndian.Uint32(body))
+	}
+	return nil
+}
+
+func (m *MuxSession) handleSyn(id uint32, body []byte) error {
+	if m.client || id%2 == 0 {
+		return errors.New("unexpected mux syn")
+	}
+	host, port, _, err := parseAddress(body)
+	if err != nil {
+		m.writeReset(id, CodeMetadata)
+		return nil
+	}
+
+	m.mu.Lock()
+	if _, exists := m.streams[id]; exists {
+		m.mu.Unlock()
+		return fmt.Errorf("duplicate mux stream id %d", id)
+	}
+	if len(m.streams) >= MuxMaxStreams {
+		m.mu.Unlock()
+		m.writeReset(id, CodeResourceLimit)
+		return nil
+	}
+	s := newMuxStream(m, id, host, port)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	select {
+	case m.accept <- s:
+	default:
+		m.remove(id)
+		m.writeReset(id, CodeResourceLimit)
+	}
+	return nil
+}
+
+// MuxStream is one sub-stream of a MuxSession. It implements io.ReadWriteCloser
+// and CloseWrite for half-close.
+type MuxStream struct {
+	m    *MuxSession
+	id   uint32
+	host string
+	port uint16
+
+	ackCh chan error // Client side: dial result from the gateway
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte
+	consumed   int // Bytes read but not yet granted back to the peer
+	recvFin    bool
+	sendFin    bool
+	sendWindow int
+	err        error // Set by reset, peer RST or carrier failure
+	closed     bool
+}
+
+func newMuxStream(m *MuxSession, id uint32, host string, port uint16) *MuxStream {
+	s := &MuxStream{m: m, id: id, host: host, port: port, sendWindow: MuxInitialWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the sub-stream ID.
+func (s *MuxStream) ID() uint32 {
+	return s.id
+}
+
+// Target returns the destination requested by the SYN.
+func (s *MuxStream) Target() (string, uint16) {
+	return s.host, s.port
+}
+
+// Ack answers a sub-stream returned by Accept with the dial result. A non-OK code
+// also removes the sub-stream.
+func (s *MuxStream) Ack(code uint16, message string) error {
+	body := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(body[0:2], code)
+	copy(body[2:], message)
+	err := s.m.writeFrame(muxCmdAck, s.id, body)
+	if code != CodeOK {
+		s.terminate(&RemoteError{Code: code, Message: message})
+	}
+	return err
+}
+
+// Read reads data received on the sub-stream. It returns io.EOF after the peer's FIN.
+func (s *MuxStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 && !s.recvFin && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	s.consumed += n
+	credit := 0
+	if s.consumed >= MuxInitialWindow/2 && !s.recvFin {
+		credit = s.consumed
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if credit > 0 {
+		var body [4]byte
+		binary.BigEndian.PutUint32(body[:], uint32(credit))
+		_ = s.m.writeFrame(muxCmdWindow, s.id, body[:])
+	}
+	return n, nil
+}
+
+// Write sends p as DATA frames, blocking while the peer's window is exhausted.
+func (s *MuxStream) Write(p []byte) (int, error) {
+	written := 0
+	maxChunk := GetMaxRecordPayload() - muxFrameHeaderLength
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow <= 0 && !s.sendFin && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.sendFin {
+			s.mu.Unlock()
+			return written, ErrWriteClosed
+		}
+		n := min(len(p), s.sendWindow, maxChunk)
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.m.writeFrame(muxCmdData, s.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN: the peer reads io.EOF once buffered data is consumed.
+func (s *MuxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.sendFin || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sendFin = true
+	done := s.recvFin
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	err := s.m.writeFrame(muxCmdFin, s.id, nil)
+	if done {
+		s.m.remove(s.id)
+	}
+	return err
+}
+
+// Close releases the sub-stream. If either direction is still open the peer is
+// told with an RST so it stops sending.
+func (s *MuxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	graceful := s.sendFin && s.recvFin && len(s.buf) == 0
+	aborted := s.err != nil
+	s.mu.Unlock()
+
+	if !graceful && !aborted {
+		s.reset(CodeStreamAbort, net.ErrClosed)
+		return nil
+	}
+	s.terminate(net.ErrClosed)
+	return nil
+}
+
+// Reset aborts the sub-stream and tells the peer why with an RST carrying code.
+func (s *MuxStream) Reset(code uint16) {
+	s.reset(code, &RemoteError{Code: code, Message: "stream reset"})
+}
+
+// reset aborts the sub-stream locally and tells the peer.
+func (s *MuxStream) reset(code uint16, err error) {
+	s.m.writeReset(s.id, code)
+	s.terminate(err)
+}
+
+// terminate fails pending and future I/O with err and drops the sub-stream.
+func (s *MuxStream) terminate(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.buf = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.m.remove(s.id)
+}
+
+// receive queues DATA. It reports false if the peer overran the window.
+func (s *MuxStream) receive(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || s.recvFin {
+		return true
+	}
+	if len(s.buf)+s.consumed+len(data) > MuxInitialWindow {
+		return false
+	}
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	return true
+}
+
+func (s *MuxStream) receiveFin() {
+	s.mu.Lock()
+	s.recvFin = true
+	done := s.sendFin
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if done {
+		s.m.remove(s.id)
+	}
+}
+
+func (s *MuxStream) grant(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += int(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// openMuxStream opens a sub-stream to target on the session's mux carrier.
+func (sm *sessionManager) openMuxStream(target TargetAddress, suite byte) (*MuxStream, error) {
+	if !sm.peerHas(FeatureDataCipher) {
+		suite = CipherNone // The carrier is sealed only if the gateway confirmed the cipher
+	}
+	m, err := sm.muxCarrier(suite)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(sm.ctx, connectAckTimeout)
+	defer cancel()
+	return m.Open(ctx, target.Host, uint16(target.Port))
+}
+
+// muxCarrier returns the mux session of the current WebTransport session, opening
+// the carrier stream on first use or after the previous carrier (or session) died.
+func (sm *sessionManager) muxCarrier(suite byte) (*MuxSession, error) {
+	sm.muxMu.Lock()
+	defer sm.muxMu.Unlock()
+
+	sm.mu.RLock()
+	sess := sm.session
+	sm.mu.RUnlock()
+	if sm.mux != nil {
+		select {
+		case <-sm.mux.Done():
+			sm.mux = nil
+		default:
+			if sm.muxSess == sess {
+				if sm.muxSuite != suite {
+					return nil, errors.New("mux carrier uses a different data cipher")
+				}
+				return sm.mux, nil
+			}
+			// The session was rotated or retired by a GoAway: sub-streams still
+			// on the old carrier finish there, new ones go to a new carrier.
+			sm.mux = nil
+		}
+	}
+
+	dc, err := NewDataCipher(suite, sm.config.PSK)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(sm.ctx, 10*time.Second)
+	stream, _, err := sm.OpenStream(ctx)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	sm.mu.RLock()
+	sess = sm.session
+	ng := sm.nonceGen
+	sm.mu.RUnlock()
+
+	opts := Options{DataCipher: suite, Mux: true, Capabilities: LocalCapabilities()}
+	metaRecord, err := BuildKeyedMetadataRecord(sm.config.KeyID, udpRelayHost, 0, opts, sm.config.PSK, ng)
+	if err == nil {
+		_, err = stream.Write(metaRecord)
+	}
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, err
+	}
+
+	m := NewMuxSession(stream, NewRecordReader(stream), ng, dc, true)
+	go func() {
+		<-m.Done()
+		stream.CancelRead(0)
+	}()
+	log.Printf("[DEBUG] Session %s opened mux carrier stream", sm.sessionID)
+	sm.mux, sm.muxSess, sm.muxSuite = m, sess, suite
+	return m, nil
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PaddingProfile selects how data records are padded to hide application write
+// sizes. It is sent in metadata option 0x07 and the gateway pads its data records
+// for the stream with the same profile.
+type PaddingProfile byte
+
+const (
+	PaddingOff           PaddingProfile = 0x00 // No padding (default)
+	PaddingLight         PaddingProfile = 0x01 // Random 1..MaxPadding bytes per record
+	PaddingUniformBucket PaddingProfile = 0x02 // Pad record bodies to power-of-two buckets
+	PaddingMimicVideo    PaddingProfile = 0x03 // Pad record bodies to whole 7x188-byte TS payloads
+)
+
+const (
+	// paddingBucketMin is the smallest uniform-bucket size.
+	paddingBucketMin = 128
+	// paddingVideoUnit is seven 188-byte MPEG-TS packets, the common video-over-UDP payload.
+	paddingVideoUnit = 7 * 188
+	// dataTagSize is the AEAD tag added by every data cipher suite.
+	dataTagSize = 16
+)
+
+// ParsePaddingProfile maps a SessionConfig.PaddingProfile name to its profile.
+func ParsePaddingProfile(name string) (PaddingProfile, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "off", "none":
+		return PaddingOff, nil
+	case "light":
+		return PaddingLight, nil
+	case "uniform-bucket", "bucket":
+		return PaddingUniformBucket, nil
+	case "mimic-video", "video":
+		return PaddingMimicVideo, nil
+	default:
+		return PaddingOff, fmt.Errorf("unknown padding profile: %q", name)
+	}
+}
+
+// String returns the configuration name of the profile.
+func (p PaddingProfile) String() string {
+	switch p {
+	case PaddingOff:
+		return "off"
+	case PaddingLight:
+		return "light"
+	case PaddingUniformBucket:
+		return "uniform-bucket"
+	case PaddingMimicVideo:
+		return "mimic-video"
+	default:
+		return fmt.Sprintf("unknown(0x%02x)", byte(p))
+	}
+}
+
+// Padding decides the padding of each data record on one stream.
+type Padding struct {
+	Profile    PaddingProfile
+	MaxPadding uint16 // Upper bound for PaddingLight; 0 keeps the built-in 1..32 range
+}
+
+// Length returns the padding for a record whose payload (after sealing) is bodyLen bytes.
+func (p Padding) Length(bodyLen int) int {
+	switch p.Profile {
+	case PaddingLight:
+		return randomPadding(p.MaxPadding)
+	case PaddingUniformBucket:
+		return bucketPadding(bodyLen)
+	case PaddingMimicVideo:
+		return (paddingVideoUnit - bodyLen%paddingVideoUnit) % paddingVideoUnit
+	default:
+		return 0
+	}
+}
+
+// bucketPadding pads bodyLen up to the next power of two from paddingBucketMin.
+// Full-size records form the top bucket so bulk transfers pay almost nothing.
+func bucketPadding(bodyLen int) int {
+	top := GetMaxRecordPayload() + dataTagSize
+	if bodyLen >= top {
+		return 0
+	}
+	for size := paddingBucketMin; size < top; size <<= 1 {
+		if bodyLen <= size {
+			return size - bodyLen
+		}
+	}
+	return top - bodyLen
+}
+
+// BuildPaddedDataRecord creates a data record sealed with dc (if set) and padded
+// according to pad. Padding bytes are zero; they only shape record sizes.
+func BuildPaddedDataRecord(payload []byte, ng *NonceGenerator, dc *DataCipher, pad Padding) ([]byte, error) {
+	if pad.Profile == PaddingOff {
+		return buildSealedRecord(TypeData, payload, 0, ng, dc)
+	}
+	bodyLen := len(payload)
+	if dc != nil {
+		bodyLen += dc.Overhead()
+	}
+	return buildSealedRecord(TypeData, payload, pad.Length(bodyLen), ng, dc)
+}
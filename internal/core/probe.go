@@ -0,0 +1,190 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+const (
+	probeIntervalMin = 1 * time.Second
+	probeIntervalMax = 2 * time.Second
+	probeTimeout     = 3 * time.Second // A probe unanswered for this long counts as lost
+	probeDeadAfter   = 4               // Consecutive lost probes before the session is dropped
+
+	// probePayloadLength is Seq(4) | SentNano(8).
+	probePayloadLength = 12
+)
+
+// BuildProbeRecord creates a TypePing or TypePong record carrying a probe
+// sequence number and the sender's send time. Probes travel as WebTransport
+// datagrams: callers send the record without its 4-byte length prefix.
+func BuildProbeRecord(recordType byte, seq uint32, sent time.Time, ng *NonceGenerator) ([]byte, error) {
+	if recordType != TypePing && recordType != TypePong {
+		return nil, fmt.Errorf("not a probe record type: %d", recordType)
+	}
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, probePayloadLength)
+	binary.BigEndian.PutUint32(payload[0:4], seq)
+	binary.BigEndian.PutUint64(payload[4:12], uint64(sent.UnixNano()))
+	header, err := buildHeader(recordType, len(payload), 0, nonce[0:4], counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, payload, nil), nil
+}
+
+// ParseProbe returns the sequence number and send time of a probe record.
+// A pong echoes both fields of the ping it answers.
+func ParseProbe(record *Record) (uint32, time.Time, error) {
+	if record.Type != TypePing && record.Type != TypePong {
+		return 0, time.Time{}, fmt.Errorf("not a probe record: %d", record.Type)
+	}
+	if len(record.Payload) != probePayloadLength {
+		return 0, time.Time{}, fmt.Errorf("invalid probe payload length: %d", len(record.Payload))
+	}
+	seq := binary.BigEndian.Uint32(record.Payload[0:4])
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(record.Payload[4:12])))
+	return seq, sent, nil
+}
+
+// probeTracker matches pongs to outstanding pings for one session.
+type probeTracker struct {
+	mu        sync.Mutex
+	seq       uint32
+	pending   map[uint32]time.Time
+	confirmed bool // A pong arrived, so the gateway answers datagram probes
+	lost      int  // Consecutive probes lost since the last pong
+}
+
+func newProbeTracker() *probeTracker {
+	return &probeTracker{pending: make(map[uint32]time.Time)}
+}
+
+// next allocates a sequence number for a probe sent at now.
+func (p *probeTracker) next(now time.Time) uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	p.pending[p.seq] = now
+	return p.seq
+}
+
+// cancel forgets a probe that could not be sent.
+func (p *probeTracker) cancel(seq uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, seq)
+}
+
+// expire drops probes older than probeTimeout and returns how many were lost.
+func (p *probeTracker) expire(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for seq, sent := range p.pending {
+		if now.Sub(sent) >= probeTimeout {
+			delete(p.pending, seq)
+			n++
+		}
+	}
+	p.lost += n
+	return n
+}
+
+// pong resolves an outstanding probe. It reports false for unknown, expired
+// or duplicate sequence numbers; the RTT is measured against the local send
+// time, never the echoed one.
+func (p *probeTracker) pong(seq uint32, now time.Time) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent, ok := p.pending[seq]
+	if !ok {
+		return 0, false
+	}
+	delete(p.pending, seq)
+	p.confirmed = true
+	p.lost = 0
+	return now.Sub(sent), true
+}
+
+// isConfirmed reports whether any probe on this session was answered.
+func (p *probeTracker) isConfirmed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.confirmed
+}
+
+// dead reports whether enough consecutive probes were lost to give up on the session.
+func (p *probeTracker) dead() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lost >= probeDeadAfter
+}
+
+// probeOnce expires overdue probes and sends the next one. It reports whether
+// the session should be considered dead. Losses only count once the gateway
+// is known to answer probes, so an older gateway never gets its session dropped.
+func (sm *sessionManager) probeOnce(sess *webtransport.Session, ng *NonceGenerator, probes *probeTracker) bool {
+	now := time.Now()
+	lost := probes.expire(now)
+	supported := probes.isConfirmed() || sm.peerHas(FeatureProbe)
+	if supported {
+		for i := 0; i < lost; i++ {
+			sm.metrics.RecordProbeLost()
+		}
+		if probes.dead() {
+			return true
+		}
+	}
+
+	seq := probes.next(now)
+	record, err := BuildProbeRecord(TypePing, seq, now, ng)
+	if err != nil {
+		probes.cancel(seq)
+		return false
+	}
+	if err := sess.SendDatagram(record[4:]); err != nil {
+		probes.cancel(seq)
+	}
+	return false
+}
+
+// handlePong feeds an answered probe into the session metrics.
+func (sm *sessionManager) handlePong(probes *probeTracker, record *Record) {
+	seq, _, err := ParseProbe(record)
+	if err != nil {
+		return
+	}
+	rtt, ok := probes.pong(seq, time.Now())
+	if !ok {
+		return
+	}
+	sm.metrics.RecordProbeRTT(rtt)
+	sm.metrics.RecordLatency(rtt.Milliseconds())
+}
+
+// dropSession forgets sess if it is still the current session, so the next
+// stream dials a fresh one instead of waiting on a dead connection.
+func (sm *sessionManager) dropSession(sess *webtransport.Session, reason string) {
+	sm.mu.Lock()
+	if sm.session != sess {
+		sm.mu.Unlock()
+		return
+	}
+	id := sm.sessionID
+	sm.session = nil
+	sm.mu.Unlock()
+
+	log.Printf("[DEBUG] Session %s dropped: %s", id, reason)
+	_ = sess.CloseWithError(0, reason)
+	sm.onEvent(NewSessionClosedEvent(id, &reason, nil))
+	sm.metrics.RecordSessionEnd()
+}
@@ -23,15 +23,31 @@ import (
 
 const (
 	ProtocolLabel      = "aether-realist-v5"
-	ProtocolVersion    = 0x05
+	ProtocolVersion    = 0x05 // Header version written by this build; readable by every supported peer
+	// MinProtocolVersion and MaxProtocolVersion bound the versions this build accepts
+	// and advertises in the capabilities option. V6 adds capability negotiation.
+	MinProtocolVersion = 0x05
+	MaxProtocolVersion = 0x06
 	RecordHeaderLength = 30
 	TypeMetadata       = 0x01
 	TypeData           = 0x02
 	TypePing           = 0x03
 	TypePong           = 0x04
+	TypeDatagram       = 0x05
+	TypeKeyedMetadata  = 0x06 // Metadata prefixed with a clear key ID (multi-user gateways)
+	TypeRekey          = 0x07 // In-session SessionID/key epoch switch
+	TypeCapabilities   = 0x08 // Negotiated capability set, first gateway record on a stream
+	TypeFin            = 0x09 // Sender is done writing (TCP half-close)
+	TypeConnectAck     = 0x0A // Gateway's target dial result
+	TypeMux            = 0x0B // Framed sub-stream traffic on a mux carrier stream
+	TypeGoAway         = 0x0C // Gateway is draining the session, sent as a datagram
 	TypeError          = 0x7f
 	MaxRecordSize      = 1 * 1024 * 1024
-	MaxCounterValue    = uint64(1 << 32) // 2^32 rekey threshold
+	MaxCounterValue    = uint64(1 << 32) // 2^32 hard limit per SessionID
+	// RekeyThreshold leaves headroom below MaxCounterValue for in-flight records while a rekey completes.
+	RekeyThreshold = MaxCounterValue - MaxCounterValue/8
+	// MaxKeyIDLength bounds the clear key ID carried by keyed metadata and datagram records.
+	MaxKeyIDLength = 64
 	// DefaultMaxRecordPayload is the default data record chunk size.
 	DefaultMaxRecordPayload = 16 * 1024
 )
@@ -118,6 +134,7 @@ const (
 )
 
 // ErrCounterExhausted is returned when the counter reaches MaxCounterValue.
+// Callers are expected to rekey (see NeedsRekey) well before this happens.
 var ErrCounterExhausted = errors.New("counter exhausted, session rekey required")
 
 // Metadata represents the connection target information
@@ -129,7 +146,39 @@ type Metadata struct {
 
 // Options represents the connection options
 type Options struct {
-	MaxPadding uint16
+	MaxPadding     uint16
+	DataCipher     byte           // CipherNone, CipherAES128GCM or CipherChaCha20Poly1305
+	UDPRelay       bool           // Stream carries TypeDatagram records instead of a TCP pipe
+	Mux            bool           // Stream carries TypeMux sub-stream frames instead of a TCP pipe
+	EarlyData      bool           // First data record was written together with the metadata
+	PaddingProfile PaddingProfile // Data record shaping, applied by both ends of the stream
+	ReverseName    string         // Reverse tunnel binding the stream registers (client) or serves (gateway)
+	ReversePort    uint16         // Gateway port of that binding
+	Capabilities   *Capabilities  // Client version range and features; nil for V5 clients
+}
+
+// Option TLV types carried in the metadata payload.
+// Unknown options are skipped, unless the type has optionCritical set,
+// in which case the receiver must reject the stream (see UnsupportedOptionError).
+const (
+	optionMaxPadding   = 0x01
+	optionDataCipher   = 0x02
+	optionUDPRelay     = 0x03
+	optionCapabilities = 0x04
+	optionMux          = 0x05
+	optionEarlyData    = 0x06
+	optionPadding      = 0x07
+	optionCritical     = 0x80
+	optionReverse      = optionCritical | 0x08 // Port(2) | Name
+)
+
+// UnsupportedOptionError reports a critical metadata option the receiver does not understand.
+type UnsupportedOptionError struct {
+	Type byte
+}
+
+func (e *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("unsupported critical option: 0x%02x", e.Type)
 }
 
 // Record represents a parsed record
@@ -143,22 +192,37 @@ type Record struct {
 	Header        []byte
 	SessionID     []byte
 	Counter       uint64
+	ErrorCode     uint16
 	ErrorMessage  string
 	RawBuffer     []byte // Original pooled buffer for later release
 }
 
 // NonceGenerator generates unique nonces using SessionID + monotonic counter.
+// The SessionID/counter pair lives in an epoch that is swapped atomically on rekey,
+// so streams sharing the generator switch over without coordination.
 type NonceGenerator struct {
+	current atomic.Pointer[nonceEpoch]
+	rekeyAt uint64 // counter value at which NeedsRekey reports true
+
+	mu      sync.Mutex
+	pending *nonceEpoch // prepared by PrepareRekey, activated by CommitRekey
+}
+
+// nonceEpoch is one SessionID with its counter.
+type nonceEpoch struct {
 	sessionID [4]byte
+	epoch     uint32
 	counter   atomic.Uint64
 }
 
 // NewNonceGenerator creates a new NonceGenerator with a random SessionID.
 func NewNonceGenerator() (*NonceGenerator, error) {
-	ng := &NonceGenerator{}
-	if _, err := rand.Read(ng.sessionID[:]); err != nil {
+	ng := &NonceGenerator{rekeyAt: RekeyThreshold}
+	st := &nonceEpoch{}
+	if _, err := rand.Read(st.sessionID[:]); err != nil {
 		return nil, err
 	}
+	ng.current.Store(st)
 	return ng, nil
 }
 
@@ -166,16 +230,17 @@ func NewNonceGenerator() (*NonceGenerator, error) {
 // Returns ErrCounterExhausted if the counter reaches MaxCounterValue.
 func (ng *NonceGenerator) Next() ([12]byte, uint64, error) {
 	for {
-		current := ng.counter.Load()
+		st := ng.current.Load()
+		current := st.counter.Load()
 		if current >= MaxCounterValue {
 			return [12]byte{}, 0, ErrCounterExhausted
 		}
-		if !ng.counter.CompareAndSwap(current, current+1) {
+		if !st.counter.CompareAndSwap(current, current+1) {
 			continue
 		}
 
 		var nonce [12]byte
-		copy(nonce[0:4], ng.sessionID[:])
+		copy(nonce[0:4], st.sessionID[:])
 		binary.BigEndian.PutUint64(nonce[4:12], current)
 		return nonce, current, nil
 	}
@@ -183,12 +248,69 @@ func (ng *NonceGenerator) Next() ([12]byte, uint64, error) {
 
 // SessionID returns the session ID.
 func (ng *NonceGenerator) SessionID() [4]byte {
-	return ng.sessionID
+	return ng.current.Load().sessionID
 }
 
 // Counter returns the current counter value (for monitoring).
 func (ng *NonceGenerator) Counter() uint64 {
-	return ng.counter.Load()
+	return ng.current.Load().counter.Load()
+}
+
+// Epoch returns the key epoch (0 until the first rekey).
+func (ng *NonceGenerator) Epoch() uint32 {
+	return ng.current.Load().epoch
+}
+
+// NeedsRekey reports whether the counter has passed the rekey threshold.
+func (ng *NonceGenerator) NeedsRekey() bool {
+	return ng.Counter() >= ng.rekeyAt
+}
+
+// PrepareRekey allocates the next epoch with a fresh random SessionID without
+// activating it. Repeated calls return the same pending epoch until CommitRekey.
+func (ng *NonceGenerator) PrepareRekey() ([4]byte, uint32, error) {
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+	if ng.pending != nil {
+		return ng.pending.sessionID, ng.pending.epoch, nil
+	}
+	cur := ng.current.Load()
+	next := &nonceEpoch{epoch: cur.epoch + 1}
+	for {
+		if _, err := rand.Read(next.sessionID[:]); err != nil {
+			return [4]byte{}, 0, err
+		}
+		if next.sessionID != cur.sessionID {
+			break
+		}
+	}
+	ng.pending = next
+	return next.sessionID, next.epoch, nil
+}
+
+// CommitRekey activates the epoch allocated by PrepareRekey.
+// Records built afterwards carry the new SessionID (and therefore new keys).
+func (ng *NonceGenerator) CommitRekey() error {
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+	if ng.pending == nil {
+		return errors.New("no pending rekey")
+	}
+	ng.current.Store(ng.pending)
+	ng.pending = nil
+	return nil
+}
+
+// Rekey switches to a new SessionID immediately (PrepareRekey + CommitRekey).
+func (ng *NonceGenerator) Rekey() ([4]byte, uint32, error) {
+	sid, epoch, err := ng.PrepareRekey()
+	if err != nil {
+		return [4]byte{}, 0, err
+	}
+	if err := ng.CommitRekey(); err != nil {
+		return [4]byte{}, 0, err
+	}
+	return sid, epoch, nil
 }
 
 const (
@@ -201,7 +323,23 @@ const (
 // BuildMetadataRecord creates an encrypted metadata record.
 // V5: Requires NonceGenerator for counter-based nonce.
 func BuildMetadataRecord(host string, port uint16, maxPadding uint16, psk string, ng *NonceGenerator) ([]byte, error) {
-	plaintext, err := buildMetadataPayload(host, port, maxPadding)
+	return BuildMetadataRecordWithOptions(host, port, Options{MaxPadding: maxPadding}, psk, ng)
+}
+
+// BuildMetadataRecordWithOptions creates an encrypted metadata record carrying the full options TLV.
+func BuildMetadataRecordWithOptions(host string, port uint16, opts Options, psk string, ng *NonceGenerator) ([]byte, error) {
+	return BuildKeyedMetadataRecord("", host, port, opts, psk, ng)
+}
+
+// BuildKeyedMetadataRecord creates a metadata record that names the PSK it was sealed with,
+// so a multi-user gateway can pick the key directly. An empty keyID produces a plain
+// TypeMetadata record; otherwise the record is TypeKeyedMetadata with payload
+// KeyIDLen(u8) | KeyID | Ciphertext and the key ID authenticated as AAD.
+func BuildKeyedMetadataRecord(keyID string, host string, port uint16, opts Options, psk string, ng *NonceGenerator) ([]byte, error) {
+	if len(keyID) > MaxKeyIDLength {
+		return nil, fmt.Errorf("key ID too long: %d", len(keyID))
+	}
+	plaintext, err := buildMetadataPayload(host, port, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -228,8 +366,15 @@ func BuildMetadataRecord(host string, port uint16, maxPadding uint16, psk string
 		return nil, err
 	}
 
+	recordType := byte(TypeMetadata)
+	var prefix []byte
+	if keyID != "" {
+		recordType = TypeKeyedMetadata
+		prefix = append([]byte{byte(len(keyID))}, keyID...)
+	}
+
 	// Use final ciphertext length for AAD consistency
-	ciphertextLen := len(plaintext) + gcm.Overhead()
+	ciphertextLen := len(prefix) + len(plaintext) + gcm.Overhead()
 	paddingLen, err := randomPaddingRange(metadataPaddingMin, metadataPaddingMax)
 	if err != nil {
 		return nil, err
@@ -238,24 +383,34 @@ func BuildMetadataRecord(host string, port uint16, maxPadding uint16, psk string
 	if _, err := rand.Read(padding); err != nil {
 		return nil, err
 	}
-	header, err := buildHeader(TypeMetadata, ciphertextLen, paddingLen, sessionID, counter)
+	header, err := buildHeader(recordType, ciphertextLen, paddingLen, sessionID, counter)
 	if err != nil {
 		return nil, err
 	}
 
 	// V5: Nonce = SessionID || Counter
-	ciphertext := gcm.Seal(nil, nonce[:], plaintext, header)
+	aad := append(header[:len(header):len(header)], prefix...)
+	payload := gcm.Seal(prefix, nonce[:], plaintext, aad)
 
-	return buildRecord(header, ciphertext, padding), nil
+	return buildRecord(header, payload, padding), nil
 }
 
 // BuildDataRecord creates a data record with optional padding using pooled buffers.
 // V5.1: Automatically forces padding to 0 for TypeData to maximize throughput.
 // V5: Requires NonceGenerator for counter-based nonce.
 func BuildDataRecord(payload []byte, _ uint16, ng *NonceGenerator) ([]byte, error) {
-	// V5.1 Optimization: Data records MUST NOT have padding.
-	const paddingLength = 0
-	
+	return buildPooledRecord(TypeData, payload, 0, ng)
+}
+
+// BuildSealedDataRecord creates a data record whose payload is sealed with dc.
+// Nonce is SessionID||Counter and the AAD is the 30-byte header, same as metadata.
+// Falls back to BuildDataRecord when dc is nil.
+func BuildSealedDataRecord(payload []byte, ng *NonceGenerator, dc *DataCipher) ([]byte, error) {
+	return buildSealedRecord(TypeData, payload, 0, ng, dc)
+}
+
+// buildPooledRecord creates a record in a pooled buffer with paddingLength zero bytes.
+func buildPooledRecord(recordType byte, payload []byte, paddingLength int, ng *NonceGenerator) ([]byte, error) {
 	// V5.1: Get nonce from generator
 	nonce, counter, err := ng.Next()
 	if err != nil {
@@ -263,7 +418,7 @@ func BuildDataRecord(payload []byte, _ uint16, ng *NonceGenerator) ([]byte, erro
 	}
 	sessionID := nonce[0:4]
 
-	totalLength := RecordHeaderLength + len(payload)
+	totalLength := RecordHeaderLength + len(payload) + paddingLength
 	// Use pool for data records which are the bulk of traffic
 	buf := GetBuffer()
 	
@@ -276,15 +431,54 @@ func BuildDataRecord(payload []byte, _ uint16, ng *NonceGenerator) ([]byte, erro
 
 	binary.BigEndian.PutUint32(buf[0:4], uint32(totalLength))
 	// Zero-alloc: build header directly into pool buffer
-	if err := buildHeaderInto(buf[4:4+RecordHeaderLength], TypeData, len(payload), paddingLength, sessionID, counter); err != nil {
+	if err := buildHeaderInto(buf[4:4+RecordHeaderLength], recordType, len(payload), paddingLength, sessionID, counter); err != nil {
 		PutBuffer(buf)
 		return nil, err
 	}
 	copy(buf[4+RecordHeaderLength:], payload)
+	clear(buf[4+RecordHeaderLength+len(payload):])
 	
 	return buf, nil
 }
 
+// buildSealedRecord creates a record of recordType whose payload is sealed with dc,
+// or left in the clear when dc is nil, followed by paddingLength zero bytes.
+func buildSealedRecord(recordType byte, payload []byte, paddingLength int, ng *NonceGenerator, dc *DataCipher) ([]byte, error) {
+	if dc == nil {
+		return buildPooledRecord(recordType, payload, paddingLength, ng)
+	}
+
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	aead, err := dc.aeadFor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedLen := len(payload) + aead.Overhead()
+	totalLength := RecordHeaderLength + sealedLen + paddingLength
+	buf := GetBuffer()
+	if cap(buf) < 4+totalLength {
+		buf = make([]byte, 4+totalLength)
+	} else {
+		buf = buf[:4+totalLength]
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(totalLength))
+	header := buf[4 : 4+RecordHeaderLength]
+	if err := buildHeaderInto(header, recordType, sealedLen, paddingLength, sessionID, counter); err != nil {
+		PutBuffer(buf)
+		return nil, err
+	}
+	aead.Seal(buf[4+RecordHeaderLength:4+RecordHeaderLength], nonce[:], payload, header)
+	clear(buf[4+RecordHeaderLength+sealedLen:])
+
+	return buf, nil
+}
+
 // BuildPingRecord creates a ping record.
 // V5: Requires NonceGenerator for counter-based nonce.
 func BuildPingRecord(ng *NonceGenerator) ([]byte, error) {
@@ -297,6 +491,28 @@ func BuildPongRecord(ng *NonceGenerator) ([]byte, error) {
 	return buildControlRecord(TypePong, ng)
 }
 
+// BuildFinRecord creates a FIN record: the sender will write no more data on the stream.
+// With a data cipher the empty payload is sealed so the FIN cannot be forged.
+func BuildFinRecord(ng *NonceGenerator, dc *DataCipher) ([]byte, error) {
+	if dc == nil {
+		return buildControlRecord(TypeFin, ng)
+	}
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	aead, err := dc.aeadFor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	header, err := buildHeader(TypeFin, aead.Overhead(), 0, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, aead.Seal(nil, nonce[:], nil, header), nil), nil
+}
+
 // buildRecord assembles a complete record.
 func buildRecord(header, payload, padding []byte) []byte {
 	totalLength := RecordHeaderLength + len(payload) + len(padding)
@@ -357,7 +573,23 @@ func buildControlRecord(recordType byte, ng *NonceGenerator) ([]byte, error) {
 }
 
 // buildMetadataPayload creates the plaintext metadata.
-func buildMetadataPayload(host string, port uint16, maxPadding uint16) ([]byte, error) {
+func buildMetadataPayload(host string, port uint16, opts Options) ([]byte, error) {
+	options := buildOptions(opts)
+	payload, err := appendAddress(make([]byte, 0, 1+2+1+len(host)+2+len(options)), host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	optionsLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(optionsLen, uint16(len(options)))
+	payload = append(payload, optionsLen...)
+	payload = append(payload, options...)
+	return payload, nil
+}
+
+// appendAddress appends AddrType(u8) | Port(u16) | Address, the target encoding
+// shared by metadata and datagram records.
+func appendAddress(dst []byte, host string, port uint16) ([]byte, error) {
 	var addrType byte
 	var addrBytes []byte
 
@@ -377,32 +609,48 @@ func buildMetadataPayload(host string, port uint16, maxPadding uint16) ([]byte,
 		addrBytes = append([]byte{byte(len(host))}, []byte(host)...)
 	}
 
-	options := buildOptions(maxPadding)
-	payload := make([]byte, 0, 1+2+len(addrBytes)+2+len(options))
-	payload = append(payload, addrType)
-
+	dst = append(dst, addrType)
 	portBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(portBytes, port)
-	payload = append(payload, portBytes...)
-	payload = append(payload, addrBytes...)
-
-	optionsLen := make([]byte, 2)
-	binary.BigEndian.PutUint16(optionsLen, uint16(len(options)))
-	payload = append(payload, optionsLen...)
-	payload = append(payload, options...)
-	return payload, nil
+	dst = append(dst, portBytes...)
+	dst = append(dst, addrBytes...)
+	return dst, nil
 }
 
 // buildOptions creates the options TLV.
-func buildOptions(maxPadding uint16) []byte {
-	if maxPadding == 0 {
-		return nil
+func buildOptions(opts Options) []byte {
+	var options []byte
+	if opts.MaxPadding != 0 {
+		option := make([]byte, 4)
+		option[0] = optionMaxPadding
+		option[1] = 0x02
+		binary.BigEndian.PutUint16(option[2:4], opts.MaxPadding)
+		options = append(options, option...)
+	}
+	if opts.DataCipher != CipherNone {
+		options = append(options, optionDataCipher, 0x01, opts.DataCipher)
+	}
+	if opts.UDPRelay {
+		options = append(options, optionUDPRelay, 0x00)
+	}
+	if opts.Mux {
+		options = append(options, optionMux, 0x00)
 	}
-	option := make([]byte, 4)
-	option[0] = 0x01
-	option[1] = 0x02
-	binary.BigEndian.PutUint16(option[2:4], maxPadding)
-	return option
+	if opts.EarlyData {
+		options = append(options, optionEarlyData, 0x00)
+	}
+	if opts.PaddingProfile != PaddingOff {
+		options = append(options, optionPadding, 0x01, byte(opts.PaddingProfile))
+	}
+	if opts.ReverseName != "" && len(opts.ReverseName) <= 253 {
+		options = append(options, optionReverse, byte(2+len(opts.ReverseName)))
+		options = binary.BigEndian.AppendUint16(options, opts.ReversePort)
+		options = append(options, opts.ReverseName...)
+	}
+	if opts.Capabilities != nil {
+		options = appendCapabilities(options, opts.Capabilities)
+	}
+	return options
 }
 
 // deriveKey derives AES key from PSK using HKDF.
@@ -452,6 +700,32 @@ func randomPaddingRange(min, max int) (int, error) {
 	return min + int(n.Int64()), nil
 }
 
+// MetadataKeyID returns the key ID named by a metadata record.
+// Plain TypeMetadata records carry no key ID and return "".
+func MetadataKeyID(record *Record) (string, error) {
+	keyID, _, err := splitMetadataKeyID(record)
+	return keyID, err
+}
+
+// splitMetadataKeyID separates the clear key ID prefix from the ciphertext.
+func splitMetadataKeyID(record *Record) (string, []byte, error) {
+	switch record.Type {
+	case TypeMetadata:
+		return "", record.Payload, nil
+	case TypeKeyedMetadata:
+		if len(record.Payload) < 1 {
+			return "", nil, fmt.Errorf("missing key ID")
+		}
+		keyIDLen := int(record.Payload[0])
+		if keyIDLen == 0 || keyIDLen > MaxKeyIDLength || len(record.Payload) < 1+keyIDLen {
+			return "", nil, fmt.Errorf("invalid key ID length: %d", keyIDLen)
+		}
+		return string(record.Payload[1 : 1+keyIDLen]), record.Payload[1+keyIDLen:], nil
+	default:
+		return "", nil, fmt.Errorf("not a metadata record: %d", record.Type)
+	}
+}
+
 // DecryptMetadata decrypts the metadata record
 // V5: Uses SessionID as salt and SessionID||Counter as nonce
 func DecryptMetadata(record *Record, psk string) (*Metadata, error) {
@@ -472,8 +746,15 @@ func DecryptMetadata(record *Record, psk string) (*Metadata, error) {
 	copy(nonce[0:4], record.SessionID)
 	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
 
-	header := make([]byte, len(record.Header))
-	copy(header, record.Header)
+	_, ciphertext, err := splitMetadataKeyID(record)
+	if err != nil {
+		return nil, err
+	}
+	// AAD is the header followed by the key ID prefix (empty for TypeMetadata).
+	prefixLen := len(record.Payload) - len(ciphertext)
+	aad := make([]byte, 0, len(record.Header)+prefixLen)
+	aad = append(aad, record.Header...)
+	aad = append(aad, record.Payload[:prefixLen]...)
 
 	// V5: Use SessionID as HKDF salt
 	key, err := deriveKey(psk, record.SessionID)
@@ -491,7 +772,7 @@ func DecryptMetadata(record *Record, psk string) (*Metadata, error) {
 	}
 
 	decryptStart := time.Now()
-	plaintext, err := gcm.Open(nil, nonce[:], record.Payload, header)
+	plaintext, err := gcm.Open(nil, nonce[:], ciphertext, aad)
 	perfObserveDownDecrypt(time.Since(decryptStart))
 	if err != nil {
 		return nil, err
@@ -520,6 +801,39 @@ func ParseMetadata(buffer []byte) (*Metadata, error) {
 	if len(buffer) < 3 {
 		return nil, fmt.Errorf("metadata too short")
 	}
+	host, port, offset, err := parseAddress(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buffer) < offset+2 {
+		return nil, fmt.Errorf("missing options length")
+	}
+	optionsLength := binary.BigEndian.Uint16(buffer[offset : offset+2])
+	offset += 2
+
+	if len(buffer) < offset+int(optionsLength) {
+		return nil, fmt.Errorf("missing options payload")
+	}
+	optionsPayload := buffer[offset : offset+int(optionsLength)]
+
+	options, err := parseOptions(optionsPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Metadata{
+		Host:    host,
+		Port:    port,
+		Options: options,
+	}, nil
+}
+
+// parseAddress decodes AddrType(u8) | Port(u16) | Address and returns the bytes consumed.
+func parseAddress(buffer []byte) (string, uint16, int, error) {
+	if len(buffer) < 3 {
+		return "", 0, 0, fmt.Errorf("metadata too short")
+	}
 	addressType := buffer[0]
 	port := binary.BigEndian.Uint16(buffer[1:3])
 	offset := 3
@@ -527,52 +841,34 @@ func ParseMetadata(buffer []byte) (*Metadata, error) {
 	var host string
 	if addressType == 0x01 { // IPv4
 		if len(buffer) < offset+4 {
-			return nil, fmt.Errorf("invalid ipv4 length")
+			return "", 0, 0, fmt.Errorf("invalid ipv4 length")
 		}
 		host = net.IP(buffer[offset : offset+4]).String()
 		offset += 4
 	} else if addressType == 0x02 { // IPv6
 		if len(buffer) < offset+16 {
-			return nil, fmt.Errorf("invalid ipv6 length")
+			return "", 0, 0, fmt.Errorf("invalid ipv6 length")
 		}
 		host = net.IP(buffer[offset : offset+16]).String()
 		offset += 16
 	} else if addressType == 0x03 { // Domain
 		if len(buffer) < offset+1 {
-			return nil, fmt.Errorf("invalid domain length")
+			return "", 0, 0, fmt.Errorf("invalid domain length")
 		}
 		domainLen := int(buffer[offset])
 		offset += 1
 		if len(buffer) < offset+domainLen {
-			return nil, fmt.Errorf("invalid domain content length")
+			return "", 0, 0, fmt.Errorf("invalid domain content length")
 		}
 		host = string(buffer[offset : offset+domainLen])
 		offset += domainLen
 	} else {
-		return nil, fmt.Errorf("unsupported address type: %d", addressType)
-	}
-
-	if len(buffer) < offset+2 {
-		return nil, fmt.Errorf("missing options length")
-	}
-	optionsLength := binary.BigEndian.Uint16(buffer[offset : offset+2])
-	offset += 2
-
-	if len(buffer) < offset+int(optionsLength) {
-		return nil, fmt.Errorf("missing options payload")
+		return "", 0, 0, fmt.Errorf("unsupported address type: %d", addressType)
 	}
-	optionsPayload := buffer[offset : offset+int(optionsLength)]
-
-	options := parseOptions(optionsPayload)
-
-	return &Metadata{
-		Host:    host,
-		Port:    port,
-		Options: options,
-	}, nil
+	return host, port, offset, nil
 }
 
-func parseOptions(buffer []byte) Options {
+func parseOptions(buffer []byte) (Options, error) {
 	opts := Options{}
 	offset := 0
 	for offset+2 <= len(buffer) {
@@ -585,11 +881,29 @@ func parseOptions(buffer []byte) Options {
 		value := buffer[offset : offset+length]
 		offset += length
 
-		if typ == 0x01 && len(value) == 2 {
+		switch {
+		case typ == optionMaxPadding && len(value) == 2:
 			opts.MaxPadding = binary.BigEndian.Uint16(value)
+		case typ == optionDataCipher && len(value) == 1:
+			opts.DataCipher = value[0]
+		case typ == optionUDPRelay:
+			opts.UDPRelay = true
+		case typ == optionMux:
+			opts.Mux = true
+		case typ == optionEarlyData:
+			opts.EarlyData = true
+		case typ == optionPadding && len(value) == 1:
+			opts.PaddingProfile = PaddingProfile(value[0])
+		case typ == optionReverse && len(value) > 2:
+			opts.ReversePort = binary.BigEndian.Uint16(value[:2])
+			opts.ReverseName = string(value[2:])
+		case typ == optionCapabilities && len(value) == capabilitiesLength:
+			opts.Capabilities = parseCapabilities(value)
+		case typ&optionCritical != 0:
+			return opts, &UnsupportedOptionError{Type: typ}
 		}
 	}
-	return opts
+	return opts, nil
 }
 
 // BuildErrorRecord creates an error record
@@ -3,8 +3,15 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"testing"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // TestBuildHeaderInto_MatchesBuildHeader verifies that buildHeaderInto produces
@@ -183,3 +190,1073 @@ func TestMultipleRecordRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+// TestSealedDataRecordRoundTrip verifies AEAD data records for every suite,
+// including the metadata options TLV that negotiates them.
+func TestSealedDataRecordRoundTrip(t *testing.T) {
+	for _, suite := range []byte{CipherAES128GCM, CipherChaCha20Poly1305} {
+		t.Run(DataCipherName(suite), func(t *testing.T) {
+			ng, err := NewNonceGenerator()
+			if err != nil {
+				t.Fatalf("NewNonceGenerator: %v", err)
+			}
+			dc, err := NewDataCipher(suite, "test-psk")
+			if err != nil {
+				t.Fatalf("NewDataCipher: %v", err)
+			}
+
+			meta, err := BuildMetadataRecordWithOptions("example.com", 443, Options{DataCipher: suite}, "test-psk", ng)
+			if err != nil {
+				t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+			}
+			payload := []byte("sealed payload")
+			record, err := BuildSealedDataRecord(payload, ng, dc)
+			if err != nil {
+				t.Fatalf("BuildSealedDataRecord: %v", err)
+			}
+			if bytes.Contains(record, payload) {
+				t.Fatal("sealed record leaks plaintext")
+			}
+
+			var buf bytes.Buffer
+			buf.Write(meta)
+			buf.Write(record)
+			PutBuffer(record)
+
+			reader := NewRecordReader(&buf)
+			metaRecord, err := reader.ReadNextRecord()
+			if err != nil {
+				t.Fatalf("ReadNextRecord: %v", err)
+			}
+			parsed, err := DecryptMetadata(metaRecord, "test-psk")
+			if err != nil {
+				t.Fatalf("DecryptMetadata: %v", err)
+			}
+			if parsed.Options.DataCipher != suite {
+				t.Fatalf("DataCipher option: got %d, want %d", parsed.Options.DataCipher, suite)
+			}
+
+			peer, err := NewDataCipher(parsed.Options.DataCipher, "test-psk")
+			if err != nil {
+				t.Fatalf("NewDataCipher(peer): %v", err)
+			}
+			reader.SetDataCipher(peer)
+			out := make([]byte, 64)
+			n, err := reader.Read(out)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if !bytes.Equal(out[:n], payload) {
+				t.Errorf("Payload: got %q, want %q", out[:n], payload)
+			}
+		})
+	}
+}
+
+func TestParsePaddingProfile(t *testing.T) {
+	for _, profile := range []PaddingProfile{PaddingOff, PaddingLight, PaddingUniformBucket, PaddingMimicVideo} {
+		got, err := ParsePaddingProfile(profile.String())
+		if err != nil || got != profile {
+			t.Errorf("ParsePaddingProfile(%q): got %v, %v", profile.String(), got, err)
+		}
+	}
+	if got, err := ParsePaddingProfile(""); err != nil || got != PaddingOff {
+		t.Errorf("ParsePaddingProfile(\"\"): got %v, %v", got, err)
+	}
+	if _, err := ParsePaddingProfile("loud"); err == nil {
+		t.Error("ParsePaddingProfile(\"loud\"): expected error")
+	}
+}
+
+func TestPaddingLength(t *testing.T) {
+	top := GetMaxRecordPayload() + dataTagSize
+	bucket := Padding{Profile: PaddingUniformBucket}
+	for body, want := range map[int]int{1: 127, 128: 0, 129: 127, 1000: 24, top - 1: 1, top: 0} {
+		if got := bucket.Length(body); got != want {
+			t.Errorf("uniform-bucket Length(%d): got %d, want %d", body, got, want)
+		}
+	}
+	video := Padding{Profile: PaddingMimicVideo}
+	for _, body := range []int{1, 1316, 1317, 16400} {
+		if got := video.Length(body); (body+got)%1316 != 0 || got >= 1316 {
+			t.Errorf("mimic-video Length(%d): got %d", body, got)
+		}
+	}
+	light := Padding{Profile: PaddingLight, MaxPadding: 64}
+	for i := 0; i < 100; i++ {
+		if got := light.Length(100); got < 1 || got > 64 {
+			t.Fatalf("light Length: got %d, want 1..64", got)
+		}
+	}
+	if got := (Padding{}).Length(100); got != 0 {
+		t.Errorf("off Length: got %d, want 0", got)
+	}
+}
+
+// TestPaddedDataRecordRoundTrip verifies that padding shapes the record size
+// without reaching the payload returned by Read.
+func TestPaddedDataRecordRoundTrip(t *testing.T) {
+	for _, profile := range []PaddingProfile{PaddingLight, PaddingUniformBucket, PaddingMimicVideo} {
+		for _, suite := range []byte{CipherNone, CipherChaCha20Poly1305} {
+			t.Run(profile.String()+"/"+DataCipherName(suite), func(t *testing.T) {
+				ng, err := NewNonceGenerator()
+				if err != nil {
+					t.Fatalf("NewNonceGenerator: %v", err)
+				}
+				dc, err := NewDataCipher(suite, "test-psk")
+				if err != nil {
+					t.Fatalf("NewDataCipher: %v", err)
+				}
+				payload := bytes.Repeat([]byte("p"), 300)
+				record, err := BuildPaddedDataRecord(payload, ng, dc, Padding{Profile: profile, MaxPadding: 64})
+				if err != nil {
+					t.Fatalf("BuildPaddedDataRecord: %v", err)
+				}
+				body := len(record) - 4 - RecordHeaderLength
+				switch profile {
+				case PaddingUniformBucket:
+					if body != 512 {
+						t.Errorf("record body: got %d, want 512", body)
+					}
+				case PaddingMimicVideo:
+					if body != 1316 {
+						t.Errorf("record body: got %d, want 1316", body)
+					}
+				}
+
+				reader := NewRecordReader(bytes.NewReader(record))
+				reader.SetDataCipher(dc)
+				got, err := io.ReadAll(reader)
+				if err != nil || !bytes.Equal(got, payload) {
+					t.Errorf("ReadAll: got %d bytes, %v", len(got), err)
+				}
+			})
+		}
+	}
+}
+
+func TestMetadataPaddingOption(t *testing.T) {
+	payload, err := buildMetadataPayload("example.com", 443, Options{MaxPadding: 96, PaddingProfile: PaddingMimicVideo})
+	if err != nil {
+		t.Fatalf("buildMetadataPayload: %v", err)
+	}
+	meta, err := ParseMetadata(payload)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if meta.Options.PaddingProfile != PaddingMimicVideo || meta.Options.MaxPadding != 96 {
+		t.Errorf("options: got %+v", meta.Options)
+	}
+}
+
+// TestSealedDataRecordTamper verifies that modified ciphertext is rejected.
+func TestSealedDataRecordTamper(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := NewDataCipher(CipherAES128GCM, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	record, err := BuildSealedDataRecord([]byte("payload"), ng, dc)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+	tampered := append([]byte(nil), record...)
+	PutBuffer(record)
+	tampered[4+RecordHeaderLength] ^= 0xff
+
+	reader := NewRecordReader(bytes.NewReader(tampered))
+	reader.SetDataCipher(dc)
+	if _, err := reader.Read(make([]byte, 64)); err == nil {
+		t.Fatal("expected authentication failure for tampered record")
+	}
+}
+
+// TestUDPDatagramRecordRoundTrip verifies datagram records both as raw
+// WebTransport datagrams and as length-prefixed records on a relay stream.
+func TestUDPDatagramRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := NewDataCipher(CipherChaCha20Poly1305, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+
+	for _, host := range []string{"8.8.8.8", "2001:db8::1", "dns.example"} {
+		in := &UDPDatagram{FlowID: 0xdeadbeef, KeyID: "alice", Host: host, Port: 53, Payload: []byte("udp payload")}
+		record, err := BuildUDPDatagramRecord(in, ng, dc)
+		if err != nil {
+			t.Fatalf("BuildUDPDatagramRecord(%s): %v", host, err)
+		}
+		if bytes.Contains(record, in.Payload) {
+			t.Fatalf("datagram record leaks plaintext")
+		}
+
+		// Raw datagram (no length prefix), opened through a fresh cipher set.
+		parsed, err := ParseDatagramRecord(append([]byte(nil), record[4:]...))
+		if err != nil {
+			t.Fatalf("ParseDatagramRecord: %v", err)
+		}
+		out, err := StaticDatagramCiphers("test-psk").Open(parsed)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if out.FlowID != in.FlowID || out.KeyID != in.KeyID || out.Host != in.Host || out.Port != in.Port || !bytes.Equal(out.Payload, in.Payload) {
+			t.Errorf("datagram mismatch: got %+v, want %+v", out, in)
+		}
+
+		// Same record on a relay stream.
+		streamRecord, err := NewRecordReader(bytes.NewReader(record)).ReadNextRecord()
+		if err != nil {
+			t.Fatalf("ReadNextRecord: %v", err)
+		}
+		if _, err := OpenUDPDatagram(streamRecord, dc); err != nil {
+			t.Fatalf("OpenUDPDatagram(stream): %v", err)
+		}
+	}
+}
+
+// TestUDPDatagramRecordTamper verifies that the clear suite byte and the body are authenticated.
+func TestUDPDatagramRecordTamper(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := NewDataCipher(CipherAES128GCM, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	record, err := BuildUDPDatagramRecord(&UDPDatagram{FlowID: 1, Host: "1.1.1.1", Port: 53, Payload: []byte("q")}, ng, dc)
+	if err != nil {
+		t.Fatalf("BuildUDPDatagramRecord: %v", err)
+	}
+
+	for _, offset := range []int{RecordHeaderLength, RecordHeaderLength + 3} {
+		tampered := append([]byte(nil), record[4:]...)
+		tampered[offset] ^= 0x03
+		parsed, err := ParseDatagramRecord(tampered)
+		if err != nil {
+			t.Fatalf("ParseDatagramRecord: %v", err)
+		}
+		if _, err := StaticDatagramCiphers("test-psk").Open(parsed); err == nil {
+			t.Errorf("expected failure with byte %d modified", offset)
+		}
+	}
+}
+
+// TestMetadataUDPRelayOption verifies the UDP relay flag survives the options TLV.
+func TestMetadataUDPRelayOption(t *testing.T) {
+	payload, err := buildMetadataPayload("0.0.0.0", 0, Options{DataCipher: CipherAES128GCM, UDPRelay: true})
+	if err != nil {
+		t.Fatalf("buildMetadataPayload: %v", err)
+	}
+	meta, err := ParseMetadata(payload)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if !meta.Options.UDPRelay || meta.Options.DataCipher != CipherAES128GCM {
+		t.Errorf("options: got %+v", meta.Options)
+	}
+}
+
+func TestMetadataMuxOption(t *testing.T) {
+	payload, err := buildMetadataPayload("0.0.0.0", 0, Options{Mux: true})
+	if err != nil {
+		t.Fatalf("buildMetadataPayload: %v", err)
+	}
+	meta, err := ParseMetadata(payload)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if !meta.Options.Mux || meta.Options.UDPRelay {
+		t.Errorf("options: got %+v", meta.Options)
+	}
+}
+
+func TestMetadataEarlyDataOption(t *testing.T) {
+	payload, err := buildMetadataPayload("example.com", 443, Options{DataCipher: CipherAES128GCM, EarlyData: true})
+	if err != nil {
+		t.Fatalf("buildMetadataPayload: %v", err)
+	}
+	meta, err := ParseMetadata(payload)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if !meta.Options.EarlyData || meta.Options.Mux || meta.Options.DataCipher != CipherAES128GCM {
+		t.Errorf("options: got %+v", meta.Options)
+	}
+}
+
+func TestMetadataReverseOption(t *testing.T) {
+	payload, err := buildMetadataPayload("0.0.0.0", 0, Options{ReverseName: "dev-web", ReversePort: 8080})
+	if err != nil {
+		t.Fatalf("buildMetadataPayload: %v", err)
+	}
+	meta, err := ParseMetadata(payload)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if meta.Options.ReverseName != "dev-web" || meta.Options.ReversePort != 8080 {
+		t.Errorf("options: got %+v", meta.Options)
+	}
+
+	// The option is critical: a receiver that does not know it must refuse the stream.
+	if optionReverse&optionCritical == 0 {
+		t.Error("reverse option is not critical")
+	}
+}
+
+func TestReverseBindingValidate(t *testing.T) {
+	valid := ReverseBinding{Name: "dev", RemotePort: 8080, LocalAddr: "127.0.0.1:3000"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid binding: %v", err)
+	}
+	for _, b := range []ReverseBinding{
+		{Name: "", RemotePort: 8080, LocalAddr: "127.0.0.1:3000"},
+		{Name: "a b", RemotePort: 8080, LocalAddr: "127.0.0.1:3000"},
+		{Name: "dev", RemotePort: 0, LocalAddr: "127.0.0.1:3000"},
+		{Name: "dev", RemotePort: 70000, LocalAddr: "127.0.0.1:3000"},
+		{Name: "dev", RemotePort: 8080, LocalAddr: "3000"},
+	} {
+		if err := b.Validate(); err == nil {
+			t.Errorf("binding %+v: expected error", b)
+		}
+	}
+}
+
+// TestKeyedMetadataRecord verifies that the key ID is readable before decryption
+// and authenticated by the AEAD.
+func TestKeyedMetadataRecord(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildKeyedMetadataRecord("alice", "example.com", 443, Options{}, "alice-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildKeyedMetadataRecord: %v", err)
+	}
+
+	parsed, err := NewRecordReader(bytes.NewReader(record)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	if parsed.Type != TypeKeyedMetadata {
+		t.Fatalf("Type: got %d, want %d", parsed.Type, TypeKeyedMetadata)
+	}
+	keyID, err := MetadataKeyID(parsed)
+	if err != nil || keyID != "alice" {
+		t.Fatalf("MetadataKeyID: got %q, %v", keyID, err)
+	}
+	meta, err := DecryptMetadata(parsed, "alice-psk")
+	if err != nil {
+		t.Fatalf("DecryptMetadata: %v", err)
+	}
+	if meta.Host != "example.com" || meta.Port != 443 {
+		t.Errorf("Metadata: got %s:%d", meta.Host, meta.Port)
+	}
+	if _, err := DecryptMetadata(parsed, "bob-psk"); err == nil {
+		t.Error("expected failure with another user's PSK")
+	}
+
+	// Swapping the key ID must break authentication even with the right PSK.
+	tampered := append([]byte(nil), record...)
+	copy(tampered[4+RecordHeaderLength+1:], "bobby")
+	parsed, err = NewRecordReader(bytes.NewReader(tampered)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord(tampered): %v", err)
+	}
+	if _, err := DecryptMetadata(parsed, "alice-psk"); err == nil {
+		t.Error("expected failure with modified key ID")
+	}
+
+	// No key ID keeps the legacy record type.
+	plain, err := BuildKeyedMetadataRecord("", "example.com", 443, Options{}, "alice-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildKeyedMetadataRecord(no key): %v", err)
+	}
+	if plain[4+headerTypeOffset] != TypeMetadata {
+		t.Errorf("Type without key ID: got %d, want %d", plain[4+headerTypeOffset], TypeMetadata)
+	}
+}
+
+func TestNonceGeneratorRekey(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	ng.rekeyAt = 3
+	oldSID := ng.SessionID()
+	for i := 0; i < 3; i++ {
+		if ng.NeedsRekey() {
+			t.Fatalf("NeedsRekey before threshold at counter %d", ng.Counter())
+		}
+		if _, _, err := ng.Next(); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+	if !ng.NeedsRekey() {
+		t.Fatal("NeedsRekey: got false at threshold")
+	}
+
+	sid, epoch, err := ng.PrepareRekey()
+	if err != nil {
+		t.Fatalf("PrepareRekey: %v", err)
+	}
+	if again, _, _ := ng.PrepareRekey(); again != sid {
+		t.Error("PrepareRekey is not idempotent while pending")
+	}
+	if ng.SessionID() != oldSID {
+		t.Error("SessionID changed before CommitRekey")
+	}
+	if err := ng.CommitRekey(); err != nil {
+		t.Fatalf("CommitRekey: %v", err)
+	}
+	if err := ng.CommitRekey(); err == nil {
+		t.Error("expected error committing without a pending rekey")
+	}
+
+	if sid == oldSID || ng.SessionID() != sid {
+		t.Errorf("SessionID: got %x, want new %x (old %x)", ng.SessionID(), sid, oldSID)
+	}
+	if epoch != 1 || ng.Epoch() != 1 {
+		t.Errorf("Epoch: got %d/%d, want 1", epoch, ng.Epoch())
+	}
+	if ng.Counter() != 0 || ng.NeedsRekey() {
+		t.Errorf("Counter after rekey: got %d", ng.Counter())
+	}
+	nonce, _, err := ng.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !bytes.Equal(nonce[0:4], sid[:]) {
+		t.Errorf("nonce SessionID: got %x, want %x", nonce[0:4], sid)
+	}
+}
+
+func TestRekeyRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := NewDataCipher(CipherAES128GCM, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	before, err := BuildSealedDataRecord([]byte("before"), ng, dc)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+
+	sid, epoch, err := ng.PrepareRekey()
+	if err != nil {
+		t.Fatalf("PrepareRekey: %v", err)
+	}
+	record, err := BuildRekeyRecord(RekeyMessage{SessionID: sid, Epoch: epoch}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildRekeyRecord: %v", err)
+	}
+	if err := ng.CommitRekey(); err != nil {
+		t.Fatalf("CommitRekey: %v", err)
+	}
+	after, err := BuildSealedDataRecord([]byte("after"), ng, dc)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(record)
+	buf.Write(before)
+	buf.Write(after)
+	PutBuffer(before)
+	PutBuffer(after)
+
+	reader := NewRecordReader(&buf)
+	parsed, err := reader.ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	if _, err := OpenRekeyRecord(parsed, "wrong-psk"); err == nil {
+		t.Error("expected failure with wrong PSK")
+	}
+	msg, err := OpenRekeyRecord(parsed, "test-psk")
+	if err != nil {
+		t.Fatalf("OpenRekeyRecord: %v", err)
+	}
+	if msg.Ack || msg.SessionID != sid || msg.Epoch != epoch {
+		t.Errorf("RekeyMessage: got %+v, want sid=%x epoch=%d", msg, sid, epoch)
+	}
+
+	// Records sealed under both SessionIDs open with the same reader.
+	reader.SetDataCipher(dc)
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "beforeafter" {
+		t.Errorf("payload: got %q", got)
+	}
+}
+
+func TestRekeyRecordTamper(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildRekeyRecord(RekeyMessage{Ack: true, SessionID: [4]byte{1, 2, 3, 4}, Epoch: 7}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildRekeyRecord: %v", err)
+	}
+	record[len(record)-1] ^= 0x01
+	parsed, err := NewRecordReader(bytes.NewReader(record)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	if _, err := OpenRekeyRecord(parsed, "test-psk"); err == nil {
+		t.Error("expected authentication failure")
+	}
+}
+
+func TestMetadataCapabilitiesOption(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildMetadataRecordWithOptions("example.com", 443, Options{Capabilities: LocalCapabilities()}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildMetadataRecordWithOptions: %v", err)
+	}
+	parsed, err := NewRecordReader(bytes.NewReader(record)).ReadNextRecord()
+	if err != nil {
+		t.Fatalf("ReadNextRecord: %v", err)
+	}
+	meta, err := DecryptMetadata(parsed, "test-psk")
+	if err != nil {
+		t.Fatalf("DecryptMetadata: %v", err)
+	}
+	if meta.Options.Capabilities == nil || *meta.Options.Capabilities != *LocalCapabilities() {
+		t.Errorf("Capabilities: got %+v, want %+v", meta.Options.Capabilities, LocalCapabilities())
+	}
+}
+
+func TestParseMetadataUnknownOptions(t *testing.T) {
+	payload, err := buildMetadataPayload("example.com", 443, Options{})
+	if err != nil {
+		t.Fatalf("buildMetadataPayload: %v", err)
+	}
+	withOptions := func(options ...byte) []byte {
+		b := append([]byte(nil), payload[:len(payload)-2]...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(options)))
+		return append(b, options...)
+	}
+
+	// Unknown non-critical options are skipped.
+	meta, err := ParseMetadata(withOptions(0x7e, 0x02, 0xaa, 0xbb, optionUDPRelay, 0x00))
+	if err != nil {
+		t.Fatalf("ParseMetadata(non-critical): %v", err)
+	}
+	if !meta.Options.UDPRelay {
+		t.Error("option after unknown option not parsed")
+	}
+
+	// Unknown critical options reject the metadata.
+	_, err = ParseMetadata(withOptions(0x90, 0x00))
+	var unsupported *UnsupportedOptionError
+	if !errors.As(err, &unsupported) || unsupported.Type != 0x90 {
+		t.Errorf("ParseMetadata(critical): got %v, want UnsupportedOptionError", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		peer    *Capabilities
+		want    Negotiated
+		wantErr bool
+	}{
+		{"v5 client", nil, BaselineNegotiated(), false},
+		{"same build", LocalCapabilities(), Negotiated{Version: MaxProtocolVersion, Features: SupportedFeatures}, false},
+		{"newer client", &Capabilities{MinVersion: MinProtocolVersion, MaxVersion: MaxProtocolVersion + 3, Features: 0xffffffff}, Negotiated{Version: MaxProtocolVersion, Features: SupportedFeatures}, false},
+		{"older range", &Capabilities{MinVersion: 0x05, MaxVersion: 0x05, Features: FeatureDataCipher | FeatureUDPRelay}, Negotiated{Version: 0x05}, false},
+		{"too new", &Capabilities{MinVersion: MaxProtocolVersion + 1, MaxVersion: MaxProtocolVersion + 2}, Negotiated{}, true},
+		{"too old", &Capabilities{MinVersion: 0x01, MaxVersion: MinProtocolVersion - 1}, Negotiated{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Negotiate(tt.peer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Negotiate: err=%v, wantErr=%v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Negotiate: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A peer without capabilities is a V5 peer: negotiating against it must
+// leave every V6 feature off, so neither side expects V6-only records.
+func TestNegotiateWithoutCapabilities(t *testing.T) {
+	n, err := Negotiate(nil)
+	if err != nil {
+		t.Fatalf("Negotiate(nil): %v", err)
+	}
+	if n.Version != MinProtocolVersion || n.Features != 0 {
+		t.Fatalf("Negotiate(nil): got %+v, want version 0x%02x and no features", n, MinProtocolVersion)
+	}
+	for bit := uint32(1); bit != 0 && bit <= SupportedFeatures; bit <<= 1 {
+		if SupportedFeatures&bit != 0 && n.Has(bit) {
+			t.Errorf("feature bit 0x%x negotiated with a V5 peer", bit)
+		}
+	}
+	if featuresFor(0x05) != 0 {
+		t.Errorf("featuresFor(0x05) = 0x%x, want 0", featuresFor(0x05))
+	}
+}
+
+func TestCapabilitiesRecordRead(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	caps, err := BuildCapabilitiesRecord(Negotiated{Version: MaxProtocolVersion, Features: FeatureRekey}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildCapabilitiesRecord: %v", err)
+	}
+	data, err := BuildDataRecord([]byte("payload"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+
+	// A reader that does not expect capabilities (V5 client) skips the record.
+	reader := NewRecordReader(bytes.NewReader(append(append([]byte(nil), caps...), data...)))
+	got, err := io.ReadAll(reader)
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("ReadAll(v5): got %q, %v", got, err)
+	}
+	if _, ok := reader.Negotiated(); ok {
+		t.Error("V5 reader reported a negotiated set")
+	}
+
+	reader = NewRecordReader(bytes.NewReader(append(append([]byte(nil), caps...), data...)))
+	reader.ExpectCapabilities("test-psk", nil)
+	got, err = io.ReadAll(reader)
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("ReadAll: got %q, %v", got, err)
+	}
+	n, ok := reader.Negotiated()
+	if !ok || n.Version != MaxProtocolVersion || !n.Has(FeatureRekey) || n.Has(FeatureUDPRelay) {
+		t.Errorf("Negotiated: got %+v, %v", n, ok)
+	}
+
+	// A V5 capabilities record cannot carry V6 features.
+	v5caps, err := BuildCapabilitiesRecord(Negotiated{Version: 0x05, Features: FeatureDataCipher | FeatureRekey}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildCapabilitiesRecord(v5): %v", err)
+	}
+	reader = NewRecordReader(bytes.NewReader(append(append([]byte(nil), v5caps...), data...)))
+	reader.ExpectCapabilities("test-psk", nil)
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatalf("ReadAll(v5 caps): %v", err)
+	}
+	if n, ok := reader.Negotiated(); !ok || n.Version != 0x05 || n.Features != 0 {
+		t.Errorf("Negotiated(v5 caps): got %+v, %v", n, ok)
+	}
+
+	// A gateway that did not confirm the data cipher answers in plain records.
+	dc, err := NewDataCipher(CipherAES128GCM, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	reader = NewRecordReader(bytes.NewReader(append(append([]byte(nil), caps...), data...)))
+	reader.SetDataCipher(dc)
+	reader.ExpectCapabilities("test-psk", nil)
+	got, err = io.ReadAll(reader)
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("ReadAll(unconfirmed cipher): got %q, %v", got, err)
+	}
+
+	reader = NewRecordReader(bytes.NewReader(caps))
+	reader.ExpectCapabilities("wrong-psk", nil)
+	if _, err := reader.Read(make([]byte, 16)); err == nil {
+		t.Error("expected authentication failure with wrong PSK")
+	}
+}
+
+func TestRecordVersionRange(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildDataRecord([]byte("x"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+	for version := byte(MinProtocolVersion - 1); version <= MaxProtocolVersion+1; version++ {
+		b := append([]byte(nil), record...)
+		b[4+headerVersionOffset] = version
+		_, err := NewRecordReader(bytes.NewReader(b)).ReadNextRecord()
+		supported := version >= MinProtocolVersion && version <= MaxProtocolVersion
+		if (err == nil) != supported {
+			t.Errorf("version %d: err=%v, supported=%v", version, err, supported)
+		}
+	}
+}
+
+func TestReplayFilterWindow(t *testing.T) {
+	f := NewReplayFilter(DefaultReplayWindow, 16)
+	now := time.Now()
+	ts := uint64(now.UnixNano())
+	sid := []byte{1, 2, 3, 4}
+
+	for _, c := range []uint64{0, 5, 3, 4000} {
+		if err := f.Check("alice", sid, c, ts, now); err != nil {
+			t.Fatalf("counter %d: %v", c, err)
+		}
+	}
+	for _, c := range []uint64{0, 3, 4000} {
+		if err := f.Check("alice", sid, c, ts, now); !errors.Is(err, ErrReplay) {
+			t.Errorf("replayed counter %d: got %v, want ErrReplay", c, err)
+		}
+	}
+	// Another user or another SessionID has its own window.
+	if err := f.Check("bob", sid, 0, ts, now); err != nil {
+		t.Errorf("other scope: %v", err)
+	}
+	if err := f.Check("alice", []byte{4, 3, 2, 1}, 0, ts, now); err != nil {
+		t.Errorf("other session: %v", err)
+	}
+
+	// Slide far ahead: counters that fell out of the window are rejected, the
+	// ones still inside keep their history across the ring boundary.
+	top := uint64(4000 + ReplayWindowSize + 10)
+	if err := f.Check("alice", sid, top, ts, now); err != nil {
+		t.Fatalf("top: %v", err)
+	}
+	if err := f.Check("alice", sid, 5, ts, now); !errors.Is(err, ErrReplayTooOld) {
+		t.Errorf("old counter: got %v, want ErrReplayTooOld", err)
+	}
+	if err := f.Check("alice", sid, top-ReplayWindowSize+1, ts, now); err != nil {
+		t.Errorf("oldest counter in window: %v", err)
+	}
+	if err := f.Check("alice", sid, top-1, ts, now); err != nil {
+		t.Errorf("counter below top: %v", err)
+	}
+	if err := f.Check("alice", sid, top-1, ts, now); !errors.Is(err, ErrReplay) {
+		t.Errorf("replay below top: got %v, want ErrReplay", err)
+	}
+	if got := f.Rejected(); got != 5 {
+		t.Errorf("Rejected: got %d, want 5", got)
+	}
+}
+
+func TestReplayFilterExpiry(t *testing.T) {
+	f := NewReplayFilter(time.Second, 2)
+	now := time.Now()
+	ts := uint64(now.UnixNano())
+
+	if err := f.Check("u", []byte{0, 0, 0, 1}, 0, uint64(now.Add(-2*time.Second).UnixNano()), now); !errors.Is(err, ErrReplayExpired) {
+		t.Errorf("stale timestamp: got %v, want ErrReplayExpired", err)
+	}
+	if err := f.Check("u", []byte{0, 0, 0, 1}, 0, ts, now); err != nil {
+		t.Fatalf("first session: %v", err)
+	}
+	if err := f.Check("u", []byte{0, 0, 0, 2}, 0, ts+1, now); err != nil {
+		t.Fatalf("second session: %v", err)
+	}
+
+	// Full: the oldest window is evicted, and its records stay rejected
+	// because unknown sessions must be newer than anything forgotten.
+	if err := f.Check("u", []byte{0, 0, 0, 3}, 0, ts+2, now); err != nil {
+		t.Fatalf("third session: %v", err)
+	}
+	if f.Len() != 2 {
+		t.Errorf("Len: got %d, want 2", f.Len())
+	}
+	if err := f.Check("u", []byte{0, 0, 0, 1}, 0, ts, now); !errors.Is(err, ErrReplayForgotten) {
+		t.Errorf("evicted session: got %v, want ErrReplayForgotten", err)
+	}
+
+	// Once everything has aged out the windows are swept.
+	later := now.Add(3 * time.Second)
+	if err := f.Check("u", []byte{0, 0, 0, 4}, 0, uint64(later.UnixNano()), later); err != nil {
+		t.Fatalf("later session: %v", err)
+	}
+	if f.Len() != 1 {
+		t.Errorf("Len after sweep: got %d, want 1", f.Len())
+	}
+}
+
+func TestProbeRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	sent := time.Unix(1700000000, 123456789)
+	b, err := BuildProbeRecord(TypePing, 42, sent, ng)
+	if err != nil {
+		t.Fatalf("BuildProbeRecord: %v", err)
+	}
+	record, err := ParseDatagramRecord(b[4:])
+	if err != nil {
+		t.Fatalf("ParseDatagramRecord: %v", err)
+	}
+	seq, got, err := ParseProbe(record)
+	if err != nil {
+		t.Fatalf("ParseProbe: %v", err)
+	}
+	if seq != 42 || !got.Equal(sent) {
+		t.Errorf("got seq=%d sent=%v, want 42 %v", seq, got, sent)
+	}
+	if _, err := BuildProbeRecord(TypeData, 1, sent, ng); err == nil {
+		t.Error("expected error for non-probe record type")
+	}
+}
+
+func TestGoAwayRecordRoundTrip(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	b, err := BuildGoAwayRecord(29500*time.Millisecond, ng)
+	if err != nil {
+		t.Fatalf("BuildGoAwayRecord: %v", err)
+	}
+	record, err := ParseDatagramRecord(b[4:])
+	if err != nil {
+		t.Fatalf("ParseDatagramRecord: %v", err)
+	}
+	remaining, err := ParseGoAway(record)
+	if err != nil {
+		t.Fatalf("ParseGoAway: %v", err)
+	}
+	if remaining != 29500*time.Millisecond {
+		t.Errorf("remaining: got %v, want 29.5s", remaining)
+	}
+
+	// A deadline already passed is sent as zero.
+	b, _ = BuildGoAwayRecord(-time.Second, ng)
+	record, _ = ParseDatagramRecord(b[4:])
+	if remaining, err := ParseGoAway(record); err != nil || remaining != 0 {
+		t.Errorf("past deadline: got %v %v, want 0", remaining, err)
+	}
+
+	probe, _ := BuildProbeRecord(TypePing, 1, time.Now(), ng)
+	record, _ = ParseDatagramRecord(probe[4:])
+	if _, err := ParseGoAway(record); err == nil {
+		t.Error("expected error for a probe record")
+	}
+}
+
+func TestProbeTracker(t *testing.T) {
+	p := newProbeTracker()
+	now := time.Now()
+
+	seq := p.next(now)
+	rtt, ok := p.pong(seq, now.Add(30*time.Millisecond))
+	if !ok || rtt != 30*time.Millisecond {
+		t.Fatalf("pong: got %v %v, want 30ms true", rtt, ok)
+	}
+	if _, ok := p.pong(seq, now); ok {
+		t.Error("duplicate pong accepted")
+	}
+	if !p.isConfirmed() {
+		t.Error("tracker not confirmed after a pong")
+	}
+
+	for i := 0; i < probeDeadAfter; i++ {
+		p.next(now.Add(time.Duration(i) * time.Second))
+	}
+	if n := p.expire(now.Add(probeTimeout)); n != 1 {
+		t.Errorf("expire: got %d lost, want 1", n)
+	}
+	if p.dead() {
+		t.Error("dead after a single lost probe")
+	}
+	if n := p.expire(now.Add(probeTimeout + time.Hour)); n != probeDeadAfter-1 {
+		t.Errorf("expire: got %d lost, want %d", n, probeDeadAfter-1)
+	}
+	if !p.dead() {
+		t.Error("not dead after consecutive lost probes")
+	}
+
+	seq = p.next(now)
+	if _, ok := p.pong(seq, now); !ok || p.dead() {
+		t.Error("a pong should reset the lost count")
+	}
+}
+
+func TestMetricsProbeStats(t *testing.T) {
+	m := NewMetrics()
+	if srtt, _, _ := m.ProbeStats(); srtt != nil {
+		t.Fatal("expected no probe stats before the first sample")
+	}
+	m.RecordProbeRTT(100 * time.Millisecond)
+	m.RecordProbeRTT(180 * time.Millisecond)
+	m.RecordProbeLost()
+	srtt, jitter, loss := m.ProbeStats()
+	if *srtt != 110 {
+		t.Errorf("srtt: got %dms, want 110ms", *srtt)
+	}
+	if *jitter != 5 {
+		t.Errorf("jitter: got %dms, want 5ms", *jitter)
+	}
+	if *loss < 6 || *loss > 7 {
+		t.Errorf("loss: got %.2f%%, want 6.25%%", *loss)
+	}
+}
+
+// buildDNSAnswer returns a response for name with one A record per TTL.
+func buildDNSAnswer(t *testing.T, id uint16, name string, ttls ...uint32) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true})
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(q); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	for i, ttl := range ttls {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if err := b.AResource(h, dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	c := newDNSCache(0)
+	now := time.Now()
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("Example.COM."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	key := newDNSCacheKey(q)
+	if key.name != "example.com" {
+		t.Fatalf("key name: got %q", key.name)
+	}
+
+	c.put(key, buildDNSAnswer(t, 1, "example.com.", 300, 60), now)
+	b := c.get(key, 7, now.Add(20*time.Second))
+	if b == nil {
+		t.Fatal("expected cache hit")
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if msg.ID != 7 {
+		t.Errorf("ID: got %d, want 7", msg.ID)
+	}
+	if len(msg.Answers) != 2 || msg.Answers[0].Header.TTL != 280 || msg.Answers[1].Header.TTL != 40 {
+		t.Errorf("aged TTLs: got %+v", msg.Answers)
+	}
+
+	// The entry lives as long as the smallest TTL.
+	if c.get(key, 8, now.Add(60*time.Second)) != nil {
+		t.Error("expected miss once the smallest TTL ran out")
+	}
+	if c.len() != 0 {
+		t.Errorf("expired entry not dropped: len=%d", c.len())
+	}
+
+	// Zero TTLs and server failures are not cached.
+	c.put(key, buildDNSAnswer(t, 1, "example.com.", 0), now)
+	if c.len() != 0 {
+		t.Error("zero-TTL answer cached")
+	}
+	if newDNSCache(-1) != nil {
+		t.Error("negative size should disable the cache")
+	}
+}
+
+func TestDNSServerRules(t *testing.T) {
+	s, err := newDNSServer(&DNSConfig{
+		ListenAddr: "127.0.0.1:0",
+		Rules: []*Rule{
+			{ID: "ads", Name: "ads", Enabled: true, Action: ActionBlock, Matches: []MatchCondition{{Type: MatchDomainSuffix, Value: "ads.example"}}},
+			{ID: "no", Name: "no", Enabled: true, Action: ActionReject, Matches: []MatchCondition{{Type: MatchDomain, Value: "refused.example"}}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("newDNSServer: %v", err)
+	}
+
+	query := func(name string) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+		_ = b.StartQuestions()
+		_ = b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		msg, _ := b.Finish()
+		return msg
+	}
+	for name, want := range map[string]dnsmessage.RCode{
+		"tracker.ads.example.": dnsmessage.RCodeNameError,
+		"refused.example.":     dnsmessage.RCodeRefused,
+	} {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(s.handle(query(name), false)); err != nil {
+			t.Fatalf("%s: Unpack: %v", name, err)
+		}
+		if msg.ID != 42 || !msg.Response || msg.RCode != want || len(msg.Questions) != 1 {
+			t.Errorf("%s: got id=%d rcode=%v questions=%d, want rcode %v", name, msg.ID, msg.RCode, len(msg.Questions), want)
+		}
+	}
+
+	// Oversized UDP answers are cut down to the question with TC set.
+	var p dnsmessage.Parser
+	hdr, _ := p.Start(query("big.example."))
+	q, _ := p.Question()
+	big := buildDNSAnswer(t, 42, "big.example.", make([]uint32, 40)...)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(dnsFitResponse(big, hdr, q, false, dnsMaxUDPSize)); err != nil {
+		t.Fatalf("Unpack truncated: %v", err)
+	}
+	if !msg.Truncated || len(msg.Answers) != 0 {
+		t.Errorf("truncated: TC=%v answers=%d", msg.Truncated, len(msg.Answers))
+	}
+	if got := dnsFitResponse(big, hdr, q, true, dnsMaxUDPSize); !bytes.Equal(got, big) {
+		t.Error("TCP answers must not be truncated")
+	}
+}
+
+func TestRemoteErrorReplies(t *testing.T) {
+	remote := func(code uint16) error {
+		return fmt.Errorf("open stream: %w", &RemoteError{Code: code, Message: "x"})
+	}
+	tests := []struct {
+		name   string
+		err    error
+		socks5 byte
+		status int
+	}{
+		{"refused", remote(CodeConnRefused), socks5RepConnectionRefused, http.StatusBadGateway},
+		{"host unreachable", remote(CodeHostUnreachable), socks5RepHostUnreachable, http.StatusBadGateway},
+		{"dns failure", remote(CodeDNSFailure), socks5RepHostUnreachable, http.StatusBadGateway},
+		{"connect timeout", remote(CodeConnectTimeout), socks5RepTTLExpired, http.StatusGatewayTimeout},
+		{"timeout", remote(CodeTimeout), socks5RepTTLExpired, http.StatusGatewayTimeout},
+		{"policy denied", remote(CodePolicyDenied), socks5RepNotAllowed, http.StatusForbidden},
+		{"quota exceeded", remote(CodeQuotaExceeded), socks5RepNotAllowed, http.StatusTooManyRequests},
+		{"going away", remote(CodeGoingAway), socks5RepGeneralFailure, http.StatusServiceUnavailable},
+		{"connect failed", remote(CodeConnectFailed), socks5RepGeneralFailure, http.StatusBadGateway},
+		{"resource limit", remote(CodeResourceLimit), socks5RepGeneralFailure, http.StatusBadGateway},
+		{"local timeout", fmt.Errorf("dial: %w", os.ErrDeadlineExceeded), socks5RepTTLExpired, http.StatusGatewayTimeout},
+		{"rule", &socks5RuleError{ruleID: "ads"}, socks5RepNotAllowed, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if got := socks5ReplyCode(tt.err); got != tt.socks5 {
+			t.Errorf("%s: SOCKS5 reply 0x%02x, want 0x%02x", tt.name, got, tt.socks5)
+		}
+		if got := httpStatusForError(tt.err); got != tt.status {
+			t.Errorf("%s: HTTP status %d, want %d", tt.name, got, tt.status)
+		}
+	}
+}
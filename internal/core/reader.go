@@ -5,15 +5,22 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"net"
+	"sync"
 	"time"
 )
 
 // RecordReader reads records from a stream.
 type RecordReader struct {
-	reader        io.Reader
+	reader        *bufio.Reader
 	stash         []byte
-	currentRecord *Record // Keep track of pooled buffer
-	lengthBuf     [4]byte // Reusable buffer for reading record length prefix
+	currentRecord *Record     // Keep track of pooled buffer
+	lengthBuf     [4]byte     // Reusable buffer for reading record length prefix
+	dataCipher    *DataCipher // Opens sealed TypeData payloads when set
+	capsPSK       string      // Opens the gateway's TypeCapabilities record when set
+	onNegotiated  func(Negotiated)
+	negotiated    *Negotiated
+	finished      bool // Peer sent TypeFin; Read returns io.EOF from now on
 }
 
 // NewRecordReader creates a new record reader with a 1MB buffer.
@@ -25,12 +32,46 @@ func NewRecordReader(reader io.Reader) *RecordReader {
 // Read implements io.Reader, reassembling records into continuous data.
 func (r *RecordReader) Read(p []byte) (int, error) {
 	for len(r.stash) == 0 {
+		if r.finished {
+			return 0, io.EOF
+		}
 		record, err := r.ReadNextRecord()
 		if err != nil {
 			return 0, err
 		}
 		if record.Type == TypeError {
-			return 0, errors.New("server error: " + record.ErrorMessage)
+			return 0, &RemoteError{Code: record.ErrorCode, Message: record.ErrorMessage}
+		}
+		if record.Type == TypeConnectAck {
+			// Only reached when the stream was not opened with AwaitConnectAck.
+			err := ParseConnectAck(record, r.dataCipher)
+			if record.RawBuffer != nil {
+				PutBuffer(record.RawBuffer)
+			}
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if record.Type == TypeFin {
+			var err error
+			if r.dataCipher != nil {
+				_, err = r.dataCipher.open(record)
+			}
+			if record.RawBuffer != nil {
+				PutBuffer(record.RawBuffer)
+			}
+			if err != nil {
+				return 0, errors.New("fin record authentication failed")
+			}
+			r.finished = true
+			return 0, io.EOF
+		}
+		if record.Type == TypeCapabilities && r.capsPSK != "" {
+			if err := r.handleCapabilities(record); err != nil {
+				return 0, err
+			}
+			continue
 		}
 		if record.Type != TypeData {
 			// Non-data records: put buffer back immediately as we won't stash it
@@ -39,6 +80,18 @@ func (r *RecordReader) Read(p []byte) (int, error) {
 			}
 			continue // No recursive call, use loop
 		}
+		if r.dataCipher != nil {
+			decryptStart := time.Now()
+			plaintext, err := r.dataCipher.open(record)
+			perfObserveDownDecrypt(time.Since(decryptStart))
+			if err != nil {
+				if record.RawBuffer != nil {
+					PutBuffer(record.RawBuffer)
+				}
+				return 0, errors.New("data record authentication failed")
+			}
+			record.Payload = plaintext
+		}
 		r.stash = record.Payload
 		// IMPORTANT: we keep record.RawBuffer until stash is fully consumed
 		r.currentRecord = record
@@ -57,6 +110,113 @@ func (r *RecordReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// SetDataCipher enables AEAD opening of TypeData records returned by Read.
+func (r *RecordReader) SetDataCipher(dc *DataCipher) {
+	r.dataCipher = dc
+}
+
+// ExpectCapabilities makes Read consume the gateway's TypeCapabilities record,
+// authenticated with psk. Without it the record is skipped like any unknown type.
+// onNegotiated, if not nil, is called once the record has been read.
+func (r *RecordReader) ExpectCapabilities(psk string, onNegotiated func(Negotiated)) {
+	r.capsPSK = psk
+	r.onNegotiated = onNegotiated
+}
+
+func (r *RecordReader) handleCapabilities(record *Record) error {
+	n, err := OpenCapabilitiesRecord(record, r.capsPSK)
+	if record.RawBuffer != nil {
+		PutBuffer(record.RawBuffer)
+	}
+	if err != nil {
+		return err
+	}
+	r.negotiated = &n
+	if !n.Has(FeatureDataCipher) {
+		// The gateway ignored the data cipher option and answers in plain records.
+		r.dataCipher = nil
+	}
+	if r.onNegotiated != nil {
+		r.onNegotiated(n)
+	}
+	return nil
+}
+
+// AwaitConnectAck reads the gateway's handshake records up to its TypeConnectAck.
+// It returns nil once the gateway has connected to the target and a *RemoteError
+// if it could not. Only call it when FeatureConnectAck is known to be negotiated.
+func (r *RecordReader) AwaitConnectAck() error {
+	for {
+		record, err := r.ReadNextRecord()
+		if err != nil {
+			return err
+		}
+		switch record.Type {
+		case TypeConnectAck:
+			err := ParseConnectAck(record, r.dataCipher)
+			if record.RawBuffer != nil {
+				PutBuffer(record.RawBuffer)
+			}
+			return err
+		case TypeCapabilities:
+			if r.capsPSK == "" {
+				break
+			}
+			if err := r.handleCapabilities(record); err != nil {
+				return err
+			}
+			if !r.negotiated.Has(FeatureConnectAck) {
+				return nil // Gateway declined; stream is optimistic like V5
+			}
+			continue
+		case TypeError:
+			if record.RawBuffer != nil {
+				PutBuffer(record.RawBuffer)
+			}
+			return &RemoteError{Code: record.ErrorCode, Message: record.ErrorMessage}
+		}
+		if record.RawBuffer != nil {
+			PutBuffer(record.RawBuffer)
+		}
+	}
+}
+
+// AwaitCapabilities waits for the gateway's first record and consumes it if it is
+// the TypeCapabilities record. ok is false when the gateway sent another record
+// first, which is left for Read, or nothing before the stream's read deadline, as
+// a V5 gateway does before the target answers.
+func (r *RecordReader) AwaitCapabilities() (n Negotiated, ok bool, err error) {
+	// Peek does not consume, so a deadline that fires mid-header loses nothing.
+	prefix, err := r.reader.Peek(4 + headerTypeOffset + 1)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return BaselineNegotiated(), false, nil
+		}
+		return Negotiated{}, false, err
+	}
+	if prefix[4+headerTypeOffset] != TypeCapabilities || r.capsPSK == "" {
+		return BaselineNegotiated(), false, nil
+	}
+	record, err := r.ReadNextRecord()
+	if err != nil {
+		return Negotiated{}, false, err
+	}
+	if err := r.handleCapabilities(record); err != nil {
+		return Negotiated{}, false, err
+	}
+	return *r.negotiated, true, nil
+}
+
+// Negotiated returns the capability set announced by the gateway, once read.
+// ok is false until then, and for V5 gateways that never send one.
+func (r *RecordReader) Negotiated() (n Negotiated, ok bool) {
+	if r.negotiated == nil {
+		return BaselineNegotiated(), false
+	}
+	return *r.negotiated, true
+}
+
 // ReadNextRecord reads and parses a single record.
 func (r *RecordReader) ReadNextRecord() (*Record, error) {
 	readStart := time.Now()
@@ -92,8 +252,28 @@ func (r *RecordReader) ReadNextRecord() (*Record, error) {
 	perfObserveDownRead(int(totalLength)+4, time.Since(readStart))
 
 	parseStart := time.Now()
+	result, err := parseRecord(recordBytes)
+	if err != nil {
+		if isPooled {
+			PutBuffer(recordBytes)
+		}
+		return nil, err
+	}
+	if isPooled {
+		result.RawBuffer = recordBytes // Store for later release
+	}
+	perfObserveDownParse(time.Since(parseStart))
+	return result, nil
+}
+
+// parseRecord validates and parses a record body (without the 4-byte length prefix).
+// The returned Record aliases recordBytes; RawBuffer is left nil.
+func parseRecord(recordBytes []byte) (*Record, error) {
+	if len(recordBytes) < RecordHeaderLength {
+		return nil, errors.New("invalid record length")
+	}
 	version := recordBytes[headerVersionOffset]
-	if version != ProtocolVersion {
+	if version < MinProtocolVersion || version > MaxProtocolVersion {
 		return nil, errors.New("unsupported protocol version")
 	}
 
@@ -109,7 +289,7 @@ func (r *RecordReader) ReadNextRecord() (*Record, error) {
 		return nil, errors.New("timestamp outside allowed window")
 	}
 
-	if int(RecordHeaderLength+payloadLength+paddingLength) != len(recordBytes) {
+	if uint64(RecordHeaderLength)+uint64(payloadLength)+uint64(paddingLength) != uint64(len(recordBytes)) {
 		return nil, errors.New("invalid payload length")
 	}
 
@@ -128,18 +308,15 @@ func (r *RecordReader) ReadNextRecord() (*Record, error) {
 		Header:        header,
 		SessionID:     sessionID,
 		Counter:       counter,
-		RawBuffer:     recordBytes, // Store for later release
-	}
-	if !isPooled {
-		// If not pooled, RawBuffer is nil to prevent putting non-pool items
-		result.RawBuffer = nil
 	}
 	if recordType == TypeError {
+		if len(payload) >= 2 {
+			result.ErrorCode = binary.BigEndian.Uint16(payload[0:2])
+		}
 		if len(payload) >= 4 {
 			result.ErrorMessage = string(payload[4:])
 		}
 	}
-	perfObserveDownParse(time.Since(parseStart))
 	return result, nil
 }
 
@@ -152,6 +329,11 @@ type RecordReadWriter struct {
 	closer     io.Closer
 	maxPadding uint16
 	nonceGen   *NonceGenerator
+	dataCipher *DataCipher
+	padding    Padding
+
+	writeMu     sync.Mutex
+	writeClosed bool
 }
 
 // NewRecordReadWriter creates a new RecordReadWriter.
@@ -163,15 +345,32 @@ func NewRecordReadWriter(rw io.ReadWriteCloser, maxPadding uint16, ng *NonceGene
 		closer:       rw,
 		maxPadding:   maxPadding,
 		nonceGen:     ng,
+		padding:      Padding{MaxPadding: maxPadding},
 	}
 }
 
+// SetDataCipher enables AEAD for TypeData records in both directions.
+func (rw *RecordReadWriter) SetDataCipher(dc *DataCipher) {
+	rw.dataCipher = dc
+	rw.RecordReader.SetDataCipher(dc)
+}
+
+// SetPaddingProfile shapes outgoing TypeData records with profile (see Padding).
+func (rw *RecordReadWriter) SetPaddingProfile(profile PaddingProfile) {
+	rw.padding.Profile = profile
+}
+
 // Write wraps data into core.Records before writing to the underlying stream.
 // V5: Uses NonceGenerator for counter-based nonce.
 func (rw *RecordReadWriter) Write(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	rw.writeMu.Lock()
+	defer rw.writeMu.Unlock()
+	if rw.writeClosed {
+		return 0, ErrWriteClosed
+	}
 
 	totalWritten := 0
 	src := p
@@ -186,9 +385,9 @@ func (rw *RecordReadWriter) Write(p []byte) (n int, err error) {
 		chunk := src[:chunkSize]
 
 		// V5.1: Build record with NonceGenerator and Buffer Pool
-		// Data records now have 0 padding for maximum throughput
+		// Data records are unpadded unless a padding profile is set
 		buildStart := time.Now()
-		record, err := BuildDataRecord(chunk, rw.maxPadding, rw.nonceGen)
+		record, err := BuildPaddedDataRecord(chunk, rw.nonceGen, rw.dataCipher, rw.padding)
 		if err != nil {
 			return totalWritten, err
 		}
@@ -211,6 +410,26 @@ func (rw *RecordReadWriter) Write(p []byte) (n int, err error) {
 	return totalWritten, nil
 }
 
+// ErrWriteClosed is returned by Write after CloseWrite.
+var ErrWriteClosed = errors.New("write after CloseWrite")
+
+// CloseWrite sends a FIN record: the peer sees EOF on its read side while this
+// side keeps reading. Peers without FeatureHalfClose skip the record.
+func (rw *RecordReadWriter) CloseWrite() error {
+	rw.writeMu.Lock()
+	defer rw.writeMu.Unlock()
+	if rw.writeClosed {
+		return nil
+	}
+	rw.writeClosed = true
+	record, err := BuildFinRecord(rw.nonceGen, rw.dataCipher)
+	if err != nil {
+		return err
+	}
+	_, err = rw.writer.Write(record)
+	return err
+}
+
 // Close closes the underlying stream.
 func (rw *RecordReadWriter) Close() error {
 	return rw.closer.Close()
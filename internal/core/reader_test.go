@@ -2,7 +2,13 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 // TestRecordReaderLengthBufReuse verifies that the lengthBuf field is correctly
@@ -88,3 +94,355 @@ func TestRecordReaderReadInterface(t *testing.T) {
 		t.Errorf("Reassembled data: got %q, want %q", result, fullPayload)
 	}
 }
+
+// bufferStream is an in-memory io.ReadWriteCloser for RecordReadWriter tests.
+type bufferStream struct {
+	bytes.Buffer
+}
+
+func (b *bufferStream) Close() error { return nil }
+
+// TestRecordReadWriterCloseWrite verifies that CloseWrite emits a FIN record that
+// ends the peer's Read with io.EOF after all earlier data, and blocks further writes.
+func TestRecordReadWriterCloseWrite(t *testing.T) {
+	for _, suite := range []byte{CipherNone, CipherAES128GCM} {
+		t.Run(DataCipherName(suite), func(t *testing.T) {
+			ng, err := NewNonceGenerator()
+			if err != nil {
+				t.Fatalf("NewNonceGenerator: %v", err)
+			}
+			dc, err := NewDataCipher(suite, "test-psk")
+			if err != nil {
+				t.Fatalf("NewDataCipher: %v", err)
+			}
+
+			var wire bufferStream
+			rw := NewRecordReadWriter(&wire, 0, ng)
+			rw.SetDataCipher(dc)
+			if _, err := rw.Write([]byte("request")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := rw.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+			if _, err := rw.Write([]byte("late")); !errors.Is(err, ErrWriteClosed) {
+				t.Errorf("Write after CloseWrite: got %v, want ErrWriteClosed", err)
+			}
+			// Data after the FIN must never be delivered.
+			trailing, err := BuildDataRecord([]byte("trailing"), 0, ng)
+			if err != nil {
+				t.Fatalf("BuildDataRecord: %v", err)
+			}
+			wire.Write(trailing)
+
+			reader := NewRecordReader(&wire)
+			reader.SetDataCipher(dc)
+			got, err := io.ReadAll(reader)
+			if err != nil || string(got) != "request" {
+				t.Fatalf("ReadAll: got %q, %v", got, err)
+			}
+			if n, err := reader.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+				t.Errorf("Read after FIN: got %d, %v", n, err)
+			}
+		})
+	}
+}
+
+// TestRecordReaderForgedFin verifies that an unsealed FIN is rejected on a sealed stream.
+func TestRecordReaderForgedFin(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := NewDataCipher(CipherChaCha20Poly1305, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	fin, err := BuildFinRecord(ng, nil)
+	if err != nil {
+		t.Fatalf("BuildFinRecord: %v", err)
+	}
+	reader := NewRecordReader(bytes.NewReader(fin))
+	reader.SetDataCipher(dc)
+	if _, err := reader.Read(make([]byte, 8)); err == nil || err == io.EOF {
+		t.Errorf("Read: got %v, want authentication error", err)
+	}
+}
+
+// TestRecordReaderAwaitConnectAck verifies the client handshake: capabilities,
+// then the connect ack, with failures surfacing as *RemoteError.
+func TestRecordReaderAwaitConnectAck(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	dc, err := NewDataCipher(CipherAES128GCM, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	caps, err := BuildCapabilitiesRecord(Negotiated{Version: MaxProtocolVersion, Features: SupportedFeatures}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildCapabilitiesRecord: %v", err)
+	}
+
+	okAck, err := BuildConnectAckRecord(CodeOK, "", ng, dc)
+	if err != nil {
+		t.Fatalf("BuildConnectAckRecord: %v", err)
+	}
+	data, err := BuildSealedDataRecord([]byte("hello"), ng, dc)
+	if err != nil {
+		t.Fatalf("BuildSealedDataRecord: %v", err)
+	}
+	var wire bytes.Buffer
+	wire.Write(caps)
+	wire.Write(okAck)
+	wire.Write(data)
+	PutBuffer(data)
+
+	var announced *Negotiated
+	reader := NewRecordReader(&wire)
+	reader.SetDataCipher(dc)
+	reader.ExpectCapabilities("test-psk", func(n Negotiated) { announced = &n })
+	if err := reader.AwaitConnectAck(); err != nil {
+		t.Fatalf("AwaitConnectAck: %v", err)
+	}
+	if announced == nil || !announced.Has(FeatureConnectAck) {
+		t.Errorf("onNegotiated: got %+v", announced)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("ReadAll: got %q, %v", got, err)
+	}
+
+	refused, err := BuildConnectAckRecord(CodeConnRefused, "connection refused", ng, dc)
+	if err != nil {
+		t.Fatalf("BuildConnectAckRecord: %v", err)
+	}
+	reader = NewRecordReader(bytes.NewReader(refused))
+	reader.SetDataCipher(dc)
+	err = reader.AwaitConnectAck()
+	remote, ok := AsRemoteError(err)
+	if !ok || remote.Code != CodeConnRefused || remote.Message != "connection refused" || !remote.IsConnectFailure() {
+		t.Errorf("AwaitConnectAck(refused): got %v", err)
+	}
+
+	// Without AwaitConnectAck the failure surfaces on Read.
+	reader = NewRecordReader(bytes.NewReader(refused))
+	reader.SetDataCipher(dc)
+	if _, err := reader.Read(make([]byte, 8)); !errors.As(err, &remote) || remote.Code != CodeConnRefused {
+		t.Errorf("Read(refused): got %v", err)
+	}
+
+	// An unsealed ack cannot be passed off on a sealed stream.
+	forged, err := BuildConnectAckRecord(CodeOK, "", ng, nil)
+	if err != nil {
+		t.Fatalf("BuildConnectAckRecord: %v", err)
+	}
+	reader = NewRecordReader(bytes.NewReader(forged))
+	reader.SetDataCipher(dc)
+	if err := reader.AwaitConnectAck(); err == nil {
+		t.Error("AwaitConnectAck(forged): expected authentication error")
+	}
+}
+
+// TestRecordReaderAwaitCapabilities verifies how the first stream of a session
+// learns whether a connect ack follows, from V6 and V5 gateways alike.
+func TestRecordReaderAwaitCapabilities(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	caps, err := BuildCapabilitiesRecord(Negotiated{Version: MaxProtocolVersion, Features: SupportedFeatures}, "test-psk", ng)
+	if err != nil {
+		t.Fatalf("BuildCapabilitiesRecord: %v", err)
+	}
+	refused, err := BuildConnectAckRecord(CodeConnRefused, "connection refused", ng, nil)
+	if err != nil {
+		t.Fatalf("BuildConnectAckRecord: %v", err)
+	}
+	data, err := BuildDataRecord([]byte("hello"), 0, ng)
+	if err != nil {
+		t.Fatalf("BuildDataRecord: %v", err)
+	}
+
+	// V6: capabilities first, then the dial result.
+	reader := NewRecordReader(bytes.NewReader(append(append([]byte(nil), caps...), refused...)))
+	reader.ExpectCapabilities("test-psk", nil)
+	n, ok, err := reader.AwaitCapabilities()
+	if err != nil || !ok || !n.Has(FeatureConnectAck) {
+		t.Fatalf("AwaitCapabilities(v6): got %+v, %v, %v", n, ok, err)
+	}
+	if remote, isRemote := AsRemoteError(reader.AwaitConnectAck()); !isRemote || remote.Code != CodeConnRefused {
+		t.Errorf("AwaitConnectAck after capabilities: got %v", remote)
+	}
+
+	// V5: the first record is data and stays readable.
+	reader = NewRecordReader(bytes.NewReader(data))
+	reader.ExpectCapabilities("test-psk", nil)
+	if _, ok, err := reader.AwaitCapabilities(); err != nil || ok {
+		t.Fatalf("AwaitCapabilities(v5 data): ok=%v, err=%v", ok, err)
+	}
+	if got, err := io.ReadAll(reader); err != nil || string(got) != "hello" {
+		t.Errorf("ReadAll(v5 data): got %q, %v", got, err)
+	}
+
+	// V5, silent until the target answers: the deadline ends the wait without
+	// losing what arrives later.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	reader = NewRecordReader(client)
+	reader.ExpectCapabilities("test-psk", nil)
+	_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, ok, err := reader.AwaitCapabilities(); err != nil || ok {
+		t.Fatalf("AwaitCapabilities(timeout): ok=%v, err=%v", ok, err)
+	}
+	_ = client.SetReadDeadline(time.Time{})
+	go server.Write(data)
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "hello" {
+		t.Errorf("Read after timeout: got %q, %v", got, err)
+	}
+}
+
+// TestRecordReaderErrorRecord verifies that error records become typed RemoteErrors.
+func TestRecordReaderErrorRecord(t *testing.T) {
+	ng, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	record, err := BuildErrorRecord(CodeConnectFailed, "connect failed", ng)
+	if err != nil {
+		t.Fatalf("BuildErrorRecord: %v", err)
+	}
+	_, err = NewRecordReader(bytes.NewReader(record)).Read(make([]byte, 8))
+	remote, ok := AsRemoteError(err)
+	if !ok || remote.Code != CodeConnectFailed || remote.Message != "connect failed" {
+		t.Fatalf("Read: got %v", err)
+	}
+	if remote.EventCode() != ErrTargetConnect {
+		t.Errorf("EventCode: got %s", remote.EventCode())
+	}
+}
+
+// newMuxPair connects a client and a gateway MuxSession over an in-memory pipe.
+func newMuxPair(t *testing.T, suite byte) (client, gateway *MuxSession) {
+	t.Helper()
+	dc, err := NewDataCipher(suite, "test-psk")
+	if err != nil {
+		t.Fatalf("NewDataCipher: %v", err)
+	}
+	clientNG, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	gatewayNG, err := NewNonceGenerator()
+	if err != nil {
+		t.Fatalf("NewNonceGenerator: %v", err)
+	}
+	a, b := net.Pipe()
+	client = NewMuxSession(a, NewRecordReader(a), clientNG, dc, true)
+	gateway = NewMuxSession(b, NewRecordReader(b), gatewayNG, dc, false)
+	t.Cleanup(func() {
+		client.Close()
+		gateway.Close()
+	})
+	return client, gateway
+}
+
+// TestMuxStreamHalfClose verifies that sub-streams carry more than the flow-control
+// window in each direction and close each direction independently.
+func TestMuxStreamHalfClose(t *testing.T) {
+	for _, suite := range []byte{CipherNone, CipherChaCha20Poly1305} {
+		t.Run(DataCipherName(suite), func(t *testing.T) {
+			client, gateway := newMuxPair(t, suite)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			request := bytes.Repeat([]byte("q"), 3*MuxInitialWindow+17)
+			response := bytes.Repeat([]byte("r"), 2*MuxInitialWindow+5)
+			served := make(chan error, 1)
+			go func() {
+				sub, err := gateway.Accept()
+				if err != nil {
+					served <- err
+					return
+				}
+				defer sub.Close()
+				if host, port := sub.Target(); host != "example.com" || port != 443 {
+					served <- fmt.Errorf("target %s:%d", host, port)
+					return
+				}
+				if err := sub.Ack(CodeOK, ""); err != nil {
+					served <- err
+					return
+				}
+				got, err := io.ReadAll(sub)
+				if err != nil || !bytes.Equal(got, request) {
+					served <- fmt.Errorf("gateway read %d bytes: %v", len(got), err)
+					return
+				}
+				if _, err := sub.Write(response); err != nil {
+					served <- err
+					return
+				}
+				served <- sub.CloseWrite()
+			}()
+
+			sub, err := client.Open(ctx, "example.com", 443)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer sub.Close()
+			if _, err := sub.Write(request); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := sub.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+			got, err := io.ReadAll(sub)
+			if err != nil || !bytes.Equal(got, response) {
+				t.Fatalf("client read %d bytes: %v", len(got), err)
+			}
+			if err := <-served; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestMuxOpenRejected verifies that a failed dial surfaces from Open as *RemoteError
+// and leaves the carrier usable.
+func TestMuxOpenRejected(t *testing.T) {
+	client, gateway := newMuxPair(t, CipherAES128GCM)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		for {
+			sub, err := gateway.Accept()
+			if err != nil {
+				return
+			}
+			if _, port := sub.Target(); port == 1 {
+				sub.Ack(CodeConnRefused, "connection refused")
+				continue
+			}
+			sub.Ack(CodeOK, "")
+			sub.CloseWrite()
+		}
+	}()
+
+	_, err := client.Open(ctx, "127.0.0.1", 1)
+	remote, ok := AsRemoteError(err)
+	if !ok || remote.Code != CodeConnRefused {
+		t.Fatalf("Open: got %v, want CodeConnRefused", err)
+	}
+	sub, err := client.Open(ctx, "127.0.0.1", 2)
+	if err != nil {
+		t.Fatalf("Open after rejection: %v", err)
+	}
+	if n, err := sub.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Errorf("Read: got %d, %v, want io.EOF", n, err)
+	}
+}
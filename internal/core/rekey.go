@@ -0,0 +1,175 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Rekey record flags.
+const (
+	rekeyFlagAck = 0x01
+)
+
+// rekeyPayloadLength is Flags(1) | NewSessionID(4) | Epoch(4).
+const rekeyPayloadLength = 1 + headerSessionIDLength + 4
+
+// RekeyMessage announces the SessionID a peer switches to for the given key epoch.
+// The client sends a request on a fresh stream; the gateway answers with an ack
+// carrying its own new SessionID. Both sides switch after the exchange.
+type RekeyMessage struct {
+	Ack       bool
+	SessionID [4]byte
+	Epoch     uint32
+}
+
+// BuildRekeyRecord creates a TypeRekey record sealed like metadata: key derived from
+// the sender's current SessionID, nonce SessionID||Counter, header as AAD.
+func BuildRekeyRecord(msg RekeyMessage, psk string, ng *NonceGenerator) ([]byte, error) {
+	plaintext := make([]byte, rekeyPayloadLength)
+	if msg.Ack {
+		plaintext[0] = rekeyFlagAck
+	}
+	copy(plaintext[1:5], msg.SessionID[:])
+	binary.BigEndian.PutUint32(plaintext[5:9], msg.Epoch)
+
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	gcm, err := metadataAEAD(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	header, err := buildHeader(TypeRekey, len(plaintext)+gcm.Overhead(), 0, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, gcm.Seal(nil, nonce[:], plaintext, header), nil), nil
+}
+
+// OpenRekeyRecord authenticates and parses a TypeRekey record.
+func OpenRekeyRecord(record *Record, psk string) (*RekeyMessage, error) {
+	if record.Type != TypeRekey {
+		return nil, fmt.Errorf("not a rekey record: %d", record.Type)
+	}
+	if psk == "" {
+		return nil, fmt.Errorf("missing psk")
+	}
+	gcm, err := metadataAEAD(psk, record.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [12]byte
+	copy(nonce[0:4], record.SessionID)
+	binary.BigEndian.PutUint64(nonce[4:12], record.Counter)
+
+	plaintext, err := gcm.Open(nil, nonce[:], record.Payload, record.Header)
+	if err != nil {
+		return nil, errors.New("rekey record authentication failed")
+	}
+	if len(plaintext) != rekeyPayloadLength {
+		return nil, fmt.Errorf("invalid rekey payload length: %d", len(plaintext))
+	}
+	msg := &RekeyMessage{
+		Ack:   plaintext[0]&rekeyFlagAck != 0,
+		Epoch: binary.BigEndian.Uint32(plaintext[5:9]),
+	}
+	copy(msg.SessionID[:], plaintext[1:5])
+	return msg, nil
+}
+
+// metadataAEAD returns the metadata AEAD (AES-128-GCM) for a SessionID.
+func metadataAEAD(psk string, sessionID []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// rekeyIfNeeded runs a rekey exchange once the nonce counter passes the threshold.
+// If the exchange keeps failing and the counter is about to run out, the session
+// is rotated instead so new streams never hit ErrCounterExhausted.
+func (sm *sessionManager) rekeyIfNeeded() {
+	sm.mu.RLock()
+	ng := sm.nonceGen
+	sm.mu.RUnlock()
+	if ng == nil || !ng.NeedsRekey() {
+		return
+	}
+	err := errors.New("gateway does not support rekey")
+	if n := sm.peerCaps.Load(); n == nil || n.Has(FeatureRekey) {
+		err = sm.rekey(ng)
+	}
+	if err != nil {
+		log.Printf("[WARN] Session %s rekey failed: %v", sm.sessionID, err)
+		if ng.Counter() >= MaxCounterValue-MaxCounterValue/32 {
+			log.Printf("[WARN] Session %s nonce space nearly exhausted, rotating", sm.sessionID)
+			_ = sm.rotate()
+		}
+	}
+}
+
+// rekey announces a new SessionID to the gateway on a dedicated stream and switches
+// the nonce generator once the gateway has acknowledged it. Records already in flight
+// stay valid because receivers derive keys from each record's own SessionID.
+func (sm *sessionManager) rekey(ng *NonceGenerator) error {
+	newSID, epoch, err := ng.PrepareRekey()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(sm.ctx, 10*time.Second)
+	defer cancel()
+	stream, _, err := sm.OpenStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	record, err := BuildRekeyRecord(RekeyMessage{SessionID: newSID, Epoch: epoch}, sm.config.PSK, ng)
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(record); err != nil {
+		return err
+	}
+
+	reply, err := NewRecordReader(stream).ReadNextRecord()
+	if err != nil {
+		return fmt.Errorf("read rekey ack: %w", err)
+	}
+	if reply.Type == TypeError {
+		return fmt.Errorf("rekey rejected: %s", reply.ErrorMessage)
+	}
+	ack, err := OpenRekeyRecord(reply, sm.config.PSK)
+	if err != nil {
+		return err
+	}
+	if !ack.Ack || ack.Epoch != epoch {
+		return fmt.Errorf("unexpected rekey ack (epoch %d, want %d)", ack.Epoch, epoch)
+	}
+
+	if err := ng.CommitRekey(); err != nil {
+		return err
+	}
+	sm.metrics.RecordRekey()
+	log.Printf("[INFO] Session %s rekeyed to epoch %d (sid=%x, peer sid=%x)", sm.sessionID, epoch, newSID, ack.SessionID)
+	sm.onEvent(NewSessionRekeyedEvent(sm.sessionID, epoch, hex.EncodeToString(newSID[:]), hex.EncodeToString(ack.SessionID[:])))
+	return nil
+}
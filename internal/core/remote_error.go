@@ -0,0 +1,135 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Error codes carried by TypeError and TypeConnectAck records
+// (Aether-Realist Protocol V3 Section 7.2, connect results added in V6).
+const (
+	CodeOK              uint16 = 0x0000
+	CodeBadRecord       uint16 = 0x0001
+	CodeMetadata        uint16 = 0x0002
+	CodeUnsupported     uint16 = 0x0003
+	CodeConnectFailed   uint16 = 0x0004 // Generic connect failure
+	CodeStreamAbort     uint16 = 0x0005
+	CodeResourceLimit   uint16 = 0x0006
+	CodeTimeout         uint16 = 0x0007
+	CodeQuotaExceeded   uint16 = 0x0008 // The user's traffic quota is used up
+	CodeGoingAway       uint16 = 0x0009 // The gateway is draining; open the stream on a new session
+	CodeConnRefused     uint16 = 0x0401
+	CodeHostUnreachable uint16 = 0x0402
+	CodeDNSFailure      uint16 = 0x0403
+	CodeConnectTimeout  uint16 = 0x0404
+	CodePolicyDenied    uint16 = 0x0405
+)
+
+// connectAckTimeout bounds how long OpenStream waits for the gateway's dial result
+// (the gateway gives up dialing after 10s).
+const connectAckTimeout = 15 * time.Second
+
+// capabilitiesTimeout bounds how long the first stream of a session waits for the
+// gateway's capabilities, which a V6 gateway sends before it dials.
+const capabilitiesTimeout = 3 * time.Second
+
+// RemoteError is a failure reported by the gateway, either as a TypeError record
+// or as a non-zero TypeConnectAck.
+type RemoteError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("server error: %s (0x%04x)", e.Message, e.Code)
+}
+
+// EventCode maps the code to the error codes used in core.error events.
+func (e *RemoteError) EventCode() string {
+	switch e.Code {
+	case CodeBadRecord:
+		return ErrBadRecord
+	case CodeMetadata:
+		return ErrMetadataDecrypt
+	case CodeUnsupported, CodePolicyDenied:
+		return ErrUnsupported
+	case CodeStreamAbort:
+		return ErrStreamAbort
+	case CodeResourceLimit, CodeQuotaExceeded, CodeGoingAway:
+		return ErrResourceLimit
+	case CodeTimeout, CodeConnectTimeout:
+		return ErrTimeout
+	default:
+		return ErrTargetConnect
+	}
+}
+
+// IsConnectFailure reports whether the gateway could not reach the target.
+func (e *RemoteError) IsConnectFailure() bool {
+	return e.Code == CodeConnectFailed || (e.Code >= CodeConnRefused && e.Code <= CodeConnectTimeout)
+}
+
+// AsRemoteError returns the RemoteError in err's chain, if any.
+func AsRemoteError(err error) (*RemoteError, bool) {
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		return remote, true
+	}
+	return nil, false
+}
+
+// BuildConnectAckRecord creates the TypeConnectAck record a gateway sends once the
+// target dial finished. Payload Code(u16) | Message; sealed like FIN when dc is set.
+func BuildConnectAckRecord(code uint16, message string, ng *NonceGenerator, dc *DataCipher) ([]byte, error) {
+	plaintext := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(plaintext[0:2], code)
+	copy(plaintext[2:], message)
+
+	nonce, counter, err := ng.Next()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := nonce[0:4]
+	payload := plaintext
+	if dc == nil {
+		header, err := buildHeader(TypeConnectAck, len(payload), 0, sessionID, counter)
+		if err != nil {
+			return nil, err
+		}
+		return buildRecord(header, payload, nil), nil
+	}
+	aead, err := dc.aeadFor(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	header, err := buildHeader(TypeConnectAck, len(plaintext)+aead.Overhead(), 0, sessionID, counter)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecord(header, aead.Seal(nil, nonce[:], plaintext, header), nil), nil
+}
+
+// ParseConnectAck opens a TypeConnectAck record. It returns nil for a successful
+// connect and a *RemoteError otherwise.
+func ParseConnectAck(record *Record, dc *DataCipher) error {
+	if record.Type != TypeConnectAck {
+		return fmt.Errorf("not a connect ack record: %d", record.Type)
+	}
+	plaintext := record.Payload
+	if dc != nil {
+		var err error
+		if plaintext, err = dc.open(record); err != nil {
+			return errors.New("connect ack authentication failed")
+		}
+	}
+	if len(plaintext) < 2 {
+		return errors.New("connect ack too short")
+	}
+	code := binary.BigEndian.Uint16(plaintext[0:2])
+	if code == CodeOK {
+		return nil
+	}
+	return &RemoteError{Code: code, Message: string(plaintext[2:])}
+}
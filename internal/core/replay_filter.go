@@ -0,0 +1,188 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultReplayWindow is how far a record timestamp may drift from the receiver's clock.
+	DefaultReplayWindow = 30 * time.Second
+	// ReplayWindowSize is how many counters behind the highest one seen are still tracked
+	// per SessionID. Older counters are rejected outright.
+	ReplayWindowSize = 8192
+	// DefaultReplaySessions bounds the number of SessionIDs a ReplayFilter tracks.
+	DefaultReplaySessions = 8192
+
+	// One spare word so that recycling the slot of a new top never clears counters still in the window.
+	replayWords = ReplayWindowSize/64 + 1
+)
+
+var (
+	ErrReplay          = errors.New("replayed record")
+	ErrReplayTooOld    = errors.New("record counter behind replay window")
+	ErrReplayExpired   = errors.New("record timestamp outside replay window")
+	ErrReplayForgotten = errors.New("record older than evicted replay state")
+)
+
+// ReplayFilter rejects records whose (SessionID, Counter) pair was already accepted.
+// It is shared by every stream and session of a receiver: each SessionID gets a
+// sliding bitmap window over its counters, and a window is dropped once every
+// record it covers has aged out of the timestamp window.
+//
+// Memory is bounded by maxSessions. When full, the window with the oldest
+// timestamp is evicted and its newest timestamp becomes a floor: records for
+// SessionIDs the filter does not know must be newer than that, so forgetting a
+// window never reopens it to replay.
+type ReplayFilter struct {
+	maxAge      time.Duration
+	maxSessions int
+	rejected    atomic.Uint64
+
+	mu        sync.Mutex
+	windows   map[replayKey]*replayWindow
+	floor     uint64 // newest timestamp of any evicted window
+	nextSweep time.Time
+}
+
+// replayKey scopes a SessionID, e.g. by user, so peers cannot touch each other's windows.
+type replayKey struct {
+	scope     string
+	sessionID [4]byte
+}
+
+type replayWindow struct {
+	top    uint64 // highest counter accepted
+	newest uint64 // newest timestamp accepted (unix nanoseconds)
+	bitmap [replayWords]uint64
+}
+
+// NewReplayFilter creates a filter accepting timestamps within maxAge of now and
+// tracking at most maxSessions SessionIDs.
+func NewReplayFilter(maxAge time.Duration, maxSessions int) *ReplayFilter {
+	if maxSessions <= 0 {
+		maxSessions = DefaultReplaySessions
+	}
+	return &ReplayFilter{
+		maxAge:      maxAge,
+		maxSessions: maxSessions,
+		windows:     make(map[replayKey]*replayWindow),
+	}
+}
+
+// Check accepts a record once and rejects any later copy of it. scope separates
+// SessionIDs of different peers (the gateway uses the user ID). Only call it for
+// authenticated records: the header is AEAD-bound, so the counter and timestamp
+// cannot be forged.
+func (f *ReplayFilter) Check(scope string, sessionID []byte, counter, timestampNano uint64, now time.Time) error {
+	if err := f.check(scope, sessionID, counter, timestampNano, now); err != nil {
+		f.rejected.Add(1)
+		return err
+	}
+	return nil
+}
+
+func (f *ReplayFilter) check(scope string, sessionID []byte, counter, timestampNano uint64, now time.Time) error {
+	if len(sessionID) != 4 {
+		return fmt.Errorf("invalid session ID length: %d", len(sessionID))
+	}
+	if !IsTimestampValid(timestampNano, now, f.maxAge) {
+		return ErrReplayExpired
+	}
+	key := replayKey{scope: scope}
+	copy(key.sessionID[:], sessionID)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.After(f.nextSweep) {
+		f.sweep(now)
+		f.nextSweep = now.Add(f.maxAge)
+	}
+
+	w, ok := f.windows[key]
+	if !ok {
+		if timestampNano <= f.floor {
+			return ErrReplayForgotten
+		}
+		if len(f.windows) >= f.maxSessions {
+			f.sweep(now)
+			if len(f.windows) >= f.maxSessions {
+				f.evictOldest()
+			}
+		}
+		w = &replayWindow{top: counter}
+		f.windows[key] = w
+	}
+	if err := w.accept(counter); err != nil {
+		return err
+	}
+	if timestampNano > w.newest {
+		w.newest = timestampNano
+	}
+	return nil
+}
+
+// accept marks counter as seen, sliding the window forward when it is the new top.
+func (w *replayWindow) accept(counter uint64) error {
+	if counter > w.top {
+		from, to := w.top/64+1, counter/64
+		if to-from >= replayWords {
+			from = to - replayWords + 1
+		}
+		for i := from; i <= to; i++ {
+			w.bitmap[i%replayWords] = 0
+		}
+		w.top = counter
+	} else if w.top-counter >= ReplayWindowSize {
+		return ErrReplayTooOld
+	}
+	word, bit := (counter/64)%replayWords, uint64(1)<<(counter%64)
+	if w.bitmap[word]&bit != 0 {
+		return ErrReplay
+	}
+	w.bitmap[word] |= bit
+	return nil
+}
+
+// sweep drops windows whose every record now fails the timestamp check anyway.
+func (f *ReplayFilter) sweep(now time.Time) {
+	for key, w := range f.windows {
+		if now.Sub(time.Unix(0, int64(w.newest))) > f.maxAge {
+			delete(f.windows, key)
+		}
+	}
+}
+
+// evictOldest forgets the least recently active window and raises the floor.
+func (f *ReplayFilter) evictOldest() {
+	var oldestKey replayKey
+	var oldest *replayWindow
+	for key, w := range f.windows {
+		if oldest == nil || w.newest < oldest.newest {
+			oldestKey, oldest = key, w
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(f.windows, oldestKey)
+	if oldest.newest > f.floor {
+		f.floor = oldest.newest
+	}
+}
+
+// Rejected returns how many records the filter has rejected.
+func (f *ReplayFilter) Rejected() uint64 {
+	return f.rejected.Load()
+}
+
+// Len returns how many SessionIDs are currently tracked.
+func (f *ReplayFilter) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.windows)
+}
@@ -0,0 +1,438 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// ReverseBinding exposes a local service through a TCP port on the gateway.
+// Connections to RemotePort on the gateway are carried back over the session
+// and dialed to LocalAddr on this machine.
+type ReverseBinding struct {
+	Name       string `json:"name"`        // Unique label, sent to the gateway
+	RemotePort int    `json:"remote_port"` // Port the gateway listens on; must be in the user's allowlist
+	LocalAddr  string `json:"local_addr"`  // host:port dialed for each inbound connection
+}
+
+// ReverseBindingStatus is a binding with its registration state, as reported by the API.
+type ReverseBindingStatus struct {
+	ReverseBinding
+	State       string `json:"state"` // "registering", "active" or "failed"
+	Error       string `json:"error,omitempty"`
+	Connections uint64 `json:"connections"` // Inbound connections served so far
+	Active      int64  `json:"active"`      // Inbound connections currently open
+}
+
+// Reverse binding states.
+const (
+	ReverseRegistering = "registering"
+	ReverseActive      = "active"
+	ReverseFailed      = "failed"
+)
+
+const (
+	reverseRetryMin    = time.Second
+	reverseRetryMax    = 30 * time.Second
+	reverseDialTimeout = 5 * time.Second
+)
+
+var reverseNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ErrReverseBindingExists is returned when adding a binding whose name is taken.
+var ErrReverseBindingExists = errors.New("reverse binding already exists")
+
+// Validate checks the binding fields.
+func (b *ReverseBinding) Validate() error {
+	if !reverseNamePattern.MatchString(b.Name) {
+		return fmt.Errorf("invalid reverse binding name %q (1-64 of A-Z a-z 0-9 . _ -)", b.Name)
+	}
+	if b.RemotePort < 1 || b.RemotePort > 65535 {
+		return fmt.Errorf("reverse binding %s: invalid remote port %d", b.Name, b.RemotePort)
+	}
+	if _, _, err := net.SplitHostPort(b.LocalAddr); err != nil {
+		return fmt.Errorf("reverse binding %s: invalid local address: %w", b.Name, err)
+	}
+	return nil
+}
+
+// reverseManager keeps every configured binding registered with the gateway and
+// serves the streams the gateway opens for inbound connections.
+type reverseManager struct {
+	core *Core
+
+	mu       sync.Mutex
+	bindings map[string]*reverseRunner
+}
+
+// reverseRunner registers one binding and re-registers it whenever the
+// registration stream ends, e.g. after a session rotation.
+type reverseRunner struct {
+	binding ReverseBinding
+	cancel  context.CancelFunc
+
+	mu    sync.Mutex
+	state string
+	err   string
+
+	connections atomic.Uint64
+	active      atomic.Int64
+}
+
+func newReverseManager(c *Core) *reverseManager {
+	return &reverseManager{core: c, bindings: make(map[string]*reverseRunner)}
+}
+
+// add starts registering b.
+func (m *reverseManager) add(b ReverseBinding) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bindings[b.Name]; ok {
+		return ErrReverseBindingExists
+	}
+	ctx, cancel := context.WithCancel(m.core.ctx)
+	r := &reverseRunner{binding: b, cancel: cancel, state: ReverseRegistering}
+	m.bindings[b.Name] = r
+	go r.run(ctx, m.core)
+	return nil
+}
+
+// remove unregisters the binding; the gateway closes its listener when the
+// registration stream goes away.
+func (m *reverseManager) remove(name string) bool {
+	m.mu.Lock()
+	r, ok := m.bindings[name]
+	delete(m.bindings, name)
+	m.mu.Unlock()
+	if ok {
+		r.cancel()
+	}
+	return ok
+}
+
+// stop unregisters every binding.
+func (m *reverseManager) stop() {
+	m.mu.Lock()
+	runners := m.bindings
+	m.bindings = make(map[string]*reverseRunner)
+	m.mu.Unlock()
+	for _, r := range runners {
+		r.cancel()
+	}
+}
+
+func (m *reverseManager) lookup(name string) *reverseRunner {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bindings[name]
+}
+
+// status lists the bindings sorted by name.
+func (m *reverseManager) status() []ReverseBindingStatus {
+	m.mu.Lock()
+	runners := make([]*reverseRunner, 0, len(m.bindings))
+	for _, r := range m.bindings {
+		runners = append(runners, r)
+	}
+	m.mu.Unlock()
+	sort.Slice(runners, func(i, j int) bool { return runners[i].binding.Name < runners[j].binding.Name })
+
+	res := make([]ReverseBindingStatus, 0, len(runners))
+	for _, r := range runners {
+		r.mu.Lock()
+		st := ReverseBindingStatus{ReverseBinding: r.binding, State: r.state, Error: r.err}
+		r.mu.Unlock()
+		st.Connections = r.connections.Load()
+		st.Active = r.active.Load()
+		res = append(res, st)
+	}
+	return res
+}
+
+func (r *reverseRunner) setState(state string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = state
+	r.err = ""
+	if err != nil {
+		r.err = err.Error()
+	}
+}
+
+// run keeps the binding registered until ctx is cancelled. Rejections by the
+// gateway (port not allowed, feature unsupported) are final.
+func (r *reverseRunner) run(ctx context.Context, c *Core) {
+	backoff := reverseRetryMin
+	for {
+		r.setState(ReverseRegistering, nil)
+		start := time.Now()
+		err := r.register(ctx, c)
+		if ctx.Err() != nil {
+			return
+		}
+		if remote, ok := AsRemoteError(err); ok && (remote.Code == CodePolicyDenied || remote.Code == CodeUnsupported) {
+			log.Printf("[WARN] Reverse binding %s rejected by gateway: %v", r.binding.Name, err)
+			r.setState(ReverseFailed, err)
+			return
+		}
+		if err == nil {
+			err = errors.New("registration closed by gateway")
+		}
+		r.setState(ReverseFailed, err)
+		if time.Since(start) > reverseRetryMax {
+			backoff = reverseRetryMin
+		}
+		log.Printf("[DEBUG] Reverse binding %s lost (%v), retrying in %v", r.binding.Name, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > reverseRetryMax {
+			backoff = reverseRetryMax
+		}
+	}
+}
+
+// register opens the registration stream, waits for the gateway to confirm the
+// listener and then holds the stream open until either side closes it.
+func (r *reverseRunner) register(ctx context.Context, c *Core) error {
+	c.mu.RLock()
+	sm := c.sessionMgr
+	c.mu.RUnlock()
+	if sm == nil {
+		return errors.New("no session")
+	}
+	suite, err := ParseDataCipher(c.config.DataCipher)
+	if err != nil {
+		return err
+	}
+	dc, err := NewDataCipher(suite, c.config.PSK)
+	if err != nil {
+		return err
+	}
+	stream, _, err := sm.OpenStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// The target is the same placeholder as UDP relay streams: gateways that
+	// predate reverse tunnels fail to dial it instead of reaching anything.
+	opts := Options{DataCipher: suite, ReverseName: r.binding.Name, ReversePort: uint16(r.binding.RemotePort), Capabilities: LocalCapabilities()}
+	record, err := BuildKeyedMetadataRecord(c.config.KeyID, udpRelayHost, 0, opts, c.config.PSK, sm.nonceGen)
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(record); err != nil {
+		return err
+	}
+
+	reader := NewRecordReader(stream)
+	reader.SetDataCipher(dc)
+	reader.ExpectCapabilities(c.config.PSK, sm.recordPeerCaps)
+	_ = stream.SetReadDeadline(time.Now().Add(connectAckTimeout))
+	err = reader.AwaitConnectAck()
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.CancelRead(0)
+		if n := sm.peerCaps.Load(); n != nil && !n.Has(FeatureReverse) {
+			return &RemoteError{Code: CodeUnsupported, Message: "gateway does not support reverse tunnels"}
+		}
+		return err
+	}
+	r.setState(ReverseActive, nil)
+	log.Printf("[INFO] Reverse binding %s active: gateway port %d -> %s", r.binding.Name, r.binding.RemotePort, r.binding.LocalAddr)
+
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(0)
+		stream.Close()
+	})
+	defer stop()
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
+
+// serveStream handles a stream opened by the gateway for an inbound connection
+// on one of our bindings.
+func (m *reverseManager) serveStream(sm *sessionManager, stream *webtransport.Stream) {
+	psk := m.core.config.PSK
+	rw := NewRecordReadWriter(stream, 0, sm.nonceGen)
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	record, err := rw.ReadNextRecord()
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil || record.Type != TypeMetadata {
+		log.Printf("[SECURITY] Dropping gateway stream: bad first record (%v)", err)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+	meta, err := DecryptMetadata(record, psk)
+	if err != nil || meta.Options.ReverseName == "" {
+		log.Printf("[SECURITY] Dropping gateway stream: not a reverse connection (%v)", err)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+	r := m.lookup(meta.Options.ReverseName)
+	if r == nil {
+		log.Printf("[DEBUG] Dropping reverse connection for unknown binding %q", meta.Options.ReverseName)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+	dc, err := NewDataCipher(meta.Options.DataCipher, psk)
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+	rw.SetDataCipher(dc)
+	r.serve(rw, stream)
+}
+
+// serve dials the local service and pipes it to the gateway stream with half-close.
+func (r *reverseRunner) serve(rw *RecordReadWriter, stream *webtransport.Stream) {
+	defer rw.Close()
+	r.connections.Add(1)
+	r.active.Add(1)
+	defer r.active.Add(-1)
+
+	conn, err := net.DialTimeout("tcp", r.binding.LocalAddr, reverseDialTimeout)
+	if err != nil {
+		log.Printf("[DEBUG] Reverse binding %s: dial %s failed: %v", r.binding.Name, r.binding.LocalAddr, err)
+		stream.CancelRead(0)
+		return
+	}
+	defer conn.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(conn, rw)
+		if err == nil {
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				_ = tcpConn.CloseWrite()
+			}
+		}
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(rw, conn)
+		if err == nil {
+			err = rw.CloseWrite()
+		}
+		errCh <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			log.Printf("[DEBUG] Reverse binding %s: stream error: %v", r.binding.Name, err)
+			stream.CancelRead(0)
+			return
+		}
+	}
+}
+
+// acceptLoop serves streams the gateway opens on session until it closes.
+func (sm *sessionManager) acceptLoop(session *webtransport.Session) {
+	for {
+		stream, err := session.AcceptStream(sm.ctx)
+		if err != nil {
+			return
+		}
+		if sm.reverse == nil {
+			stream.CancelRead(0)
+			stream.Close()
+			continue
+		}
+		go sm.reverse.serveStream(sm, stream)
+	}
+}
+
+// GetReverseBindings returns the configured reverse bindings and their state.
+func (c *Core) GetReverseBindings() []ReverseBindingStatus {
+	c.mu.RLock()
+	m := c.reverse
+	var configured []*ReverseBinding
+	if c.config != nil {
+		configured = c.config.ReverseBindings
+	}
+	c.mu.RUnlock()
+	if m != nil {
+		return m.status()
+	}
+	res := make([]ReverseBindingStatus, 0, len(configured))
+	for _, b := range configured {
+		res = append(res, ReverseBindingStatus{ReverseBinding: *b, State: ReverseFailed, Error: "core not running"})
+	}
+	return res
+}
+
+// AddReverseBinding saves b to the config and registers it if the core is running.
+func (c *Core) AddReverseBinding(b ReverseBinding) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config == nil {
+		return fmt.Errorf("no config loaded")
+	}
+	for _, existing := range c.config.ReverseBindings {
+		if existing.Name == b.Name {
+			return ErrReverseBindingExists
+		}
+	}
+	if c.reverse != nil {
+		if err := c.reverse.add(b); err != nil {
+			return err
+		}
+	}
+	c.config.ReverseBindings = append(c.config.ReverseBindings, &b)
+	c.saveConfigLocked()
+	return nil
+}
+
+// RemoveReverseBinding unregisters the named binding and drops it from the config.
+func (c *Core) RemoveReverseBinding(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config == nil {
+		return fmt.Errorf("no config loaded")
+	}
+	kept := c.config.ReverseBindings[:0:0]
+	for _, b := range c.config.ReverseBindings {
+		if b.Name != name {
+			kept = append(kept, b)
+		}
+	}
+	found := len(kept) != len(c.config.ReverseBindings)
+	if c.reverse != nil && c.reverse.remove(name) {
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("reverse binding not found: %s", name)
+	}
+	c.config.ReverseBindings = kept
+	c.saveConfigLocked()
+	return nil
+}
+
+// saveConfigLocked persists c.config; failures are logged like in UpdateRules.
+func (c *Core) saveConfigLocked() {
+	if c.configManager == nil {
+		return
+	}
+	if err := c.configManager.Save(c.config); err != nil {
+		log.Printf("[ERROR] Failed to save config: %v", err)
+	}
+}
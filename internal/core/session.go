@@ -10,6 +10,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -30,6 +31,21 @@ type sessionManager struct {
 	metrics   *Metrics
 	nonceGen  *NonceGenerator // V5: Counter-based nonce generator
 	streamSeq uint64
+	peerCaps  atomic.Pointer[Negotiated] // Last capability set announced by the gateway; nil until known
+
+	// UDP relay: flows registered on this manager and ciphers for incoming datagrams.
+	udpMu      sync.RWMutex
+	udpFlows   map[uint32]*UDPFlow
+	udpCiphers *DatagramCiphers
+
+	// Mux carrier shared by sub-streams opened on the current session.
+	muxMu    sync.Mutex
+	mux      *MuxSession
+	muxSess  *webtransport.Session
+	muxSuite byte
+
+	// Serves streams the gateway opens for reverse tunnels; nil refuses them.
+	reverse *reverseManager
 }
 
 // newSessionManager creates a new session manager.
@@ -41,6 +57,8 @@ func newSessionManager(config *SessionConfig, onEvent func(Event), metrics *Metr
 		metrics: metrics,
 		ctx:     ctx,
 		cancel:  cancel,
+
+		udpFlows: make(map[uint32]*UDPFlow),
 	}
 }
 
@@ -202,6 +220,7 @@ func (sm *sessionManager) connectLocked() error {
 
 	sm.session = session
 	sm.sessionID = generateSessionID()
+	sm.peerCaps.Store(nil)
 
 	// V5: Initialize NonceGenerator for counter-based nonce
 	sm.nonceGen, err = NewNonceGenerator()
@@ -210,6 +229,13 @@ func (sm *sessionManager) connectLocked() error {
 		return fmt.Errorf("nonce generator failed: %w", err)
 	}
 
+	sm.udpMu.Lock()
+	sm.udpCiphers = StaticDatagramCiphers(sm.config.PSK)
+	sm.udpMu.Unlock()
+	probes := newProbeTracker()
+	go sm.datagramLoop(session, probes)
+	go sm.acceptLoop(session)
+
 	sm.metrics.RecordSessionStart()
 
 	// Emit event
@@ -218,7 +244,7 @@ func (sm *sessionManager) connectLocked() error {
 	sm.onEvent(NewSessionEstablishedEvent(sm.sessionID, localAddr, remoteAddr))
 
 	// Start session monitor
-	go sm.monitorSession()
+	go sm.monitorSession(session, sm.nonceGen, probes)
 
 	return nil
 }
@@ -332,15 +358,17 @@ func (sm *sessionManager) dialSession(ctx context.Context) (*webtransport.Sessio
 	return sess, nil
 }
 
-func (sm *sessionManager) monitorSession() {
-	if sm.session == nil {
-		return
-	}
+func (sm *sessionManager) monitorSession(sess *webtransport.Session, ng *NonceGenerator, probes *probeTracker) {
 	// Wait for context cancellation or session close in background
 	go func() {
-		<-sm.ctx.Done()
+		select {
+		case <-sm.ctx.Done():
+		case <-sess.Context().Done():
+			return
+		}
 		sm.mu.Lock()
-		if sm.session != nil {
+		// A session retired by a gateway GoAway is no longer current.
+		if sm.session == sess {
 			reason := "closed"
 			log.Printf("[DEBUG] Session %s closed (reason: context done)", sm.sessionID)
 			sm.onEvent(NewSessionClosedEvent(sm.sessionID, &reason, nil))
@@ -350,18 +378,31 @@ func (sm *sessionManager) monitorSession() {
 		sm.metrics.RecordSessionEnd()
 	}()
 
-	// Periodic ping loop with jitter
+	// Datagram probes every 1-2s keep the session alive and measure RTT. Until
+	// the gateway answers one, fall back to the stream ping every 4-7s.
+	nextPing := time.Now()
 	for {
 		select {
 		case <-sm.ctx.Done():
 			return
-		case <-time.After(jitterDuration(4*time.Second, 7*time.Second)):
-			sm.pingOnce()
+		case <-sess.Context().Done():
+			return
+		case <-time.After(jitterDuration(probeIntervalMin, probeIntervalMax)):
+			if sm.probeOnce(sess, ng, probes) {
+				sm.dropSession(sess, "keepalive timeout")
+				return
+			}
+			if !probes.isConfirmed() && !time.Now().Before(nextPing) {
+				sm.pingOnce()
+				nextPing = time.Now().Add(jitterDuration(4*time.Second, 7*time.Second))
+			}
+			sm.rekeyIfNeeded()
 		}
 	}
 }
 
-// pingOnce performs a single latency measurement.
+// pingOnce performs a single latency measurement on a throwaway stream, for
+// gateways that do not answer datagram probes.
 func (sm *sessionManager) pingOnce() {
 	sm.mu.RLock()
 	sess := sm.session
@@ -403,6 +444,18 @@ func (sm *sessionManager) pingOnce() {
 	sm.metrics.RecordLatency(latency)
 }
 
+// recordPeerCaps remembers the gateway's capabilities so later streams on the
+// session can rely on negotiated features (e.g. waiting for the connect ack).
+func (sm *sessionManager) recordPeerCaps(n Negotiated) {
+	sm.peerCaps.Store(&n)
+}
+
+// peerHas reports whether the gateway is known to support every bit of f.
+func (sm *sessionManager) peerHas(f uint32) bool {
+	n := sm.peerCaps.Load()
+	return n != nil && n.Has(f)
+}
+
 // generateSessionID creates a unique session identifier.
 func generateSessionID() string {
 	return fmt.Sprintf("sess-%d", time.Now().UnixNano())
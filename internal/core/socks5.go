@@ -1,21 +1,56 @@
 package core
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+)
+
+// SOCKS5 constants (RFC 1928).
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
 
-	"github.com/armon/go-socks5"
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepNetworkUnreachable  = 0x03
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnectionRefused   = 0x05
+	socks5RepTTLExpired          = 0x06
+	socks5RepCommandNotSupported = 0x07
+	socks5RepAddrNotSupported    = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
 )
 
-// socks5Server wraps the SOCKS5 server for Core integration.
+// errSocks5AddrType is returned for an unknown ATYP so the caller can reply 0x08.
+var errSocks5AddrType = errors.New("unsupported address type")
+
+// socks5Server is a minimal RFC 1928 server (no-auth, CONNECT and UDP ASSOCIATE).
+// Domain names are passed to the tunnel unresolved so DNS never leaks locally.
 type socks5Server struct {
 	addr     string
 	core     *Core
-	server   *socks5.Server
 	listener net.Listener
 	cancel   context.CancelFunc
 }
@@ -30,81 +65,6 @@ func newSocks5Server(addr string, core *Core) *socks5Server {
 
 // start starts the SOCKS5 server.
 func (s *socks5Server) start() error {
-	conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			host, portStr, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, err
-			}
-			
-			port, err := parsePort(portStr)
-			if err != nil {
-				return nil, err
-			}
-			
-			// Rule matching
-			target := TargetAddress{Host: host, Port: int(port)}
-			var action ActionType = ActionProxy
-			var ruleID string
-			
-			if s.core.ruleEngine != nil {
-				req := &MatchRequest{
-					Domain: host,
-					Port:   int(port),
-				}
-				
-				// Optional: Resolve IP if needed for IP matching
-				if ip := net.ParseIP(host); ip != nil {
-					req.IP = ip
-				}
-				
-				res, err := s.core.ruleEngine.Match(req)
-				if err == nil {
-					action = res.Action
-					ruleID = res.RuleID
-				}
-			}
-			
-			log.Printf("[SOCKS5] %s -> %s (action=%s, rule=%s)", host, addr, action, ruleID)
-			s.core.emit(NewCoreErrorEvent("socks5.info", fmt.Sprintf("Proxying to %s:%d (%s)", host, port, action), false))
-
-			switch action {
-			case ActionDirect:
-				return net.Dial(network, addr)
-				
-			case ActionBlock, ActionReject:
-				return nil, fmt.Errorf("blocked by rule: %s", ruleID)
-				
-			case ActionProxy:
-				fallthrough
-			default:
-				// Open stream through Core
-				log.Printf("[SOCKS5] Opening stream to %s:%d", target.Host, target.Port)
-				handle, err := s.core.OpenStream(target, nil)
-				if err != nil {
-					log.Printf("[SOCKS5] OpenStream failed: %v", err)
-					s.core.emit(NewCoreErrorEvent(ErrTargetConnect, err.Error(), false))
-					return nil, err
-				}
-				log.Printf("[SOCKS5] Stream opened: %s", handle.ID)
-				
-				return &streamConn{
-					handle:  handle,
-					core:    s.core,
-					local:   dummyAddr("socks-local"),
-					remote:  dummyAddr(fmt.Sprintf("%s:%d", host, port)),
-				}, nil
-			}
-		},
-	}
-
-	server, err := socks5.New(conf)
-	if err != nil {
-		return err
-	}
-
-	s.server = server
-
 	// Start listening in background
 	ctx, cancel := context.WithCancel(context.Background())
 	s.cancel = cancel
@@ -116,14 +76,19 @@ func (s *socks5Server) start() error {
 	s.listener = listener
 
 	go func() {
-		if err := s.server.Serve(listener); err != nil {
-			// Log error but don't crash
-			select {
-			case <-ctx.Done():
-				// Expected shutdown
-			default:
-				s.core.emit(NewCoreErrorEvent(ErrNetwork, err.Error(), false))
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Log error but don't crash
+				select {
+				case <-ctx.Done():
+					// Expected shutdown
+				default:
+					s.core.emit(NewCoreErrorEvent(ErrNetwork, err.Error(), false))
+				}
+				return
 			}
+			go s.serveConn(conn)
 		}
 	}()
 
@@ -141,13 +106,283 @@ func (s *socks5Server) stop() error {
 	return nil
 }
 
+// serveConn runs the method negotiation and dispatches one request.
+func (s *socks5Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	bufConn := bufio.NewReader(conn)
+
+	if err := socks5Negotiate(bufConn, conn); err != nil {
+		log.Printf("[SOCKS5] Handshake from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		log.Printf("[SOCKS5] Unsupported request version: %d", header[0])
+		return
+	}
+	host, port, err := readSocks5Addr(bufConn)
+	if err != nil {
+		if errors.Is(err, errSocks5AddrType) {
+			_ = writeSocks5Reply(conn, socks5RepAddrNotSupported, nil)
+		}
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch header[1] {
+	case socks5CmdConnect:
+		s.handleConnect(conn, bufConn, host, port)
+	case socks5CmdUDPAssociate:
+		s.handleAssociate(conn, host, port)
+	default:
+		_ = writeSocks5Reply(conn, socks5RepCommandNotSupported, nil)
+	}
+}
+
+// handleConnect serves a CONNECT request.
+func (s *socks5Server) handleConnect(conn net.Conn, bufConn io.Reader, host string, port uint16) {
+	target, err := s.dial(host, port)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+		return
+	}
+	defer target.Close()
+
+	if err := writeSocks5Reply(conn, socks5RepSucceeded, conn.LocalAddr()); err != nil {
+		return
+	}
+
+	errCh := make(chan error, 2)
+	go socks5Proxy(target, bufConn, errCh)
+	go socks5Proxy(conn, target, errCh)
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			return
+		}
+	}
+}
+
+// match applies the rule engine to a destination.
+func (s *socks5Server) match(host string, port uint16) (ActionType, string) {
+	action := ActionProxy
+	var ruleID string
+	if s.core.ruleEngine != nil {
+		req := &MatchRequest{
+			Domain: host,
+			Port:   int(port),
+		}
+
+		// Optional: Resolve IP if needed for IP matching
+		if ip := net.ParseIP(host); ip != nil {
+			req.IP = ip
+		}
+
+		res, err := s.core.ruleEngine.Match(req)
+		if err == nil {
+			action = res.Action
+			ruleID = res.RuleID
+		}
+	}
+	return action, ruleID
+}
+
+// dial connects to host:port directly or through the tunnel depending on rules.
+func (s *socks5Server) dial(host string, port uint16) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	action, ruleID := s.match(host, port)
+
+	log.Printf("[SOCKS5] %s -> %s (action=%s, rule=%s)", host, addr, action, ruleID)
+	s.core.emit(NewCoreErrorEvent("socks5.info", fmt.Sprintf("Proxying to %s:%d (%s)", host, port, action), false))
+
+	switch action {
+	case ActionDirect:
+		return net.DialTimeout("tcp", addr, 10*time.Second)
+
+	case ActionBlock, ActionReject:
+		return nil, &socks5RuleError{ruleID: ruleID}
+
+	case ActionProxy:
+		fallthrough
+	default:
+		// Open stream through Core
+		target := TargetAddress{Host: host, Port: int(port)}
+		log.Printf("[SOCKS5] Opening stream to %s:%d", target.Host, target.Port)
+		conn, err := s.core.dialStream(target, dummyAddr("socks-local"), dummyAddr(addr))
+		if err != nil {
+			log.Printf("[SOCKS5] OpenStream failed: %v", err)
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// socks5RuleError marks a destination rejected by a routing rule.
+type socks5RuleError struct {
+	ruleID string
+}
+
+func (e *socks5RuleError) Error() string {
+	return fmt.Sprintf("blocked by rule: %s", e.ruleID)
+}
+
+// socks5ReplyCode maps a dial error to a SOCKS5 reply code.
+func socks5ReplyCode(err error) byte {
+	var ruleErr *socks5RuleError
+	if errors.As(err, &ruleErr) {
+		return socks5RepNotAllowed
+	}
+	if remote, ok := AsRemoteError(err); ok {
+		switch remote.Code {
+		case CodeConnRefused:
+			return socks5RepConnectionRefused
+		case CodeHostUnreachable, CodeDNSFailure:
+			return socks5RepHostUnreachable
+		case CodeConnectTimeout, CodeTimeout:
+			return socks5RepTTLExpired
+		case CodePolicyDenied, CodeQuotaExceeded:
+			return socks5RepNotAllowed
+		default:
+			return socks5RepGeneralFailure
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5RepTTLExpired
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "refused"):
+		return socks5RepConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return socks5RepNetworkUnreachable
+	default:
+		return socks5RepHostUnreachable
+	}
+}
+
+// socks5Negotiate reads the method selection message and accepts no-auth.
+func socks5Negotiate(r io.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			_, err := w.Write([]byte{socks5Version, socks5AuthNone})
+			return err
+		}
+	}
+	_, _ = w.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+	return errors.New("no acceptable auth method")
+}
+
+// readSocks5Addr reads ATYP | DST.ADDR | DST.PORT.
+func readSocks5Addr(r io.Reader) (string, uint16, error) {
+	atyp := []byte{0}
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		l := []byte{0}
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, int(l[0]))
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, errSocks5AddrType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(port), nil
+}
+
+// appendSocks5Addr appends ATYP | ADDR | PORT for host:port.
+func appendSocks5Addr(dst []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, socks5AddrIPv4)
+			dst = append(dst, ip4...)
+		} else {
+			dst = append(dst, socks5AddrIPv6)
+			dst = append(dst, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			host = host[:255]
+		}
+		dst = append(dst, socks5AddrDomain, byte(len(host)))
+		dst = append(dst, host...)
+	}
+	return binary.BigEndian.AppendUint16(dst, port)
+}
+
+// writeSocks5Reply sends a reply with BND.ADDR taken from bind (0.0.0.0:0 if nil).
+func writeSocks5Reply(w io.Writer, rep byte, bind net.Addr) error {
+	host, port := "0.0.0.0", uint16(0)
+	switch a := bind.(type) {
+	case *net.TCPAddr:
+		host, port = a.IP.String(), uint16(a.Port)
+	case *net.UDPAddr:
+		host, port = a.IP.String(), uint16(a.Port)
+	}
+	reply := appendSocks5Addr([]byte{socks5Version, rep, 0x00}, host, port)
+	_, err := w.Write(reply)
+	return err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// socks5Proxy copies src to dst and half-closes dst when src is drained.
+func socks5Proxy(dst io.Writer, src io.Reader, errCh chan error) {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+	errCh <- err
+}
+
 // parsePort parses a port string to uint16.
 func parsePort(portStr string) (uint16, error) {
 	port, err := net.LookupPort("tcp", portStr)
 	if err == nil {
 		return uint16(port), nil
 	}
-	
+
 	var value uint64
 	_, err = fmt.Sscanf(portStr, "%d", &value)
 	if err != nil || value > 65535 {
@@ -157,16 +392,29 @@ func parsePort(portStr string) (uint16, error) {
 }
 
 // streamConn wraps a Core stream as net.Conn.
+// In early-data mode the stream is opened by the first Write (see early_data.go).
 type streamConn struct {
-	handle StreamHandle
-	core   *Core
-	local  net.Addr
-	remote net.Addr
-	closed bool
+	handle              StreamHandle
+	core                *Core
+	local               net.Addr
+	remote              net.Addr
+	closed              bool
 	lastReadEndUnixNano atomic.Int64
+
+	target    TargetAddress
+	started   time.Time     // Connection request time, for TTFB
+	ready     chan struct{} // Closed once handle is set or opening failed
+	openMu    sync.Mutex
+	opened    bool
+	openErr   error
+	earlySent bool
+	firstByte atomic.Bool
 }
 
 func (c *streamConn) Read(p []byte) (int, error) {
+	if err := c.waitOpen(); err != nil {
+		return 0, err
+	}
 	readStart := time.Now()
 	if prev := c.lastReadEndUnixNano.Load(); prev > 0 {
 		perfObserveDownConsumerGap(readStart.Sub(time.Unix(0, prev)))
@@ -179,26 +427,51 @@ func (c *streamConn) Read(p []byte) (int, error) {
 	c.lastReadEndUnixNano.Store(time.Now().UnixNano())
 	if n > 0 && c.core.metrics != nil {
 		c.core.metrics.RecordBytesReceived(uint64(n))
+		if c.firstByte.CompareAndSwap(false, true) {
+			c.core.metrics.RecordTTFB(time.Since(c.started), c.earlySent)
+		}
 	}
 	return n, err
 }
 
 func (c *streamConn) Write(p []byte) (int, error) {
+	early, err := c.writeEarly(p)
+	if err != nil || early == len(p) {
+		return early, err
+	}
+	p = p[early:]
+
 	stream, ok := c.core.GetUnderlyingStream(c.handle)
 	if !ok {
-		return 0, fmt.Errorf("stream not found")
+		return early, fmt.Errorf("stream not found")
 	}
 
 	n, err := stream.Write(p)
 	if err != nil {
-		return 0, err
+		return early, err
 	}
-	
+
 	if c.core.metrics != nil {
 		c.core.metrics.RecordBytesSent(uint64(n))
 	}
 
-	return n, nil
+	return early + n, nil
+}
+
+// CloseWrite half-closes the tunnel stream; the gateway shuts down the
+// write side of its target connection and keeps relaying the other direction.
+func (c *streamConn) CloseWrite() error {
+	if _, err := c.open(nil); err != nil {
+		return err
+	}
+	stream, ok := c.core.GetUnderlyingStream(c.handle)
+	if !ok {
+		return fmt.Errorf("stream not found")
+	}
+	if cw, ok := stream.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
 }
 
 func (c *streamConn) Close() error {
@@ -206,14 +479,17 @@ func (c *streamConn) Close() error {
 		return nil
 	}
 	c.closed = true
+	if !c.abandon() {
+		return nil
+	}
 	return c.core.CloseStream(c.handle)
 }
 
-func (c *streamConn) LocalAddr() net.Addr  { return c.local }
-func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
-func (c *streamConn) SetDeadline(t time.Time) error       { return nil }
-func (c *streamConn) SetReadDeadline(t time.Time) error   { return nil }
-func (c *streamConn) SetWriteDeadline(t time.Time) error  { return nil }
+func (c *streamConn) LocalAddr() net.Addr                { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
 
 type dummyAddr string
 
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// socks5UDPAssociation relays datagrams for one UDP ASSOCIATE request.
+// Its lifetime is tied to the TCP control connection (RFC 1928 section 7).
+type socks5UDPAssociation struct {
+	server     *socks5Server
+	conn       *net.UDPConn // client-facing relay socket
+	clientIP   net.IP
+	clientPort int // 0 accepts any source port from clientIP
+
+	mu     sync.Mutex
+	client *net.UDPAddr // learned from the first valid datagram
+	flow   *UDPFlow     // tunnel flow, opened on first proxied datagram
+	direct *net.UDPConn // local socket for ActionDirect destinations
+	closed bool
+}
+
+// handleAssociate serves a UDP ASSOCIATE request until the control connection closes.
+func (s *socks5Server) handleAssociate(conn net.Conn, host string, port uint16) {
+	localTCP, ok := conn.LocalAddr().(*net.TCPAddr)
+	remoteTCP, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ok2 {
+		_ = writeSocks5Reply(conn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localTCP.IP})
+	if err != nil {
+		log.Printf("[SOCKS5] UDP associate bind failed: %v", err)
+		_ = writeSocks5Reply(conn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	assoc := &socks5UDPAssociation{
+		server:   s,
+		conn:     udpConn,
+		clientIP: remoteTCP.IP,
+	}
+	// DST.ADDR/DST.PORT announce where the client will send from; zero means unknown.
+	if port != 0 {
+		assoc.clientPort = int(port)
+	}
+
+	if err := writeSocks5Reply(conn, socks5RepSucceeded, udpConn.LocalAddr()); err != nil {
+		udpConn.Close()
+		return
+	}
+	log.Printf("[SOCKS5] UDP associate for %s relaying on %s", remoteTCP, udpConn.LocalAddr())
+
+	go assoc.serve()
+
+	// Nothing else is expected on the control connection; EOF ends the association.
+	_, _ = io.Copy(io.Discard, conn)
+	assoc.close()
+	log.Printf("[SOCKS5] UDP associate for %s closed", remoteTCP)
+}
+
+// serve reads client datagrams and forwards them according to the routing rules.
+func (a *socks5UDPAssociation) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !src.IP.Equal(a.clientIP) || (a.clientPort != 0 && src.Port != a.clientPort) {
+			continue
+		}
+		host, port, payload, err := parseSocks5UDPRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		a.mu.Lock()
+		a.client = src
+		a.mu.Unlock()
+
+		action, _ := a.server.match(host, port)
+		switch action {
+		case ActionBlock, ActionReject:
+			continue
+		case ActionDirect:
+			err = a.sendDirect(host, port, payload)
+		default:
+			err = a.sendTunnel(host, port, payload)
+		}
+		if err != nil {
+			log.Printf("[SOCKS5] UDP to %s failed: %v", net.JoinHostPort(host, strconv.Itoa(int(port))), err)
+		}
+	}
+}
+
+// sendTunnel relays a datagram through the gateway.
+func (a *socks5UDPAssociation) sendTunnel(host string, port uint16, payload []byte) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return net.ErrClosed
+	}
+	flow := a.flow
+	if flow == nil {
+		var err error
+		flow, err = a.server.core.OpenUDPFlow(func(d *UDPDatagram) {
+			a.reply(d.Host, d.Port, d.Payload)
+		})
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		a.flow = flow
+	}
+	a.mu.Unlock()
+	return flow.Send(host, port, payload)
+}
+
+// sendDirect sends a datagram from a local socket, bypassing the tunnel.
+func (a *socks5UDPAssociation) sendDirect(host string, port uint16, payload []byte) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return net.ErrClosed
+	}
+	direct := a.direct
+	if direct == nil {
+		direct, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		a.direct = direct
+		go a.readDirect(direct)
+	}
+	a.mu.Unlock()
+
+	_, err = direct.WriteToUDP(payload, addr)
+	return err
+}
+
+// readDirect relays replies received on the direct socket back to the client.
+func (a *socks5UDPAssociation) readDirect(direct *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := direct.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		a.reply(src.IP.String(), uint16(src.Port), buf[:n])
+	}
+}
+
+// reply wraps payload in a SOCKS5 UDP header and sends it to the client.
+func (a *socks5UDPAssociation) reply(host string, port uint16, payload []byte) {
+	a.mu.Lock()
+	client := a.client
+	closed := a.closed
+	a.mu.Unlock()
+	if client == nil || closed {
+		return
+	}
+	packet := appendSocks5Addr(make([]byte, 3, 3+1+16+2+len(payload)), host, port)
+	packet = append(packet, payload...)
+	_, _ = a.conn.WriteToUDP(packet, client)
+}
+
+// close releases the relay socket, the direct socket and the tunnel flow.
+func (a *socks5UDPAssociation) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	flow := a.flow
+	direct := a.direct
+	a.mu.Unlock()
+
+	a.conn.Close()
+	if direct != nil {
+		direct.Close()
+	}
+	if flow != nil {
+		flow.Close()
+	}
+}
+
+// parseSocks5UDPRequest parses RSV(2) | FRAG | ATYP | DST.ADDR | DST.PORT | DATA.
+// Fragmented datagrams (FRAG != 0) are not supported and are rejected.
+func parseSocks5UDPRequest(b []byte) (string, uint16, []byte, error) {
+	if len(b) < 4 {
+		return "", 0, nil, errors.New("short udp request")
+	}
+	if b[2] != 0 {
+		return "", 0, nil, errors.New("fragmented udp request")
+	}
+	r := bytes.NewReader(b[3:])
+	host, port, err := readSocks5Addr(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, b[len(b)-r.Len():], nil
+}
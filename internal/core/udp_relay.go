@@ -0,0 +1,297 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	webtransport "github.com/quic-go/webtransport-go"
+)
+
+// udpRelayHost is the placeholder target carried in the metadata of a UDP relay stream.
+const udpRelayHost = "0.0.0.0"
+
+// UDPFlow is a client-side UDP association relayed through the gateway.
+// Datagrams travel as WebTransport datagrams; payloads too large for a QUIC
+// datagram fall back to a dedicated relay stream on the same session.
+type UDPFlow struct {
+	id      uint32
+	sm      *sessionManager
+	psk     string
+	keyID   string
+	dc      *DataCipher
+	metrics *Metrics
+	onRecv  func(*UDPDatagram)
+
+	mu           sync.Mutex
+	fallback     *webtransport.Stream
+	fallbackSess *webtransport.Session
+	closed       bool
+}
+
+// OpenUDPFlow registers a new UDP flow on one of the pooled sessions.
+// onRecv is called for every datagram relayed back by the gateway; the
+// UDPDatagram and its Payload are only valid for the duration of the call.
+func (c *Core) OpenUDPFlow(onRecv func(*UDPDatagram)) (*UDPFlow, error) {
+	c.mu.RLock()
+	config := c.config
+	metrics := c.metrics
+	c.mu.RUnlock()
+	if config == nil {
+		return nil, fmt.Errorf("core not started")
+	}
+
+	suite, err := ParseDataCipher(config.DataCipher)
+	if err != nil {
+		return nil, err
+	}
+	if suite == CipherNone {
+		// Datagrams are always sealed; they have no TLS record layer of their own to hide in.
+		suite = CipherAES128GCM
+	}
+	dc, err := NewDataCipher(suite, config.PSK)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newFlowID()
+	if err != nil {
+		return nil, err
+	}
+	sm := c.pickSessionManagerForFlow(id)
+	if sm == nil {
+		return nil, fmt.Errorf("no available session manager")
+	}
+
+	flow := &UDPFlow{
+		id:      id,
+		sm:      sm,
+		psk:     config.PSK,
+		keyID:   config.KeyID,
+		dc:      dc,
+		metrics: metrics,
+		onRecv:  onRecv,
+	}
+	sm.udpMu.Lock()
+	sm.udpFlows[id] = flow
+	sm.udpMu.Unlock()
+	return flow, nil
+}
+
+// ID returns the flow identifier carried in every datagram record.
+func (f *UDPFlow) ID() uint32 {
+	return f.id
+}
+
+// Send relays one UDP payload to host:port through the gateway.
+func (f *UDPFlow) Send(host string, port uint16, payload []byte) error {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return net.ErrClosed
+	}
+
+	sess, ng, err := f.sm.datagramSession()
+	if err != nil {
+		return err
+	}
+	record, err := BuildUDPDatagramRecord(&UDPDatagram{FlowID: f.id, KeyID: f.keyID, Host: host, Port: port, Payload: payload}, ng, f.dc)
+	if err != nil {
+		return err
+	}
+
+	err = sess.SendDatagram(record[4:])
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		err = f.sendOnStream(sess, ng, record)
+	}
+	if err != nil {
+		return err
+	}
+	if f.metrics != nil {
+		f.metrics.RecordBytesSent(uint64(len(payload)))
+	}
+	return nil
+}
+
+// Close unregisters the flow and closes its fallback stream, if any.
+func (f *UDPFlow) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	fallback := f.fallback
+	f.fallback = nil
+	f.mu.Unlock()
+
+	f.sm.udpMu.Lock()
+	delete(f.sm.udpFlows, f.id)
+	f.sm.udpMu.Unlock()
+
+	if fallback != nil {
+		fallback.CancelRead(0)
+		return fallback.Close()
+	}
+	return nil
+}
+
+// sendOnStream writes a length-prefixed datagram record on the flow's relay stream,
+// opening it first if needed. The stream is tied to the session it was opened on.
+func (f *UDPFlow) sendOnStream(sess *webtransport.Session, ng *NonceGenerator, record []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return net.ErrClosed
+	}
+
+	if f.fallback == nil || f.fallbackSess != sess {
+		if f.fallback != nil {
+			f.fallback.CancelRead(0)
+			_ = f.fallback.Close()
+			f.fallback = nil
+		}
+		ctx, cancel := context.WithTimeout(f.sm.ctx, 10*time.Second)
+		stream, err := sess.OpenStreamSync(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("udp relay stream: %w", err)
+		}
+		metaRecord, err := BuildKeyedMetadataRecord(f.keyID, udpRelayHost, 0, Options{DataCipher: f.dc.Suite(), UDPRelay: true, Capabilities: LocalCapabilities()}, f.psk, ng)
+		if err != nil {
+			stream.CancelRead(0)
+			_ = stream.Close()
+			return err
+		}
+		if _, err := stream.Write(metaRecord); err != nil {
+			stream.CancelRead(0)
+			_ = stream.Close()
+			return err
+		}
+		log.Printf("[UDP] Flow %08x: opened relay stream for oversized datagrams", f.id)
+		f.fallback = stream
+		f.fallbackSess = sess
+		go f.sm.readRelayStream(stream)
+	}
+
+	if _, err := f.fallback.Write(record); err != nil {
+		f.fallback.CancelRead(0)
+		_ = f.fallback.Close()
+		f.fallback = nil
+		return err
+	}
+	return nil
+}
+
+// deliver hands a relayed datagram to the flow owner.
+func (f *UDPFlow) deliver(d *UDPDatagram) {
+	if f.metrics != nil {
+		f.metrics.RecordBytesReceived(uint64(len(d.Payload)))
+	}
+	if f.onRecv != nil {
+		f.onRecv(d)
+	}
+}
+
+// datagramSession returns the live session and its nonce generator, connecting if needed.
+func (sm *sessionManager) datagramSession() (*webtransport.Session, *NonceGenerator, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.session == nil {
+		if err := sm.connectLocked(); err != nil {
+			return nil, nil, err
+		}
+		if sm.session == nil {
+			return nil, nil, fmt.Errorf("no active session")
+		}
+	}
+	return sm.session, sm.nonceGen, nil
+}
+
+// datagramLoop receives WebTransport datagrams for one session until it ends.
+// Probe pongs are matched here; everything else goes to the UDP flows.
+func (sm *sessionManager) datagramLoop(sess *webtransport.Session, probes *probeTracker) {
+	for {
+		b, err := sess.ReceiveDatagram(sm.ctx)
+		if err != nil {
+			return
+		}
+		record, err := ParseDatagramRecord(b)
+		if err != nil {
+			continue
+		}
+		if record.Type == TypePong {
+			sm.handlePong(probes, record)
+			continue
+		}
+		if record.Type == TypeGoAway {
+			sm.handleGoAway(sess, record)
+			continue
+		}
+		sm.dispatchDatagram(record)
+	}
+}
+
+// readRelayStream reads datagram records sent back on a UDP relay stream.
+func (sm *sessionManager) readRelayStream(stream *webtransport.Stream) {
+	reader := NewRecordReader(stream)
+	for {
+		record, err := reader.ReadNextRecord()
+		if err != nil {
+			return
+		}
+		sm.dispatchDatagram(record)
+		if record.RawBuffer != nil {
+			PutBuffer(record.RawBuffer)
+		}
+	}
+}
+
+// dispatchDatagram routes a TypeDatagram record to its registered flow.
+func (sm *sessionManager) dispatchDatagram(record *Record) {
+	if record.Type != TypeDatagram {
+		return
+	}
+	sm.udpMu.RLock()
+	ciphers := sm.udpCiphers
+	sm.udpMu.RUnlock()
+	if ciphers == nil {
+		return
+	}
+	d, err := ciphers.Open(record)
+	if err != nil {
+		log.Printf("[UDP] Dropping datagram: %v", err)
+		return
+	}
+	sm.udpMu.RLock()
+	flow := sm.udpFlows[d.FlowID]
+	sm.udpMu.RUnlock()
+	if flow != nil {
+		flow.deliver(d)
+	}
+}
+
+// pickSessionManagerForFlow spreads UDP flows across the session pool by flow ID.
+func (c *Core) pickSessionManagerForFlow(id uint32) *sessionManager {
+	if len(c.sessionPool) == 0 {
+		return c.sessionMgr
+	}
+	return c.sessionPool[int(id%uint32(len(c.sessionPool)))]
+}
+
+func newFlowID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}